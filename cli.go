@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"quest_maker/engine"
+	"quest_maker/handlers"
+	"quest_maker/questfile"
+	"quest_maker/questgraph"
+	"quest_maker/questscript"
+	"quest_maker/simulator"
+	"quest_maker/storage"
+	"quest_maker/storyimport"
+)
+
+const commandsUsage = `usage: quest_maker [command] [arguments]
+
+Without a command the server is started. Commands:
+  simulate [-depth N] [-max-paths N] quest.json
+        enumerate every path through the quest and report endings, point ranges and dead character lines
+  play quest.json
+        play a quest file in the terminal
+  play -server URL (-quest ID | -playthrough ID) [-token TOKEN]
+        play on a running server; without a token a guest session is used
+  upgrade [-o new.json] old.json
+        convert a quest script or a quest in the /make_quest request format into the versioned quest file format
+  graph [-format dot|mermaid|json] [-o graph.dot] quest.json
+        print the graph of steps and transitions of the quest; unreachable steps are highlighted
+  import [-format twee|ink] [-title TITLE] [-o quest.json] story.twee
+        convert a Twine (Twee 3) or Ink story into the quest file format; unsupported constructs are reported as warnings
+
+Commands that read a quest accept quest scripts (*.quest), the quest file format and the /make_quest request format.
+`
+
+// Команды для авторов квестов; возвращает код завершения процесса
+func runCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	switch args[0] {
+	case "simulate":
+		return simulateCommand(args[1:], stdout, stderr)
+	case "play":
+		return playCommand(args[1:], stdin, stdout, stderr)
+	case "upgrade":
+		return upgradeCommand(args[1:], stdout, stderr)
+	case "import":
+		return importCommand(args[1:], stdout, stderr)
+	case "graph":
+		return graphCommand(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, commandsUsage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], commandsUsage)
+		return 2
+	}
+}
+
+// Читает квест из сценария .quest, файла в формате questfile или в формате запроса /make_quest
+func loadQuestFile(path string) (storage.NewQuest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return storage.NewQuest{}, err
+	}
+	if filepath.Ext(path) == ".quest" {
+		return questscript.Parse(string(data))
+	}
+	if questfile.IsQuestFile(data) {
+		file, err := questfile.Parse(data)
+		if err != nil {
+			return storage.NewQuest{}, err
+		}
+		return file.Quest()
+	}
+
+	var req handlers.QuestRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return storage.NewQuest{}, fmt.Errorf("invalid JSON: %v", err)
+	}
+	quest, err := handlers.BuildQuest(req)
+	if err != nil {
+		return storage.NewQuest{}, err
+	}
+	if len(quest.Steps) == 0 {
+		return storage.NewQuest{}, errors.New("quest has no steps")
+	}
+	return quest, nil
+}
+
+func simulateCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	depth := flags.Int("depth", simulator.DefaultMaxDepth, "maximum number of steps on a path; longer paths are cut")
+	maxPaths := flags.Int("max-paths", simulator.DefaultMaxPaths, "stop after this many paths, complete or cut by depth")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: quest_maker simulate [-depth N] [-max-paths N] quest.json")
+		return 2
+	}
+
+	quest, err := loadQuestFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+
+	// Номера шагов в отчете совпадают с порядком шагов в файле
+	report, err := simulator.Explore(engine.FromQuest(quest), 1, simulator.Options{MaxDepth: *depth, MaxPaths: *maxPaths})
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "Quest: %s\n", quest.Title)
+	report.Write(stdout)
+	return 0
+}
+
+func playCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("play", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	server := flags.String("server", "", "URL of a running server, e.g. http://localhost:8080")
+	questID := flags.Int("quest", 0, "quest to start a new playthrough of on the server")
+	playthroughID := flags.Int("playthrough", 0, "playthrough to continue on the server")
+	token := flags.String("token", "", "session token from /login or /register")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var session playSession
+	switch {
+	case *server == "" && flags.NArg() == 1:
+		quest, err := loadQuestFile(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", flags.Arg(0), err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "%s\n", quest.Title)
+		session = newLocalSession(quest)
+
+	case *server != "" && flags.NArg() == 0 && (*questID != 0) != (*playthroughID != 0):
+		remote, err := newRemoteSession(*server, *token, *questID, *playthroughID)
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "Playthrough %d\n", remote.playthroughID)
+		session = remote
+
+	default:
+		fmt.Fprintln(stderr, "usage: quest_maker play quest.json\n       quest_maker play -server URL (-quest ID | -playthrough ID) [-token TOKEN]")
+		return 2
+	}
+
+	if err := play(session, stdin, stdout); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func upgradeCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	output := flags.String("o", "", "write the upgraded quest to this file instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: quest_maker upgrade [-o new.json] old.json")
+		return 2
+	}
+
+	quest, err := loadQuestFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	return writeQuestFile(quest, *output, stdout, stderr)
+}
+
+func importCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "", "story format, twee or ink; by default it is taken from the file extension")
+	title := flags.String("title", "", "quest title if the story has none; by default the file name")
+	output := flags.String("o", "", "write the quest to this file instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: quest_maker import [-format twee|ink] [-title TITLE] [-o quest.json] story.twee")
+		return 2
+	}
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = storyimport.FormatOf(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	result, err := storyimport.Convert(*format, string(data))
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", path, err)
+		return 1
+	}
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(stderr, "%s: %v\n", path, warning)
+	}
+
+	quest := result.Quest
+	if quest.Title == "" {
+		quest.Title = *title
+	}
+	if quest.Title == "" {
+		quest.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return writeQuestFile(quest, *output, stdout, stderr)
+}
+
+func graphCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("graph", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", questgraph.FormatDOT, "output format: dot, mermaid or json")
+	output := flags.String("o", "", "write the graph to this file instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: quest_maker graph [-format dot|mermaid|json] [-o graph.dot] quest.json")
+		return 2
+	}
+
+	quest, err := loadQuestFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	graph := questgraph.FromQuest(quest)
+	var buf bytes.Buffer
+	if err := graph.Write(&buf, *format); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 2
+	}
+	if unreachable := graph.Unreachable(); len(unreachable) > 0 {
+		fmt.Fprintf(stderr, "%s: unreachable steps %v\n", flags.Arg(0), unreachable)
+	}
+
+	if *output == "" {
+		stdout.Write(buf.Bytes())
+		return 0
+	}
+	if err := os.WriteFile(*output, buf.Bytes(), 0644); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Пишет квест в формате questfile в файл output или, если он не задан, в stdout
+func writeQuestFile(quest storage.NewQuest, output string, stdout, stderr io.Writer) int {
+	data, err := json.MarshalIndent(questfile.FromQuest(quest), "", "  ")
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	data = append(data, '\n')
+
+	if output == "" {
+		stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(output, data, 0644); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
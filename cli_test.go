@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stdout []string
+		stderr string
+	}{
+		{
+			"simulate test quest",
+			[]string{"simulate", "test_quest.json"},
+			0,
+			[]string{"Quest: Тайна заброшенного замка", "Paths: 5", "step 8: paths 5, violence 0..2, whatever 0..3, pacifism 0..2"},
+			"",
+		},
+		{"simulate with a short depth", []string{"simulate", "-depth", "3", "test_quest.json"}, 0, []string{"Paths: 0, truncated by depth: 4"}, ""},
+		{"simulate without a file", []string{"simulate"}, 2, nil, "usage: quest_maker simulate"},
+		{"simulate a missing file", []string{"simulate", "missing.json"}, 1, nil, "missing.json"},
+		{"upgrade test quest", []string{"upgrade", "test_quest.json"}, 0, []string{`"format": "quest_maker"`, `"next": "step-7"`}, ""},
+		{"upgrade without a file", []string{"upgrade"}, 2, nil, "usage: quest_maker upgrade"},
+		{"import without a file", []string{"import"}, 2, nil, "usage: quest_maker import"},
+		{"graph of test quest", []string{"graph", "test_quest.json"}, 0, []string{"digraph quest {", `s2 [label="2. choice", shape=diamond];`, "s8 -> end;"}, ""},
+		{"graph in mermaid", []string{"graph", "-format", "mermaid", "test_quest.quest"}, 0, []string{"flowchart TD", "s8 --> end_"}, ""},
+		{"graph in an unknown format", []string{"graph", "-format", "svg", "test_quest.json"}, 2, nil, "unknown graph format"},
+		{"import of an unknown format", []string{"import", "test_quest.json"}, 1, nil, "unknown story format"},
+		{"unknown command", []string{"frobnicate"}, 2, nil, `unknown command "frobnicate"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runCommand(tt.args, strings.NewReader(""), &stdout, &stderr); code != tt.code {
+				t.Errorf("Expected exit code %d, got %d (stderr: %s)", tt.code, code, stderr.String())
+			}
+			for _, want := range tt.stdout {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("Expected output to contain %q, got:\n%s", want, stdout.String())
+				}
+			}
+			if !strings.Contains(stderr.String(), tt.stderr) {
+				t.Errorf("Expected errors to contain %q, got %q", tt.stderr, stderr.String())
+			}
+		})
+	}
+}
+
+// Обновленный файл читается остальными командами и дает тот же квест
+func TestUpgradeCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quest.json")
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"upgrade", "-o", path, "test_quest.json"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+	}
+
+	if code := runCommand([]string{"simulate", path}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+	}
+	want := "step 8: paths 5, violence 0..2, whatever 0..3, pacifism 0..2"
+	if !strings.Contains(stdout.String(), want) {
+		t.Errorf("Expected output to contain %q, got:\n%s", want, stdout.String())
+	}
+}
+
+// Сценарий test_quest.quest описывает тот же квест, что и test_quest.json
+func TestLoadQuestScript(t *testing.T) {
+	want, err := loadQuestFile("test_quest.json")
+	if err != nil {
+		t.Fatalf("Failed to load test_quest.json: %v", err)
+	}
+	got, err := loadQuestFile("test_quest.quest")
+	if err != nil {
+		t.Fatalf("Failed to load test_quest.quest: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+// Импортированная история читается остальными командами; название по умолчанию - имя файла
+func TestImportCommand(t *testing.T) {
+	dir := t.TempDir()
+	story := filepath.Join(dir, "cave.ink")
+	source := "Вход в пещеру.\n* Войти -> hall\n* Уйти -> END\n=== hall ===\nТемно. {torch: Светло.}\n-> END\n"
+	if err := os.WriteFile(story, []byte(source), 0644); err != nil {
+		t.Fatalf("Failed to write story: %v", err)
+	}
+
+	path := filepath.Join(dir, "cave.json")
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"import", "-o", path, story}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+	}
+	want := "cave.ink: line 5: conditional text is not supported"
+	if !strings.Contains(stderr.String(), want) {
+		t.Errorf("Expected errors to contain %q, got %q", want, stderr.String())
+	}
+
+	quest, err := loadQuestFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load imported quest: %v", err)
+	}
+	if quest.Title != "cave" || len(quest.Steps) != 3 {
+		t.Errorf("Unexpected quest %+v", quest)
+	}
+}
@@ -0,0 +1,216 @@
+// Пакет engine - правила прохождения квеста без HTTP и базы данных:
+// переходы между шагами, выбор реплик персонажей, подсчет очков и голосов.
+// Функции пакета получают граф квеста и состояние и возвращают новое состояние, ничего не сохраняя
+package engine
+
+import (
+	"errors"
+
+	"quest_maker/storage"
+)
+
+var (
+	ErrFinished          = errors.New("quest is finished")
+	ErrChoiceRequired    = errors.New("step requires a player choice")
+	ErrNotChoiceStep     = errors.New("step has no player choices")
+	ErrChoiceUnavailable = errors.New("choice is not available at this step")
+	ErrWrongRole         = errors.New("choice belongs to another role")
+)
+
+// Граф квеста: шаги по ID. storage.QuestStore подходит без изменений
+type Graph interface {
+	Step(id int) (*storage.Step, error)
+}
+
+// Граф, целиком загруженный в память
+type Steps map[int]*storage.Step
+
+func (s Steps) Step(id int) (*storage.Step, error) {
+	step, ok := s[id]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return step, nil
+}
+
+// Граф нового, еще не сохраненного квеста. ID шагов совпадают с их номерами, начиная с 1,
+// поэтому первый шаг - 1; выборы нумеруются подряд по всему квесту.
+// Неверный номер шага у реплики или варианта означает переход шага, как и при сохранении квеста
+func FromQuest(quest storage.NewQuest) Steps {
+	steps := make(Steps)
+	choiceID := 0
+	for i, s := range quest.Steps {
+		step := s
+		step.ID = i + 1
+		step.Number = i + 1
+		step.NextStep = quest.NextStepNumber(i)
+
+		step.Choices = nil
+		for _, c := range s.Choices {
+			choiceID++
+			c.ID = choiceID
+			c.StepID = step.ID
+			if c.NextStep < 0 || c.NextStep > len(quest.Steps) {
+				c.NextStep = 0
+			}
+			step.Choices = append(step.Choices, c)
+		}
+
+		step.Lines = nil
+		for _, line := range s.Lines {
+			if line.NextStep < 0 || line.NextStep > len(quest.Steps) {
+				line.NextStep = 0
+			}
+			step.Lines = append(step.Lines, line)
+		}
+
+		steps[step.ID] = &step
+	}
+	return steps
+}
+
+// Состояние прохождения: текущий шаг и набранные очки.
+// После последнего шага StepID остается на нем, а Finished становится true
+type State struct {
+	StepID   int
+	Points   storage.Points
+	Finished bool
+}
+
+// Что видно на текущем шаге
+type View struct {
+	Step *storage.Step
+	// Текст рассказчика или выбранной реплики персонажа; для player_action пустой
+	Text string
+	// Реплика персонажа для текущих очков; nil, если шаг не character_action или реплик нет
+	Line    *storage.CharacterLine
+	Choices []storage.Choice
+	// Шаг, к которому ведет текущий при этих очках; 0 - на нем квест заканчивается
+	NextStep int
+}
+
+func (v *View) NeedsChoice() bool {
+	return v.Step.Type == storage.StepPlayerAction
+}
+
+func Look(g Graph, state State) (*View, error) {
+	step, err := g.Step(state.StepID)
+	if err != nil {
+		return nil, err
+	}
+
+	view := View{Step: step, NextStep: NextStep(step, state.Points)}
+	switch step.Type {
+	case storage.StepNarration:
+		view.Text = step.Text
+	case storage.StepPlayerAction:
+		view.Choices = step.Choices
+	case storage.StepCharacterAction:
+		view.Line = PickLine(step.Lines, state.Points)
+		if view.Line != nil {
+			view.Text = view.Line.Text
+		}
+	}
+	return &view, nil
+}
+
+// Переход дальше с шага без выбора: narration или character_action
+func Proceed(g Graph, state State) (State, error) {
+	if state.Finished {
+		return state, ErrFinished
+	}
+	step, err := g.Step(state.StepID)
+	if err != nil {
+		return state, err
+	}
+	if step.Type == storage.StepPlayerAction {
+		return state, ErrChoiceRequired
+	}
+	return advance(state, NextStep(step, state.Points)), nil
+}
+
+// Выбор варианта в одиночном прохождении: роли не учитываются, очки варианта прибавляются
+func Choose(g Graph, state State, choiceID int) (State, error) {
+	if state.Finished {
+		return state, ErrFinished
+	}
+	step, err := g.Step(state.StepID)
+	if err != nil {
+		return state, err
+	}
+	if step.Type != storage.StepPlayerAction {
+		return state, ErrNotChoiceStep
+	}
+	choice := FindChoice(step.Choices, choiceID)
+	if choice == nil {
+		return state, ErrChoiceUnavailable
+	}
+
+	state.Points = state.Points.Add(choice.Points)
+	return advance(state, ChoiceNextStep(step, choice)), nil
+}
+
+// Шаг, к которому ведет вариант выбора: свой переход варианта или переход шага
+func ChoiceNextStep(step *storage.Step, choice *storage.Choice) int {
+	if choice != nil && choice.NextStep != 0 {
+		return choice.NextStep
+	}
+	return step.NextStep
+}
+
+func advance(state State, next int) State {
+	if next == 0 {
+		state.Finished = true
+		return state
+	}
+	state.StepID = next
+	return state
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Насколько очки прохождения далеки от условия реплики
+func pointsDistance(condition, points storage.Points) int {
+	return abs(condition.Violence-points.Violence) +
+		abs(condition.Whatever-points.Whatever) +
+		abs(condition.Pacifism-points.Pacifism)
+}
+
+// Выбирает реплику персонажа для текущих очков: сначала по приоритету, затем по близости условия к очкам.
+// При равенстве побеждает реплика, объявленная в квесте раньше; nil, если реплик нет
+func PickLine(lines []storage.CharacterLine, points storage.Points) *storage.CharacterLine {
+	var best *storage.CharacterLine
+	for i := range lines {
+		line := &lines[i]
+		if best == nil || line.Priority > best.Priority ||
+			line.Priority == best.Priority && pointsDistance(line.Condition, points) < pointsDistance(best.Condition, points) {
+			best = line
+		}
+	}
+	return best
+}
+
+// Шаг, к которому ведет step при данных очках; реплика персонажа может задать свой переход.
+// 0 - квест завершен
+func NextStep(step *storage.Step, points storage.Points) int {
+	if step.Type == storage.StepCharacterAction {
+		if line := PickLine(step.Lines, points); line != nil && line.NextStep != 0 {
+			return line.NextStep
+		}
+	}
+	return step.NextStep
+}
+
+func FindChoice(choices []storage.Choice, id int) *storage.Choice {
+	for i := range choices {
+		if choices[i].ID == id {
+			return &choices[i]
+		}
+	}
+	return nil
+}
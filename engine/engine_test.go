@@ -0,0 +1,332 @@
+package engine_test
+
+import (
+	"errors"
+	"testing"
+
+	"quest_maker/engine"
+	"quest_maker/storage"
+)
+
+// Квест для тестов:
+// 1 рассказ -> 2 выбор -> 3 реплика стражника -> 4 рассказ, конец.
+// Реплика "Стой!" уводит на 5 - последний выбор без следующего шага
+func testQuest() engine.Steps {
+	return engine.Steps{
+		1: {ID: 1, Type: storage.StepNarration, Text: "Каджит вышел из кустов.", NextStep: 2},
+		2: {ID: 2, Type: storage.StepPlayerAction, NextStep: 3, AudiencePoll: true, Choices: []storage.Choice{
+			{ID: 21, StepID: 2, Text: "Напасть", Points: storage.Points{Violence: 2}, PlayerIndex: 1},
+			{ID: 22, StepID: 2, Text: "Уйти", Points: storage.Points{Pacifism: 1}, IsDefault: true},
+			{ID: 23, StepID: 2, Text: "Спрятаться", Points: storage.Points{Whatever: 1}, PlayerIndex: 2},
+		}},
+		3: {ID: 3, Type: storage.StepCharacterAction, Character: "Стражник", NextStep: 4, Lines: []storage.CharacterLine{
+			{ID: 31, Text: "Стой!", Condition: storage.Points{Violence: 2}, NextStep: 5},
+			{ID: 32, Text: "Проходи.", Condition: storage.Points{Pacifism: 1}},
+			{ID: 33, Text: "Хм.", Condition: storage.Points{Whatever: 1}},
+		}},
+		4: {ID: 4, Type: storage.StepNarration, Text: "Конец."},
+		5: {ID: 5, Type: storage.StepPlayerAction, Choices: []storage.Choice{
+			{ID: 51, StepID: 5, Text: "Сдаться", Points: storage.Points{Pacifism: 3}},
+		}},
+	}
+}
+
+func TestSteps(t *testing.T) {
+	quest := testQuest()
+	step, err := quest.Step(4)
+	if err != nil || step.Text != "Конец." {
+		t.Errorf("Expected step 4, got %+v, %v", step, err)
+	}
+	if _, err := quest.Step(99); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFromQuest(t *testing.T) {
+	steps := engine.FromQuest(storage.NewQuest{Steps: []storage.Step{
+		{Type: storage.StepNarration, Text: "Начало"},
+		{Type: storage.StepPlayerAction, Choices: []storage.Choice{{Text: "Да"}, {Text: "Нет"}}},
+		{Type: storage.StepCharacterAction, Character: "Стражник", Lines: []storage.CharacterLine{
+			{Text: "Назад", NextStep: 1},
+			{Text: "Дальше", NextStep: 7},
+		}},
+		{Type: storage.StepPlayerAction, Choices: []storage.Choice{{Text: "Конец"}}},
+	}})
+
+	if len(steps) != 4 {
+		t.Fatalf("Expected 4 steps, got %d", len(steps))
+	}
+	for id, next := range map[int]int{1: 2, 2: 3, 3: 4, 4: 0} {
+		if steps[id].ID != id || steps[id].NextStep != next {
+			t.Errorf("Expected step %d to lead to %d, got %+v", id, next, steps[id])
+		}
+	}
+	if choices := steps[4].Choices; len(choices) != 1 || choices[0].ID != 3 || choices[0].StepID != 4 {
+		t.Errorf("Expected choices numbered across the quest, got %+v", choices)
+	}
+	if lines := steps[3].Lines; lines[0].NextStep != 1 || lines[1].NextStep != 0 {
+		t.Errorf("Expected invalid line target to fall back to the next step, got %+v", lines)
+	}
+}
+
+func TestPickLine(t *testing.T) {
+	lines := []storage.CharacterLine{
+		{ID: 1, Text: "Привет", Condition: storage.Points{Pacifism: 2}},
+		{ID: 2, Text: "Уходи", Condition: storage.Points{Violence: 2}},
+		{ID: 3, Text: "Снова привет", Condition: storage.Points{Pacifism: 2}},
+	}
+
+	tests := []struct {
+		name   string
+		lines  []storage.CharacterLine
+		points storage.Points
+		want   int
+	}{
+		{"no lines", nil, storage.Points{}, 0},
+		{"single line", lines[1:2], storage.Points{Pacifism: 5}, 2},
+		{"closest condition", lines, storage.Points{Violence: 3}, 2},
+		{"tie goes to the earlier line", lines, storage.Points{Pacifism: 2}, 1},
+		{"equal distance goes to the earlier line", lines, storage.Points{}, 1},
+		{"distance sums all categories", lines, storage.Points{Violence: 1, Pacifism: 1, Whatever: 4}, 1},
+		{
+			"priority beats distance",
+			append([]storage.CharacterLine{{ID: 4, Text: "Стой", Condition: storage.Points{Whatever: 9}, Priority: 1}}, lines...),
+			storage.Points{Pacifism: 2},
+			4,
+		},
+		{
+			"negative points",
+			[]storage.CharacterLine{{ID: 5, Condition: storage.Points{Violence: -3}}, {ID: 6, Condition: storage.Points{Violence: 3}}},
+			storage.Points{Violence: 2},
+			6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := engine.PickLine(tt.lines, tt.points)
+			got := 0
+			if line != nil {
+				got = line.ID
+			}
+			if got != tt.want {
+				t.Errorf("Expected line %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNextStep(t *testing.T) {
+	quest := testQuest()
+	tests := []struct {
+		name   string
+		step   int
+		points storage.Points
+		want   int
+	}{
+		{"narration", 1, storage.Points{}, 2},
+		{"player action", 2, storage.Points{Violence: 5}, 3},
+		{"line with its own next step", 3, storage.Points{Violence: 2}, 5},
+		{"line without next step", 3, storage.Points{Pacifism: 1}, 4},
+		{"last step", 4, storage.Points{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := engine.NextStep(quest[tt.step], tt.points); got != tt.want {
+				t.Errorf("Expected next step %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	// Персонаж без реплик идет дальше по порядку
+	silent := &storage.Step{Type: storage.StepCharacterAction, NextStep: 7}
+	if got := engine.NextStep(silent, storage.Points{}); got != 7 {
+		t.Errorf("Expected next step 7, got %d", got)
+	}
+}
+
+func TestLook(t *testing.T) {
+	quest := testQuest()
+	tests := []struct {
+		name        string
+		state       engine.State
+		text        string
+		choices     int
+		line        int
+		next        int
+		needsChoice bool
+	}{
+		{"narration", engine.State{StepID: 1}, "Каджит вышел из кустов.", 0, 0, 2, false},
+		{"player action", engine.State{StepID: 2}, "", 3, 0, 3, true},
+		{"character line by points", engine.State{StepID: 3, Points: storage.Points{Whatever: 1}}, "Хм.", 0, 33, 4, false},
+		{"character line with its own next step", engine.State{StepID: 3, Points: storage.Points{Violence: 4}}, "Стой!", 0, 31, 5, false},
+		{"last step", engine.State{StepID: 4}, "Конец.", 0, 0, 0, false},
+		{"finished quest still shows its last step", engine.State{StepID: 4, Finished: true}, "Конец.", 0, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			view, err := engine.Look(quest, tt.state)
+			if err != nil {
+				t.Fatalf("Look: %v", err)
+			}
+			if view.Step.ID != tt.state.StepID {
+				t.Errorf("Expected step %d, got %d", tt.state.StepID, view.Step.ID)
+			}
+			if view.Text != tt.text {
+				t.Errorf("Expected text %q, got %q", tt.text, view.Text)
+			}
+			if len(view.Choices) != tt.choices {
+				t.Errorf("Expected %d choices, got %d", tt.choices, len(view.Choices))
+			}
+			line := 0
+			if view.Line != nil {
+				line = view.Line.ID
+			}
+			if line != tt.line {
+				t.Errorf("Expected line %d, got %d", tt.line, line)
+			}
+			if view.NextStep != tt.next {
+				t.Errorf("Expected next step %d, got %d", tt.next, view.NextStep)
+			}
+			if view.NeedsChoice() != tt.needsChoice {
+				t.Errorf("Expected NeedsChoice %v, got %v", tt.needsChoice, view.NeedsChoice())
+			}
+		})
+	}
+
+	if _, err := engine.Look(quest, engine.State{StepID: 99}); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing step, got %v", err)
+	}
+}
+
+func TestProceed(t *testing.T) {
+	quest := testQuest()
+	tests := []struct {
+		name  string
+		state engine.State
+		want  engine.State
+		err   error
+	}{
+		{"narration", engine.State{StepID: 1}, engine.State{StepID: 2}, nil},
+		{
+			"character line keeps points",
+			engine.State{StepID: 3, Points: storage.Points{Pacifism: 1}},
+			engine.State{StepID: 4, Points: storage.Points{Pacifism: 1}},
+			nil,
+		},
+		{
+			"character line with its own next step",
+			engine.State{StepID: 3, Points: storage.Points{Violence: 2}},
+			engine.State{StepID: 5, Points: storage.Points{Violence: 2}},
+			nil,
+		},
+		{"last step finishes the quest", engine.State{StepID: 4}, engine.State{StepID: 4, Finished: true}, nil},
+		{"player action needs a choice", engine.State{StepID: 2}, engine.State{StepID: 2}, engine.ErrChoiceRequired},
+		{"finished quest", engine.State{StepID: 4, Finished: true}, engine.State{StepID: 4, Finished: true}, engine.ErrFinished},
+		{"missing step", engine.State{StepID: 99}, engine.State{StepID: 99}, storage.ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := engine.Proceed(quest, tt.state)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestChoose(t *testing.T) {
+	quest := withBranch(testQuest())
+	start := engine.State{StepID: 2, Points: storage.Points{Violence: 1}}
+	tests := []struct {
+		name   string
+		state  engine.State
+		choice int
+		want   engine.State
+		err    error
+	}{
+		{"adds points and moves on", start, 21, engine.State{StepID: 3, Points: storage.Points{Violence: 3}}, nil},
+		{"roles are ignored in a single playthrough", start, 23, engine.State{StepID: 3, Points: storage.Points{Violence: 1, Whatever: 1}}, nil},
+		{"choice leads to its own step", start, 22, engine.State{StepID: 4, Points: storage.Points{Violence: 1, Pacifism: 1}}, nil},
+		{"last choice finishes the quest", engine.State{StepID: 5}, 51, engine.State{StepID: 5, Points: storage.Points{Pacifism: 3}, Finished: true}, nil},
+		{"choice of another step", start, 51, start, engine.ErrChoiceUnavailable},
+		{"unknown choice", start, 99, start, engine.ErrChoiceUnavailable},
+		{"step without choices", engine.State{StepID: 1}, 21, engine.State{StepID: 1}, engine.ErrNotChoiceStep},
+		{"finished quest", engine.State{StepID: 5, Finished: true}, 51, engine.State{StepID: 5, Finished: true}, engine.ErrFinished},
+		{"missing step", engine.State{StepID: 99}, 21, engine.State{StepID: 99}, storage.ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := engine.Choose(quest, tt.state, tt.choice)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// Полное прохождение: выбор определяет, что скажет стражник и куда поведет его реплика
+func TestPlaythrough(t *testing.T) {
+	tests := []struct {
+		name   string
+		choice int
+		texts  []string
+		points storage.Points
+		last   int
+	}{
+		{"peaceful", 22, []string{"Каджит вышел из кустов.", "", "Проходи.", "Конец."}, storage.Points{Pacifism: 1}, 4},
+		{"violent", 21, []string{"Каджит вышел из кустов.", "", "Стой!", ""}, storage.Points{Violence: 2, Pacifism: 3}, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quest := testQuest()
+			state := engine.State{StepID: 1}
+			var texts []string
+			for !state.Finished {
+				if len(texts) > 10 {
+					t.Fatalf("Quest did not finish, stuck at %+v", state)
+				}
+				view, err := engine.Look(quest, state)
+				if err != nil {
+					t.Fatalf("Look: %v", err)
+				}
+				texts = append(texts, view.Text)
+
+				switch {
+				case !view.NeedsChoice():
+					state, err = engine.Proceed(quest, state)
+				case view.Step.ID == 2:
+					state, err = engine.Choose(quest, state, tt.choice)
+				default:
+					state, err = engine.Choose(quest, state, view.Choices[0].ID)
+				}
+				if err != nil {
+					t.Fatalf("Step %d: %v", view.Step.ID, err)
+				}
+			}
+
+			if len(texts) != len(tt.texts) {
+				t.Fatalf("Expected %d steps, got %d: %q", len(tt.texts), len(texts), texts)
+			}
+			for i := range texts {
+				if texts[i] != tt.texts[i] {
+					t.Errorf("Step %d: expected %q, got %q", i+1, tt.texts[i], texts[i])
+				}
+			}
+			if state.Points != tt.points || state.StepID != tt.last {
+				t.Errorf("Expected to finish at step %d with %+v, got %+v", tt.last, tt.points, state)
+			}
+		})
+	}
+}
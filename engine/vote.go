@@ -0,0 +1,162 @@
+package engine
+
+import (
+	"time"
+
+	"quest_maker/storage"
+)
+
+// Варианты выбора, доступные игроку с ролью playerIndex: общие и варианты его роли
+func ChoicesForRole(choices []storage.Choice, playerIndex int) []storage.Choice {
+	var available []storage.Choice
+	for _, c := range choices {
+		if c.PlayerIndex == 0 || c.PlayerIndex == playerIndex {
+			available = append(available, c)
+		}
+	}
+	return available
+}
+
+// Проверяет голос игрока с ролью playerIndex на шаге step
+func CheckVote(step *storage.Step, choiceID, playerIndex int) (*storage.Choice, error) {
+	choice := FindChoice(step.Choices, choiceID)
+	if step.Type != storage.StepPlayerAction || choice == nil {
+		return nil, ErrChoiceUnavailable
+	}
+	if choice.PlayerIndex != 0 && choice.PlayerIndex != playerIndex {
+		return nil, ErrWrongRole
+	}
+	return choice, nil
+}
+
+// Проголосовали ли все игроки сервера, которым на шаге step доступен хотя бы один вариант;
+// голоса ушедших игроков не учитываются. На шагах без выбора голосования нет
+func AllVoted(step *storage.Step, players []storage.Player, votes []storage.Vote) bool {
+	if step.Type != storage.StepPlayerAction || len(players) == 0 {
+		return false
+	}
+	voted := make(map[string]bool)
+	for _, vote := range votes {
+		voted[vote.PlayerName] = true
+	}
+	for _, player := range players {
+		// Игрок, у роли которого нет вариантов, проголосовать не может и голосование не задерживает
+		if !voted[player.Name] && len(ChoicesForRole(step.Choices, player.PlayerIndex)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Подводит итог голосования на текущем шаге: суммирует очки всех голосов
+// и переводит прохождение на шаг варианта, набравшего больше всего голосов, или завершает его.
+// audience - голоса зрителей по вариантам; учитываются, только если шаг проводит опрос
+func Resolve(g Graph, state State, votes []storage.Vote, audience map[int]int) (State, error) {
+	if state.Finished {
+		return state, ErrFinished
+	}
+	step, err := g.Step(state.StepID)
+	if err != nil {
+		return state, err
+	}
+	if step.Type != storage.StepPlayerAction {
+		return state, ErrNotChoiceStep
+	}
+
+	var total storage.Points
+	counts := make(map[int]int)
+	for _, vote := range votes {
+		if choice := FindChoice(step.Choices, vote.ChoiceID); choice != nil {
+			total = total.Add(choice.Points)
+			counts[choice.ID]++
+		}
+	}
+	if step.AudiencePoll {
+		if winner := AudienceWinner(step.Choices, audience); winner != nil {
+			total = total.Add(winner.Points)
+			counts[winner.ID]++
+		}
+	}
+	state.Points = state.Points.Add(total)
+
+	// Переход задает вариант, набравший больше всего голосов
+	return advance(state, ChoiceNextStep(step, MostVoted(step.Choices, counts))), nil
+}
+
+// Вариант с наибольшим числом голосов; при равенстве побеждает вариант, объявленный в квесте раньше.
+// nil, если голосов нет
+func MostVoted(choices []storage.Choice, counts map[int]int) *storage.Choice {
+	var winner *storage.Choice
+	for i := range choices {
+		choice := &choices[i]
+		if counts[choice.ID] > 0 && (winner == nil || counts[choice.ID] > counts[winner.ID]) {
+			winner = choice
+		}
+	}
+	return winner
+}
+
+// Вариант, набравший больше всего голосов зрителей; он считается еще одним голосом.
+// При равенстве побеждает вариант, объявленный в квесте раньше; nil, если голосов нет
+func AudienceWinner(choices []storage.Choice, audience map[int]int) *storage.Choice {
+	return MostVoted(choices, audience)
+}
+
+// Голоса за игроков, не успевших сделать выбор, по стратегии fallback.
+// pick(n) возвращает случайное число от 0 до n-1 для стратегии random
+func FallbackVotes(step *storage.Step, players []storage.Player, votes []storage.Vote, fallback string, pick func(n int) int) []storage.Vote {
+	if fallback == storage.AFKFallbackSkip {
+		return nil
+	}
+
+	voted := make(map[string]bool)
+	for _, vote := range votes {
+		voted[vote.PlayerName] = true
+	}
+
+	var fallbackVotes []storage.Vote
+	for _, player := range players {
+		if voted[player.Name] {
+			continue
+		}
+		candidates := ChoicesForRole(step.Choices, player.PlayerIndex)
+		if len(candidates) == 0 {
+			continue
+		}
+
+		var chosen storage.Choice
+		if fallback == storage.AFKFallbackDefault {
+			chosen = candidates[0]
+			for _, c := range candidates {
+				if c.IsDefault {
+					chosen = c
+					break
+				}
+			}
+		} else {
+			chosen = candidates[pick(len(candidates))]
+		}
+		fallbackVotes = append(fallbackVotes, storage.Vote{PlayerName: player.Name, ChoiceID: chosen.ID})
+	}
+	return fallbackVotes
+}
+
+// Дедлайн голосования на шаге step. Ставится только для player_action шагов идущей игры,
+// у которых задан таймаут (на самом шаге или на сервере); nil - без ограничения по времени.
+// Таймаут шага, не больший нуля, не действует: тогда работает таймаут сервера
+func VoteDeadline(server *storage.Server, step *storage.Step, now time.Time) *time.Time {
+	if step.Type != storage.StepPlayerAction || server.Status != storage.ServerStatusInProgress {
+		return nil
+	}
+
+	timeout := server.VoteTimeoutSeconds
+	if step.VoteTimeoutSeconds != nil && *step.VoteTimeoutSeconds > 0 {
+		timeout = *step.VoteTimeoutSeconds
+	}
+	if timeout <= 0 {
+		return nil
+	}
+
+	deadline := now.Add(time.Duration(timeout) * time.Second)
+	return &deadline
+}
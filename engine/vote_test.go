@@ -0,0 +1,309 @@
+package engine_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"quest_maker/engine"
+	"quest_maker/storage"
+)
+
+func choiceIDs(choices []storage.Choice) []int {
+	var ids []int
+	for _, c := range choices {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func TestChoicesForRole(t *testing.T) {
+	choices := testQuest()[2].Choices
+	tests := []struct {
+		role int
+		want []int
+	}{
+		{0, []int{22}},
+		{1, []int{21, 22}},
+		{2, []int{22, 23}},
+		{3, []int{22}},
+	}
+
+	for _, tt := range tests {
+		got := choiceIDs(engine.ChoicesForRole(choices, tt.role))
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("Role %d: expected %v, got %v", tt.role, tt.want, got)
+		}
+	}
+}
+
+func TestCheckVote(t *testing.T) {
+	quest := testQuest()
+	tests := []struct {
+		name   string
+		step   int
+		choice int
+		role   int
+		err    error
+	}{
+		{"common choice", 2, 22, 1, nil},
+		{"choice of the player's role", 2, 21, 1, nil},
+		{"choice of another role", 2, 21, 2, engine.ErrWrongRole},
+		{"role choice without a role", 2, 23, 0, engine.ErrWrongRole},
+		{"choice of another step", 2, 51, 1, engine.ErrChoiceUnavailable},
+		{"step without choices", 1, 21, 1, engine.ErrChoiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			choice, err := engine.CheckVote(quest[tt.step], tt.choice, tt.role)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			if err == nil && choice.ID != tt.choice {
+				t.Errorf("Expected choice %d, got %d", tt.choice, choice.ID)
+			}
+		})
+	}
+}
+
+func TestAllVoted(t *testing.T) {
+	quest := testQuest()
+	players := []storage.Player{{Name: "Alice", PlayerIndex: 1}, {Name: "Bob", PlayerIndex: 2}}
+	// Вариант есть только у первой роли: второму игроку голосовать не за что
+	roleOnly := &storage.Step{ID: 6, Type: storage.StepPlayerAction, Choices: []storage.Choice{
+		{ID: 61, StepID: 6, Text: "Открыть дверь", PlayerIndex: 1},
+	}}
+	tests := []struct {
+		name    string
+		step    *storage.Step
+		players []storage.Player
+		votes   []storage.Vote
+		want    bool
+	}{
+		{"nobody voted", quest[2], players, nil, false},
+		{"one of two voted", quest[2], players, []storage.Vote{{PlayerName: "Alice", ChoiceID: 21}}, false},
+		{"everyone voted", quest[2], players, []storage.Vote{{PlayerName: "Bob", ChoiceID: 22}, {PlayerName: "Alice", ChoiceID: 21}}, true},
+		{"vote of a player who left", quest[2], players, []storage.Vote{{PlayerName: "Alice"}, {PlayerName: "Carol"}}, false},
+		{"everyone left voted", quest[2], players[:1], []storage.Vote{{PlayerName: "Alice"}, {PlayerName: "Bob"}}, true},
+		{"no players", quest[2], nil, nil, false},
+		{"step without choices", quest[1], players, nil, false},
+		{"player without choices is not waited for", roleOnly, players, []storage.Vote{{PlayerName: "Alice", ChoiceID: 61}}, true},
+		{"player with choices is still waited for", roleOnly, players, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := engine.AllVoted(tt.step, tt.players, tt.votes); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAudienceWinner(t *testing.T) {
+	choices := testQuest()[2].Choices
+	tests := []struct {
+		name     string
+		audience map[int]int
+		want     int
+	}{
+		{"no votes", nil, 0},
+		{"most votes", map[int]int{21: 1, 23: 3}, 23},
+		{"tie goes to the earlier choice", map[int]int{23: 2, 22: 2}, 22},
+		{"votes for unknown choices are ignored", map[int]int{99: 5}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			winner := engine.AudienceWinner(choices, tt.audience)
+			got := 0
+			if winner != nil {
+				got = winner.ID
+			}
+			if got != tt.want {
+				t.Errorf("Expected choice %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	quest := testQuest()
+	start := engine.State{StepID: 2, Points: storage.Points{Whatever: 1}}
+	votes := []storage.Vote{{PlayerName: "Alice", ChoiceID: 21}, {PlayerName: "Bob", ChoiceID: 22}}
+
+	tests := []struct {
+		name     string
+		quest    engine.Steps
+		state    engine.State
+		votes    []storage.Vote
+		audience map[int]int
+		want     engine.State
+		err      error
+	}{
+		{
+			"sums all votes",
+			quest, start, votes, nil,
+			engine.State{StepID: 3, Points: storage.Points{Violence: 2, Whatever: 1, Pacifism: 1}}, nil,
+		},
+		{
+			"audience winner counts as one more vote",
+			quest, start, votes, map[int]int{22: 1, 21: 4},
+			engine.State{StepID: 3, Points: storage.Points{Violence: 4, Whatever: 1, Pacifism: 1}}, nil,
+		},
+		{
+			"no votes",
+			quest, start, nil, nil,
+			engine.State{StepID: 3, Points: storage.Points{Whatever: 1}}, nil,
+		},
+		{
+			"votes for other steps are ignored",
+			quest, start, []storage.Vote{{PlayerName: "Alice", ChoiceID: 51}}, nil,
+			engine.State{StepID: 3, Points: storage.Points{Whatever: 1}}, nil,
+		},
+		{
+			"audience is ignored without a poll",
+			withoutPoll(testQuest()), start, votes, map[int]int{21: 4},
+			engine.State{StepID: 3, Points: storage.Points{Violence: 2, Whatever: 1, Pacifism: 1}}, nil,
+		},
+		{
+			"last step finishes the quest",
+			quest, engine.State{StepID: 5}, []storage.Vote{{PlayerName: "Alice", ChoiceID: 51}, {PlayerName: "Bob", ChoiceID: 51}}, nil,
+			engine.State{StepID: 5, Points: storage.Points{Pacifism: 6}, Finished: true}, nil,
+		},
+		{
+			"most voted choice leads to its step",
+			withBranch(testQuest()), start, append(votes, storage.Vote{PlayerName: "Carol", ChoiceID: 22}), nil,
+			engine.State{StepID: 4, Points: storage.Points{Violence: 2, Whatever: 1, Pacifism: 2}}, nil,
+		},
+		{
+			"tie goes to the earlier choice",
+			withBranch(testQuest()), start, votes, nil,
+			engine.State{StepID: 3, Points: storage.Points{Violence: 2, Whatever: 1, Pacifism: 1}}, nil,
+		},
+		{
+			"audience winner breaks a tie",
+			withBranch(testQuest()), start, votes, map[int]int{22: 3},
+			engine.State{StepID: 4, Points: storage.Points{Violence: 2, Whatever: 1, Pacifism: 2}}, nil,
+		},
+		{"step without choices", quest, engine.State{StepID: 1}, votes, nil, engine.State{StepID: 1}, engine.ErrNotChoiceStep},
+		{"finished quest", quest, engine.State{StepID: 5, Finished: true}, nil, nil, engine.State{StepID: 5, Finished: true}, engine.ErrFinished},
+		{"missing step", quest, engine.State{StepID: 99}, nil, nil, engine.State{StepID: 99}, storage.ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := engine.Resolve(tt.quest, tt.state, tt.votes, tt.audience)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// Вариант "Уйти" ведет сразу к концу, минуя стражника
+func withBranch(quest engine.Steps) engine.Steps {
+	step := *quest[2]
+	step.Choices = append([]storage.Choice(nil), step.Choices...)
+	step.Choices[1].NextStep = 4
+	quest[2] = &step
+	return quest
+}
+
+func withoutPoll(quest engine.Steps) engine.Steps {
+	step := *quest[2]
+	step.AudiencePoll = false
+	quest[2] = &step
+	return quest
+}
+
+func TestFallbackVotes(t *testing.T) {
+	step := testQuest()[2]
+	players := []storage.Player{
+		{Name: "Alice", PlayerIndex: 1},
+		{Name: "Bob", PlayerIndex: 2},
+		{Name: "Carol"},
+	}
+	last := func(n int) int { return n - 1 }
+
+	tests := []struct {
+		name     string
+		step     *storage.Step
+		votes    []storage.Vote
+		fallback string
+		want     string
+	}{
+		{"skip", step, nil, storage.AFKFallbackSkip, "[]"},
+		{"default choice", step, nil, storage.AFKFallbackDefault, "[{Alice 22} {Bob 22} {Carol 22}]"},
+		{"random choice among the role's choices", step, nil, storage.AFKFallbackRandom, "[{Alice 22} {Bob 23} {Carol 22}]"},
+		{"players who voted are skipped", step, []storage.Vote{{PlayerName: "Bob", ChoiceID: 23}}, storage.AFKFallbackDefault, "[{Alice 22} {Carol 22}]"},
+		{
+			"first choice without a default",
+			&storage.Step{Choices: []storage.Choice{{ID: 1, PlayerIndex: 1}, {ID: 2}, {ID: 3}}},
+			nil, storage.AFKFallbackDefault, "[{Alice 1} {Bob 2} {Carol 2}]",
+		},
+		{
+			"players without choices are skipped",
+			&storage.Step{Choices: []storage.Choice{{ID: 1, PlayerIndex: 1}}},
+			nil, storage.AFKFallbackRandom, "[{Alice 1}]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fmt.Sprint(engine.FallbackVotes(tt.step, players, tt.votes, tt.fallback, last))
+			if got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestVoteDeadline(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	stepTimeout, zero := 10, 0
+	vote := &storage.Step{Type: storage.StepPlayerAction}
+	timedVote := &storage.Step{Type: storage.StepPlayerAction, VoteTimeoutSeconds: &stepTimeout}
+	zeroVote := &storage.Step{Type: storage.StepPlayerAction, VoteTimeoutSeconds: &zero}
+	narration := &storage.Step{Type: storage.StepNarration, VoteTimeoutSeconds: &stepTimeout}
+
+	playing := func(timeout int) *storage.Server {
+		return &storage.Server{Status: storage.ServerStatusInProgress, VoteTimeoutSeconds: timeout}
+	}
+
+	tests := []struct {
+		name   string
+		server *storage.Server
+		step   *storage.Step
+		want   time.Duration // -1 - без дедлайна
+	}{
+		{"server timeout", playing(30), vote, 30 * time.Second},
+		{"step timeout overrides the server", playing(30), timedVote, 10 * time.Second},
+		{"step timeout without a server timeout", playing(0), timedVote, 10 * time.Second},
+		{"zero step timeout uses the server timeout", playing(30), zeroVote, 30 * time.Second},
+		{"zero step timeout without a server timeout", playing(0), zeroVote, -1},
+		{"no timeout", playing(0), vote, -1},
+		{"not a vote", playing(30), narration, -1},
+		{"game not started", &storage.Server{Status: storage.ServerStatusWaiting, VoteTimeoutSeconds: 30}, vote, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deadline := engine.VoteDeadline(tt.server, tt.step, now)
+			if tt.want < 0 {
+				if deadline != nil {
+					t.Errorf("Expected no deadline, got %v", deadline)
+				}
+				return
+			}
+			if deadline == nil || !deadline.Equal(now.Add(tt.want)) {
+				t.Errorf("Expected deadline %v, got %v", now.Add(tt.want), deadline)
+			}
+		})
+	}
+}
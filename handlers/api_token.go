@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"quest_maker/storage"
+)
+
+// Области доступа API-токенов
+const (
+	ScopeQuestsWrite      = "quests:write"
+	ScopeQuestsRead       = "quests:read"
+	ScopePlaythroughsRead = "playthroughs:read"
+	ScopeServersAdmin     = "servers:admin"
+)
+
+var apiTokenScopes = []string{ScopeQuestsWrite, ScopeQuestsRead, ScopePlaythroughsRead, ScopeServersAdmin}
+
+const (
+	apiTokenPrefix        = "qm_"
+	apiTokenDisplayLength = 10 // Сколько первых символов токена показывать в списке
+)
+
+// Область, которой нет ни у одного токена: ее маршруты доступны только по сессии входа
+const scopeSession = "session"
+
+var errMissingScope = errors.New("api token does not have the required scope")
+
+type scopeContextKey struct{}
+
+// Объявляет область доступа маршрута: API-токен принимается, только если она есть у токена.
+// Маршруты без области принимают любой действующий токен.
+// Оборачивает RequireUser, RequireAccount, WithUser или WithGuest снаружи
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopeContextKey{}, scope)))
+	})
+}
+
+// Маршрут, который не принимает API-токены, например выпуск новых токенов:
+// иначе токен с узкой областью мог бы выпустить себе токен с любой
+func RequireSession(next http.Handler) http.Handler {
+	return RequireScope(scopeSession, next)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func authenticateAPIToken(store storage.Store, r *http.Request, token string) (*User, error) {
+	account, scopes, err := store.Users().UseAPIToken(hashToken(token), time.Now())
+	if err == storage.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user := User{ID: account.ID, Username: account.Username, Scopes: scopes}
+	required, _ := r.Context().Value(scopeContextKey{}).(string)
+	if required != "" && !hasScope(user.Scopes, required) {
+		return nil, errMissingScope
+	}
+	return &user, nil
+}
+
+func writeAuthError(w http.ResponseWriter, err error) {
+	if err == errMissingScope {
+		http.Error(w, "API token does not have the required scope", http.StatusForbidden)
+		return
+	}
+	http.Error(w, "Failed to check session", http.StatusInternalServerError)
+}
+
+type APITokenInfo struct {
+	TokenID    int        `json:"token_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Revoked    bool       `json:"revoked"`
+}
+
+// Выпуск API-токена; сам токен возвращается только в этом ответе
+type CreateAPITokenHandler struct {
+	Store storage.Store
+}
+
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"` // 0 - бессрочный
+}
+
+type CreateAPITokenResponse struct {
+	APITokenInfo
+	Token string `json:"token"`
+}
+
+func (h *CreateAPITokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Token name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !hasScope(apiTokenScopes, scope) {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "Invalid expires_in_days", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := generateSessionToken()
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	token := apiTokenPrefix + secret
+
+	resp := CreateAPITokenResponse{
+		APITokenInfo: APITokenInfo{
+			Name:   req.Name,
+			Prefix: token[:apiTokenDisplayLength],
+			Scopes: req.Scopes,
+		},
+		Token: token,
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		resp.ExpiresAt = &expiresAt
+	}
+
+	apiToken := storage.APIToken{
+		UserID:    currentUser(r).ID,
+		Name:      req.Name,
+		TokenHash: hashToken(token),
+		Prefix:    resp.Prefix,
+		Scopes:    req.Scopes,
+		ExpiresAt: resp.ExpiresAt,
+	}
+	if err := h.Store.Users().CreateAPIToken(&apiToken); err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	resp.TokenID = apiToken.ID
+	resp.CreatedAt = apiToken.CreatedAt
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Список API-токенов пользователя, без самих токенов
+type ListAPITokensHandler struct {
+	Store storage.Store
+}
+
+func (h *ListAPITokensHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	apiTokens, err := h.Store.Users().APITokens(currentUser(r).ID)
+	if err != nil {
+		http.Error(w, "Failed to get tokens", http.StatusInternalServerError)
+		return
+	}
+
+	tokens := []APITokenInfo{}
+	for _, t := range apiTokens {
+		tokens = append(tokens, APITokenInfo{
+			TokenID:    t.ID,
+			Name:       t.Name,
+			Prefix:     t.Prefix,
+			Scopes:     t.Scopes,
+			CreatedAt:  t.CreatedAt,
+			LastUsedAt: t.LastUsedAt,
+			ExpiresAt:  t.ExpiresAt,
+			Revoked:    t.RevokedAt != nil,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// Отзыв API-токена
+type RevokeAPITokenHandler struct {
+	Store storage.Store
+}
+
+type RevokeAPITokenRequest struct {
+	TokenID int `json:"token_id"`
+}
+
+func (h *RevokeAPITokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req RevokeAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	err := h.Store.Users().RevokeAPIToken(req.TokenID, currentUser(r).ID, time.Now())
+	if err == storage.ErrNotFound {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+}
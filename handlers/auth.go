@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"quest_maker/storage"
+)
+
+const (
+	sessionCookieName = "quest_session"
+	sessionTTL        = 30 * 24 * time.Hour
+	minPasswordLength = 8
+	maxUsernameLength = 32
+)
+
+type User struct {
+	ID       int    `json:"user_id"`
+	Username string `json:"username"`
+	IsGuest  bool   `json:"is_guest"`
+	// Области доступа API-токена; nil для сессии входа, которой доступно все
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+type userContextKey struct{}
+
+// Пользователь, от имени которого выполняется запрос. Заполняется RequireUser
+func currentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey{}).(*User)
+	return user
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Токен сессии или API-токен из cookie или заголовка Authorization: Bearer
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// Находит пользователя по токену запроса; nil, если запрос не аутентифицирован
+func authenticate(store storage.Store, r *http.Request) (*User, error) {
+	token := requestToken(r)
+	if token == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(token, guestTokenPrefix) {
+		return authenticateGuest(store, token)
+	}
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		return authenticateAPIToken(store, r, token)
+	}
+
+	user, err := store.Users().SessionUser(hashToken(token), time.Now())
+	if err == storage.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &User{ID: user.ID, Username: user.Username}, nil
+}
+
+// Пропускает запрос дальше только с действующей сессией
+func RequireUser(store storage.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(store, r)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		if user == nil {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	})
+}
+
+// Как RequireUser, но только для зарегистрированных пользователей, без гостей
+func RequireAccount(store storage.Store, next http.Handler) http.Handler {
+	return RequireUser(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r).IsGuest {
+			http.Error(w, "Registered account required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// Определяет пользователя, если запрос аутентифицирован, но пропускает и анонимные запросы
+func WithUser(store storage.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(store, r)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Создает сессию и отдает токен в cookie; тот же токен можно передавать как Bearer
+func startUserSession(w http.ResponseWriter, store storage.Store, userID int) (string, error) {
+	token, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	expiresAt := time.Now().Add(sessionTTL)
+
+	if err := store.Users().CreateSession(userID, hashToken(token), expiresAt); err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, nil
+}
+
+type CredentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type AuthResponse struct {
+	User
+	Token string `json:"token"`
+}
+
+// Регистрация нового пользователя
+type RegisterHandler struct {
+	Store storage.Store
+}
+
+func (h *RegisterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req CredentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" || utf8.RuneCountInString(req.Username) > maxUsernameLength {
+		http.Error(w, fmt.Sprintf("Username must be 1 to %d characters long", maxUsernameLength), http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(req.Username, guestNamePrefix) {
+		http.Error(w, "Username is reserved for guests", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(req.Password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters long", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	guest, err := requestGuest(h.Store, r)
+	if err != nil {
+		http.Error(w, "Failed to check guest session", http.StatusInternalServerError)
+		return
+	}
+
+	var resp AuthResponse
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		account, err := tx.Users().Create(req.Username, passwordHash)
+		if err != nil {
+			return err
+		}
+		resp.User = User{ID: account.ID, Username: account.Username}
+
+		// Игры, начатые гостем, переходят в новую учетную запись
+		if guest != nil {
+			if err := tx.Users().ClaimGuest(storage.User{ID: guest.ID, Username: guest.Username}, *account); err != nil {
+				return err
+			}
+		}
+
+		resp.Token, err = startUserSession(w, tx, resp.ID)
+		return err
+	})
+	if err == storage.ErrConflict {
+		http.Error(w, "Username is already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Вход по имени пользователя и паролю
+type LoginHandler struct {
+	Store storage.Store
+}
+
+func (h *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req CredentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	account, err := h.Store.Users().GetByName(strings.TrimSpace(req.Username))
+	if err != nil && err != storage.ErrNotFound {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	if err == storage.ErrNotFound || account.IsGuest || !checkPassword(account.PasswordHash, req.Password) {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	guest, err := requestGuest(h.Store, r)
+	if err != nil {
+		http.Error(w, "Failed to check guest session", http.StatusInternalServerError)
+		return
+	}
+
+	resp := AuthResponse{User: User{ID: account.ID, Username: account.Username}}
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		if guest != nil {
+			if err := tx.Users().ClaimGuest(storage.User{ID: guest.ID, Username: guest.Username}, *account); err != nil {
+				return err
+			}
+		}
+
+		resp.Token, err = startUserSession(w, tx, resp.ID)
+		return err
+	})
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Выход: сессия удаляется, cookie сбрасывается
+type LogoutHandler struct {
+	Store storage.Store
+}
+
+func (h *LogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if token := requestToken(r); token != "" {
+		if err := h.Store.Users().DeleteSession(hashToken(token)); err != nil {
+			http.Error(w, "Failed to delete session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged_out"})
+}
+
+// Текущий пользователь
+type MeHandler struct {
+}
+
+func (h *MeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentUser(r))
+}
@@ -0,0 +1,15 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// Страница редактора квестов; квест выбирается параметром quest_id, без него создается новый
+type EditorPageHandler struct {
+}
+
+func (h *EditorPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("templates/editor.html"))
+	tmpl.Execute(w, nil)
+}
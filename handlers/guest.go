@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"quest_maker/storage"
+)
+
+const (
+	guestTokenPrefix = "guest."
+	guestNamePrefix  = "Гость-"
+	guestTTL         = 30 * 24 * time.Hour
+)
+
+var guestTokenSecret []byte
+
+// Ключ подписи гостевых токенов. Без него ключ генерируется при запуске,
+// и после перезапуска сервера гости теряют доступ к своим играм
+func SetGuestTokenSecret(secret string) {
+	if secret != "" {
+		guestTokenSecret = []byte(secret)
+		return
+	}
+	guestTokenSecret = make([]byte, 32)
+	if _, err := rand.Read(guestTokenSecret); err != nil {
+		panic(err)
+	}
+	fmt.Println("GUEST_TOKEN_SECRET is not set, guest sessions will not survive a restart")
+}
+
+func signGuestPayload(payload string) string {
+	mac := hmac.New(sha256.New, guestTokenSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Токен вида guest.<id>.<время выдачи>.<подпись>; в базе не хранится
+func issueGuestToken(userID int, issuedAt time.Time) string {
+	payload := fmt.Sprintf("%d.%d", userID, issuedAt.Unix())
+	return guestTokenPrefix + payload + "." + signGuestPayload(payload)
+}
+
+// Проверяет подпись и срок действия гостевого токена, возвращает id гостя
+func parseGuestToken(token string) (int, bool) {
+	if len(guestTokenSecret) == 0 || !strings.HasPrefix(token, guestTokenPrefix) {
+		return 0, false
+	}
+	parts := strings.Split(strings.TrimPrefix(token, guestTokenPrefix), ".")
+	if len(parts) != 3 {
+		return 0, false
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(signGuestPayload(payload))) {
+		return 0, false
+	}
+
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, false
+	}
+	issuedAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Since(time.Unix(issuedAt, 0)) > guestTTL {
+		return 0, false
+	}
+	return userID, true
+}
+
+func authenticateGuest(store storage.Store, token string) (*User, error) {
+	userID, ok := parseGuestToken(token)
+	if !ok {
+		return nil, nil
+	}
+
+	user, err := store.Users().Get(userID)
+	if err == storage.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsGuest {
+		return nil, nil
+	}
+	return &User{ID: user.ID, Username: user.Username, IsGuest: true}, nil
+}
+
+// Создает гостя со случайным именем и отдает его токен в cookie сессии
+func createGuest(w http.ResponseWriter, store storage.Store) (*User, error) {
+	for {
+		suffix := make([]byte, 4)
+		for i := range suffix {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(inviteCodeAlphabet))))
+			if err != nil {
+				return nil, err
+			}
+			suffix[i] = inviteCodeAlphabet[n.Int64()]
+		}
+
+		guest, err := store.Users().CreateGuest(guestNamePrefix + string(suffix))
+		if err == storage.ErrConflict {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		issuedAt := time.Now()
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    issueGuestToken(guest.ID, issuedAt),
+			Path:     "/",
+			Expires:  issuedAt.Add(guestTTL),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return &User{ID: guest.ID, Username: guest.Username, IsGuest: true}, nil
+	}
+}
+
+// Как RequireUser, но запросу без сессии автоматически выдается гостевая.
+// Используется там, где игрок впервые попадает в игру
+func WithGuest(store storage.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(store, r)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		if user == nil {
+			user, err = createGuest(w, store)
+			if err != nil {
+				http.Error(w, "Failed to create guest", http.StatusInternalServerError)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	})
+}
+
+// Гость, от имени которого пришел запрос на регистрацию или вход
+func requestGuest(store storage.Store, r *http.Request) (*User, error) {
+	return authenticateGuest(store, requestToken(r))
+}
+
+// Явный перенос гостевых игр в учетную запись по гостевому токену,
+// например, если гость вошел в существующую учетную запись с другого устройства
+type ClaimGuestHandler struct {
+	Store storage.Store
+}
+
+type ClaimGuestRequest struct {
+	GuestToken string `json:"guest_token"`
+}
+
+func (h *ClaimGuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req ClaimGuestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	guest, err := authenticateGuest(h.Store, req.GuestToken)
+	if err != nil {
+		http.Error(w, "Failed to check guest token", http.StatusInternalServerError)
+		return
+	}
+	if guest == nil {
+		http.Error(w, "Invalid guest token", http.StatusBadRequest)
+		return
+	}
+
+	user := currentUser(r)
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		return tx.Users().ClaimGuest(
+			storage.User{ID: guest.ID, Username: guest.Username},
+			storage.User{ID: user.ID, Username: user.Username},
+		)
+	})
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to claim guest games", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "claimed"})
+}
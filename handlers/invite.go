@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"quest_maker/storage"
+)
+
+// Без похожих друг на друга символов (0/O, 1/I), чтобы код было легко продиктовать
+const inviteCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const inviteCodeLength = 6
+
+func generateInviteCode(store storage.Store) (string, error) {
+	for {
+		code := make([]byte, inviteCodeLength)
+		for i := range code {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(inviteCodeAlphabet))))
+			if err != nil {
+				return "", err
+			}
+			code[i] = inviteCodeAlphabet[n.Int64()]
+		}
+
+		exists, err := store.Servers().InviteCodeTaken(string(code))
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return string(code), nil
+		}
+	}
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+var (
+	errServerNotFound        = errors.New("server not found")
+	errServerPrivate         = errors.New("server is private")
+	errInvalidServerPassword = errors.New("invalid server password")
+)
+
+// Находит сервер по id или коду приглашения и проверяет доступ к нему.
+// На приватный сервер можно попасть только по коду, пароль проверяется в обоих случаях
+func findServerForEntry(store storage.Store, serverID int, inviteCode, password string) (*storage.Server, error) {
+	var server *storage.Server
+	var err error
+	if inviteCode != "" {
+		server, err = store.Servers().GetByInviteCode(inviteCode)
+	} else {
+		server, err = store.Servers().Get(serverID)
+	}
+	if err == storage.ErrNotFound {
+		return nil, errServerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !server.IsPublic && inviteCode == "" {
+		return nil, errServerPrivate
+	}
+	if server.PasswordHash != "" && !checkPassword(server.PasswordHash, password) {
+		return nil, errInvalidServerPassword
+	}
+	return server, nil
+}
+
+func writeServerEntryError(w http.ResponseWriter, err error) {
+	switch err {
+	case errServerNotFound:
+		http.Error(w, "Server not found", http.StatusNotFound)
+	case errServerPrivate:
+		http.Error(w, "Server is private, join by invite code", http.StatusForbidden)
+	case errInvalidServerPassword:
+		http.Error(w, "Invalid password", http.StatusForbidden)
+	default:
+		http.Error(w, "Failed to get server", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"quest_maker/storage"
+)
+
+type LobbyRole struct {
+	Name        string `json:"name"`
+	PlayerIndex int    `json:"player_index"`
+	Character   string `json:"character,omitempty"`
+	ClaimedBy   string `json:"claimed_by,omitempty"`
+}
+
+type LobbyPlayer struct {
+	PlayerName string `json:"player_name"`
+	Role       string `json:"role,omitempty"`
+	IsReady    bool   `json:"is_ready"`
+	Online     bool   `json:"online"`
+}
+
+type LobbyState struct {
+	ServerID   int           `json:"server_id"`
+	Status     string        `json:"status"`
+	Host       string        `json:"host"`
+	MaxPlayers int           `json:"max_players"`
+	Roles      []LobbyRole   `json:"roles"`
+	Players    []LobbyPlayer `json:"players"`
+	Spectators []Spectator   `json:"spectators"`
+}
+
+// Роли, доступные на сервере: объявленные в квесте или нумерованные по количеству мест
+func lobbyRoles(store storage.Store, server *storage.Server, players []storage.Player) ([]LobbyRole, error) {
+	questRoles, err := store.Quests().Roles(server.QuestID)
+	if err != nil {
+		return nil, err
+	}
+
+	claimedBy := make(map[int]string)
+	for _, player := range players {
+		if player.PlayerIndex != 0 {
+			claimedBy[player.PlayerIndex] = player.Name
+		}
+	}
+
+	var roles []LobbyRole
+	for _, role := range questRoles {
+		roles = append(roles, LobbyRole{
+			Name:        role.Name,
+			PlayerIndex: role.Position,
+			Character:   role.Character,
+			ClaimedBy:   claimedBy[role.Position],
+		})
+	}
+	if len(roles) > 0 {
+		return roles, nil
+	}
+
+	for i := 1; i <= server.MaxPlayers; i++ {
+		roles = append(roles, LobbyRole{Name: roleName("", i), PlayerIndex: i, ClaimedBy: claimedBy[i]})
+	}
+	return roles, nil
+}
+
+func findPlayer(players []storage.Player, name string) *storage.Player {
+	for i := range players {
+		if players[i].Name == name {
+			return &players[i]
+		}
+	}
+	return nil
+}
+
+// Место пользователя на сервере; в отличие от имени, ID не меняется при переходе гостя в учетную запись
+func findUserPlayer(players []storage.Player, userID int) *storage.Player {
+	for i := range players {
+		if players[i].UserID == userID {
+			return &players[i]
+		}
+	}
+	return nil
+}
+
+// Начинает игру, если сервер заполнен, все игроки заняли роли и готовы
+func tryStartGame(tx storage.Store, server *storage.Server) (bool, error) {
+	if server.Status != storage.ServerStatusWaiting {
+		return false, nil
+	}
+
+	players, err := tx.Servers().Players(server.ID)
+	if err != nil {
+		return false, err
+	}
+	readyCount := 0
+	for _, player := range players {
+		if player.IsReady && player.PlayerIndex != 0 {
+			readyCount++
+		}
+	}
+
+	if len(players) < server.MaxPlayers || readyCount < len(players) {
+		return false, nil
+	}
+
+	return true, startGame(tx, server)
+}
+
+func startGame(tx storage.Store, server *storage.Server) error {
+	if err := transitionServerStatus(tx, server.ID, storage.ServerStatusInProgress); err != nil {
+		return err
+	}
+	server.Status = storage.ServerStatusInProgress
+
+	mp, err := tx.Servers().Playthrough(server.ID)
+	if err != nil {
+		return err
+	}
+	return moveToStep(tx, server, mp, mp.StepID)
+}
+
+// Состояние лобби: роли, кто их занял и готовность игроков; приватный сервер виден только его игрокам и зрителям
+type GetLobbyHandler struct {
+	Store storage.Store
+}
+
+func (h *GetLobbyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serverID, err := strconv.Atoi(r.URL.Query().Get("server_id"))
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+
+	server, err := visibleServer(h.Store, serverID, currentUser(r))
+	if err != nil {
+		writeVisibleServerError(w, err)
+		return
+	}
+	state := LobbyState{ServerID: serverID, Status: server.Status, Host: server.Host, MaxPlayers: server.MaxPlayers}
+
+	players, err := h.Store.Servers().Players(serverID)
+	if err != nil {
+		http.Error(w, "Failed to get players", http.StatusInternalServerError)
+		return
+	}
+
+	state.Roles, err = lobbyRoles(h.Store, server, players)
+	if err != nil {
+		http.Error(w, "Failed to get roles", http.StatusInternalServerError)
+		return
+	}
+
+	roleNames := make(map[string]string)
+	for _, role := range state.Roles {
+		if role.ClaimedBy != "" {
+			roleNames[role.ClaimedBy] = role.Name
+		}
+	}
+
+	now := time.Now()
+	for _, player := range players {
+		state.Players = append(state.Players, LobbyPlayer{
+			PlayerName: player.Name,
+			Role:       roleNames[player.Name],
+			IsReady:    player.IsReady,
+			Online:     isOnline(player.LastSeenAt, now),
+		})
+	}
+
+	state.Spectators, err = listSpectators(h.Store, serverID)
+	if err != nil {
+		http.Error(w, "Failed to get spectators", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// Занятие роли в лобби
+type ClaimRoleHandler struct {
+	Store storage.Store
+}
+
+type ClaimRoleRequest struct {
+	ServerID int    `json:"server_id"`
+	Role     string `json:"role"`
+}
+
+func (h *ClaimRoleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req ClaimRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	user := currentUser(r)
+
+	err := h.Store.Atomic(func(tx storage.Store) error {
+		// Блокируем сервер, чтобы два игрока не заняли одну роль одновременно
+		server, err := tx.Servers().Lock(req.ServerID)
+		if err == storage.ErrNotFound {
+			return rejectRequest(http.StatusNotFound, "Server not found")
+		}
+		if err != nil {
+			return err
+		}
+		if server.Status != storage.ServerStatusWaiting {
+			return rejectRequest(http.StatusBadRequest, "Roles can only be changed before the game starts")
+		}
+
+		players, err := tx.Servers().Players(req.ServerID)
+		if err != nil {
+			return err
+		}
+		roles, err := lobbyRoles(tx, server, players)
+		if err != nil {
+			return err
+		}
+
+		var role *LobbyRole
+		for i := range roles {
+			if roles[i].Name == req.Role {
+				role = &roles[i]
+			}
+		}
+		if role == nil {
+			return rejectRequest(http.StatusNotFound, "Role not found")
+		}
+		if role.ClaimedBy != "" && role.ClaimedBy != user.Username {
+			return rejectRequest(http.StatusConflict, "Role is already taken")
+		}
+
+		// Смена роли сбрасывает готовность
+		err = tx.Servers().SetPlayerRole(req.ServerID, user.Username, role.PlayerIndex)
+		if err == storage.ErrNotFound {
+			return rejectRequest(http.StatusForbidden, "Player is not on this server")
+		}
+		return err
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to claim role")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "role_claimed"})
+}
+
+// Освобождение роли в лобби
+type ReleaseRoleHandler struct {
+	Store storage.Store
+}
+
+type ReleaseRoleRequest struct {
+	ServerID int `json:"server_id"`
+}
+
+func (h *ReleaseRoleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req ReleaseRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	user := currentUser(r)
+
+	err := h.Store.Atomic(func(tx storage.Store) error {
+		server, err := tx.Servers().Lock(req.ServerID)
+		if err != nil && err != storage.ErrNotFound {
+			return err
+		}
+		if err == storage.ErrNotFound || server.Status != storage.ServerStatusWaiting {
+			return rejectRequest(http.StatusBadRequest, "Player is not in this server's lobby")
+		}
+
+		err = tx.Servers().SetPlayerRole(req.ServerID, user.Username, 0)
+		if err == storage.ErrNotFound {
+			return rejectRequest(http.StatusBadRequest, "Player is not in this server's lobby")
+		}
+		return err
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to release role")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "role_released"})
+}
+
+// Отметка готовности; когда готовы все, игра начинается
+type SetReadyHandler struct {
+	Store storage.Store
+}
+
+type SetReadyRequest struct {
+	ServerID int  `json:"server_id"`
+	Ready    bool `json:"ready"`
+}
+
+func (h *SetReadyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req SetReadyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	user := currentUser(r)
+
+	var started bool
+	err := h.Store.Atomic(func(tx storage.Store) error {
+		server, err := tx.Servers().Lock(req.ServerID)
+		if err == storage.ErrNotFound {
+			return rejectRequest(http.StatusNotFound, "Server not found")
+		}
+		if err != nil {
+			return err
+		}
+		if server.Status != storage.ServerStatusWaiting {
+			return rejectRequest(http.StatusBadRequest, "Game has already started")
+		}
+
+		players, err := tx.Servers().Players(req.ServerID)
+		if err != nil {
+			return err
+		}
+		player := findPlayer(players, user.Username)
+		if player == nil {
+			return rejectRequest(http.StatusForbidden, "Player is not on this server")
+		}
+		if req.Ready && player.PlayerIndex == 0 {
+			return rejectRequest(http.StatusBadRequest, "Claim a role before getting ready")
+		}
+
+		if err := tx.Servers().SetPlayerReady(req.ServerID, user.Username, req.Ready); err != nil {
+			return err
+		}
+
+		started, err = tryStartGame(tx, server)
+		if err != nil {
+			return fmt.Errorf("failed to start game: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to update readiness")
+		return
+	}
+
+	status := "ready_updated"
+	if started {
+		status = "game_started"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
@@ -1,14 +1,14 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http"
+
+	"quest_maker/storage"
 )
 
 type StartPlaythroughRequest struct {
-	PlayerName string `json:"player_name"`
-	QuestID    int    `json:"quest_id"`
+	QuestID int `json:"quest_id"`
 }
 
 type StartPlaythroughResponse struct {
@@ -16,30 +16,47 @@ type StartPlaythroughResponse struct {
 }
 
 type MakePlayThroughHandler struct {
-	DB *sql.DB
+	Store storage.Store
 }
 
 func (h *MakePlayThroughHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var req StartPlaythroughRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	user := currentUser(r)
+
+	// Черновик могут проходить только его авторы
+	access, err := h.Store.Quests().Access(req.QuestID, user.ID)
+	if err != nil {
+		writeQuestAccessError(w, err)
+		return
+	}
+	if !access.CanPlay() {
+		http.Error(w, "Quest not found", http.StatusNotFound)
 		return
 	}
 
 	// Найдем начальный шаг квеста
-	var initialStepID int
-	err := h.DB.QueryRow("SELECT initial_step FROM quest WHERE id = $1", req.QuestID).Scan(&initialStepID)
+	quest, err := h.Store.Quests().Get(req.QuestID)
 	if err != nil {
 		http.Error(w, "Quest not found", http.StatusNotFound)
 		return
 	}
+	// Черновик без шагов пройти нельзя: прохождение встало бы на несуществующий шаг
+	if quest.InitialStep == 0 {
+		http.Error(w, "Quest has no steps", http.StatusBadRequest)
+		return
+	}
 
 	// Создаем запись о прохождении
-	var playthroughID int
-	err = h.DB.QueryRow(
-		"INSERT INTO playthrough (player_name, quest, step) VALUES ($1, $2, $3) RETURNING id",
-		req.PlayerName, req.QuestID, initialStepID,
-	).Scan(&playthroughID)
+	playthroughID, err := h.Store.Playthroughs().Create(storage.Playthrough{
+		QuestID:    req.QuestID,
+		UserID:     user.ID,
+		PlayerName: user.Username,
+		StepID:     quest.InitialStep,
+	})
 	if err != nil {
 		http.Error(w, "Failed to start playthrough", http.StatusInternalServerError)
 		return
@@ -50,3 +67,44 @@ func (h *MakePlayThroughHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
+
+type PlaythroughInfo struct {
+	PlaythroughID int    `json:"playthrough_id"`
+	QuestID       int    `json:"quest_id"`
+	QuestTitle    string `json:"quest_title"`
+	StepID        int    `json:"step_id"`
+	Finished      bool   `json:"finished"`
+	ViolencePoint int    `json:"violence_point"`
+	WhateverPoint int    `json:"whatever_point"`
+	PacifismPoint int    `json:"pacifism_point"`
+}
+
+// Прохождения текущего пользователя, последние сначала
+type ListPlaythroughsHandler struct {
+	Store storage.Store
+}
+
+func (h *ListPlaythroughsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	list, err := h.Store.Playthroughs().List(currentUser(r).ID)
+	if err != nil {
+		http.Error(w, "Failed to get playthroughs", http.StatusInternalServerError)
+		return
+	}
+
+	playthroughs := []PlaythroughInfo{}
+	for _, p := range list {
+		playthroughs = append(playthroughs, PlaythroughInfo{
+			PlaythroughID: p.ID,
+			QuestID:       p.QuestID,
+			QuestTitle:    p.QuestTitle,
+			StepID:        p.StepID,
+			Finished:      p.Finished,
+			ViolencePoint: p.Points.Violence,
+			WhateverPoint: p.Points.Whatever,
+			PacifismPoint: p.Points.Pacifism,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(playthroughs)
+}
@@ -1,14 +1,18 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+
+	"quest_maker/storage"
 )
 
 type QuestRequest struct {
 	Title      string         `json:"title"`
+	MaxPlayers int            `json:"max_players"` // По умолчанию - количество ролей
+	Roles      []RoleReq      `json:"roles"`
 	Characters []CharacterReq `json:"characters"`
 	Steps      []StepReq      `json:"steps"`
 }
@@ -17,6 +21,12 @@ type CharacterReq struct {
 	Name string `json:"name"`
 }
 
+// Роль игрока; выборы player_action могут быть доступны только определенной роли
+type RoleReq struct {
+	Name      string `json:"name"`
+	Character string `json:"character"` // Персонаж, которого играет обладатель роли
+}
+
 type StepReq struct {
 	Type string      `json:"type"`
 	Body interface{} `json:"body"`
@@ -27,15 +37,20 @@ type NarrationBody struct {
 }
 
 type PlayerActionBody struct {
-	Choices []PlayerActionChoice `json:"choices"`
+	Choices            []PlayerActionChoice `json:"choices"`
+	VoteTimeoutSeconds int                  `json:"vote_timeout_seconds"` // Переопределяет таймаут голосования сервера; 0 - таймаут сервера
+	AudiencePoll       bool                 `json:"audience_poll"`        // Голос зрителей засчитывается как дополнительный
 }
 
 type PlayerActionChoice struct {
-	Text          string `json:"text"`
-	ViolencePoint int    `json:"violence_point"`
-	WhateverPoint int    `json:"whatever_point"`
-	PacifismPoint int    `json:"pacifism_point"`
-	PlayerIndex   int    `json:"player_index"` // 1 для первого игрока, 2 для второго
+	Text           string `json:"text"`
+	ViolencePoint  int    `json:"violence_point"`
+	WhateverPoint  int    `json:"whatever_point"`
+	PacifismPoint  int    `json:"pacifism_point"`
+	PlayerIndex    int    `json:"player_index"`     // 1 для первого игрока, 2 для второго
+	Role           string `json:"role"`             // Имя роли, заменяет player_index
+	IsDefault      bool   `json:"is_default"`       // Выбирается за игрока, не успевшего проголосовать
+	NextStepNumber int    `json:"next_step_number"` // Номер шага для перехода после этого выбора
 }
 
 type CharacterActionBody struct {
@@ -53,175 +68,205 @@ type CharacterActionChoice struct {
 }
 
 type MakeQuestHandler struct {
-	DB *sql.DB
+	Store storage.Store
+}
+
+type MakeQuestResponse struct {
+	QuestID int    `json:"quest_id"`
+	Status  string `json:"status"`
 }
 
 func (h *MakeQuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var req QuestRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		writeBodyError(w, err, "Invalid JSON")
 		return
 	}
 
-	tx, err := h.DB.Begin()
+	quest, err := BuildQuest(req)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer tx.Rollback()
+	quest.OwnerID = currentUser(r).ID
 
-	characterIDs := make(map[string]int)
+	// Новый квест - черновик автора, пока тот его не опубликует
 	var questID int
-	err = tx.QueryRow("INSERT INTO quest (title, created_at, updated_at) VALUES ($1, NOW(), NOW()) RETURNING id", req.Title).Scan(&questID)
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		var err error
+		questID, err = tx.Quests().Create(quest)
+		return err
+	})
 	if err != nil {
-		http.Error(w, "Failed to insert quest", http.StatusInternalServerError)
+		fmt.Println(err)
+		http.Error(w, "Failed to save quest", http.StatusInternalServerError)
 		return
 	}
 
-	for _, char := range req.Characters {
-		var charID int
-		err := tx.QueryRow("INSERT INTO character (quest, name) VALUES ($1, $2) RETURNING id", questID, char.Name).Scan(&charID)
-		if err != nil {
-			http.Error(w, "Failed to insert character", http.StatusInternalServerError)
-			return
-		}
-		characterIDs[char.Name] = charID
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(MakeQuestResponse{QuestID: questID, Status: storage.QuestStatusDraft})
+}
+
+// Переводит запрос на создание квеста в модель хранилища; ошибка описывает неверное поле запроса.
+// Используется и обработчиком, и командами, читающими квест из файла
+func BuildQuest(req QuestRequest) (storage.NewQuest, error) {
+	maxPlayers := req.MaxPlayers
+	if maxPlayers < 0 {
+		return storage.NewQuest{}, errors.New("Invalid max_players")
+	}
+	if maxPlayers == 0 {
+		maxPlayers = len(req.Roles)
+	}
+	if maxPlayers == 0 {
+		maxPlayers = 2
 	}
 
-	// Сначала создаем все шаги без содержимого
-	stepIDs := make([]int, len(req.Steps))
-	for i := range req.Steps {
-		var stepID int
-		err := tx.QueryRow("INSERT INTO step (number, created_at, updated_at) VALUES ($1, NOW(), NOW()) RETURNING id", i+1).Scan(&stepID)
-		if err != nil {
-			http.Error(w, "Failed to insert step", http.StatusInternalServerError)
-			return
-		}
-		stepIDs[i] = stepID
+	quest := storage.NewQuest{Title: req.Title, MaxPlayers: maxPlayers}
+
+	characters := make(map[string]bool)
+	for _, char := range req.Characters {
+		quest.Characters = append(quest.Characters, char.Name)
+		characters[char.Name] = true
 	}
 
-	// Устанавливаем связи между шагами (каждый шаг ведет к следующему по умолчанию)
-	for i := 0; i < len(stepIDs)-1; i++ {
-		_, err := tx.Exec("UPDATE step SET next_step = $1 WHERE id = $2", stepIDs[i+1], stepIDs[i])
-		if err != nil {
-			http.Error(w, "Failed to update next_step", http.StatusInternalServerError)
-			return
+	// Позиция роли используется как player_index в выборах
+	roleIndexes := make(map[string]int)
+	for i, role := range req.Roles {
+		if role.Name == "" {
+			return storage.NewQuest{}, errors.New("Role name is required")
+		}
+		if _, exists := roleIndexes[role.Name]; exists {
+			return storage.NewQuest{}, errors.New("Duplicate role name")
 		}
+		if role.Character != "" && !characters[role.Character] {
+			return storage.NewQuest{}, errors.New("Character not found")
+		}
+
+		quest.Roles = append(quest.Roles, storage.Role{Position: i + 1, Name: role.Name, Character: role.Character})
+		roleIndexes[role.Name] = i + 1
+	}
+	// Как и в /update_quest, у квеста с ролями мест столько же, сколько ролей: иначе игру не начать
+	if len(req.Roles) > 0 && maxPlayers != len(req.Roles) {
+		return storage.NewQuest{}, errors.New("max_players must match the number of roles")
 	}
 
-	// Теперь создаем содержимое для каждого шага
-	for i, step := range req.Steps {
-		stepID := stepIDs[i]
+	// Каждый шаг ведет к следующему по порядку; вариант выбора и реплика могут увести на шаг по номеру
+	for _, step := range req.Steps {
+		body, ok := step.Body.(map[string]interface{})
+		if !ok {
+			return storage.NewQuest{}, errors.New("Step body must be an object")
+		}
 
 		switch step.Type {
-		case "narration":
-			body := step.Body.(map[string]interface{})
-			_, err := tx.Exec("INSERT INTO narration_action (step, text) VALUES ($1, $2)", stepID, body["text"].(string))
-			if err != nil {
-				http.Error(w, "Failed to insert narration action", http.StatusInternalServerError)
-				return
-			}
+		case storage.StepNarration:
+			quest.Steps = append(quest.Steps, storage.Step{Type: storage.StepNarration, Text: stringField(body, "text")})
 
-		case "player_action":
-			var playerActionID int
-			err := tx.QueryRow("INSERT INTO player_action (step) VALUES ($1) RETURNING id", stepID).Scan(&playerActionID)
-			if err != nil {
-				http.Error(w, "Failed to insert player action", http.StatusInternalServerError)
-				return
-			}
+		case storage.StepPlayerAction:
+			s := storage.Step{Type: storage.StepPlayerAction}
 
-			body := step.Body.(map[string]interface{})
-			choices := body["choices"].([]interface{})
-			for _, choice := range choices {
-				c := choice.(map[string]interface{})
-				playerIndex := 0 // По умолчанию для всех игроков
-				if idx, ok := c["player_index"]; ok {
-					playerIndex = int(idx.(float64))
+			if t, ok := body["vote_timeout_seconds"].(float64); ok {
+				if t < 0 {
+					return storage.NewQuest{}, errors.New("Invalid vote_timeout_seconds")
 				}
-				_, err := tx.Exec(
-					"INSERT INTO player_action_choice (player_action, text, violence_point, whatever_point, pacifism_point, player_index) VALUES ($1, $2, $3, $4, $5, $6)",
-					playerActionID, c["text"].(string),
-					int(c["violence_point"].(float64)), int(c["whatever_point"].(float64)), int(c["pacifism_point"].(float64)),
-					playerIndex,
-				)
-				if err != nil {
-					http.Error(w, "Failed to insert player action choice", http.StatusInternalServerError)
-					return
+				// 0 - как и без поля, действует таймаут сервера
+				if timeout := int(t); timeout > 0 {
+					s.VoteTimeoutSeconds = &timeout
 				}
 			}
+			s.AudiencePoll, _ = body["audience_poll"].(bool)
 
-		case "character_action":
-			body := step.Body.(map[string]interface{})
-			charID, exists := characterIDs[body["character_name"].(string)]
-			if !exists {
-				http.Error(w, "Character not found", http.StatusBadRequest)
-				return
+			choices, ok := body["choices"].([]interface{})
+			if !ok {
+				return storage.NewQuest{}, errors.New("Choices must be an array")
 			}
+			// На шаге без вариантов голосовать не за что, и игра на нем остановится
+			if len(choices) == 0 {
+				return storage.NewQuest{}, errors.New("Player action must have at least one choice")
+			}
+			for _, choice := range choices {
+				c, ok := choice.(map[string]interface{})
+				if !ok {
+					return storage.NewQuest{}, errors.New("Choice must be an object")
+				}
+				playerIndex := intField(c, "player_index") // По умолчанию 0 - для всех игроков
+				if playerIndex < 0 || playerIndex > maxPlayers {
+					return storage.NewQuest{}, errors.New("Invalid player_index")
+				}
+				if role := stringField(c, "role"); role != "" {
+					idx, exists := roleIndexes[role]
+					if !exists {
+						return storage.NewQuest{}, errors.New("Role not found")
+					}
+					playerIndex = idx
+				}
+				isDefault, _ := c["is_default"].(bool)
+				s.Choices = append(s.Choices, storage.Choice{
+					Text: stringField(c, "text"),
+					Points: storage.Points{
+						Violence: intField(c, "violence_point"),
+						Whatever: intField(c, "whatever_point"),
+						Pacifism: intField(c, "pacifism_point"),
+					},
+					PlayerIndex: playerIndex,
+					IsDefault:   isDefault,
+					NextStep:    intField(c, "next_step_number"),
+				})
+			}
+			quest.Steps = append(quest.Steps, s)
 
-			var characterActionID int
-			err := tx.QueryRow("INSERT INTO character_action (character, step) VALUES ($1, $2) RETURNING id", charID, stepID).Scan(&characterActionID)
-			if err != nil {
-				http.Error(w, "Failed to insert character action", http.StatusInternalServerError)
-				return
+		case storage.StepCharacterAction:
+			characterName := stringField(body, "character_name")
+			if !characters[characterName] {
+				return storage.NewQuest{}, errors.New("Character not found")
 			}
+			s := storage.Step{Type: storage.StepCharacterAction, Character: characterName}
 
 			choicesInterface, exists := body["choices"]
 			if !exists || choicesInterface == nil {
-				http.Error(w, "Missing or invalid choices in character_action", http.StatusBadRequest)
-				return
+				return storage.NewQuest{}, errors.New("Missing or invalid choices in character_action")
 			}
 
 			choices, ok := choicesInterface.([]interface{})
 			if !ok {
-				http.Error(w, "Choices must be an array", http.StatusBadRequest)
-				return
+				return storage.NewQuest{}, errors.New("Choices must be an array")
 			}
 
 			for _, choice := range choices {
-				c := choice.(map[string]interface{})
-
-				// Находим ID следующего шага по его номеру
-				var nextStepID sql.NullInt64
-				if nextStepNum, ok := c["next_step_number"]; ok && nextStepNum != nil {
-					stepNum := int(nextStepNum.(float64))
-					// Проверяем, что номер шага валиден (от 1 до количества шагов)
-					if stepNum > 0 && stepNum <= len(req.Steps) {
-						// Используем правильный ID шага из массива (stepNum-1 так как массив с нуля)
-						nextStepID.Valid = true
-						nextStepID.Int64 = int64(stepIDs[stepNum-1])
-					}
+				c, ok := choice.(map[string]interface{})
+				if !ok {
+					return storage.NewQuest{}, errors.New("Choice must be an object")
 				}
 
-				priority := 0
-				if p, ok := c["priority"]; ok {
-					priority = int(p.(float64))
-				}
-
-				_, err = tx.Exec(
-					"INSERT INTO character_action_choice (character_action, text, violence_point_condition, whatever_point_condition, pacifism_point_condition, priority, next_step) VALUES ($1, $2, $3, $4, $5, $6, $7)",
-					characterActionID, c["text"].(string),
-					int(c["violence_point_condition"].(float64)),
-					int(c["whatever_point_condition"].(float64)),
-					int(c["pacifism_point_condition"].(float64)),
-					priority,
-					nextStepID,
-				)
-				if err != nil {
-					http.Error(w, "Failed to insert character action choice", http.StatusInternalServerError)
-					return
-				}
+				// Номер шага для перехода; неверный номер означает переход по порядку
+				s.Lines = append(s.Lines, storage.CharacterLine{
+					Text: stringField(c, "text"),
+					Condition: storage.Points{
+						Violence: intField(c, "violence_point_condition"),
+						Whatever: intField(c, "whatever_point_condition"),
+						Pacifism: intField(c, "pacifism_point_condition"),
+					},
+					Priority: intField(c, "priority"),
+					NextStep: intField(c, "next_step_number"),
+				})
 			}
+			quest.Steps = append(quest.Steps, s)
+
+		default:
+			return storage.NewQuest{}, errors.New("Unknown step type")
 		}
 	}
 
-	// Устанавливаем начальный шаг квеста
-	_, err = tx.Exec("UPDATE quest SET initial_step = $1 WHERE id = $2", stepIDs[0], questID)
-	if err != nil {
-		http.Error(w, "Failed to update quest initial_step", http.StatusInternalServerError)
-		return
-	}
+	return quest, nil
+}
 
-	tx.Commit()
-	w.WriteHeader(http.StatusCreated)
+// Поля тела шага; отсутствующее или неверного типа поле считается пустым
+func stringField(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func intField(m map[string]interface{}, key string) int {
+	n, _ := m[key].(float64)
+	return int(n)
 }
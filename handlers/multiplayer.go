@@ -1,118 +1,201 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"time"
+
+	"quest_maker/engine"
+	"quest_maker/storage"
 )
 
-// Создание публичного сервера
+// Создание публичного или приватного сервера
 type CreateServerHandler struct {
-	DB *sql.DB
+	Store storage.Store
 }
 
 type CreateServerRequest struct {
-	QuestID    int    `json:"quest_id"`
-	ServerName string `json:"server_name"`
-	PlayerName string `json:"player_name"`
+	QuestID            int    `json:"quest_id"`
+	ServerName         string `json:"server_name"`
+	MaxPlayers         int    `json:"max_players"`          // 0 - столько, сколько допускает квест
+	VoteTimeoutSeconds int    `json:"vote_timeout_seconds"` // 0 - ждать всех игроков без ограничения
+	AFKFallback        string `json:"afk_fallback"`         // random, default или skip
+	IsPublic           *bool  `json:"is_public"`            // По умолчанию сервер публичный
+	Password           string `json:"password"`             // Необязательный пароль для входа
+	AllowSpectators    *bool  `json:"allow_spectators"`     // По умолчанию зрители разрешены
 }
 
 type CreateServerResponse struct {
-	ServerID int `json:"server_id"`
+	ServerID     int    `json:"server_id"`
+	InviteCode   string `json:"invite_code"`
+	SessionToken string `json:"session_token"`
+	PlayerName   string `json:"player_name"` // Имя учетной записи или гостя
 }
 
 func (h *CreateServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var req CreateServerRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		writeBodyError(w, err, "Invalid JSON")
 		return
 	}
+	user := currentUser(r)
 
-	// Создаем сервер
-	var serverID int
-	err := h.DB.QueryRow(
-		"INSERT INTO game_server (quest_id, server_name) VALUES ($1, $2) RETURNING id",
-		req.QuestID, req.ServerName,
-	).Scan(&serverID)
+	if req.AFKFallback == "" {
+		req.AFKFallback = storage.AFKFallbackRandom
+	}
+	if !validAFKFallback(req.AFKFallback) {
+		http.Error(w, "Invalid afk_fallback", http.StatusBadRequest)
+		return
+	}
+	if req.VoteTimeoutSeconds < 0 {
+		http.Error(w, "Invalid vote_timeout_seconds", http.StatusBadRequest)
+		return
+	}
+	// Серверы для черновика могут создавать только его авторы, чтобы проверить квест
+	access, err := h.Store.Quests().Access(req.QuestID, user.ID)
 	if err != nil {
-		http.Error(w, "Failed to create server", http.StatusInternalServerError)
+		writeQuestAccessError(w, err)
+		return
+	}
+	if !access.CanPlay() {
+		http.Error(w, "Quest not found", http.StatusNotFound)
 		return
 	}
 
-	// Добавляем создателя как первого игрока
-	_, err = h.DB.Exec(
-		"INSERT INTO server_player (server_id, player_name) VALUES ($1, $2)",
-		serverID, req.PlayerName,
-	)
+	quest, err := h.Store.Quests().Get(req.QuestID)
 	if err != nil {
-		http.Error(w, "Failed to add player to server", http.StatusInternalServerError)
+		http.Error(w, "Quest not found", http.StatusNotFound)
 		return
 	}
+	questMaxPlayers := quest.MaxPlayers
 
-	// Создаем мультиплеерное прохождение
-	var initialStepID int
-	err = h.DB.QueryRow("SELECT initial_step FROM quest WHERE id = $1", req.QuestID).Scan(&initialStepID)
+	if req.MaxPlayers == 0 {
+		req.MaxPlayers = questMaxPlayers
+	}
+	if req.MaxPlayers < 1 || req.MaxPlayers > questMaxPlayers {
+		http.Error(w, fmt.Sprintf("max_players must be between 1 and %d", questMaxPlayers), http.StatusBadRequest)
+		return
+	}
+
+	isPublic := true
+	if req.IsPublic != nil {
+		isPublic = *req.IsPublic
+	}
+
+	allowSpectators := true
+	if req.AllowSpectators != nil {
+		allowSpectators = *req.AllowSpectators
+	}
+
+	var passwordHash string
+	if req.Password != "" {
+		passwordHash, err = hashPassword(req.Password)
+		if err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	inviteCode, err := generateInviteCode(h.Store)
 	if err != nil {
-		http.Error(w, "Quest not found", http.StatusNotFound)
+		http.Error(w, "Failed to generate invite code", http.StatusInternalServerError)
 		return
 	}
 
-	_, err = h.DB.Exec(
-		"INSERT INTO multiplayer_playthrough (server_id, current_step) VALUES ($1, $2)",
-		serverID, initialStepID,
-	)
+	sessionToken, err := generateSessionToken()
 	if err != nil {
-		http.Error(w, "Failed to create multiplayer playthrough", http.StatusInternalServerError)
+		http.Error(w, "Failed to generate session token", http.StatusInternalServerError)
 		return
 	}
 
-	resp := CreateServerResponse{ServerID: serverID}
+	// Создаем сервер и мультиплеерное прохождение; создатель становится первым игроком и хостом,
+	// роль он выберет в лобби
+	var serverID int
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		var err error
+		serverID, err = tx.Servers().Create(storage.Server{
+			QuestID:            req.QuestID,
+			Name:               req.ServerName,
+			MaxPlayers:         req.MaxPlayers,
+			VoteTimeoutSeconds: req.VoteTimeoutSeconds,
+			AFKFallback:        req.AFKFallback,
+			IsPublic:           isPublic,
+			InviteCode:         inviteCode,
+			PasswordHash:       passwordHash,
+			Host:               user.Username,
+			AllowSpectators:    allowSpectators,
+		}, storage.Player{
+			Name:         user.Username,
+			UserID:       user.ID,
+			SessionToken: sessionToken,
+			LastSeenAt:   time.Now(),
+		}, quest.InitialStep)
+		return err
+	})
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to create server", http.StatusInternalServerError)
+		return
+	}
+
+	resp := CreateServerResponse{ServerID: serverID, InviteCode: inviteCode, SessionToken: sessionToken, PlayerName: user.Username}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-// Получение списка серверов
+// Получение списка публичных серверов, ожидающих игроков. С параметром spectatable=true -
+// список идущих игр, открытых для зрителей
 type ListServersHandler struct {
-	DB *sql.DB
+	Store storage.Store
 }
 
 type ServerInfo struct {
-	ServerID    int    `json:"server_id"`
-	ServerName  string `json:"server_name"`
-	QuestTitle  string `json:"quest_title"`
-	PlayerCount int    `json:"player_count"`
-	MaxPlayers  int    `json:"max_players"`
-	Status      string `json:"status"`
+	ServerID        int    `json:"server_id"`
+	ServerName      string `json:"server_name"`
+	QuestTitle      string `json:"quest_title"`
+	PlayerCount     int    `json:"player_count"`
+	MaxPlayers      int    `json:"max_players"`
+	Status          string `json:"status"`
+	HasPassword     bool   `json:"has_password"`
+	AllowSpectators bool   `json:"allow_spectators"`
 }
 
 func (h *ListServersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	rows, err := h.DB.Query(`
-		SELECT gs.id, gs.server_name, q.title, COUNT(sp.id), gs.max_players, gs.status
-		FROM game_server gs
-		JOIN quest q ON gs.quest_id = q.id
-		LEFT JOIN server_player sp ON gs.id = sp.server_id
-		WHERE gs.is_public = true AND gs.status = 'waiting'
-		GROUP BY gs.id, gs.server_name, q.title, gs.max_players, gs.status
-		ORDER BY gs.created_at DESC
-	`)
+	spectatable := false
+	if value := r.URL.Query().Get("spectatable"); value != "" {
+		var err error
+		if spectatable, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Invalid spectatable", http.StatusBadRequest)
+			return
+		}
+	}
+
+	listServers := h.Store.Servers().ListPublic
+	if spectatable {
+		listServers = h.Store.Servers().ListSpectatable
+	}
+	list, err := listServers()
 	if err != nil {
 		http.Error(w, "Failed to get servers", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
 	var servers []ServerInfo
-	for rows.Next() {
-		var server ServerInfo
-		err := rows.Scan(&server.ServerID, &server.ServerName, &server.QuestTitle,
-			&server.PlayerCount, &server.MaxPlayers, &server.Status)
-		if err != nil {
-			http.Error(w, "Failed to scan server", http.StatusInternalServerError)
-			return
-		}
-		servers = append(servers, server)
+	for _, server := range list {
+		servers = append(servers, ServerInfo{
+			ServerID:        server.ID,
+			ServerName:      server.Name,
+			QuestTitle:      server.QuestTitle,
+			PlayerCount:     server.PlayerCount,
+			MaxPlayers:      server.MaxPlayers,
+			Status:          server.Status,
+			HasPassword:     server.PasswordHash != "",
+			AllowSpectators: server.AllowSpectators,
+		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -121,72 +204,95 @@ func (h *ListServersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // Присоединение к серверу
 type JoinServerHandler struct {
-	DB *sql.DB
+	Store storage.Store
 }
 
 type JoinServerRequest struct {
 	ServerID   int    `json:"server_id"`
-	PlayerName string `json:"player_name"`
+	InviteCode string `json:"invite_code"` // Обязателен для приватных серверов
+	Password   string `json:"password"`
 }
 
 func (h *JoinServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var req JoinServerRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		writeBodyError(w, err, "Invalid JSON")
 		return
 	}
+	user := currentUser(r)
 
-	// Проверяем, что сервер существует и есть место
-	var playerCount, maxPlayers int
-	var status string
-	err := h.DB.QueryRow(`
-		SELECT COUNT(sp.id), gs.max_players, gs.status
-		FROM game_server gs
-		LEFT JOIN server_player sp ON gs.id = sp.server_id
-		WHERE gs.id = $1
-		GROUP BY gs.max_players, gs.status
-	`, req.ServerID).Scan(&playerCount, &maxPlayers, &status)
+	// Проверяем, что сервер существует, доступен и есть место
+	server, err := findServerForEntry(h.Store, req.ServerID, req.InviteCode, req.Password)
 	if err != nil {
-		http.Error(w, "Server not found", http.StatusNotFound)
+		writeServerEntryError(w, err)
 		return
 	}
+	req.ServerID = server.ID
 
-	if status != "waiting" {
-		http.Error(w, "Server is not available", http.StatusBadRequest)
-		return
-	}
-
-	if playerCount >= maxPlayers {
-		http.Error(w, "Server is full", http.StatusBadRequest)
-		return
-	}
-
-	// Добавляем игрока
-	_, err = h.DB.Exec(
-		"INSERT INTO server_player (server_id, player_name) VALUES ($1, $2)",
-		req.ServerID, req.PlayerName,
-	)
+	sessionToken, err := generateSessionToken()
 	if err != nil {
-		http.Error(w, "Failed to join server", http.StatusInternalServerError)
+		http.Error(w, "Failed to generate session token", http.StatusInternalServerError)
 		return
 	}
 
-	// Если сервер заполнен, меняем статус
-	if playerCount+1 >= maxPlayers {
-		_, err = h.DB.Exec("UPDATE game_server SET status = 'in_progress' WHERE id = $1", req.ServerID)
+	// Добавляем игрока; игра начнется, когда все займут роли и будут готовы.
+	// Вернуться на место после обрыва соединения можно через /rejoin_server
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		server, err := tx.Servers().Lock(req.ServerID)
 		if err != nil {
-			http.Error(w, "Failed to update server status", http.StatusInternalServerError)
-			return
+			return err
 		}
+		if server.Status != storage.ServerStatusWaiting {
+			return rejectRequest(http.StatusBadRequest, "Server is not available")
+		}
+
+		players, err := tx.Servers().Players(req.ServerID)
+		if err != nil {
+			return err
+		}
+		for _, player := range players {
+			if player.UserID == user.ID {
+				return rejectRequest(http.StatusConflict, "Already joined this server")
+			}
+		}
+		// Зритель сначала покидает зрительские места, см. SpectateServerHandler
+		spectators, err := tx.Servers().Spectators(req.ServerID)
+		if err != nil {
+			return err
+		}
+		for _, spectator := range spectators {
+			if spectator.UserID == user.ID {
+				return rejectRequest(http.StatusConflict, "Already spectating this server")
+			}
+		}
+		if len(players) >= server.MaxPlayers {
+			return rejectRequest(http.StatusBadRequest, "Server is full")
+		}
+
+		err = tx.Servers().AddPlayer(storage.Player{
+			ServerID:     req.ServerID,
+			Name:         user.Username,
+			UserID:       user.ID,
+			SessionToken: sessionToken,
+			LastSeenAt:   time.Now(),
+		})
+		if err == storage.ErrConflict {
+			return rejectRequest(http.StatusConflict, "Already joined this server")
+		}
+		return err
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to join server")
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "joined"})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "joined", "server_id": req.ServerID, "session_token": sessionToken, "player_name": user.Username})
 }
 
-// Получение текущего состояния мультиплеерной игры
+// Получение текущего состояния мультиплеерной игры; приватный сервер виден только его игрокам и зрителям
 type GetMultiplayerStateHandler struct {
-	DB *sql.DB
+	Store storage.Store
 }
 
 type MultiplayerState struct {
@@ -197,27 +303,46 @@ type MultiplayerState struct {
 	PlayerChoices   map[string]int              `json:"player_choices,omitempty"`
 	AllPlayersVoted bool                        `json:"all_players_voted"`
 	NextStep        *int                        `json:"next_step,omitempty"`
+	VoteDeadline    *time.Time                  `json:"vote_deadline,omitempty"`
+	VoteSecondsLeft *int                        `json:"vote_seconds_left,omitempty"`
 }
 
-// Получение диалога и вариантов ответа для всех игроков
+// Получение диалога и вариантов ответа для всех игроков. Приватный сервер видят только его игроки и зрители
 type GetMultiplayerDialogHandler struct {
-	DB *sql.DB
+	Store storage.Store
 }
 
 type PlayerChoice struct {
-	PlayerName string                      `json:"player_name"`
-	Choices    []PlayerActionChoiceProcess `json:"choices"`
-	HasChosen  bool                        `json:"has_chosen"`
-	ChosenID   int                         `json:"chosen_id,omitempty"`
+	PlayerName  string                      `json:"player_name"`
+	PlayerIndex int                         `json:"player_index"`
+	Role        string                      `json:"role"`
+	Choices     []PlayerActionChoiceProcess `json:"choices"`
+	HasChosen   bool                        `json:"has_chosen"`
+	ChosenID    int                         `json:"chosen_id,omitempty"`
+	Online      bool                        `json:"online"`
 }
 
 type MultiplayerDialogState struct {
-	ServerID      int            `json:"server_id"`
-	CurrentStepID int            `json:"current_step_id"`
-	StepText      string         `json:"step_text,omitempty"`
-	StepType      string         `json:"step_type"`
-	Players       []PlayerChoice `json:"players"`
-	NextStep      *int           `json:"next_step,omitempty"`
+	ServerID        int            `json:"server_id"`
+	Status          string         `json:"status"`
+	CurrentStepID   int            `json:"current_step_id"`
+	StepText        string         `json:"step_text,omitempty"`
+	StepType        string         `json:"step_type"`
+	Players         []PlayerChoice `json:"players"`
+	NextStep        *int           `json:"next_step,omitempty"`
+	VoteDeadline    *time.Time     `json:"vote_deadline,omitempty"`
+	VoteSecondsLeft *int           `json:"vote_seconds_left,omitempty"`
+	AudiencePoll    bool           `json:"audience_poll"`
+	VoteTally       []ChoiceTally  `json:"vote_tally,omitempty"`
+	Spectators      []Spectator    `json:"spectators"`
+}
+
+// Голоса игроков и зрителей за вариант текущего шага
+type ChoiceTally struct {
+	ChoiceID      int    `json:"choice_id"`
+	Text          string `json:"text"`
+	Votes         int    `json:"votes"`
+	AudienceVotes int    `json:"audience_votes"`
 }
 
 type PlayerActionChoiceProcess struct {
@@ -227,6 +352,7 @@ type PlayerActionChoiceProcess struct {
 	WhateverPoint int    `json:"whatever_point"`
 	PacifismPoint int    `json:"pacifism_point"`
 	PlayerIndex   int    `json:"player_index"`
+	Role          string `json:"role,omitempty"`
 }
 
 func (h *GetMultiplayerDialogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -236,191 +362,238 @@ func (h *GetMultiplayerDialogHandler) ServeHTTP(w http.ResponseWriter, r *http.R
 		http.Error(w, "Invalid server_id", http.StatusBadRequest)
 		return
 	}
+	if _, err := visibleServer(h.Store, serverID, currentUser(r)); err != nil {
+		writeVisibleServerError(w, err)
+		return
+	}
 
-	// Получаем текущее состояние прохождения
-	var currentStepID, violencePoint, whateverPoint, pacifismPoint int
-	err = h.DB.QueryRow(`
-		SELECT current_step, violence_point, whatever_point, pacifism_point
-		FROM multiplayer_playthrough
-		WHERE server_id = $1
-	`, serverID).Scan(&currentStepID, &violencePoint, &whateverPoint, &pacifismPoint)
-	if err != nil {
+	state, err := loadDialogState(h.Store, serverID)
+	if err == errPlaythroughNotFound {
 		http.Error(w, "Playthrough not found", http.StatusNotFound)
 		return
 	}
-
-	// Получаем информацию о шаге
-	var stepType string
-	var stepText sql.NullString
-	var nextStepID sql.NullInt64
-	err = h.DB.QueryRow(`
-		SELECT 
-			CASE 
-				WHEN na.id IS NOT NULL THEN 'narration'
-				WHEN pa.id IS NOT NULL THEN 'player_action'
-				WHEN ca.id IS NOT NULL THEN 'character_action'
-			END as step_type,
-			na.text,
-			s.next_step
-		FROM step s
-		LEFT JOIN narration_action na ON s.id = na.step
-		LEFT JOIN player_action pa ON s.id = pa.step
-		LEFT JOIN character_action ca ON s.id = ca.step
-		WHERE s.id = $1
-	`, currentStepID).Scan(&stepType, &stepText, &nextStepID)
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "Failed to get step info", http.StatusInternalServerError)
+		http.Error(w, "Failed to get dialog state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+var errPlaythroughNotFound = errors.New("playthrough not found")
+
+// Сервер, за которым может следить пользователь: публичный виден всем, а приватный - только
+// своим игрокам и зрителям. Для остальных, как и для несуществующего, возвращается storage.ErrNotFound
+func visibleServer(store storage.Store, serverID int, user *User) (*storage.Server, error) {
+	server, err := store.Servers().Get(serverID)
+	if err != nil || server.IsPublic {
+		return server, err
+	}
+	if user == nil {
+		return nil, storage.ErrNotFound
+	}
+
+	players, err := store.Servers().Players(serverID)
+	if err != nil {
+		return nil, err
+	}
+	for _, player := range players {
+		if player.UserID == user.ID {
+			return server, nil
+		}
+	}
+	spectators, err := store.Servers().Spectators(serverID)
+	if err != nil {
+		return nil, err
+	}
+	for _, spectator := range spectators {
+		if spectator.UserID == user.ID {
+			return server, nil
+		}
+	}
+	return nil, storage.ErrNotFound
+}
+
+// Отвечает ошибкой, если сервер не виден пользователю запроса
+func writeVisibleServerError(w http.ResponseWriter, err error) {
+	if err == storage.ErrNotFound {
+		http.Error(w, "Server not found", http.StatusNotFound)
 		return
 	}
+	fmt.Println(err)
+	http.Error(w, "Failed to get server", http.StatusInternalServerError)
+}
+
+// Текущий шаг общего прохождения сервера
+func loadServerStep(store storage.Store, serverID int) (*storage.Server, *storage.MultiplayerPlaythrough, *engine.View, error) {
+	server, err := store.Servers().Get(serverID)
+	if err == storage.ErrNotFound {
+		return nil, nil, nil, errPlaythroughNotFound
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get server: %v", err)
+	}
+
+	mp, err := store.Servers().Playthrough(serverID)
+	if err == storage.ErrNotFound {
+		return nil, nil, nil, errPlaythroughNotFound
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get playthrough: %v", err)
+	}
+
+	view, err := engine.Look(store.Quests(), multiplayerState(mp))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get step info: %v", err)
+	}
+	return server, mp, view, nil
+}
+
+// Дедлайн голосования и сколько секунд до него осталось
+func voteTimer(mp *storage.MultiplayerPlaythrough, now time.Time) (*time.Time, *int) {
+	if mp.VoteDeadline == nil {
+		return nil, nil
+	}
+	left := secondsLeft(*mp.VoteDeadline, now)
+	return mp.VoteDeadline, &left
+}
 
+func choiceProcess(choice storage.Choice) PlayerActionChoiceProcess {
+	return PlayerActionChoiceProcess{
+		ChoiceID:      choice.ID,
+		Text:          choice.Text,
+		ViolencePoint: choice.Points.Violence,
+		WhateverPoint: choice.Points.Whatever,
+		PacifismPoint: choice.Points.Pacifism,
+		PlayerIndex:   choice.PlayerIndex,
+	}
+}
+
+// Собирает диалог текущего шага и варианты ответа для каждого игрока сервера
+func loadDialogState(store storage.Store, serverID int) (*MultiplayerDialogState, error) {
+	server, mp, view, err := loadServerStep(store, serverID)
+	if err != nil {
+		return nil, err
+	}
+	step := view.Step
+
+	// Реплика персонажа может вести к своему следующему шагу
 	state := MultiplayerDialogState{
 		ServerID:      serverID,
-		CurrentStepID: currentStepID,
-		StepType:      stepType,
+		Status:        server.Status,
+		CurrentStepID: step.ID,
+		StepText:      view.Text,
+		StepType:      step.Type,
 	}
 
-	if nextStepID.Valid {
-		nextStep := int(nextStepID.Int64)
+	if view.NextStep != 0 {
+		nextStep := view.NextStep
 		state.NextStep = &nextStep
 	}
 
-	// Получаем список игроков
-	playerRows, err := h.DB.Query(`
-		SELECT player_name FROM server_player WHERE server_id = $1 ORDER BY joined_at
-	`, serverID)
+	now := time.Now()
+	state.VoteDeadline, state.VoteSecondsLeft = voteTimer(mp, now)
+
+	roles, err := store.Quests().Roles(server.QuestID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get roles: %v", err)
+	}
+	names := roleNames(roles)
+
+	// Получаем список игроков и их роли; игроки без роли идут последними
+	serverPlayers, err := store.Servers().Players(serverID)
 	if err != nil {
-		http.Error(w, "Failed to get players", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("failed to get players: %v", err)
 	}
-	defer playerRows.Close()
+	sort.SliceStable(serverPlayers, func(i, j int) bool {
+		a, b := serverPlayers[i].PlayerIndex, serverPlayers[j].PlayerIndex
+		return a != 0 && (b == 0 || a < b)
+	})
 
-	var playerNames []string
-	for playerRows.Next() {
-		var playerName string
-		err := playerRows.Scan(&playerName)
-		if err != nil {
-			http.Error(w, "Failed to scan player name", http.StatusInternalServerError)
-			return
-		}
-		playerNames = append(playerNames, playerName)
+	var players []PlayerChoice
+	for _, p := range serverPlayers {
+		players = append(players, PlayerChoice{
+			PlayerName:  p.Name,
+			PlayerIndex: p.PlayerIndex,
+			Role:        roleName(names[p.PlayerIndex], p.PlayerIndex),
+			Online:      isOnline(p.LastSeenAt, now),
+		})
 	}
 
 	// Обработка в зависимости от типа шага
-	if stepType == "narration" {
-		state.StepText = stepText.String
+	switch step.Type {
+	case storage.StepNarration:
 		// Для нарративного шага у всех игроков одинаковые условия (нет выбора)
-		for _, playerName := range playerNames {
-			state.Players = append(state.Players, PlayerChoice{
-				PlayerName: playerName,
-				Choices:    []PlayerActionChoiceProcess{},
-				HasChosen:  true,
-			})
-		}
-	} else if stepType == "player_action" {
-		// Получаем все варианты выбора для этого шага
-		choiceRows, err := h.DB.Query(`
-			SELECT pac.id, pac.text, pac.violence_point, pac.whatever_point, pac.pacifism_point, pac.player_index
-			FROM player_action_choice pac
-			JOIN player_action pa ON pac.player_action = pa.id
-			WHERE pa.step = $1
-		`, currentStepID)
-		if err != nil {
-			http.Error(w, "Failed to get choices", http.StatusInternalServerError)
-			return
-		}
-		defer choiceRows.Close()
-
-		playerChoicesMap := make(map[int][]PlayerActionChoiceProcess)
-		for choiceRows.Next() {
-			var choice PlayerActionChoiceProcess
-			err := choiceRows.Scan(&choice.ChoiceID, &choice.Text, &choice.ViolencePoint, &choice.WhateverPoint, &choice.PacifismPoint, &choice.PlayerIndex)
-			if err != nil {
-				http.Error(w, "Failed to scan choice", http.StatusInternalServerError)
-				return
-			}
-			playerChoicesMap[choice.PlayerIndex] = append(playerChoicesMap[choice.PlayerIndex], choice)
+		for _, player := range players {
+			player.Choices = []PlayerActionChoiceProcess{}
+			player.HasChosen = true
+			state.Players = append(state.Players, player)
 		}
 
-		// Получаем выборы игроков
-		playerChoiceRows, err := h.DB.Query(`
-			SELECT pc.player_name, pc.choice_id
-			FROM player_choice pc
-			JOIN multiplayer_playthrough mp ON pc.multiplayer_playthrough = mp.id
-			WHERE mp.server_id = $1 AND pc.step_id = $2
-		`, serverID, currentStepID)
+	case storage.StepPlayerAction:
+		votes, err := store.Servers().Votes(serverID, step.ID)
 		if err != nil {
-			http.Error(w, "Failed to get player choices", http.StatusInternalServerError)
-			return
+			return nil, fmt.Errorf("failed to get player choices: %v", err)
 		}
-		defer playerChoiceRows.Close()
-
 		playerChoices := make(map[string]int)
-		for playerChoiceRows.Next() {
-			var playerName string
-			var choiceID int
-			err := playerChoiceRows.Scan(&playerName, &choiceID)
-			if err != nil {
-				http.Error(w, "Failed to scan player choice", http.StatusInternalServerError)
-				return
-			}
-			playerChoices[playerName] = choiceID
+		for _, vote := range votes {
+			playerChoices[vote.PlayerName] = vote.ChoiceID
 		}
 
-		// Формируем данные для каждого игрока
-		for i, playerName := range playerNames {
-			playerChoice := PlayerChoice{
-				PlayerName: playerName,
-				Choices:    playerChoicesMap[i+1], // Player index starts from 1
-				HasChosen:  false,
+		// Формируем данные для каждого игрока: общие выборы и выборы его роли
+		for _, player := range players {
+			player.Choices = []PlayerActionChoiceProcess{}
+			for _, c := range engine.ChoicesForRole(step.Choices, player.PlayerIndex) {
+				choice := choiceProcess(c)
+				choice.Role = roleName(names[c.PlayerIndex], c.PlayerIndex)
+				player.Choices = append(player.Choices, choice)
 			}
 
-			if choiceID, exists := playerChoices[playerName]; exists {
-				playerChoice.HasChosen = true
-				playerChoice.ChosenID = choiceID
+			if choiceID, exists := playerChoices[player.PlayerName]; exists {
+				player.HasChosen = true
+				player.ChosenID = choiceID
 			}
 
-			state.Players = append(state.Players, playerChoice)
-		}
-
-	} else if stepType == "character_action" {
-		// Для character_action выбираем наиболее подходящий вариант в зависимости от очков
-		var chosenText sql.NullString
-		var chosenNextStep sql.NullInt64
-		err := h.DB.QueryRow(`
-			SELECT cac.text, cac.next_step
-			FROM character_action_choice cac
-			JOIN character_action ca ON cac.character_action = ca.id
-			WHERE ca.step = $1
-			ORDER BY 
-				cac.priority DESC,
-				ABS(cac.violence_point_condition - $2) + 
-				ABS(cac.whatever_point_condition - $3) + 
-				ABS(cac.pacifism_point_condition - $4) ASC
-			LIMIT 1
-		`, currentStepID, violencePoint, whateverPoint, pacifismPoint).Scan(&chosenText, &chosenNextStep)
-
-		if err == nil {
-			state.StepText = chosenText.String
-			// Обновляем следующий шаг, если он указан в выборе
-			if chosenNextStep.Valid {
-				nextStep := int(chosenNextStep.Int64)
-				state.NextStep = &nextStep
-			}
+			state.Players = append(state.Players, player)
 		}
 
-		// Для персонажных действий у всех игроков одинаковые условия (нет выбора)
-		for _, playerName := range playerNames {
-			state.Players = append(state.Players, PlayerChoice{
-				PlayerName: playerName,
-				Choices:    []PlayerActionChoiceProcess{},
-				HasChosen:  true,
+		state.AudiencePoll = step.AudiencePoll
+
+		audienceVotes, err := store.Servers().AudienceVotes(serverID, step.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get audience votes: %v", err)
+		}
+
+		tally := make(map[int]int)
+		for _, choiceID := range playerChoices {
+			tally[choiceID]++
+		}
+		for _, choice := range step.Choices {
+			state.VoteTally = append(state.VoteTally, ChoiceTally{
+				ChoiceID:      choice.ID,
+				Text:          choice.Text,
+				Votes:         tally[choice.ID],
+				AudienceVotes: audienceVotes[choice.ID],
 			})
 		}
+
+	case storage.StepCharacterAction:
+		// Для персонажных действий у всех игроков одинаковые условия (нет выбора)
+		for _, player := range players {
+			player.Choices = []PlayerActionChoiceProcess{}
+			player.HasChosen = true
+			state.Players = append(state.Players, player)
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(state)
+	state.Spectators, err = listSpectators(store, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
 }
 
 func (h *GetMultiplayerStateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -430,38 +603,16 @@ func (h *GetMultiplayerStateHandler) ServeHTTP(w http.ResponseWriter, r *http.Re
 		http.Error(w, "Invalid server_id", http.StatusBadRequest)
 		return
 	}
+	if _, err := visibleServer(h.Store, serverID, currentUser(r)); err != nil {
+		writeVisibleServerError(w, err)
+		return
+	}
 
-	// Получаем текущее состояние прохождения
-	var currentStepID, violencePoint, whateverPoint, pacifismPoint int
-	err = h.DB.QueryRow(`
-		SELECT current_step, violence_point, whatever_point, pacifism_point
-		FROM multiplayer_playthrough
-		WHERE server_id = $1
-	`, serverID).Scan(&currentStepID, &violencePoint, &whateverPoint, &pacifismPoint)
-	if err != nil {
+	_, mp, view, err := loadServerStep(h.Store, serverID)
+	if err == errPlaythroughNotFound {
 		http.Error(w, "Playthrough not found", http.StatusNotFound)
 		return
 	}
-
-	// Получаем информацию о шаге
-	var stepType string
-	var stepText sql.NullString
-	var nextStepID sql.NullInt64
-	err = h.DB.QueryRow(`
-		SELECT 
-			CASE 
-				WHEN na.id IS NOT NULL THEN 'narration'
-				WHEN pa.id IS NOT NULL THEN 'player_action'
-				WHEN ca.id IS NOT NULL THEN 'character_action'
-			END as step_type,
-			na.text,
-			s.next_step
-		FROM step s
-		LEFT JOIN narration_action na ON s.id = na.step
-		LEFT JOIN player_action pa ON s.id = pa.step
-		LEFT JOIN character_action ca ON s.id = ca.step
-		WHERE s.id = $1
-	`, currentStepID).Scan(&stepType, &stepText, &nextStepID)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Failed to get step info", http.StatusInternalServerError)
@@ -470,91 +621,39 @@ func (h *GetMultiplayerStateHandler) ServeHTTP(w http.ResponseWriter, r *http.Re
 
 	state := MultiplayerState{
 		ServerID:      serverID,
-		CurrentStepID: currentStepID,
+		CurrentStepID: view.Step.ID,
+		StepText:      view.Text,
 	}
 
-	if nextStepID.Valid {
-		nextStep := int(nextStepID.Int64)
+	if view.NextStep != 0 {
+		nextStep := view.NextStep
 		state.NextStep = &nextStep
 	}
 
-	// Обработка в зависимости от типа шага
-	if stepType == "narration" {
-		state.StepText = stepText.String
-	} else if stepType == "player_action" {
-		// Получаем варианты выбора
-		rows, err := h.DB.Query(`
-			SELECT pac.id, pac.text, pac.violence_point, pac.whatever_point, pac.pacifism_point
-			FROM player_action_choice pac
-			JOIN player_action pa ON pac.player_action = pa.id
-			WHERE pa.step = $1
-		`, currentStepID)
-		if err != nil {
-			http.Error(w, "Failed to get choices", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
+	state.VoteDeadline, state.VoteSecondsLeft = voteTimer(mp, time.Now())
 
-		var choices []PlayerActionChoiceProcess
-		for rows.Next() {
-			var choice PlayerActionChoiceProcess
-			err := rows.Scan(&choice.ChoiceID, &choice.Text, &choice.ViolencePoint, &choice.WhateverPoint, &choice.PacifismPoint)
-			if err != nil {
-				http.Error(w, "Failed to scan choice", http.StatusInternalServerError)
-				return
-			}
-			choices = append(choices, choice)
+	if view.NeedsChoice() {
+		for _, c := range view.Choices {
+			state.Choices = append(state.Choices, choiceProcess(c))
 		}
-		state.Choices = choices
 
-		// Получаем выборы игроков
-		choiceRows, err := h.DB.Query(`
-			SELECT pc.player_name, pc.choice_id
-			FROM player_choice pc
-			JOIN multiplayer_playthrough mp ON pc.multiplayer_playthrough = mp.id
-			WHERE mp.server_id = $1 AND pc.step_id = $2
-		`, serverID, currentStepID)
+		votes, err := h.Store.Servers().Votes(serverID, view.Step.ID)
 		if err != nil {
 			http.Error(w, "Failed to get player choices", http.StatusInternalServerError)
 			return
 		}
-		defer choiceRows.Close()
-
-		playerChoices := make(map[string]int)
-		for choiceRows.Next() {
-			var playerName string
-			var choiceID int
-			err := choiceRows.Scan(&playerName, &choiceID)
-			if err != nil {
-				http.Error(w, "Failed to scan player choice", http.StatusInternalServerError)
-				return
-			}
-			playerChoices[playerName] = choiceID
+		state.PlayerChoices = make(map[string]int)
+		for _, vote := range votes {
+			state.PlayerChoices[vote.PlayerName] = vote.ChoiceID
 		}
-		state.PlayerChoices = playerChoices
 
 		// Проверяем, проголосовали ли все игроки
-		var playerCount int
-		h.DB.QueryRow("SELECT COUNT(*) FROM server_player WHERE server_id = $1", serverID).Scan(&playerCount)
-		state.AllPlayersVoted = len(playerChoices) == playerCount
-
-	} else if stepType == "character_action" {
-		// Для character_action выбираем наиболее подходящий вариант в зависимости от очков
-		err := h.DB.QueryRow(`
-			SELECT cac.text
-			FROM character_action_choice cac
-			JOIN character_action ca ON cac.character_action = ca.id
-			WHERE ca.step = $1
-			ORDER BY 
-				cac.priority DESC,
-				ABS(cac.violence_point_condition - $2) + 
-				ABS(cac.whatever_point_condition - $3) + 
-				ABS(cac.pacifism_point_condition - $4) ASC
-			LIMIT 1
-		`, currentStepID, violencePoint, whateverPoint, pacifismPoint).Scan(&stepText)
-		if err == nil {
-			state.StepText = stepText.String
+		players, err := h.Store.Servers().Players(serverID)
+		if err != nil {
+			http.Error(w, "Failed to get players", http.StatusInternalServerError)
+			return
 		}
+		state.AllPlayersVoted = engine.AllVoted(view.Step, players, votes)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -563,119 +662,86 @@ func (h *GetMultiplayerStateHandler) ServeHTTP(w http.ResponseWriter, r *http.Re
 
 // Совершение выбора в мультиплеере
 type MakeMultiplayerChoiceHandler struct {
-	DB *sql.DB
+	Store storage.Store
 }
 
 type MultiplayerChoiceRequest struct {
-	ServerID   int    `json:"server_id"`
-	PlayerName string `json:"player_name"`
-	ChoiceID   int    `json:"choice_id"`
+	ServerID int `json:"server_id"`
+	ChoiceID int `json:"choice_id"`
 }
 
 func (h *MakeMultiplayerChoiceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var req MultiplayerChoiceRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		writeBodyError(w, err, "Invalid JSON")
 		return
 	}
+	user := currentUser(r)
 
-	// Получаем ID прохождения и текущий шаг
-	var playthroughID, currentStepID int
-	err := h.DB.QueryRow(`
-		SELECT id, current_step
-		FROM multiplayer_playthrough
-		WHERE server_id = $1
-	`, req.ServerID).Scan(&playthroughID, &currentStepID)
-	if err != nil {
-		http.Error(w, "Playthrough not found", http.StatusNotFound)
-		return
-	}
-
-	// Сохраняем выбор игрока
-	_, err = h.DB.Exec(`
-		INSERT INTO player_choice (multiplayer_playthrough, player_name, choice_id, step_id)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (multiplayer_playthrough, player_name, step_id) 
-		DO UPDATE SET choice_id = EXCLUDED.choice_id
-	`, playthroughID, req.PlayerName, req.ChoiceID, currentStepID)
-	if err != nil {
-		http.Error(w, "Failed to save choice", http.StatusInternalServerError)
-		return
-	}
-
-	// Проверяем, проголосовали ли все игроки
-	var playerCount, choiceCount int
-	h.DB.QueryRow("SELECT COUNT(*) FROM server_player WHERE server_id = $1", req.ServerID).Scan(&playerCount)
-	h.DB.QueryRow(`
-		SELECT COUNT(*) FROM player_choice pc
-		JOIN multiplayer_playthrough mp ON pc.multiplayer_playthrough = mp.id
-		WHERE mp.server_id = $1 AND pc.step_id = $2
-	`, req.ServerID, currentStepID).Scan(&choiceCount)
-
-	// Если все проголосовали, обрабатываем результат
-	if choiceCount == playerCount {
-		// Получаем следующий шаг и суммируем очки от всех выборов
-		var totalViolence, totalWhatever, totalPacifism int
-		var _ sql.NullInt64
-		rows, err := h.DB.Query(`
-			SELECT pac.violence_point, pac.whatever_point, pac.pacifism_point, s.next_step
-			FROM player_choice pc
-			JOIN multiplayer_playthrough mp ON pc.multiplayer_playthrough = mp.id
-			JOIN player_action_choice pac ON pc.choice_id = pac.id
-			JOIN player_action pa ON pac.player_action = pa.id
-			JOIN step s ON pa.step = s.id
-			WHERE mp.server_id = $1 AND pc.step_id = $2
-		`, req.ServerID, currentStepID)
+	err := h.Store.Atomic(func(tx storage.Store) error {
+		// Блокируем сервер от одновременного подсчета голосов
+		server, err := tx.Servers().Lock(req.ServerID)
+		if err == storage.ErrNotFound {
+			return rejectRequest(http.StatusNotFound, "Playthrough not found")
+		}
 		if err != nil {
-			http.Error(w, "Failed to get choice points", http.StatusInternalServerError)
-			return
+			return err
+		}
+		if server.Status != storage.ServerStatusInProgress {
+			return rejectRequest(http.StatusBadRequest, "Game is not in progress")
 		}
-		defer rows.Close()
 
-		var calculatedNextStepID int64 = 0
+		mp, err := tx.Servers().Playthrough(req.ServerID)
+		if err == storage.ErrNotFound {
+			return rejectRequest(http.StatusNotFound, "Playthrough not found")
+		}
+		if err != nil {
+			return err
+		}
 
-		for rows.Next() {
-			var violence, whatever, pacifism int
-			var nextStep sql.NullInt64
-			err := rows.Scan(&violence, &whatever, &pacifism, &nextStep)
-			if err != nil {
-				http.Error(w, "Failed to scan points", http.StatusInternalServerError)
-				return
-			}
-			totalViolence += violence
-			totalWhatever += whatever
-			totalPacifism += pacifism
-			if nextStep.Valid {
-				calculatedNextStepID = nextStep.Int64 // Все выборы должны вести к одному следующему шагу
-			}
+		// Игрок должен быть на сервере, а выбор - относиться к текущему шагу и его роли
+		players, err := tx.Servers().Players(req.ServerID)
+		if err != nil {
+			return err
+		}
+		player := findUserPlayer(players, user.ID)
+		if player == nil {
+			return rejectRequest(http.StatusForbidden, "Player is not on this server")
+		}
 
+		step, err := tx.Quests().Step(mp.StepID)
+		if err != nil {
+			return err
+		}
+		_, err = engine.CheckVote(step, req.ChoiceID, player.PlayerIndex)
+		if err == engine.ErrChoiceUnavailable {
+			return rejectRequest(http.StatusBadRequest, "Choice is not available at this step")
+		}
+		if err == engine.ErrWrongRole {
+			return rejectRequest(http.StatusForbidden, "Choice belongs to another role")
 		}
 
-		// Проверяем, есть ли следующий шаг (квест завершен?)
-		if calculatedNextStepID == 0 {
-			// Квест завершен, обновляем статус сервера
-			_, err = h.DB.Exec(`
-				UPDATE game_server SET status = 'finished' WHERE id = $1
-			`, req.ServerID)
-			if err != nil {
-				http.Error(w, "Failed to finish game", http.StatusInternalServerError)
-				return
-			}
+		// Сохраняем выбор игрока
+		vote := storage.Vote{PlayerName: player.Name, ChoiceID: req.ChoiceID}
+		if err := tx.Servers().SaveVote(req.ServerID, mp.StepID, vote, true); err != nil {
+			return fmt.Errorf("failed to save choice: %v", err)
 		}
 
-		// Обновляем прохождение
-		_, err = h.DB.Exec(`
-			UPDATE multiplayer_playthrough
-			SET current_step = $1,
-				violence_point = violence_point + $2,
-				whatever_point = whatever_point + $3,
-				pacifism_point = pacifism_point + $4
-			WHERE server_id = $5
-		`, calculatedNextStepID, totalViolence, totalWhatever, totalPacifism, req.ServerID)
+		// Если все проголосовали, обрабатываем результат
+		votes, err := tx.Servers().Votes(req.ServerID, mp.StepID)
 		if err != nil {
-			http.Error(w, "Failed to update playthrough", http.StatusInternalServerError)
-			return
+			return err
 		}
+		if engine.AllVoted(step, players, votes) {
+			if err := resolveStep(tx, server, mp); err != nil {
+				return fmt.Errorf("failed to resolve step: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to save choice")
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -684,7 +750,7 @@ func (h *MakeMultiplayerChoiceHandler) ServeHTTP(w http.ResponseWriter, r *http.
 
 // Переход к следующему шагу без выбора (для narration и character_action)
 type ProceedToNextStepHandler struct {
-	DB *sql.DB
+	Store storage.Store
 }
 
 type ProceedRequest struct {
@@ -694,95 +760,68 @@ type ProceedRequest struct {
 func (h *ProceedToNextStepHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var req ProceedRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		writeBodyError(w, err, "Invalid JSON")
 		return
 	}
 
-	// Получаем текущее состояние и очки
-	var currentStepID, violencePoint, whateverPoint, pacifismPoint int
-	var nextStepID sql.NullInt64
-	err := h.DB.QueryRow(`
-		SELECT mp.current_step, mp.violence_point, mp.whatever_point, mp.pacifism_point, s.next_step
-		FROM multiplayer_playthrough mp
-		JOIN step s ON mp.current_step = s.id
-		WHERE mp.server_id = $1
-	`, req.ServerID).Scan(&currentStepID, &violencePoint, &whateverPoint, &pacifismPoint, &nextStepID)
-	if err != nil {
-		http.Error(w, "Playthrough not found", http.StatusNotFound)
-		return
-	}
-
-	// Проверяем тип шага - можно переходить только для narration и character_action
-	var stepType string
-	err = h.DB.QueryRow(`
-		SELECT 
-			CASE 
-				WHEN na.id IS NOT NULL THEN 'narration'
-				WHEN pa.id IS NOT NULL THEN 'player_action'
-				WHEN ca.id IS NOT NULL THEN 'character_action'
-			END as step_type
-		FROM step s
-		LEFT JOIN narration_action na ON s.id = na.step
-		LEFT JOIN player_action pa ON s.id = pa.step
-		LEFT JOIN character_action ca ON s.id = ca.step
-		WHERE s.id = $1
-	`, currentStepID).Scan(&stepType)
-	if err != nil {
-		http.Error(w, "Failed to get step type", http.StatusInternalServerError)
-		return
-	}
+	finished := false
+	err := h.Store.Atomic(func(tx storage.Store) error {
+		server, err := tx.Servers().Lock(req.ServerID)
+		if err == storage.ErrNotFound {
+			return rejectRequest(http.StatusNotFound, "Playthrough not found")
+		}
+		if err != nil {
+			return err
+		}
+		mp, err := tx.Servers().Playthrough(req.ServerID)
+		if err == storage.ErrNotFound {
+			return rejectRequest(http.StatusNotFound, "Playthrough not found")
+		}
+		if err != nil {
+			return err
+		}
+		if server.Status != storage.ServerStatusInProgress {
+			return rejectRequest(http.StatusBadRequest, "Game is not in progress")
+		}
 
-	if stepType == "player_action" {
-		http.Error(w, "Cannot proceed without player choice", http.StatusBadRequest)
-		return
-	}
+		// Переходить дальше могут только игроки этого сервера
+		players, err := tx.Servers().Players(req.ServerID)
+		if err != nil {
+			return err
+		}
+		if findUserPlayer(players, currentUser(r).ID) == nil {
+			return rejectRequest(http.StatusForbidden, "Player is not on this server")
+		}
 
-	// Для character_action проверяем, есть ли специфичный следующий шаг
-	if stepType == "character_action" {
-		var characterNextStep sql.NullInt64
-		err = h.DB.QueryRow(`
-			SELECT cac.next_step
-			FROM character_action_choice cac
-			JOIN character_action ca ON cac.character_action = ca.id
-			WHERE ca.step = $1
-			ORDER BY 
-				cac.priority DESC,
-				ABS(cac.violence_point_condition - $2) + 
-				ABS(cac.whatever_point_condition - $3) + 
-				ABS(cac.pacifism_point_condition - $4) ASC
-			LIMIT 1
-		`, currentStepID, violencePoint, whateverPoint, pacifismPoint).Scan(&characterNextStep)
-
-		if err == nil && characterNextStep.Valid {
-			nextStepID = characterNextStep
-		}
-	}
-
-	if !nextStepID.Valid {
-		// Квест завершен
-		_, err = h.DB.Exec(`
-			UPDATE game_server SET status = 'finished' WHERE id = $1
-		`, req.ServerID)
+		// Можно переходить только для narration и character_action;
+		// реплика персонажа может вести к своему следующему шагу
+		next, err := engine.Proceed(tx.Quests(), multiplayerState(mp))
+		if err == engine.ErrChoiceRequired {
+			return rejectRequest(http.StatusBadRequest, "Cannot proceed without player choice")
+		}
 		if err != nil {
-			http.Error(w, "Failed to finish game", http.StatusInternalServerError)
-			return
+			return fmt.Errorf("failed to get next step: %v", err)
+		}
+		if next.Finished {
+			// Квест завершен
+			if err := transitionServerStatus(tx, req.ServerID, storage.ServerStatusFinished); err != nil {
+				return fmt.Errorf("failed to finish game: %v", err)
+			}
+			finished = true
+			return nil
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "quest_finished"})
-		return
-	}
 
-	// Переходим к следующему шагу
-	_, err = h.DB.Exec(`
-		UPDATE multiplayer_playthrough
-		SET current_step = $1
-		WHERE server_id = $2
-	`, nextStepID.Int64, req.ServerID)
+		return moveToStep(tx, server, mp, next.StepID)
+	})
 	if err != nil {
-		http.Error(w, "Failed to proceed to next step", http.StatusInternalServerError)
+		writeAtomicError(w, err, "Failed to proceed to next step")
 		return
 	}
 
+	status := "proceeded"
+	if finished {
+		status = "quest_finished"
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "proceeded"})
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
 }
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"quest_maker/storage"
+	"quest_maker/storage/memory"
+)
+
+// Игрок находится по ID пользователя, а голос записывается под именем его места на сервере,
+// даже если имя в сессии с ним не совпадает
+func TestMakeMultiplayerChoiceByUserID(t *testing.T) {
+	store := memory.New()
+	questID, err := store.Quests().Create(storage.NewQuest{
+		Title:      "Дверь",
+		MaxPlayers: 2,
+		Steps: []storage.Step{
+			{Type: storage.StepPlayerAction, Choices: []storage.Choice{{Text: "Открыть"}}},
+			{Type: storage.StepNarration, Text: "Дверь открыта."},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create quest: %v", err)
+	}
+	quest, err := store.Quests().Get(questID)
+	if err != nil {
+		t.Fatalf("Failed to get quest: %v", err)
+	}
+	step, err := store.Quests().Step(quest.InitialStep)
+	if err != nil {
+		t.Fatalf("Failed to get step: %v", err)
+	}
+
+	server := storage.Server{QuestID: questID, Name: "Игра", MaxPlayers: 2, InviteCode: "code"}
+	serverID, err := store.Servers().Create(server, storage.Player{Name: "Alice", UserID: 1, SessionToken: "alice"}, quest.InitialStep)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := store.Servers().AddPlayer(storage.Player{ServerID: serverID, Name: "Bob", UserID: 2, SessionToken: "bob"}); err != nil {
+		t.Fatalf("Failed to add player: %v", err)
+	}
+	if err := store.Servers().SetStatus(serverID, storage.ServerStatusInProgress); err != nil {
+		t.Fatalf("Failed to start game: %v", err)
+	}
+
+	choose := func(user *User) int {
+		body := `{"server_id": ` + strconv.Itoa(serverID) + `, "choice_id": ` + strconv.Itoa(step.Choices[0].ID) + `}`
+		req := httptest.NewRequest("POST", "/make_multiplayer_choice", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), userContextKey{}, user))
+		rec := httptest.NewRecorder()
+		(&MakeMultiplayerChoiceHandler{Store: store}).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Имя пользователя, совпадающее с чужим местом, не дает голосовать за другого игрока
+	if code := choose(&User{ID: 3, Username: "Alice"}); code != http.StatusForbidden {
+		t.Errorf("Expected %d for a user without a seat, got %d", http.StatusForbidden, code)
+	}
+
+	if code := choose(&User{ID: 1, Username: "Alice Cooper"}); code != http.StatusOK {
+		t.Fatalf("Expected the vote to be saved, got %d", code)
+	}
+	votes, err := store.Servers().Votes(serverID, quest.InitialStep)
+	if err != nil {
+		t.Fatalf("Failed to get votes: %v", err)
+	}
+	if len(votes) != 1 || votes[0].PlayerName != "Alice" {
+		t.Errorf("Expected the vote of the seat Alice, got %+v", votes)
+	}
+}
@@ -1,123 +1,106 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
+	"strconv"
+
+	"quest_maker/engine"
+	"quest_maker/storage"
 )
 
 type GetCurrentStepHandler struct {
-	DB *sql.DB
+	Store storage.Store
 }
 
 type MakeChoiceHandler struct {
-	DB *sql.DB
+	Store storage.Store
 }
 
 type StepResponse struct {
-	StepID   int                         `json:"step_id"`
-	Text     string                      `json:"text"`
-	Choices  []PlayerActionChoiceProcess `json:"choices,omitempty"`
-	NextStep int                         `json:"next_step,omitempty"`
+	StepID    int                         `json:"step_id"`
+	StepType  string                      `json:"step_type,omitempty"`
+	Character string                      `json:"character,omitempty"` // Персонаж, который говорит реплику
+	Text      string                      `json:"text"`
+	Choices   []PlayerActionChoiceProcess `json:"choices,omitempty"`
+	NextStep  int                         `json:"next_step,omitempty"`
+	// Квест закончился: на этом шаге для /get_step или после выбора для /make_choice
+	Finished bool `json:"finished"`
+	// Очки прохождения после шага или выбора
+	ViolencePoint int `json:"violence_point"`
+	WhateverPoint int `json:"whatever_point"`
+	PacifismPoint int `json:"pacifism_point"`
+}
+
+func (r *StepResponse) setPoints(p storage.Points) {
+	r.ViolencePoint = p.Violence
+	r.WhateverPoint = p.Whatever
+	r.PacifismPoint = p.Pacifism
 }
 
 func (h *GetCurrentStepHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	playthroughID := r.URL.Query().Get("playthrough_id")
-	if playthroughID == "" {
+	playthroughIDStr := r.URL.Query().Get("playthrough_id")
+	if playthroughIDStr == "" {
 		http.Error(w, "Missing playthrough_id", http.StatusBadRequest)
 		return
 	}
+	playthroughID, err := strconv.Atoi(playthroughIDStr)
+	if err != nil {
+		http.Error(w, "Invalid playthrough_id", http.StatusBadRequest)
+		return
+	}
+	user := currentUser(r)
 
-	var currentStepID, nextStepID, violencePoint, whateverPoint, pacifismPoint int
-	var stepText sql.NullString
-	var stepType string // narration, player_action, character_action
-
-	err := h.DB.QueryRow(`
-		SELECT s.id, s.next_step, p.violence_point, p.whatever_point, p.pacifism_point,
-		       COALESCE(na.text, NULL) AS narration_text,
-		       CASE 
-		           WHEN pa.step IS NOT NULL THEN 'player_action'
-		           WHEN ca.step IS NOT NULL THEN 'character_action'
-		           ELSE 'narration'
-		       END AS step_type
-		FROM playthrough p
-		JOIN step s ON p.step = s.id
-		LEFT JOIN narration_action na ON s.id = na.step
-		LEFT JOIN player_action pa ON s.id = pa.step
-		LEFT JOIN character_action ca ON s.id = ca.step
-		WHERE p.id = $1`, playthroughID).Scan(&currentStepID, &nextStepID, &violencePoint, &whateverPoint, &pacifismPoint, &stepText, &stepType)
-
+	playthrough, err := h.Store.Playthroughs().Get(playthroughID, user.ID)
+	if err == storage.ErrNotFound {
+		http.Error(w, "Playthrough not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to get current step", http.StatusInternalServerError)
 		return
 	}
 
-	var choices []PlayerActionChoiceProcess
-
-	if stepType == "player_action" {
-		// Для player_action выбор идёт из player_action_choice
-		rows, err := h.DB.Query(`
-			SELECT pac.id, pac.text, pac.violence_point, pac.whatever_point, pac.pacifism_point
-			FROM player_action_choice pac
-			JOIN player_action pa ON pac.player_action = pa.id
-			WHERE pa.step = $1`, currentStepID)
-		if err != nil {
-			http.Error(w, "Failed to get player action choices", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var choice PlayerActionChoiceProcess
-			if err := rows.Scan(&choice.ChoiceID, &choice.Text, &choice.ViolencePoint, &choice.WhateverPoint, &choice.PacifismPoint); err != nil {
-				http.Error(w, "Failed to scan player action choice", http.StatusInternalServerError)
-				return
-			}
-			choices = append(choices, choice)
-		}
-		// Текст не выводим
-		stepText.Valid = false
-	}
-
-	if stepType == "character_action" {
-		// Для character_action текст выбираем в зависимости от текущих показателей
-		err := h.DB.QueryRow(`
-			SELECT cac.text
-			FROM character_action_choice cac
-			JOIN character_action ca ON cac.character_action = ca.id
-			WHERE ca.step = $1
-			ORDER BY 
-				ABS(cac.violence_point_condition - $2) + 
-				ABS(cac.whatever_point_condition - $3) + 
-				ABS(cac.pacifism_point_condition - $4)
-			LIMIT 1`, currentStepID, violencePoint, whateverPoint, pacifismPoint).Scan(&stepText)
+	state := playthroughState(playthrough)
+	view, err := engine.Look(h.Store.Quests(), state)
+	if err != nil {
+		http.Error(w, "Failed to get current step", http.StatusInternalServerError)
+		return
+	}
 
-		if err != nil {
-			http.Error(w, "Failed to get character action text", http.StatusInternalServerError)
-			return
-		}
+	// Для player_action текст не выводим, только варианты выбора;
+	// для character_action текст реплики выбран по текущим показателям
+	response := StepResponse{
+		StepID:    view.Step.ID,
+		StepType:  view.Step.Type,
+		Character: view.Step.Character,
+		Text:      view.Text,
+		NextStep:  view.NextStep,
+		Finished:  state.Finished,
+	}
+	response.setPoints(state.Points)
+	for _, c := range view.Choices {
+		choice := choiceProcess(c)
+		choice.PlayerIndex = 0
+		response.Choices = append(response.Choices, choice)
+	}
+	if view.Step.Type == storage.StepCharacterAction && view.Line == nil {
+		http.Error(w, "Failed to get character action text", http.StatusInternalServerError)
+		return
 	}
 
-	// Если выбора нет и есть следующий шаг, обновляем `playthrough`
-	if len(choices) == 0 && nextStepID != 0 {
-		_, err := h.DB.Exec(`UPDATE playthrough SET step = $1 WHERE id = $2`, nextStepID, playthroughID)
+	// Если выбора нет и есть следующий шаг, переводим прохождение на него
+	if !view.NeedsChoice() && !state.Finished {
+		next, err := engine.Proceed(h.Store.Quests(), state)
+		if err == nil {
+			err = savePlaythrough(h.Store, playthroughID, user.ID, state, next)
+		}
 		if err != nil {
 			http.Error(w, "Failed to update step", http.StatusInternalServerError)
 			return
 		}
-	}
-
-	// Формируем ответ
-	response := StepResponse{
-		StepID:   currentStepID,
-		Text:     "",
-		Choices:  choices,
-		NextStep: nextStepID,
-	}
-
-	if stepText.Valid {
-		response.Text = stepText.String
+		response.Finished = next.Finished
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -136,46 +119,50 @@ type ChoiceRequest struct {
 func (h *MakeChoiceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var req ChoiceRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		writeBodyError(w, err, "Invalid JSON")
 		return
 	}
 
-	// Получаем ID следующего шага и изменения очков, основываясь на выбранном действии
-	var nextStepID, violencePoint, whateverPoint, pacifismPoint int
-	err := h.DB.QueryRow(`
-		SELECT s.next_step, pac.violence_point, pac.whatever_point, pac.pacifism_point
-		FROM player_action_choice pac
-        JOIN player_action pa ON pac.player_action = pa.id
-        JOIN step s ON pa.step = s.id
-		WHERE pac.id = $1
-`, req.ChoiceID).Scan(&nextStepID, &violencePoint, &whateverPoint, &pacifismPoint)
+	user := currentUser(r)
+
+	// Чужое прохождение не найдется
+	playthrough, err := h.Store.Playthroughs().Get(req.PlaythroughID, user.ID)
+	if err == storage.ErrNotFound {
+		http.Error(w, "Playthrough not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
+		http.Error(w, "Failed to get playthrough", http.StatusInternalServerError)
+		return
+	}
+
+	// Следующий шаг и изменение очков, основываясь на выбранном действии
+	state := playthroughState(playthrough)
+	next, err := engine.Choose(h.Store.Quests(), state, req.ChoiceID)
+	switch {
+	case errors.Is(err, engine.ErrFinished):
+		http.Error(w, "Playthrough is finished", http.StatusBadRequest)
+		return
+	case errors.Is(err, engine.ErrNotChoiceStep), errors.Is(err, engine.ErrChoiceUnavailable):
+		http.Error(w, "Choice is not available at this step", http.StatusBadRequest)
+		return
+	case err != nil:
 		http.Error(w, "Failed to get next step and points", http.StatusInternalServerError)
 		return
 	}
 
-	// Обновляем очки в playthrough, в зависимости от выбора
-	_, err = h.DB.Exec(`
-		UPDATE playthrough
-		SET step = $1,
-			violence_point = violence_point + $2,
-			whatever_point = whatever_point + $3,
-			pacifism_point = pacifism_point + $4
-		WHERE id = $5`, nextStepID, violencePoint, whateverPoint, pacifismPoint, req.PlaythroughID)
+	err = savePlaythrough(h.Store, req.PlaythroughID, user.ID, state, next)
 	if err != nil {
 		http.Error(w, "Failed to update playthrough", http.StatusInternalServerError)
 		return
 	}
-	fmt.Println("popaa")
-	fmt.Println(nextStepID)
-	fmt.Println(req.PlaythroughID)
 
-	// Ответ с текстом следующего шага и его ID
-	response := StepResponse{
-		StepID:   nextStepID,
-		Text:     "",
-		NextStep: nextStepID,
+	// Ответ с ID следующего шага; 0 - квест завершен
+	response := StepResponse{StepID: next.StepID, Finished: next.Finished}
+	if !next.Finished {
+		response.NextStep = next.StepID
 	}
+	response.setPoints(next.Points)
 
 	// Отправляем успешный ответ
 	w.Header().Set("Content-Type", "application/json")
@@ -183,3 +170,18 @@ func (h *MakeChoiceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
+
+// Состояние одиночного прохождения для движка
+func playthroughState(p *storage.Playthrough) engine.State {
+	return engine.State{StepID: p.StepID, Points: p.Points, Finished: p.Finished}
+}
+
+// Сохраняет переход прохождения из state в next; на последнем шаге прохождение
+// остается на нем и помечается завершенным
+func savePlaythrough(store storage.Store, id, userID int, state, next engine.State) error {
+	points := next.Points.Sub(state.Points)
+	if next.Finished {
+		return store.Playthroughs().Finish(id, userID, points)
+	}
+	return store.Playthroughs().Advance(id, userID, next.StepID, points)
+}
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"quest_maker/storage"
+)
+
+func writeQuestAccessError(w http.ResponseWriter, err error) {
+	if err == storage.ErrNotFound {
+		http.Error(w, "Quest not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "Failed to get quest", http.StatusInternalServerError)
+}
+
+// Права автора квеста. Тем, кто не автор, управлять квестом нельзя, и для них он не существует
+func authorAccess(store storage.Store, questID, userID int) (storage.QuestAccess, error) {
+	access, err := store.Quests().Access(questID, userID)
+	if err == nil && access.Role == "" {
+		err = storage.ErrNotFound
+	}
+	return access, err
+}
+
+type QuestAuthor struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type QuestInfo struct {
+	QuestID    int           `json:"quest_id"`
+	Title      string        `json:"title"`
+	Status     string        `json:"status"`
+	MaxPlayers int           `json:"max_players"`
+	Owner      string        `json:"owner,omitempty"`
+	MyRole     string        `json:"my_role,omitempty"`
+	Authors    []QuestAuthor `json:"authors,omitempty"`
+}
+
+// Информация о квесте; черновик виден только его авторам
+type GetQuestHandler struct {
+	Store storage.Store
+}
+
+func (h *GetQuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	questID, err := strconv.Atoi(r.URL.Query().Get("quest_id"))
+	if err != nil {
+		http.Error(w, "Invalid quest_id", http.StatusBadRequest)
+		return
+	}
+
+	userID := 0
+	if user := currentUser(r); user != nil {
+		userID = user.ID
+	}
+
+	access, err := h.Store.Quests().Access(questID, userID)
+	if err != nil {
+		writeQuestAccessError(w, err)
+		return
+	}
+	if !access.CanPlay() {
+		http.Error(w, "Quest not found", http.StatusNotFound)
+		return
+	}
+
+	quest, err := h.Store.Quests().Get(questID)
+	if err != nil {
+		http.Error(w, "Failed to get quest", http.StatusInternalServerError)
+		return
+	}
+	info := QuestInfo{
+		QuestID:    questID,
+		Title:      quest.Title,
+		Status:     access.Status,
+		MaxPlayers: quest.MaxPlayers,
+		Owner:      quest.Owner,
+		MyRole:     access.Role,
+	}
+
+	// Состав соавторов показываем только самим авторам
+	if access.Role != "" {
+		authors, err := h.Store.Quests().Authors(questID)
+		if err != nil {
+			http.Error(w, "Failed to get authors", http.StatusInternalServerError)
+			return
+		}
+		for _, author := range authors {
+			info.Authors = append(info.Authors, QuestAuthor{Username: author.Username, Role: author.Role})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// Список опубликованных квестов и черновиков, доступных пользователю
+type ListQuestsHandler struct {
+	Store storage.Store
+}
+
+func (h *ListQuestsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID := 0
+	if user := currentUser(r); user != nil {
+		userID = user.ID
+	}
+
+	list, err := h.Store.Quests().List(userID)
+	if err != nil {
+		http.Error(w, "Failed to get quests", http.StatusInternalServerError)
+		return
+	}
+
+	quests := []QuestInfo{}
+	for _, quest := range list {
+		quests = append(quests, QuestInfo{
+			QuestID:    quest.ID,
+			Title:      quest.Title,
+			Status:     quest.Status,
+			MaxPlayers: quest.MaxPlayers,
+			Owner:      quest.Owner,
+			MyRole:     quest.MyRole,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quests)
+}
+
+// Изменение свойств квеста владельцем или редактором
+type UpdateQuestHandler struct {
+	Store storage.Store
+}
+
+type UpdateQuestRequest struct {
+	QuestID    int    `json:"quest_id"`
+	Title      string `json:"title"`       // Пустая строка - не менять
+	MaxPlayers int    `json:"max_players"` // 0 - не менять
+}
+
+func (h *UpdateQuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req UpdateQuestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	if req.MaxPlayers < 0 {
+		http.Error(w, "Invalid max_players", http.StatusBadRequest)
+		return
+	}
+
+	access, err := authorAccess(h.Store, req.QuestID, currentUser(r).ID)
+	if err != nil {
+		writeQuestAccessError(w, err)
+		return
+	}
+	if !access.CanEdit() {
+		http.Error(w, "Only the owner or an editor can change the quest", http.StatusForbidden)
+		return
+	}
+
+	// Объявленных ролей не может быть больше, чем мест
+	if req.MaxPlayers > 0 {
+		roles, err := h.Store.Quests().Roles(req.QuestID)
+		if err != nil {
+			http.Error(w, "Failed to get roles", http.StatusInternalServerError)
+			return
+		}
+		if len(roles) > 0 && req.MaxPlayers != len(roles) {
+			http.Error(w, "max_players must match the number of roles", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = h.Store.Quests().Update(req.QuestID, strings.TrimSpace(req.Title), req.MaxPlayers)
+	if err != nil {
+		http.Error(w, "Failed to update quest", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+}
+
+// Публикация квеста или возврат в черновики; доступно только владельцу
+type PublishQuestHandler struct {
+	Store storage.Store
+}
+
+type PublishQuestRequest struct {
+	QuestID   int  `json:"quest_id"`
+	Published bool `json:"published"`
+}
+
+func (h *PublishQuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req PublishQuestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	access, err := authorAccess(h.Store, req.QuestID, currentUser(r).ID)
+	if err != nil {
+		writeQuestAccessError(w, err)
+		return
+	}
+	if !access.IsOwner() {
+		http.Error(w, "Only the owner can publish the quest", http.StatusForbidden)
+		return
+	}
+
+	status := storage.QuestStatusDraft
+	if req.Published {
+		status = storage.QuestStatusPublished
+	}
+	if err := h.Store.Quests().SetStatus(req.QuestID, status); err != nil {
+		http.Error(w, "Failed to update quest status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// Удаление квеста владельцем. Квест помечается удаленным: на него ссылаются
+// прохождения и серверы, поэтому строки остаются, но новые игры начать нельзя
+type DeleteQuestHandler struct {
+	Store storage.Store
+}
+
+type DeleteQuestRequest struct {
+	QuestID int `json:"quest_id"`
+}
+
+func (h *DeleteQuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req DeleteQuestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	access, err := authorAccess(h.Store, req.QuestID, currentUser(r).ID)
+	if err != nil {
+		writeQuestAccessError(w, err)
+		return
+	}
+	if !access.IsOwner() {
+		http.Error(w, "Only the owner can delete the quest", http.StatusForbidden)
+		return
+	}
+
+	if err := h.Store.Quests().SetStatus(req.QuestID, storage.QuestStatusDeleted); err != nil {
+		http.Error(w, "Failed to delete quest", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// Добавление соавтора или смена его роли; доступно только владельцу
+type AddQuestAuthorHandler struct {
+	Store storage.Store
+}
+
+type QuestAuthorRequest struct {
+	QuestID  int    `json:"quest_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"` // editor или viewer
+}
+
+func (h *AddQuestAuthorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req QuestAuthorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	if req.Role != storage.AuthorRoleEditor && req.Role != storage.AuthorRoleViewer {
+		http.Error(w, "Role must be editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	user := currentUser(r)
+	access, err := authorAccess(h.Store, req.QuestID, user.ID)
+	if err != nil {
+		writeQuestAccessError(w, err)
+		return
+	}
+	if !access.IsOwner() {
+		http.Error(w, "Only the owner can manage authors", http.StatusForbidden)
+		return
+	}
+
+	author, err := h.Store.Users().GetByName(req.Username)
+	if err == storage.ErrNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	if author.ID == user.ID {
+		http.Error(w, "Owner cannot be a co-author", http.StatusBadRequest)
+		return
+	}
+	// Гостевая учетная запись временная, соавтором может быть только зарегистрированный пользователь
+	if author.IsGuest {
+		http.Error(w, "Guests cannot be co-authors", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Store.Quests().SetAuthor(req.QuestID, author.ID, req.Role); err != nil {
+		http.Error(w, "Failed to add author", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "author_added"})
+}
+
+// Удаление соавтора; соавтор может и сам отказаться от участия
+type RemoveQuestAuthorHandler struct {
+	Store storage.Store
+}
+
+func (h *RemoveQuestAuthorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req QuestAuthorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	user := currentUser(r)
+	access, err := authorAccess(h.Store, req.QuestID, user.ID)
+	if err != nil {
+		writeQuestAccessError(w, err)
+		return
+	}
+	if !access.IsOwner() && !strings.EqualFold(req.Username, user.Username) {
+		http.Error(w, "Only the owner can manage authors", http.StatusForbidden)
+		return
+	}
+
+	err = h.Store.Quests().RemoveAuthor(req.QuestID, req.Username)
+	if err == storage.ErrNotFound {
+		http.Error(w, "Author not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to remove author", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "author_removed"})
+}
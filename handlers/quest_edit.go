@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"quest_maker/questfile"
+	"quest_maker/storage"
+)
+
+// Ошибки проверки квеста из редактора; каждая указывает путь к неверному полю
+type QuestErrorsResponse struct {
+	Errors questfile.Errors `json:"errors"`
+}
+
+// Квест в переносимом формате со всеми шагами, включая недостижимые; так его открывает редактор
+type EditQuestHandler struct {
+	Store storage.Store
+}
+
+func (h *EditQuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	questID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid quest id", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := authorAccess(h.Store, questID, currentUser(r).ID); err != nil {
+		writeQuestAccessError(w, err)
+		return
+	}
+
+	file, err := questfile.Load(h.Store.Quests(), questID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to load quest", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// Сохранение квеста из редактора. Без id в пути создается новый черновик, с id - содержимое
+// квеста заменяется целиком. Квест проверяется строже, чем при импорте: пустые тексты и шаги
+// выбора без вариантов не сохраняются, а все ошибки возвращаются сразу со статусом 422.
+// Квест, у которого есть ожидающие серверы или идущие игры, не заменяется (409)
+type SaveQuestHandler struct {
+	Store storage.Store
+}
+
+func (h *SaveQuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	questID := 0
+	if id := r.PathValue("id"); id != "" {
+		var err error
+		if questID, err = strconv.Atoi(id); err != nil {
+			http.Error(w, "Invalid quest id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err, "Failed to read request body")
+		return
+	}
+	file, err := questfile.Parse(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs := file.Validate(); len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(QuestErrorsResponse{Errors: errs})
+		return
+	}
+	quest, _ := file.Quest()
+
+	user := currentUser(r)
+	status := storage.QuestStatusDraft
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		if questID == 0 {
+			quest.OwnerID = user.ID
+			var err error
+			questID, err = tx.Quests().Create(quest)
+			return err
+		}
+
+		// Права проверяются в той же транзакции, что и замена: соавтора могут убрать между запросами
+		access, err := authorAccess(tx, questID, user.ID)
+		if err == storage.ErrNotFound {
+			return rejectRequest(http.StatusNotFound, "Quest not found")
+		}
+		if err != nil {
+			return err
+		}
+		if !access.CanEdit() {
+			return rejectRequest(http.StatusForbidden, "Only the owner or an editor can change the quest")
+		}
+
+		// Лобби и идущая игра ссылаются на шаги квеста, поэтому менять его можно, только когда они закрыты
+		active, err := tx.Servers().HasActive(questID)
+		if err != nil {
+			return err
+		}
+		if active {
+			return rejectRequest(http.StatusConflict, "Quest has waiting or running servers, close them before saving")
+		}
+
+		if err := tx.Quests().Replace(questID, quest); err != nil {
+			return err
+		}
+		saved, err := tx.Quests().Get(questID)
+		if err != nil {
+			return err
+		}
+		status = saved.Status
+		return nil
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to save quest")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.PathValue("id") == "" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(MakeQuestResponse{QuestID: questID, Status: status})
+}
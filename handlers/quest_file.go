@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"quest_maker/questfile"
+	"quest_maker/storage"
+)
+
+// Выгрузка квеста в переносимом формате; доступна только авторам квеста
+type ExportQuestHandler struct {
+	Store storage.Store
+}
+
+func (h *ExportQuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	questID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid quest id", http.StatusBadRequest)
+		return
+	}
+
+	userID := 0
+	if user := currentUser(r); user != nil {
+		userID = user.ID
+	}
+
+	access, err := h.Store.Quests().Access(questID, userID)
+	if err != nil {
+		writeQuestAccessError(w, err)
+		return
+	}
+	// Опубликованный квест играть может любой, но целиком со всеми ветками его видят только авторы
+	if access.Role == "" {
+		http.Error(w, "Quest not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := questfile.Export(h.Store.Quests(), questID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to export quest", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"quest-%d.json\"", questID))
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(file)
+}
+
+// Создание квеста из файла в переносимом формате; как и /make_quest, квест сохраняется черновиком
+type ImportQuestHandler struct {
+	Store storage.Store
+}
+
+func (h *ImportQuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err, "Failed to read request body")
+		return
+	}
+
+	file, err := questfile.Parse(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	quest, err := file.Quest()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	quest.OwnerID = currentUser(r).ID
+
+	var questID int
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		var err error
+		questID, err = tx.Quests().Create(quest)
+		return err
+	})
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to save quest", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(MakeQuestResponse{QuestID: questID, Status: storage.QuestStatusDraft})
+}
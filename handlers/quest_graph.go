@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"quest_maker/questgraph"
+	"quest_maker/storage"
+)
+
+// Граф переходов квеста в формате dot, mermaid или json (по умолчанию); как и выгрузка,
+// доступен только авторам, потому что показывает все ветки
+type QuestGraphHandler struct {
+	Store storage.Store
+}
+
+func (h *QuestGraphHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	questID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid quest id", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = questgraph.FormatJSON
+	}
+	if format != questgraph.FormatJSON && format != questgraph.FormatDOT && format != questgraph.FormatMermaid {
+		http.Error(w, "Unknown format, expected dot, mermaid or json", http.StatusBadRequest)
+		return
+	}
+
+	userID := 0
+	if user := currentUser(r); user != nil {
+		userID = user.ID
+	}
+	access, err := h.Store.Quests().Access(questID, userID)
+	if err != nil {
+		writeQuestAccessError(w, err)
+		return
+	}
+	if access.Role == "" {
+		http.Error(w, "Quest not found", http.StatusNotFound)
+		return
+	}
+
+	graph, err := questgraph.Load(h.Store.Quests(), questID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to build quest graph", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", questgraph.ContentType(format))
+	graph.Write(w, format)
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Лимит запросов: в среднем Rate в секунду, подряд не больше Burst
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// Ограничитель запросов по алгоритму token bucket, отдельная корзина на каждый ключ
+type RateLimiter struct {
+	limit     RateLimit
+	now       func() time.Time
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Возвращает nil, если лимит выключен (Rate или Burst не больше нуля); nil-ограничитель пропускает все запросы
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	if limit.Rate <= 0 || limit.Burst <= 0 {
+		return nil
+	}
+	return &RateLimiter{limit: limit, now: time.Now, buckets: make(map[string]*tokenBucket)}
+}
+
+// Забирает токен из корзины ключа. Если корзина пуста, возвращает время до появления следующего токена
+func (l *RateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), updatedAt: now}
+		l.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+elapsed*l.limit.Rate)
+	b.updatedAt = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Раз в минуту удаляет корзины, которые успели наполниться: они ничем не отличаются от новых
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.updatedAt) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *RateLimiter) allow(w http.ResponseWriter, key string) bool {
+	if l == nil {
+		return true
+	}
+	ok, wait := l.take(key, l.now())
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Ограничивает частоту запросов с одного IP. Ставится снаружи аутентификации,
+// чтобы ограничивать и запросы, которые создают гостей
+func LimitByIP(l *RateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.allow(w, "ip:"+clientIP(r)) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Ограничивает частоту запросов одного пользователя; ставится внутри RequireUser или WithGuest.
+// Анонимные запросы считаются по IP
+func LimitByUser(l *RateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := "ip:" + clientIP(r)
+		if user := currentUser(r); user != nil {
+			key = fmt.Sprintf("user:%d", user.ID)
+		}
+		if !l.allow(w, key) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Ограничивает размер тела запроса; maxBytes <= 0 выключает ограничение
+func LimitBody(maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxBytes > 0 {
+			if r.ContentLength > maxBytes {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Ответ на ошибку чтения тела запроса: 413, если тело превысило лимит LimitBody
+// (без Content-Length это выясняется только при чтении), иначе 400 с сообщением message
+func writeBodyError(w http.ResponseWriter, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, message, http.StatusBadRequest)
+}
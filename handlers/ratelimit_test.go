@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Часы, которые идут только по команде теста
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(limit RateLimit) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	l := NewRateLimiter(limit)
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestNewRateLimiterDisabled(t *testing.T) {
+	for _, limit := range []RateLimit{{Rate: 0, Burst: 5}, {Rate: 1, Burst: 0}, {Rate: -1, Burst: -1}} {
+		if l := NewRateLimiter(limit); l != nil {
+			t.Errorf("Expected limit %+v to be disabled, got %+v", limit, l)
+		}
+	}
+
+	// Выключенный ограничитель пропускает все запросы
+	var l *RateLimiter
+	for i := 0; i < 100; i++ {
+		if !l.allow(httptest.NewRecorder(), "ip:1.2.3.4") {
+			t.Fatalf("Expected a nil limiter to allow request %d", i+1)
+		}
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	l, clock := newTestLimiter(RateLimit{Rate: 4, Burst: 3})
+
+	// Полная корзина выдерживает Burst запросов подряд
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.take("a", clock.Now()); !ok {
+			t.Fatalf("Expected request %d within the burst to pass", i+1)
+		}
+	}
+	ok, wait := l.take("a", clock.Now())
+	if ok || wait != 250*time.Millisecond {
+		t.Errorf("Expected the bucket to be empty with 250ms to wait, got %v and %v", ok, wait)
+	}
+
+	// У другого ключа своя корзина
+	if ok, _ := l.take("b", clock.Now()); !ok {
+		t.Errorf("Expected another key to have its own bucket")
+	}
+
+	// Токены добавляются со скоростью Rate
+	clock.Advance(125 * time.Millisecond)
+	ok, wait = l.take("a", clock.Now())
+	if ok || wait != 125*time.Millisecond {
+		t.Errorf("Expected 125ms to wait after a partial refill, got %v and %v", ok, wait)
+	}
+	clock.Advance(125 * time.Millisecond)
+	if ok, _ := l.take("a", clock.Now()); !ok {
+		t.Errorf("Expected a request to pass after the refill")
+	}
+
+	// Корзина не наполняется больше Burst
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.take("a", clock.Now()); !ok {
+			t.Fatalf("Expected request %d after a long pause to pass", i+1)
+		}
+	}
+	if ok, _ := l.take("a", clock.Now()); ok {
+		t.Errorf("Expected the bucket to hold no more than the burst")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	// Пустая корзина наполняется за 50 секунд
+	l, clock := newTestLimiter(RateLimit{Rate: 1, Burst: 50})
+	l.take("idle", clock.Now())
+	clock.Advance(30 * time.Second)
+	l.take("busy", clock.Now())
+
+	// Раньше чем через минуту после прошлой очистки корзины не удаляются
+	clock.Advance(10 * time.Second)
+	l.take("other", clock.Now())
+	if len(l.buckets) != 3 {
+		t.Fatalf("Expected 3 buckets before the sweep, got %d", len(l.buckets))
+	}
+
+	// Удаляются только корзины, которые успели наполниться
+	clock.Advance(20 * time.Second)
+	l.take("other", clock.Now())
+	if _, ok := l.buckets["idle"]; ok {
+		t.Errorf("Expected the refilled bucket to be removed")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Errorf("Expected the recently used bucket to be kept")
+	}
+	if len(l.buckets) != 2 {
+		t.Errorf("Expected 2 buckets after the sweep, got %d", len(l.buckets))
+	}
+}
+
+func TestLimitByIP(t *testing.T) {
+	l, clock := newTestLimiter(RateLimit{Rate: 0.4, Burst: 2})
+	calls := 0
+	handler := LimitByIP(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/list_servers", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := serve("10.0.0.1:1000"); rec.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to pass, got %d", i+1, rec.Code)
+		}
+	}
+
+	// Порт не важен: лимит считается по IP. До следующего токена 2.5 секунды, Retry-After округляется вверх
+	rec := serve("10.0.0.1:2000")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "3" {
+		t.Errorf("Expected Retry-After 3, got %q", retry)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the limited request not to reach the handler, got %d calls", calls)
+	}
+
+	if rec := serve("10.0.0.2:1000"); rec.Code != http.StatusOK {
+		t.Errorf("Expected another IP to pass, got %d", rec.Code)
+	}
+	clock.Advance(2500 * time.Millisecond)
+	if rec := serve("10.0.0.1:1000"); rec.Code != http.StatusOK {
+		t.Errorf("Expected a request to pass after Retry-After, got %d", rec.Code)
+	}
+}
+
+func TestLimitByUser(t *testing.T) {
+	l, _ := newTestLimiter(RateLimit{Rate: 1, Burst: 1})
+	handler := LimitByUser(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(user *User) int {
+		req := httptest.NewRequest("GET", "/make_choice", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		if user != nil {
+			req = req.WithContext(context.WithValue(req.Context(), userContextKey{}, user))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Пользователи с одного IP ограничиваются по отдельности, анонимные запросы - по IP
+	for _, user := range []*User{{ID: 1}, {ID: 2}, nil} {
+		if code := serve(user); code != http.StatusOK {
+			t.Errorf("Expected the first request of %+v to pass, got %d", user, code)
+		}
+		if code := serve(user); code != http.StatusTooManyRequests {
+			t.Errorf("Expected the second request of %+v to be limited, got %d", user, code)
+		}
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	handler := LimitBody(32, &LeaveServerHandler{})
+	tests := []struct {
+		name          string
+		body          string
+		contentLength bool
+		want          int
+	}{
+		{"declared too large", `{"server_id": 1, "padding": "` + strings.Repeat("x", 64) + `"}`, true, http.StatusRequestEntityTooLarge},
+		{"too large without Content-Length", `{"server_id": 1, "padding": "` + strings.Repeat("x", 64) + `"}`, false, http.StatusRequestEntityTooLarge},
+		{"invalid JSON within the limit", `{"server_id": `, false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/leave_server", strings.NewReader(tt.body))
+			if !tt.contentLength {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("Expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+package handlers
+
+import "fmt"
+
+// Имя роли для отображения; квесты без объявленных ролей получают нумерованные роли
+func roleName(name string, playerIndex int) string {
+	if name != "" {
+		return name
+	}
+	if playerIndex == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Игрок %d", playerIndex)
+}
@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"quest_maker/engine"
+	"quest_maker/storage"
+)
+
+var errPlayerNotOnServer = errors.New("player is not on this server")
+
+// Убирает игрока с сервера. Права хоста переходят к следующему по времени входа игроку,
+// опустевший сервер закрывается, а в идущей игре шаг разрешается, если оставшиеся уже проголосовали.
+func removePlayer(tx storage.Store, serverID int, playerName string) error {
+	server, err := tx.Servers().Lock(serverID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Servers().RemovePlayer(serverID, playerName)
+	if err == storage.ErrNotFound {
+		return errPlayerNotOnServer
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove player: %v", err)
+	}
+
+	mp, err := tx.Servers().Playthrough(serverID)
+	if err != nil {
+		return fmt.Errorf("failed to get current step: %v", err)
+	}
+
+	// Голос ушедшего игрока на текущем шаге больше не учитывается
+	if err := tx.Servers().DeleteVote(serverID, mp.StepID, playerName); err != nil {
+		return fmt.Errorf("failed to remove player choice: %v", err)
+	}
+
+	players, err := tx.Servers().Players(serverID)
+	if err != nil {
+		return fmt.Errorf("failed to count players: %v", err)
+	}
+
+	if server.Host == playerName {
+		nextHost := ""
+		if len(players) > 0 {
+			nextHost = players[0].Name
+		}
+		if err := tx.Servers().SetHost(serverID, nextHost); err != nil {
+			return fmt.Errorf("failed to transfer host: %v", err)
+		}
+	}
+
+	if len(players) == 0 {
+		if storage.CanTransitionServerStatus(server.Status, storage.ServerStatusAbandoned) {
+			return closeServer(tx, serverID)
+		}
+		return nil
+	}
+
+	if server.Status != storage.ServerStatusInProgress {
+		return nil
+	}
+
+	votes, err := tx.Servers().Votes(serverID, mp.StepID)
+	if err != nil {
+		return fmt.Errorf("failed to count choices: %v", err)
+	}
+
+	step, err := tx.Quests().Step(mp.StepID)
+	if err != nil {
+		return fmt.Errorf("failed to get current step: %v", err)
+	}
+
+	// Голоса всех оставшихся игроков, которым есть из чего выбрать, означают конец голосования
+	if engine.AllVoted(step, players, votes) {
+		return resolveStep(tx, server, mp)
+	}
+	return nil
+}
+
+func closeServer(tx storage.Store, serverID int) error {
+	if err := transitionServerStatus(tx, serverID, storage.ServerStatusAbandoned); err != nil {
+		return err
+	}
+	mp, err := tx.Servers().Playthrough(serverID)
+	if err != nil {
+		return err
+	}
+	mp.VoteDeadline = nil
+	return tx.Servers().SavePlaythrough(*mp)
+}
+
+func writeRemovePlayerError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errPlayerNotOnServer) {
+		http.Error(w, "Player is not on this server", http.StatusBadRequest)
+		return
+	}
+	writeAtomicError(w, err, "Failed to remove player")
+}
+
+// Блокирует сервер и проверяет, что запрос пришел от его хоста
+func lockServerAsHost(tx storage.Store, serverID int, user *User, forbidden string) (*storage.Server, error) {
+	server, err := tx.Servers().Lock(serverID)
+	if err == storage.ErrNotFound {
+		return nil, rejectRequest(http.StatusNotFound, "Server not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if server.Host != user.Username {
+		return nil, rejectRequest(http.StatusForbidden, forbidden)
+	}
+	return server, nil
+}
+
+// Выход игрока с сервера
+type LeaveServerHandler struct {
+	Store storage.Store
+}
+
+type LeaveServerRequest struct {
+	ServerID int `json:"server_id"`
+}
+
+func (h *LeaveServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req LeaveServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	user := currentUser(r)
+
+	err := h.Store.Atomic(func(tx storage.Store) error {
+		return removePlayer(tx, req.ServerID, user.Username)
+	})
+	if err != nil {
+		writeRemovePlayerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "left"})
+}
+
+// Хост выгоняет игрока с сервера
+type KickPlayerHandler struct {
+	Store storage.Store
+}
+
+type KickPlayerRequest struct {
+	ServerID     int    `json:"server_id"`
+	TargetPlayer string `json:"target_player"`
+}
+
+func (h *KickPlayerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req KickPlayerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	user := currentUser(r)
+
+	err := h.Store.Atomic(func(tx storage.Store) error {
+		if _, err := lockServerAsHost(tx, req.ServerID, user, "Only the host can kick players"); err != nil {
+			return err
+		}
+		if req.TargetPlayer == user.Username {
+			return rejectRequest(http.StatusBadRequest, "Host cannot kick themselves, leave the server instead")
+		}
+		return removePlayer(tx, req.ServerID, req.TargetPlayer)
+	})
+	if err != nil {
+		writeRemovePlayerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "kicked"})
+}
+
+// Передача прав хоста другому игроку
+type TransferHostHandler struct {
+	Store storage.Store
+}
+
+type TransferHostRequest struct {
+	ServerID int    `json:"server_id"`
+	NewHost  string `json:"new_host"`
+}
+
+func (h *TransferHostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req TransferHostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	user := currentUser(r)
+
+	err := h.Store.Atomic(func(tx storage.Store) error {
+		if _, err := lockServerAsHost(tx, req.ServerID, user, "Only the host can transfer host rights"); err != nil {
+			return err
+		}
+
+		players, err := tx.Servers().Players(req.ServerID)
+		if err != nil {
+			return err
+		}
+		if findPlayer(players, req.NewHost) == nil {
+			return rejectRequest(http.StatusBadRequest, "New host is not on this server")
+		}
+		return tx.Servers().SetHost(req.ServerID, req.NewHost)
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to transfer host")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "host_transferred"})
+}
+
+// Хост начинает игру, не дожидаясь заполнения сервера и готовности всех игроков
+type StartGameHandler struct {
+	Store storage.Store
+}
+
+type StartGameRequest struct {
+	ServerID int `json:"server_id"`
+}
+
+func (h *StartGameHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req StartGameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	user := currentUser(r)
+
+	err := h.Store.Atomic(func(tx storage.Store) error {
+		server, err := lockServerAsHost(tx, req.ServerID, user, "Only the host can start the game")
+		if err != nil {
+			return err
+		}
+		if server.Status != storage.ServerStatusWaiting {
+			return rejectRequest(http.StatusBadRequest, "Game has already started")
+		}
+
+		// Без роли игрок не увидит своих вариантов выбора
+		players, err := tx.Servers().Players(req.ServerID)
+		if err != nil {
+			return err
+		}
+		for _, player := range players {
+			if player.PlayerIndex == 0 {
+				return rejectRequest(http.StatusBadRequest, "All players must claim a role")
+			}
+		}
+
+		return startGame(tx, server)
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to start game")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "game_started"})
+}
+
+// Хост закрывает сервер; игра прекращается для всех игроков
+type CloseServerHandler struct {
+	Store storage.Store
+}
+
+type CloseServerRequest struct {
+	ServerID int `json:"server_id"`
+}
+
+func (h *CloseServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req CloseServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	user := currentUser(r)
+
+	err := h.Store.Atomic(func(tx storage.Store) error {
+		server, err := lockServerAsHost(tx, req.ServerID, user, "Only the host can close the server")
+		if err != nil {
+			return err
+		}
+		if !storage.CanTransitionServerStatus(server.Status, storage.ServerStatusAbandoned) {
+			return rejectRequest(http.StatusBadRequest, "Server is already closed")
+		}
+		return closeServer(tx, req.ServerID)
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to close server")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "closed"})
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+
+	"quest_maker/storage"
+)
+
+var errInvalidStatusTransition = errors.New("invalid server status transition")
+
+// Переводит сервер в новый статус, проверяя, что переход разрешен
+func transitionServerStatus(store storage.Store, serverID int, to string) error {
+	server, err := store.Servers().Get(serverID)
+	if err != nil {
+		return err
+	}
+
+	if !storage.CanTransitionServerStatus(server.Status, to) {
+		return fmt.Errorf("%w: %s -> %s", errInvalidStatusTransition, server.Status, to)
+	}
+
+	return store.Servers().SetStatus(serverID, to)
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"quest_maker/storage"
+)
+
+// Игрок считается онлайн, если присылал heartbeat за последние N секунд
+const presenceTimeoutSeconds = 30
+
+// Токен сессии выдается при входе на сервер и позволяет вернуться на свое место
+func generateSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Отметка присутствия игрока; клиент присылает ее при каждом опросе состояния
+type HeartbeatHandler struct {
+	Store storage.Store
+}
+
+type SessionRequest struct {
+	SessionToken string `json:"session_token"`
+}
+
+func (h *HeartbeatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req SessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	now := time.Now()
+	err := h.Store.Servers().TouchPlayer(req.SessionToken, now)
+	if err == storage.ErrNotFound {
+		// Токен может принадлежать зрителю
+		err = h.Store.Servers().TouchSpectator(req.SessionToken, now)
+	}
+	if err == storage.ErrNotFound {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update presence", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Возвращение на сервер по токену сессии, в том числе в уже идущую игру
+type RejoinServerHandler struct {
+	Store storage.Store
+}
+
+type RejoinServerResponse struct {
+	ServerID        int                     `json:"server_id"`
+	PlayerName      string                  `json:"player_name"`
+	Role            string                  `json:"role,omitempty"`
+	IsHost          bool                    `json:"is_host"`
+	PendingChoiceID *int                    `json:"pending_choice_id,omitempty"` // Голос на текущем шаге, если уже сделан
+	Dialog          *MultiplayerDialogState `json:"dialog"`
+}
+
+func (h *RejoinServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req SessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	player, err := h.Store.Servers().PlayerBySession(req.SessionToken)
+	if err == nil && player.UserID != currentUser(r).ID {
+		err = storage.ErrNotFound
+	}
+	if err == storage.ErrNotFound {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get session", http.StatusInternalServerError)
+		return
+	}
+
+	server, err := h.Store.Servers().Get(player.ServerID)
+	if err != nil {
+		http.Error(w, "Failed to get session", http.StatusInternalServerError)
+		return
+	}
+	if server.Status == storage.ServerStatusFinished || server.Status == storage.ServerStatusAbandoned {
+		http.Error(w, "Game is over", http.StatusGone)
+		return
+	}
+
+	resp := RejoinServerResponse{
+		ServerID:   server.ID,
+		PlayerName: player.Name,
+		IsHost:     server.Host == player.Name,
+	}
+
+	if player.PlayerIndex != 0 {
+		roles, err := h.Store.Quests().Roles(server.QuestID)
+		if err != nil {
+			http.Error(w, "Failed to get session", http.StatusInternalServerError)
+			return
+		}
+		resp.Role = roleName(roleNames(roles)[player.PlayerIndex], player.PlayerIndex)
+	}
+
+	mp, err := h.Store.Servers().Playthrough(server.ID)
+	if err != nil {
+		http.Error(w, "Failed to get session", http.StatusInternalServerError)
+		return
+	}
+	votes, err := h.Store.Servers().Votes(server.ID, mp.StepID)
+	if err != nil {
+		http.Error(w, "Failed to get session", http.StatusInternalServerError)
+		return
+	}
+	for _, vote := range votes {
+		if vote.PlayerName == player.Name {
+			choiceID := vote.ChoiceID
+			resp.PendingChoiceID = &choiceID
+		}
+	}
+
+	if err := h.Store.Servers().TouchPlayer(req.SessionToken, time.Now()); err != nil {
+		http.Error(w, "Failed to update presence", http.StatusInternalServerError)
+		return
+	}
+
+	resp.Dialog, err = loadDialogState(h.Store, resp.ServerID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to get dialog state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"quest_maker/engine"
+	"quest_maker/storage"
+)
+
+type Spectator struct {
+	Name   string `json:"name"`
+	Online bool   `json:"online"`
+}
+
+func listSpectators(store storage.Store, serverID int) ([]Spectator, error) {
+	spectators, err := store.Servers().Spectators(serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get spectators: %v", err)
+	}
+
+	now := time.Now()
+	list := []Spectator{}
+	for _, spectator := range spectators {
+		list = append(list, Spectator{Name: spectator.Name, Online: isOnline(spectator.LastSeenAt, now)})
+	}
+	return list, nil
+}
+
+// Подключение зрителя: не занимает место игрока и не участвует в основном голосовании
+type SpectateServerHandler struct {
+	Store storage.Store
+}
+
+type SpectateServerRequest struct {
+	ServerID   int    `json:"server_id"`
+	InviteCode string `json:"invite_code"` // Обязателен для приватных серверов
+	Password   string `json:"password"`
+}
+
+func (h *SpectateServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req SpectateServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+	user := currentUser(r)
+
+	server, err := findServerForEntry(h.Store, req.ServerID, req.InviteCode, req.Password)
+	if err != nil {
+		writeServerEntryError(w, err)
+		return
+	}
+
+	if !server.AllowSpectators {
+		http.Error(w, "Spectators are not allowed on this server", http.StatusForbidden)
+		return
+	}
+	if server.Status != storage.ServerStatusWaiting && server.Status != storage.ServerStatusInProgress {
+		http.Error(w, "Server is not available", http.StatusBadRequest)
+		return
+	}
+
+	sessionToken, err := generateSessionToken()
+	if err != nil {
+		http.Error(w, "Failed to generate session token", http.StatusInternalServerError)
+		return
+	}
+
+	// Игрок не может быть и зрителем: иначе его голос в опросе аудитории засчитался бы вторым голосом.
+	// Сервер блокируется, чтобы одновременный вход игроком не проскочил эту проверку
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		if _, err := tx.Servers().Lock(server.ID); err != nil {
+			return err
+		}
+		players, err := tx.Servers().Players(server.ID)
+		if err != nil {
+			return err
+		}
+		for _, player := range players {
+			if player.UserID == user.ID {
+				return rejectRequest(http.StatusConflict, "Already playing on this server")
+			}
+		}
+
+		err = tx.Servers().AddSpectator(storage.Spectator{
+			ServerID:     server.ID,
+			Name:         user.Username,
+			UserID:       user.ID,
+			SessionToken: sessionToken,
+			LastSeenAt:   time.Now(),
+		})
+		if err == storage.ErrConflict {
+			return rejectRequest(http.StatusConflict, "Already spectating this server")
+		}
+		return err
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to join as spectator")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "spectating", "server_id": server.ID, "session_token": sessionToken, "player_name": user.Username})
+}
+
+// Зритель покидает сервер
+type StopSpectatingHandler struct {
+	Store storage.Store
+}
+
+func (h *StopSpectatingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req SessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	err := h.Store.Servers().RemoveSpectator(req.SessionToken)
+	if err == storage.ErrNotFound {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to leave server", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "left"})
+}
+
+// Голос зрителя в опросе аудитории на текущем шаге
+type AudienceVoteHandler struct {
+	Store storage.Store
+}
+
+type AudienceVoteRequest struct {
+	SessionToken string `json:"session_token"`
+	ChoiceID     int    `json:"choice_id"`
+}
+
+func (h *AudienceVoteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req AudienceVoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid JSON")
+		return
+	}
+
+	spectator, err := h.Store.Servers().SpectatorBySession(req.SessionToken)
+	if err == storage.ErrNotFound {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get session", http.StatusInternalServerError)
+		return
+	}
+
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		server, err := tx.Servers().Lock(spectator.ServerID)
+		if err != nil {
+			return err
+		}
+		if server.Status != storage.ServerStatusInProgress {
+			return rejectRequest(http.StatusBadRequest, "Game is not in progress")
+		}
+
+		mp, err := tx.Servers().Playthrough(server.ID)
+		if err != nil {
+			return err
+		}
+
+		// Зрители могут голосовать за любой вариант шага, независимо от роли
+		step, err := tx.Quests().Step(mp.StepID)
+		if err != nil {
+			return err
+		}
+		if engine.FindChoice(step.Choices, req.ChoiceID) == nil {
+			return rejectRequest(http.StatusBadRequest, "Choice does not belong to the current step")
+		}
+		if !step.AudiencePoll {
+			return rejectRequest(http.StatusBadRequest, "This step has no audience poll")
+		}
+
+		return tx.Servers().SaveAudienceVote(server.ID, mp.StepID, spectator.ID, req.ChoiceID)
+	})
+	if err != nil {
+		writeAtomicError(w, err, "Failed to save vote")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "vote_saved"})
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"time"
+
+	"quest_maker/storage"
+)
+
+// Имена ролей квеста по номеру места
+func roleNames(roles []storage.Role) map[int]string {
+	names := make(map[int]string)
+	for _, role := range roles {
+		names[role.Position] = role.Name
+	}
+	return names
+}
+
+func isOnline(lastSeenAt, now time.Time) bool {
+	return now.Sub(lastSeenAt) < presenceTimeoutSeconds*time.Second
+}
+
+// Сколько целых секунд осталось до дедлайна, с округлением вверх
+func secondsLeft(deadline, now time.Time) int {
+	left := deadline.Sub(now)
+	if left <= 0 {
+		return 0
+	}
+	return int((left + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Ошибка запроса, обнаруженная внутри Atomic: откатывает транзакцию и отдается клиенту как есть
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func rejectRequest(status int, message string) error {
+	return &requestError{status: status, message: message}
+}
+
+// Отдает клиенту ошибку, которой завершилась транзакция; неожиданные ошибки - как 500 с текстом fallback
+func writeAtomicError(w http.ResponseWriter, err error, fallback string) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		http.Error(w, reqErr.message, reqErr.status)
+		return
+	}
+	fmt.Println(err)
+	http.Error(w, fallback, http.StatusInternalServerError)
+}
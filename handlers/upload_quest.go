@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"quest_maker/questscript"
+	"quest_maker/storage"
+	"quest_maker/storyimport"
+)
+
+// Создание квеста из истории Twine (twee), Ink (ink) или сценария квеста (quest).
+// Тело запроса - исходный текст истории, формат и название передаются в параметрах
+type UploadQuestHandler struct {
+	Store storage.Store
+}
+
+type UploadQuestResponse struct {
+	QuestID  int      `json:"quest_id"`
+	Status   string   `json:"status"`
+	Warnings []string `json:"warnings"` // Конструкции истории, которые не удалось перенести
+}
+
+func (h *UploadQuestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err, "Failed to read request body")
+		return
+	}
+
+	var result *storyimport.Result
+	switch format := r.URL.Query().Get("format"); format {
+	case "quest":
+		quest, err := questscript.Parse(string(data))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result = &storyimport.Result{Quest: quest}
+	case storyimport.FormatTwee, storyimport.FormatInk:
+		result, err = storyimport.Convert(format, string(data))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Unknown format, expected twee, ink or quest", http.StatusBadRequest)
+		return
+	}
+
+	quest := result.Quest
+	if quest.Title == "" {
+		quest.Title = r.URL.Query().Get("title")
+	}
+	if quest.Title == "" {
+		http.Error(w, "Story has no title, pass it in the title parameter", http.StatusBadRequest)
+		return
+	}
+	quest.OwnerID = currentUser(r).ID
+
+	var questID int
+	err = h.Store.Atomic(func(tx storage.Store) error {
+		var err error
+		questID, err = tx.Quests().Create(quest)
+		return err
+	})
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to save quest", http.StatusInternalServerError)
+		return
+	}
+
+	warnings := make([]string, 0, len(result.Warnings))
+	for _, warning := range result.Warnings {
+		warnings = append(warnings, warning.String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(UploadQuestResponse{QuestID: questID, Status: storage.QuestStatusDraft, Warnings: warnings})
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"quest_maker/engine"
+	"quest_maker/storage"
+)
+
+func validAFKFallback(fallback string) bool {
+	switch fallback {
+	case storage.AFKFallbackRandom, storage.AFKFallbackDefault, storage.AFKFallbackSkip:
+		return true
+	}
+	return false
+}
+
+// Переводит общее прохождение на шаг stepID и запускает таймер голосования на нем
+func moveToStep(tx storage.Store, server *storage.Server, mp *storage.MultiplayerPlaythrough, stepID int) error {
+	step, err := tx.Quests().Step(stepID)
+	if err != nil {
+		return fmt.Errorf("failed to get step: %v", err)
+	}
+
+	mp.StepID = stepID
+	mp.VoteDeadline = engine.VoteDeadline(server, step, time.Now())
+	if err := tx.Servers().SavePlaythrough(*mp); err != nil {
+		return fmt.Errorf("failed to update playthrough: %v", err)
+	}
+	return nil
+}
+
+// Подводит итог голосования на текущем шаге и переводит прохождение на следующий шаг (или завершает игру).
+// Вызывается внутри Atomic, в которой сервер уже заблокирован.
+func resolveStep(tx storage.Store, server *storage.Server, mp *storage.MultiplayerPlaythrough) error {
+	votes, err := tx.Servers().Votes(server.ID, mp.StepID)
+	if err != nil {
+		return fmt.Errorf("failed to get votes: %v", err)
+	}
+	audienceVotes, err := tx.Servers().AudienceVotes(server.ID, mp.StepID)
+	if err != nil {
+		return fmt.Errorf("failed to get audience poll result: %v", err)
+	}
+
+	next, err := engine.Resolve(tx.Quests(), multiplayerState(mp), votes, audienceVotes)
+	if err != nil {
+		return fmt.Errorf("failed to resolve votes: %v", err)
+	}
+	mp.Points = next.Points
+
+	if next.Finished {
+		// Квест завершен, обновляем статус сервера и начисляем очки последнего шага
+		if err := transitionServerStatus(tx, server.ID, storage.ServerStatusFinished); err != nil {
+			return fmt.Errorf("failed to finish game: %v", err)
+		}
+		server.Status = storage.ServerStatusFinished
+		mp.VoteDeadline = nil
+		if err := tx.Servers().SavePlaythrough(*mp); err != nil {
+			return fmt.Errorf("failed to update playthrough: %v", err)
+		}
+		return nil
+	}
+
+	return moveToStep(tx, server, mp, next.StepID)
+}
+
+// Состояние общего прохождения для движка
+func multiplayerState(mp *storage.MultiplayerPlaythrough) engine.State {
+	return engine.State{StepID: mp.StepID, Points: mp.Points}
+}
+
+// Голосует за игроков, которые не успели сделать выбор, согласно стратегии сервера
+func applyAFKFallback(tx storage.Store, server *storage.Server, mp *storage.MultiplayerPlaythrough) error {
+	step, err := tx.Quests().Step(mp.StepID)
+	if err != nil {
+		return fmt.Errorf("failed to get choices: %v", err)
+	}
+	players, err := tx.Servers().Players(server.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get players: %v", err)
+	}
+	votes, err := tx.Servers().Votes(server.ID, step.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get votes: %v", err)
+	}
+
+	for _, vote := range engine.FallbackVotes(step, players, votes, server.AFKFallback, rand.Intn) {
+		if err := tx.Servers().SaveVote(server.ID, step.ID, vote, false); err != nil {
+			return fmt.Errorf("failed to save fallback choice: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Фоновый планировщик, разрешающий шаги с истекшим временем голосования
+type VoteScheduler struct {
+	Store    storage.Store
+	Interval time.Duration
+}
+
+func (s *VoteScheduler) Run(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.resolveExpired(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+func (s *VoteScheduler) resolveExpired() error {
+	serverIDs, err := s.Store.Servers().ExpiredVotes(time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to get expired steps: %v", err)
+	}
+
+	for _, serverID := range serverIDs {
+		if err := s.resolveTimedOut(serverID); err != nil {
+			fmt.Println(err)
+		}
+	}
+	return nil
+}
+
+func (s *VoteScheduler) resolveTimedOut(serverID int) error {
+	return s.Store.Atomic(func(tx storage.Store) error {
+		server, err := tx.Servers().Lock(serverID)
+		if err != nil {
+			return fmt.Errorf("failed to lock server: %v", err)
+		}
+		mp, err := tx.Servers().Playthrough(serverID)
+		if err != nil {
+			return fmt.Errorf("failed to get playthrough: %v", err)
+		}
+
+		// Повторно проверяем дедлайн под блокировкой: шаг мог быть разрешен последним голосом
+		if server.Status != storage.ServerStatusInProgress || mp.VoteDeadline == nil || mp.VoteDeadline.After(time.Now()) {
+			return nil
+		}
+
+		if err := applyAFKFallback(tx, server, mp); err != nil {
+			return err
+		}
+		return resolveStep(tx, server, mp)
+	})
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	"fmt"
 	_ "github.com/lib/pq"
 	"net/http"
+	"os"
 	"quest_maker/handlers"
+	"quest_maker/migrator"
+	"quest_maker/storage"
+	"quest_maker/storage/memory"
+	"quest_maker/storage/postgres"
+	"quest_maker/storage/sqlite"
+	"strconv"
+	"time"
 )
 
 const migrationsDir = "migrations"
@@ -14,7 +23,136 @@ const migrationsDir = "migrations"
 //go:embed migrations/*.sql
 var MigrationsFS embed.FS
 
+const sqliteMigrationsDir = "migrations/sqlite"
+
+//go:embed migrations/sqlite/*.sql
+var SQLiteMigrationsFS embed.FS
+
 func main() {
+	// С аргументами выполняется команда для авторов квестов, без них запускается сервер
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
+	// Хранилище выбирается переменной STORAGE: postgres (по умолчанию), sqlite или memory
+	var store storage.Store
+	switch os.Getenv("STORAGE") {
+	case "memory":
+		// Данные живут только до перезапуска; подходит для локальных демо без базы
+		store = memory.New()
+	case "sqlite":
+		// Один файл базы, путь задает SQLITE_PATH
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "quest_maker.db"
+		}
+		store = sqlite.New(openSQLite(path))
+	case "", "postgres":
+		store = postgres.New(openDB())
+	default:
+		panic(fmt.Sprintf("unknown STORAGE %q", os.Getenv("STORAGE")))
+	}
+
+	// Ключ подписи гостевых сессий
+	handlers.SetGuestTokenSecret(os.Getenv("GUEST_TOKEN_SECRET"))
+
+	// Лимиты частоты для запросов, которые пишут в базу, и размер тела запроса
+	ipLimiter := handlers.NewRateLimiter(handlers.RateLimit{
+		Rate:  envFloat("RATE_LIMIT_IP_RPS", 5),
+		Burst: envInt("RATE_LIMIT_IP_BURST", 20),
+	})
+	userLimiter := handlers.NewRateLimiter(handlers.RateLimit{
+		Rate:  envFloat("RATE_LIMIT_USER_RPS", 2),
+		Burst: envInt("RATE_LIMIT_USER_BURST", 10),
+	})
+	maxBodyBytes := int64(envInt("MAX_BODY_BYTES", 1<<20))
+
+	// Разрешение шагов, время голосования на которых истекло
+	voteScheduler := &handlers.VoteScheduler{Store: store, Interval: time.Second}
+	go voteScheduler.Run(context.Background())
+
+	fmt.Println("starting server at :8080")
+	http.ListenAndServe(":8080", handlers.LimitBody(maxBodyBytes, routes(store, ipLimiter, userLimiter)))
+}
+
+// Маршруты приложения; nil-лимитер отключает ограничение частоты
+func routes(store storage.Store, ipLimiter, userLimiter *handlers.RateLimiter) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	rootHandler := &handlers.RootHandler{}
+	makeQuestHandler := &handlers.MakeQuestHandler{Store: store}
+	makePlayThroughHandler := &handlers.MakePlayThroughHandler{Store: store}
+	getStepHandler := &handlers.GetCurrentStepHandler{Store: store}
+	makeChoiceHandler := &handlers.MakeChoiceHandler{Store: store}
+	mux.Handle("/", rootHandler)
+	mux.Handle("/make_quest", handlers.RequireScope(handlers.ScopeQuestsWrite, handlers.LimitByIP(ipLimiter, handlers.RequireAccount(store, handlers.LimitByUser(userLimiter, makeQuestHandler)))))
+	mux.Handle("/upload_quest", handlers.RequireScope(handlers.ScopeQuestsWrite, handlers.LimitByIP(ipLimiter, handlers.RequireAccount(store, handlers.LimitByUser(userLimiter, &handlers.UploadQuestHandler{Store: store})))))
+	mux.Handle("/make_playthrough", handlers.LimitByIP(ipLimiter, handlers.WithGuest(store, handlers.LimitByUser(userLimiter, makePlayThroughHandler))))
+	mux.Handle("/get_step", handlers.RequireScope(handlers.ScopePlaythroughsRead, handlers.RequireUser(store, getStepHandler)))
+	mux.Handle("/list_playthroughs", handlers.RequireScope(handlers.ScopePlaythroughsRead, handlers.RequireUser(store, &handlers.ListPlaythroughsHandler{Store: store})))
+	mux.Handle("/make_choice", handlers.RequireUser(store, makeChoiceHandler))
+
+	// Учетные записи
+	mux.Handle("/register", handlers.LimitByIP(ipLimiter, &handlers.RegisterHandler{Store: store}))
+	mux.Handle("/login", handlers.LimitByIP(ipLimiter, &handlers.LoginHandler{Store: store}))
+	mux.Handle("/logout", &handlers.LogoutHandler{Store: store})
+	mux.Handle("/me", handlers.RequireUser(store, &handlers.MeHandler{}))
+	mux.Handle("/claim_guest", handlers.RequireSession(handlers.RequireAccount(store, &handlers.ClaimGuestHandler{Store: store})))
+
+	// Личные API-токены. Маршруты с RequireScope принимают токен с нужной областью,
+	// маршруты с RequireSession - только сессию входа, остальные - любой токен
+	mux.Handle("/create_api_token", handlers.RequireSession(handlers.RequireAccount(store, &handlers.CreateAPITokenHandler{Store: store})))
+	mux.Handle("/list_api_tokens", handlers.RequireSession(handlers.RequireAccount(store, &handlers.ListAPITokensHandler{Store: store})))
+	mux.Handle("/revoke_api_token", handlers.RequireSession(handlers.RequireAccount(store, &handlers.RevokeAPITokenHandler{Store: store})))
+
+	// Управление квестами: публикация, удаление и соавторы
+	mux.Handle("/get_quest", handlers.RequireScope(handlers.ScopeQuestsRead, handlers.WithUser(store, &handlers.GetQuestHandler{Store: store})))
+	mux.Handle("/list_quests", handlers.RequireScope(handlers.ScopeQuestsRead, handlers.WithUser(store, &handlers.ListQuestsHandler{Store: store})))
+	mux.Handle("/update_quest", handlers.RequireScope(handlers.ScopeQuestsWrite, handlers.RequireAccount(store, &handlers.UpdateQuestHandler{Store: store})))
+	mux.Handle("/publish_quest", handlers.RequireScope(handlers.ScopeQuestsWrite, handlers.RequireAccount(store, &handlers.PublishQuestHandler{Store: store})))
+	mux.Handle("/delete_quest", handlers.RequireScope(handlers.ScopeQuestsWrite, handlers.RequireAccount(store, &handlers.DeleteQuestHandler{Store: store})))
+	mux.Handle("/add_quest_author", handlers.RequireScope(handlers.ScopeQuestsWrite, handlers.RequireAccount(store, &handlers.AddQuestAuthorHandler{Store: store})))
+	mux.Handle("/remove_quest_author", handlers.RequireScope(handlers.ScopeQuestsWrite, handlers.RequireAccount(store, &handlers.RemoveQuestAuthorHandler{Store: store})))
+
+	// Перенос квестов в файлах переносимого формата (пакет questfile)
+	mux.Handle("GET /quests/{id}/export", handlers.RequireScope(handlers.ScopeQuestsRead, handlers.WithUser(store, &handlers.ExportQuestHandler{Store: store})))
+	mux.Handle("GET /quests/{id}/graph", handlers.RequireScope(handlers.ScopeQuestsRead, handlers.WithUser(store, &handlers.QuestGraphHandler{Store: store})))
+	mux.Handle("POST /quests/import", handlers.RequireScope(handlers.ScopeQuestsWrite, handlers.LimitByIP(ipLimiter, handlers.RequireAccount(store, handlers.LimitByUser(userLimiter, &handlers.ImportQuestHandler{Store: store})))))
+
+	// Редактор квестов
+	mux.Handle("/editor", &handlers.EditorPageHandler{})
+	mux.Handle("GET /quests/{id}/edit", handlers.RequireScope(handlers.ScopeQuestsRead, handlers.RequireAccount(store, &handlers.EditQuestHandler{Store: store})))
+	mux.Handle("PUT /quests/{id}/edit", handlers.RequireScope(handlers.ScopeQuestsWrite, handlers.RequireAccount(store, &handlers.SaveQuestHandler{Store: store})))
+	mux.Handle("POST /quests", handlers.RequireScope(handlers.ScopeQuestsWrite, handlers.LimitByIP(ipLimiter, handlers.RequireAccount(store, handlers.LimitByUser(userLimiter, &handlers.SaveQuestHandler{Store: store})))))
+
+	// Многопользовательские маршруты
+	mux.Handle("/multiplayer", &handlers.MultiplayerPageHandler{})
+	mux.Handle("/create_server", handlers.RequireScope(handlers.ScopeServersAdmin, handlers.LimitByIP(ipLimiter, handlers.WithGuest(store, handlers.LimitByUser(userLimiter, &handlers.CreateServerHandler{Store: store})))))
+	mux.Handle("/list_servers", &handlers.ListServersHandler{Store: store})
+	mux.Handle("/join_server", handlers.LimitByIP(ipLimiter, handlers.WithGuest(store, &handlers.JoinServerHandler{Store: store})))
+	mux.Handle("/rejoin_server", handlers.RequireUser(store, &handlers.RejoinServerHandler{Store: store}))
+	mux.Handle("/heartbeat", &handlers.HeartbeatHandler{Store: store})
+	mux.Handle("/spectate_server", handlers.LimitByIP(ipLimiter, handlers.WithGuest(store, &handlers.SpectateServerHandler{Store: store})))
+	mux.Handle("/stop_spectating", &handlers.StopSpectatingHandler{Store: store})
+	mux.Handle("/audience_vote", &handlers.AudienceVoteHandler{Store: store})
+	mux.Handle("/get_lobby", handlers.WithUser(store, &handlers.GetLobbyHandler{Store: store}))
+	mux.Handle("/claim_role", handlers.RequireUser(store, &handlers.ClaimRoleHandler{Store: store}))
+	mux.Handle("/release_role", handlers.RequireUser(store, &handlers.ReleaseRoleHandler{Store: store}))
+	mux.Handle("/set_ready", handlers.RequireUser(store, &handlers.SetReadyHandler{Store: store}))
+	mux.Handle("/leave_server", handlers.RequireUser(store, &handlers.LeaveServerHandler{Store: store}))
+	mux.Handle("/kick_player", handlers.RequireScope(handlers.ScopeServersAdmin, handlers.RequireUser(store, &handlers.KickPlayerHandler{Store: store})))
+	mux.Handle("/transfer_host", handlers.RequireScope(handlers.ScopeServersAdmin, handlers.RequireUser(store, &handlers.TransferHostHandler{Store: store})))
+	mux.Handle("/start_game", handlers.RequireScope(handlers.ScopeServersAdmin, handlers.RequireUser(store, &handlers.StartGameHandler{Store: store})))
+	mux.Handle("/close_server", handlers.RequireScope(handlers.ScopeServersAdmin, handlers.RequireUser(store, &handlers.CloseServerHandler{Store: store})))
+	mux.Handle("/get_multiplayer_state", handlers.WithUser(store, &handlers.GetMultiplayerStateHandler{Store: store}))
+	mux.Handle("/get_multiplayer_dialog", handlers.WithUser(store, &handlers.GetMultiplayerDialogHandler{Store: store}))
+	mux.Handle("/make_multiplayer_choice", handlers.LimitByIP(ipLimiter, handlers.RequireUser(store, handlers.LimitByUser(userLimiter, &handlers.MakeMultiplayerChoiceHandler{Store: store}))))
+	mux.Handle("/proceed_to_next_step", handlers.RequireUser(store, &handlers.ProceedToNextStepHandler{Store: store}))
+
+	return mux
+}
+
+func openDB() *sql.DB {
 	dsn := "user=user password=password dbname=quest host=postgres port=5432 sslmode=disable"
 	db, err := sql.Open("postgres", dsn)
 	if err != nil {
@@ -46,16 +184,47 @@ func main() {
 
 	//fmt.Printf("Migrations applied!!")
 
-	rootHandler := &handlers.RootHandler{}
-	makeQuestHandler := &handlers.MakeQuestHandler{DB: db}
-	makePlayThroughHandler := &handlers.MakePlayThroughHandler{DB: db}
-	getStepHandler := &handlers.GetCurrentStepHandler{DB: db}
-	makeChoiceHandler := &handlers.MakeChoiceHandler{DB: db}
-	http.Handle("/", rootHandler)
-	http.Handle("/make_quest", makeQuestHandler)
-	http.Handle("/make_playthrough", makePlayThroughHandler)
-	http.Handle("/get_step", getStepHandler)
-	http.Handle("/make_choice", makeChoiceHandler)
-	fmt.Println("starting server at :8080")
-	http.ListenAndServe(":8080", nil)
+	return db
+}
+
+func openSQLite(path string) *sql.DB {
+	db, err := sqlite.Open(path)
+	if err != nil {
+		panic(err)
+	}
+
+	// Схема SQLite живет в отдельном каталоге миграций и применяется при каждом запуске
+	err = migrator.MustGetNewMigrator(SQLiteMigrationsFS, sqliteMigrationsDir).ApplySQLiteMigrations(db)
+	if err != nil {
+		panic(err)
+	}
+
+	return db
+}
+
+// Числовые настройки из переменных окружения; при пустом или неверном значении берется значение по умолчанию
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("invalid %s=%q, using %d\n", name, value, def)
+		return def
+	}
+	return n
+}
+
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		fmt.Printf("invalid %s=%q, using %g\n", name, value, def)
+		return def
+	}
+	return f
 }
@@ -0,0 +1,11 @@
+-- Токен сессии, по которому игрок возвращается на сервер после обрыва соединения,
+-- и время последней активности для отображения присутствия
+ALTER TABLE server_player ADD COLUMN session_token VARCHAR NULL;
+ALTER TABLE server_player ADD COLUMN last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+
+UPDATE server_player
+SET session_token = MD5(RANDOM()::TEXT || id::TEXT) || MD5(RANDOM()::TEXT || joined_at::TEXT)
+WHERE session_token IS NULL;
+
+ALTER TABLE server_player ALTER COLUMN session_token SET NOT NULL;
+ALTER TABLE server_player ADD CONSTRAINT unique_server_player_session_token UNIQUE (session_token);
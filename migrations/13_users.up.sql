@@ -0,0 +1,33 @@
+-- Учетные записи игроков; имя пользователя используется как имя игрока в прохождениях и на серверах
+CREATE TABLE app_user
+(
+    id            SERIAL PRIMARY KEY,
+    username      VARCHAR NOT NULL,
+    password_hash VARCHAR NOT NULL,
+    created_at    TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX unique_app_user_username ON app_user (LOWER(username));
+
+-- Сессии входа; хранится только хеш токена
+CREATE TABLE user_session
+(
+    id         SERIAL PRIMARY KEY,
+    user_id    INT       NOT NULL,
+    token_hash VARCHAR   NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    CONSTRAINT fk_user_session_user FOREIGN KEY (user_id) REFERENCES app_user (id) ON DELETE CASCADE,
+    CONSTRAINT unique_user_session_token_hash UNIQUE (token_hash)
+);
+
+-- Существующие записи остаются без пользователя
+ALTER TABLE playthrough ADD COLUMN user_id INT NULL;
+ALTER TABLE playthrough ADD CONSTRAINT fk_playthrough_user FOREIGN KEY (user_id) REFERENCES app_user (id);
+
+ALTER TABLE server_player ADD COLUMN user_id INT NULL;
+ALTER TABLE server_player ADD CONSTRAINT fk_server_player_user FOREIGN KEY (user_id) REFERENCES app_user (id);
+ALTER TABLE server_player ADD CONSTRAINT unique_server_player_user UNIQUE (server_id, user_id);
+
+ALTER TABLE server_spectator ADD COLUMN user_id INT NULL;
+ALTER TABLE server_spectator ADD CONSTRAINT fk_server_spectator_user FOREIGN KEY (user_id) REFERENCES app_user (id);
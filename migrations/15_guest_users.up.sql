@@ -0,0 +1,4 @@
+-- Гости играют без регистрации; их прохождения и места на серверах переходят
+-- в учетную запись, когда гость регистрируется или входит
+ALTER TABLE app_user ADD COLUMN is_guest BOOLEAN DEFAULT FALSE;
+ALTER TABLE app_user ALTER COLUMN password_hash DROP NOT NULL;
@@ -0,0 +1,19 @@
+-- Личные API-токены для интеграций. Хранится только хеш токена,
+-- префикс нужен, чтобы пользователь мог отличить токены в списке
+CREATE TABLE api_token
+(
+    id           SERIAL PRIMARY KEY,
+    user_id      INT     NOT NULL,
+    name         VARCHAR NOT NULL,
+    token_hash   VARCHAR NOT NULL,
+    token_prefix VARCHAR NOT NULL,
+    scopes       VARCHAR NOT NULL, -- через пробел: quests:write quests:read playthroughs:read servers:admin
+    created_at   TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL,
+    expires_at   TIMESTAMP NULL,
+    revoked_at   TIMESTAMP NULL,
+    CONSTRAINT fk_api_token_user FOREIGN KEY (user_id) REFERENCES app_user (id) ON DELETE CASCADE,
+    CONSTRAINT unique_api_token_hash UNIQUE (token_hash)
+);
+
+CREATE INDEX idx_api_token_user ON api_token (user_id);
@@ -0,0 +1,4 @@
+-- Вариант выбора может вести на свой шаг; NULL - переход самого шага
+ALTER TABLE player_action_choice ADD COLUMN next_step INT NULL;
+ALTER TABLE player_action_choice ADD CONSTRAINT fk_player_action_choice_next_step
+    FOREIGN KEY (next_step) REFERENCES step (id);
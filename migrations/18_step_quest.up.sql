@@ -0,0 +1,22 @@
+-- Шаг знает свой квест, чтобы находить и шаги, до которых нельзя дойти от начального
+ALTER TABLE step ADD COLUMN quest INT NULL;
+ALTER TABLE step ADD CONSTRAINT fk_step_quest FOREIGN KEY (quest) REFERENCES quest (id);
+
+-- У существующих квестов известны только шаги, достижимые от начального
+WITH RECURSIVE reachable (quest, step) AS (
+    SELECT id, initial_step FROM quest WHERE initial_step IS NOT NULL
+    UNION
+    SELECT r.quest, n.next_step
+    FROM reachable r
+    JOIN (
+        SELECT id AS step, next_step FROM step
+        UNION ALL
+        SELECT pa.step, pac.next_step
+        FROM player_action_choice pac JOIN player_action pa ON pac.player_action = pa.id
+        UNION ALL
+        SELECT ca.step, cac.next_step
+        FROM character_action_choice cac JOIN character_action ca ON cac.character_action = ca.id
+    ) n ON n.step = r.step
+    WHERE n.next_step IS NOT NULL
+)
+UPDATE step SET quest = reachable.quest FROM reachable WHERE step.id = reachable.step;
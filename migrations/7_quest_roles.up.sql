@@ -0,0 +1,30 @@
+-- Максимальное количество игроков, которое допускает квест
+ALTER TABLE quest ADD COLUMN max_players INT DEFAULT 2;
+
+-- Именованные роли квеста; position совпадает с player_action_choice.player_index
+CREATE TABLE quest_role
+(
+    id       SERIAL PRIMARY KEY,
+    quest    INT     NOT NULL,
+    name     VARCHAR NOT NULL,
+    position INT     NOT NULL,
+    CONSTRAINT fk_quest_role_quest FOREIGN KEY (quest) REFERENCES quest (id),
+    CONSTRAINT unique_quest_role_position UNIQUE (quest, position),
+    CONSTRAINT unique_quest_role_name UNIQUE (quest, name)
+);
+
+-- Роль, которую занимает игрок на сервере
+ALTER TABLE server_player ADD COLUMN player_index INT NULL;
+
+-- Раньше роль определялась порядком входа на сервер
+UPDATE server_player sp
+SET player_index = ordered.position
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY server_id ORDER BY joined_at) AS position
+    FROM server_player
+) ordered
+WHERE sp.id = ordered.id;
+
+ALTER TABLE server_player
+ADD CONSTRAINT unique_server_player_index
+UNIQUE (server_id, player_index);
@@ -0,0 +1,13 @@
+-- Роль может быть связана с персонажем квеста, которого играет ее обладатель
+ALTER TABLE quest_role ADD COLUMN character INT NULL;
+ALTER TABLE quest_role ADD CONSTRAINT fk_quest_role_character
+    FOREIGN KEY (character) REFERENCES character (id);
+
+-- Готовность игрока начать игру; игра стартует, когда все роли заняты и все готовы
+ALTER TABLE server_player ADD COLUMN is_ready BOOLEAN DEFAULT FALSE;
+
+-- Уже идущие игры считаем начатыми с согласия всех игроков
+UPDATE server_player sp
+SET is_ready = TRUE
+FROM game_server gs
+WHERE sp.server_id = gs.id AND gs.status <> 'waiting';
@@ -0,0 +1,10 @@
+-- Код приглашения для входа на приватный сервер и необязательный пароль
+ALTER TABLE game_server ADD COLUMN invite_code VARCHAR NULL;
+ALTER TABLE game_server ADD COLUMN password_hash VARCHAR NULL;
+
+UPDATE game_server
+SET invite_code = UPPER(SUBSTRING(MD5(RANDOM()::TEXT || id::TEXT) FROM 1 FOR 8))
+WHERE invite_code IS NULL;
+
+ALTER TABLE game_server ALTER COLUMN invite_code SET NOT NULL;
+ALTER TABLE game_server ADD CONSTRAINT unique_game_server_invite_code UNIQUE (invite_code);
@@ -0,0 +1,12 @@
+-- Хост сервера управляет лобби: выгоняет игроков, передает права, начинает и закрывает игру
+ALTER TABLE game_server ADD COLUMN host_player TEXT NULL;
+
+UPDATE game_server
+SET host_player = (
+    SELECT sp.player_name FROM server_player sp
+    WHERE sp.server_id = game_server.id
+    ORDER BY sp.joined_at
+    LIMIT 1
+);
+
+-- Статусы: waiting -> in_progress -> finished, а также abandoned из waiting и in_progress
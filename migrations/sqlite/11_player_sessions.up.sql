@@ -0,0 +1,13 @@
+-- Токен сессии, по которому игрок возвращается на сервер после обрыва соединения,
+-- и время последней активности для отображения присутствия.
+-- SQLite не добавляет колонку со значением по умолчанию CURRENT_TIMESTAMP,
+-- поэтому last_seen_at заполняется отдельно, а при чтении берется joined_at, если он пуст
+ALTER TABLE server_player ADD COLUMN session_token VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE server_player ADD COLUMN last_seen_at TIMESTAMP NULL;
+
+UPDATE server_player
+SET session_token = LOWER(HEX(RANDOMBLOB(32))),
+    last_seen_at = joined_at
+WHERE session_token = '';
+
+CREATE UNIQUE INDEX unique_server_player_session_token ON server_player (session_token);
@@ -0,0 +1,34 @@
+-- Зрители: наблюдают за игрой, не занимая мест игроков
+ALTER TABLE game_server ADD COLUMN allow_spectators BOOLEAN DEFAULT TRUE;
+
+CREATE TABLE server_spectator
+(
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    server_id      INT     NOT NULL,
+    spectator_name TEXT    NOT NULL,
+    session_token  VARCHAR NOT NULL,
+    joined_at      TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at   TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_server_spectator_server FOREIGN KEY (server_id) REFERENCES game_server (id),
+    CONSTRAINT unique_server_spectator_name UNIQUE (server_id, spectator_name),
+    CONSTRAINT unique_server_spectator_session_token UNIQUE (session_token)
+);
+
+-- Голосование зрителей: вариант, набравший больше всего голосов, засчитывается
+-- как дополнительный голос на шагах, где квест включил audience_poll
+ALTER TABLE player_action ADD COLUMN audience_poll BOOLEAN DEFAULT FALSE;
+
+CREATE TABLE audience_vote
+(
+    id                      INTEGER PRIMARY KEY AUTOINCREMENT,
+    multiplayer_playthrough INT NOT NULL,
+    spectator_id            INT NOT NULL,
+    choice_id               INT NOT NULL,
+    step_id                 INT NOT NULL,
+    created_at              TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_audience_vote_playthrough FOREIGN KEY (multiplayer_playthrough) REFERENCES multiplayer_playthrough (id),
+    CONSTRAINT fk_audience_vote_spectator FOREIGN KEY (spectator_id) REFERENCES server_spectator (id) ON DELETE CASCADE,
+    CONSTRAINT fk_audience_vote_choice FOREIGN KEY (choice_id) REFERENCES player_action_choice (id),
+    CONSTRAINT fk_audience_vote_step FOREIGN KEY (step_id) REFERENCES step (id),
+    CONSTRAINT unique_audience_vote UNIQUE (multiplayer_playthrough, spectator_id, step_id)
+);
@@ -0,0 +1,21 @@
+-- Владелец квеста и статус публикации: draft, published, deleted.
+-- Квесты, созданные до появления учетных записей, остаются опубликованными и без владельца
+ALTER TABLE quest ADD COLUMN owner_id INT NULL
+    CONSTRAINT fk_quest_owner REFERENCES app_user (id);
+
+ALTER TABLE quest ADD COLUMN status VARCHAR DEFAULT 'draft';
+UPDATE quest SET status = 'published';
+
+-- Соавторы: editor может изменять квест, viewer - смотреть и тестировать черновик
+CREATE TABLE quest_author
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    quest      INT     NOT NULL,
+    user_id    INT     NOT NULL,
+    role       VARCHAR NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_quest_author_quest FOREIGN KEY (quest) REFERENCES quest (id),
+    CONSTRAINT fk_quest_author_user FOREIGN KEY (user_id) REFERENCES app_user (id) ON DELETE CASCADE,
+    CONSTRAINT unique_quest_author UNIQUE (quest, user_id),
+    CONSTRAINT check_quest_author_role CHECK (role IN ('editor', 'viewer'))
+);
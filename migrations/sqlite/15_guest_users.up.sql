@@ -0,0 +1,4 @@
+-- Гости играют без регистрации; их прохождения и места на серверах переходят
+-- в учетную запись, когда гость регистрируется или входит.
+-- password_hash допускает NULL с миграции 13
+ALTER TABLE app_user ADD COLUMN is_guest BOOLEAN DEFAULT FALSE;
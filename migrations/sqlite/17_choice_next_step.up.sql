@@ -0,0 +1,3 @@
+-- Вариант выбора может вести на свой шаг; NULL - переход самого шага
+ALTER TABLE player_action_choice ADD COLUMN next_step INT NULL
+    CONSTRAINT fk_player_action_choice_next_step REFERENCES step (id);
@@ -0,0 +1,7 @@
+-- Персонаж, убранный из квеста, остается в базе для старых шагов, которые на него ссылаются,
+-- но к объявленным персонажам квеста больше не относится
+ALTER TABLE character ADD COLUMN detached BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Раньше каждое сохранение квеста добавляло персонажей заново; объявленной остается последняя строка с именем
+UPDATE character SET detached = TRUE
+WHERE id NOT IN (SELECT MAX(id) FROM character GROUP BY quest, name);
@@ -0,0 +1,4 @@
+-- Уникальный индекс для предотвращения дублирования выборов одного игрока на одном шаге.
+-- На него опирается ON CONFLICT при сохранении голоса
+CREATE UNIQUE INDEX unique_player_choice_per_step
+    ON player_choice (multiplayer_playthrough, player_name, step_id);
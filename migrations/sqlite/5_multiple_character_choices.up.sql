@@ -0,0 +1,5 @@
+-- SQLite не умеет добавлять ограничения к таблице, поэтому внешний ключ объявлен прямо в колонке
+ALTER TABLE character_action_choice ADD COLUMN next_step INT NULL
+    CONSTRAINT fk_character_action_choice_next_step REFERENCES step (id);
+
+ALTER TABLE character_action_choice ADD COLUMN priority INT DEFAULT 0;
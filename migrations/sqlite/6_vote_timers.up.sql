@@ -0,0 +1,17 @@
+-- Таймер голосования: общий для сервера и переопределение для конкретного шага
+ALTER TABLE game_server ADD COLUMN vote_timeout_seconds INT NULL;
+
+-- Что делать с игроками, не успевшими проголосовать:
+-- random = случайный вариант, default = вариант по умолчанию, skip = пропустить игрока
+ALTER TABLE game_server ADD COLUMN afk_fallback VARCHAR DEFAULT 'random';
+
+ALTER TABLE player_action ADD COLUMN vote_timeout_seconds INT NULL;
+
+ALTER TABLE player_action_choice ADD COLUMN is_default BOOLEAN DEFAULT FALSE;
+
+-- Момент, когда текущий шаг будет разрешен без ожидания оставшихся игроков
+ALTER TABLE multiplayer_playthrough ADD COLUMN vote_deadline TIMESTAMP NULL;
+
+CREATE INDEX idx_multiplayer_playthrough_vote_deadline
+    ON multiplayer_playthrough (vote_deadline)
+    WHERE vote_deadline IS NOT NULL;
@@ -0,0 +1,28 @@
+-- Максимальное количество игроков, которое допускает квест
+ALTER TABLE quest ADD COLUMN max_players INT DEFAULT 2;
+
+-- Именованные роли квеста; position совпадает с player_action_choice.player_index
+CREATE TABLE quest_role
+(
+    id       INTEGER PRIMARY KEY AUTOINCREMENT,
+    quest    INT     NOT NULL,
+    name     VARCHAR NOT NULL,
+    position INT     NOT NULL,
+    CONSTRAINT fk_quest_role_quest FOREIGN KEY (quest) REFERENCES quest (id),
+    CONSTRAINT unique_quest_role_position UNIQUE (quest, position),
+    CONSTRAINT unique_quest_role_name UNIQUE (quest, name)
+);
+
+-- Роль, которую занимает игрок на сервере
+ALTER TABLE server_player ADD COLUMN player_index INT NULL;
+
+-- Раньше роль определялась порядком входа на сервер
+UPDATE server_player
+SET player_index = (
+    SELECT COUNT(*) FROM server_player other
+    WHERE other.server_id = server_player.server_id
+      AND (other.joined_at < server_player.joined_at
+           OR (other.joined_at = server_player.joined_at AND other.id <= server_player.id))
+);
+
+CREATE UNIQUE INDEX unique_server_player_index ON server_player (server_id, player_index);
@@ -0,0 +1,11 @@
+-- Роль может быть связана с персонажем квеста, которого играет ее обладатель
+ALTER TABLE quest_role ADD COLUMN character INT NULL
+    CONSTRAINT fk_quest_role_character REFERENCES character (id);
+
+-- Готовность игрока начать игру; игра стартует, когда все роли заняты и все готовы
+ALTER TABLE server_player ADD COLUMN is_ready BOOLEAN DEFAULT FALSE;
+
+-- Уже идущие игры считаем начатыми с согласия всех игроков
+UPDATE server_player
+SET is_ready = TRUE
+WHERE server_id IN (SELECT id FROM game_server WHERE status <> 'waiting');
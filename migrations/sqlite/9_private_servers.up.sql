@@ -0,0 +1,11 @@
+-- Код приглашения для входа на приватный сервер и необязательный пароль.
+-- SQLite не меняет NOT NULL у существующей колонки, поэтому пустое значение по умолчанию
+-- сразу заменяется случайным кодом
+ALTER TABLE game_server ADD COLUMN invite_code VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE game_server ADD COLUMN password_hash VARCHAR NULL;
+
+UPDATE game_server
+SET invite_code = UPPER(SUBSTR(HEX(RANDOMBLOB(4)), 1, 8))
+WHERE invite_code = '';
+
+CREATE UNIQUE INDEX unique_game_server_invite_code ON game_server (invite_code);
@@ -1,13 +1,16 @@
 package migrator
 
 import (
+	"context"
 	"database/sql"
-	"embed"
 	"errors"
 	"fmt"
 	"github.com/golang-migrate/migrate/v4"
+	"io/fs"
 
+	"github.com/golang-migrate/migrate/v4/database"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
 	"github.com/golang-migrate/migrate/v4/source"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 )
@@ -16,7 +19,7 @@ type Migrator struct {
 	srcDriver source.Driver
 }
 
-func MustGetNewMigrator(sqlFiles embed.FS, dirName string) *Migrator {
+func MustGetNewMigrator(sqlFiles fs.FS, dirName string) *Migrator {
 	d, err := iofs.New(sqlFiles, dirName)
 	if err != nil {
 		panic(err)
@@ -27,12 +30,33 @@ func MustGetNewMigrator(sqlFiles embed.FS, dirName string) *Migrator {
 }
 
 func (m *Migrator) ApplyMigrations(db *sql.DB) error {
-	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	// Отдельное соединение, чтобы после миграций не закрывать базу вызывающего
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("unable to get db connection: %v", err)
+	}
+
+	driver, err := postgres.WithConnection(context.Background(), conn, &postgres.Config{})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("unable to create db instance: %v", err)
+	}
+
+	return m.apply(driver, "quest")
+}
+
+func (m *Migrator) ApplySQLiteMigrations(db *sql.DB) error {
+	driver, err := sqlite.WithInstance(db, &sqlite.Config{})
 	if err != nil {
 		return fmt.Errorf("unable to create db instance: %v", err)
 	}
 
-	migrator, err := migrate.NewWithInstance("migration_embeded_sql_files", m.srcDriver, "quest", driver)
+	// Драйвер SQLite закрывает базу вместе с собой
+	return m.apply(keepOpen{driver}, "quest")
+}
+
+func (m *Migrator) apply(driver database.Driver, dbName string) error {
+	migrator, err := migrate.NewWithInstance("migration_embeded_sql_files", m.srcDriver, dbName, driver)
 	if err != nil {
 		return fmt.Errorf("unable to create migration: %v", err)
 	}
@@ -47,3 +71,11 @@ func (m *Migrator) ApplyMigrations(db *sql.DB) error {
 
 	return nil
 }
+
+type keepOpen struct {
+	database.Driver
+}
+
+func (keepOpen) Close() error {
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"strings"
+
+	"quest_maker/engine"
+	"quest_maker/handlers"
+	"quest_maker/storage"
+)
+
+// Шаг, показанный игроку в терминале
+type playStep struct {
+	Text     string
+	Choices  []storage.Choice
+	Finished bool // Шаг без выбора, на котором квест закончился
+}
+
+// Прохождение для игры в терминале: локально по движку или на сервере.
+// Как и /get_step, чтение шага без выбора переводит прохождение дальше
+type playSession interface {
+	Next() (*playStep, error)
+	Choose(choiceID int) (finished bool, err error)
+	Points() (storage.Points, error)
+}
+
+// Прохождение квеста из файла; ничего не сохраняется
+type localSession struct {
+	graph engine.Steps
+	state engine.State
+}
+
+func newLocalSession(quest storage.NewQuest) *localSession {
+	return &localSession{graph: engine.FromQuest(quest), state: engine.State{StepID: 1}}
+}
+
+func (s *localSession) Next() (*playStep, error) {
+	view, err := engine.Look(s.graph, s.state)
+	if err != nil {
+		return nil, err
+	}
+	step := &playStep{Text: view.Text, Choices: view.Choices}
+	if view.NeedsChoice() {
+		return step, nil
+	}
+
+	next, err := engine.Proceed(s.graph, s.state)
+	if err != nil {
+		return nil, err
+	}
+	s.state = next
+	step.Finished = next.Finished
+	return step, nil
+}
+
+func (s *localSession) Choose(choiceID int) (bool, error) {
+	next, err := engine.Choose(s.graph, s.state, choiceID)
+	if err != nil {
+		return false, err
+	}
+	s.state = next
+	return next.Finished, nil
+}
+
+func (s *localSession) Points() (storage.Points, error) {
+	return s.state.Points, nil
+}
+
+// Прохождение на запущенном сервере через /make_playthrough, /get_step и /make_choice.
+// Без токена сервер выдает гостевую сессию, которая хранится в cookie
+type remoteSession struct {
+	server        string
+	token         string
+	client        *http.Client
+	playthroughID int
+	points        storage.Points // Очки из последнего ответа сервера
+}
+
+// Начинает новое прохождение квеста questID или продолжает playthroughID, если он задан
+func newRemoteSession(server, token string, questID, playthroughID int) (*remoteSession, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &remoteSession{server: strings.TrimRight(server, "/"), token: token, client: &http.Client{Jar: jar}, playthroughID: playthroughID}
+	if playthroughID != 0 {
+		return s, nil
+	}
+
+	var created handlers.StartPlaythroughResponse
+	if err := s.call("POST", "/make_playthrough", map[string]int{"quest_id": questID}, &created); err != nil {
+		return nil, err
+	}
+	s.playthroughID = created.PlaythroughID
+	return s, nil
+}
+
+func (s *remoteSession) call(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.server+path, reader)
+	if err != nil {
+		return err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", path, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (s *remoteSession) Next() (*playStep, error) {
+	var resp handlers.StepResponse
+	if err := s.call("GET", fmt.Sprintf("/get_step?playthrough_id=%d", s.playthroughID), nil, &resp); err != nil {
+		return nil, err
+	}
+	s.setPoints(resp)
+	step := &playStep{Text: resp.Text, Finished: resp.Finished}
+	for _, c := range resp.Choices {
+		step.Choices = append(step.Choices, storage.Choice{
+			ID:     c.ChoiceID,
+			Text:   c.Text,
+			Points: storage.Points{Violence: c.ViolencePoint, Whatever: c.WhateverPoint, Pacifism: c.PacifismPoint},
+		})
+	}
+	return step, nil
+}
+
+func (s *remoteSession) Choose(choiceID int) (bool, error) {
+	var resp handlers.StepResponse
+	if err := s.call("POST", "/make_choice", handlers.ChoiceRequest{PlaythroughID: s.playthroughID, ChoiceID: choiceID}, &resp); err != nil {
+		return false, err
+	}
+	s.setPoints(resp)
+	return resp.Finished, nil
+}
+
+// /get_step и /make_choice возвращают очки прохождения вместе с шагом
+func (s *remoteSession) Points() (storage.Points, error) {
+	return s.points, nil
+}
+
+func (s *remoteSession) setPoints(resp handlers.StepResponse) {
+	s.points = storage.Points{Violence: resp.ViolencePoint, Whatever: resp.WhateverPoint, Pacifism: resp.PacifismPoint}
+}
+
+func formatPoints(p storage.Points) string {
+	return fmt.Sprintf("violence %d, whatever %d, pacifism %d", p.Violence, p.Whatever, p.Pacifism)
+}
+
+// Изменение очков варианта, например "+2 violence, -1 pacifism"; пустое, если очки не меняются
+func formatPointsDelta(p storage.Points) string {
+	var parts []string
+	for _, part := range []struct {
+		name  string
+		value int
+	}{{"violence", p.Violence}, {"whatever", p.Whatever}, {"pacifism", p.Pacifism}} {
+		if part.value != 0 {
+			parts = append(parts, fmt.Sprintf("%+d %s", part.value, part.name))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Играет прохождение: печатает текст шагов и очки, на шагах с выбором читает номер варианта.
+// Пустая строка продолжает после шага без выбора, q - выход
+func play(session playSession, in io.Reader, out io.Writer) error {
+	input := bufio.NewScanner(in)
+	// Ввод закончился или игрок вышел
+	quit := func(line string) bool {
+		return strings.EqualFold(strings.TrimSpace(line), "q")
+	}
+
+	for {
+		step, err := session.Next()
+		if err != nil {
+			return err
+		}
+		points, err := session.Points()
+		if err != nil {
+			return err
+		}
+
+		if step.Text != "" {
+			fmt.Fprintf(out, "\n%s\n", step.Text)
+		}
+		fmt.Fprintf(out, "[%s]\n", formatPoints(points))
+
+		if step.Finished {
+			fmt.Fprintln(out, "\nThe end.")
+			return nil
+		}
+
+		if len(step.Choices) == 0 {
+			fmt.Fprint(out, "(Enter to continue, q to quit) ")
+			if !input.Scan() || quit(input.Text()) {
+				return nil
+			}
+			continue
+		}
+
+		for i, c := range step.Choices {
+			if delta := formatPointsDelta(c.Points); delta != "" {
+				fmt.Fprintf(out, "  %d. %s (%s)\n", i+1, c.Text, delta)
+			} else {
+				fmt.Fprintf(out, "  %d. %s\n", i+1, c.Text)
+			}
+		}
+
+		var choice storage.Choice
+		for {
+			fmt.Fprint(out, "> ")
+			if !input.Scan() || quit(input.Text()) {
+				return nil
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(input.Text()))
+			if err == nil && n >= 1 && n <= len(step.Choices) {
+				choice = step.Choices[n-1]
+				break
+			}
+			fmt.Fprintf(out, "Enter a number from 1 to %d\n", len(step.Choices))
+		}
+
+		finished, err := session.Choose(choice.ID)
+		if err != nil {
+			return err
+		}
+		if finished {
+			points, err := session.Points()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "[%s]\n\nThe end.\n", formatPoints(points))
+			return nil
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"quest_maker/storage/memory"
+)
+
+func TestPlay(t *testing.T) {
+	quest, err := loadQuestFile("test_quest.json")
+	if err != nil {
+		t.Fatalf("Failed to load test quest: %v", err)
+	}
+
+	app := startApp(t, memory.New())
+	author := newClient(t, app)
+	author.register("Alice")
+	questID := author.createTestQuest()
+	// Гостю доступны только опубликованные квесты
+	author.must("POST", "/publish_quest", map[string]interface{}{"quest_id": questID, "published": true}, nil)
+
+	sessions := map[string]func(t *testing.T) playSession{
+		"local": func(t *testing.T) playSession {
+			return newLocalSession(quest)
+		},
+		"remote": func(t *testing.T) playSession {
+			session, err := newRemoteSession(app.URL+"/", "", questID, 0)
+			if err != nil {
+				t.Fatalf("Failed to start playthrough: %v", err)
+			}
+			return session
+		},
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			// Неверный номер переспрашивается; после выбора очки видны на следующем шаге
+			"peaceful path",
+			"\n7\n4\n\n\n\n\n\n",
+			[]string{
+				textCastle,
+				"  4. Осмотреть местность в поисках другого входа (+2 pacifism)",
+				"Enter a number from 1 to 4",
+				textWiseGuard,
+				"[violence 0, whatever 0, pacifism 2]",
+				textMageBattle,
+				"The end.",
+			},
+		},
+		{"quit", "\nq\n", []string{textCastle, "  1. Попытаться взломать замок на воротах (+1 violence, +2 whatever)"}},
+		{"end of input", "", []string{textCastle}},
+	}
+
+	for name, newSession := range sessions {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				var out bytes.Buffer
+				if err := play(newSession(t), strings.NewReader(tt.input), &out); err != nil {
+					t.Fatalf("Play failed: %v", err)
+				}
+				for _, want := range tt.want {
+					if !strings.Contains(out.String(), want) {
+						t.Errorf("Expected output to contain %q, got:\n%s", want, out.String())
+					}
+				}
+				if tt.name != "peaceful path" && strings.Contains(out.String(), "The end.") {
+					t.Errorf("Expected the quest to stop early, got:\n%s", out.String())
+				}
+			})
+		}
+	}
+}
+
+func TestPlayCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stderr string
+	}{
+		{"quest file", []string{"play", "test_quest.json"}, 0, ""},
+		{"no quest", []string{"play"}, 2, "usage: quest_maker play"},
+		{"both quest and playthrough", []string{"play", "-server", "http://localhost:1", "-quest", "1", "-playthrough", "2"}, 2, "usage: quest_maker play"},
+		{"server is down", []string{"play", "-server", "http://127.0.0.1:1", "-quest", "1"}, 1, "make_playthrough"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runCommand(tt.args, strings.NewReader(""), &stdout, &stderr); code != tt.code {
+				t.Errorf("Expected exit code %d, got %d (stderr: %s)", tt.code, code, stderr.String())
+			}
+			if !strings.Contains(stderr.String(), tt.stderr) {
+				t.Errorf("Expected errors to contain %q, got %q", tt.stderr, stderr.String())
+			}
+		})
+	}
+}
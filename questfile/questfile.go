@@ -0,0 +1,489 @@
+// Пакет questfile - переносимый формат файла квеста с версией.
+// Шаги в файле ссылаются друг на друга по строковым ID, поэтому их можно переставлять,
+// добавлять и удалять, не пересчитывая номера. Описание формата - docs/quest_format.md
+package questfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"quest_maker/storage"
+)
+
+const (
+	Format = "quest_maker"
+	// Текущая версия формата; файлы более новых версий не читаются
+	Version = 1
+)
+
+type File struct {
+	Format     string   `json:"format"`
+	Version    int      `json:"version"`
+	Title      string   `json:"title"`
+	MaxPlayers int      `json:"max_players,omitempty"` // По умолчанию - количество ролей
+	Characters []string `json:"characters,omitempty"`
+	Roles      []Role   `json:"roles,omitempty"`
+	Steps      []Step   `json:"steps"` // Квест начинается с первого шага
+}
+
+type Role struct {
+	Name      string `json:"name"`
+	Character string `json:"character,omitempty"`
+}
+
+type Points struct {
+	Violence int `json:"violence,omitempty"`
+	Whatever int `json:"whatever,omitempty"`
+	Pacifism int `json:"pacifism,omitempty"`
+}
+
+type Step struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Next string `json:"next,omitempty"` // ID следующего шага; пустой - квест заканчивается на этом шаге
+
+	// narration
+	Text string `json:"text,omitempty"`
+
+	// player_action
+	Choices            []Choice `json:"choices,omitempty"`
+	VoteTimeoutSeconds *int     `json:"vote_timeout_seconds,omitempty"`
+	AudiencePoll       bool     `json:"audience_poll,omitempty"`
+
+	// character_action
+	Character string `json:"character,omitempty"`
+	Lines     []Line `json:"lines,omitempty"`
+}
+
+type Choice struct {
+	Text    string `json:"text"`
+	Points  Points `json:"points"`
+	Role    string `json:"role,omitempty"`    // Пустая роль - выбор доступен всем игрокам
+	Player  int    `json:"player,omitempty"`  // Номер игрока для квестов без ролей
+	Default bool   `json:"default,omitempty"` // Выбирается за игрока, не успевшего проголосовать
+	Next    string `json:"next,omitempty"`    // Пустой - переход шага
+}
+
+type Line struct {
+	Text      string `json:"text"`
+	Condition Points `json:"condition"`
+	Priority  int    `json:"priority,omitempty"`
+	Next      string `json:"next,omitempty"` // Пустой - переход шага
+}
+
+// Читает файл квеста и проверяет формат и версию
+func Parse(data []byte) (*File, error) {
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if f.Format != Format {
+		return nil, fmt.Errorf("not a %s quest file: format is %q", Format, f.Format)
+	}
+	if f.Version < 1 || f.Version > Version {
+		return nil, fmt.Errorf("unsupported version %d, expected 1..%d", f.Version, Version)
+	}
+	return &f, nil
+}
+
+// Есть ли у данных поле format, то есть записаны ли они в этом формате, а не в формате запроса /make_quest
+func IsQuestFile(data []byte) bool {
+	var header struct {
+		Format *string `json:"format"`
+	}
+	return json.Unmarshal(data, &header) == nil && header.Format != nil
+}
+
+func (p Points) toStorage() storage.Points {
+	return storage.Points{Violence: p.Violence, Whatever: p.Whatever, Pacifism: p.Pacifism}
+}
+
+func fromStorage(p storage.Points) Points {
+	return Points{Violence: p.Violence, Whatever: p.Whatever, Pacifism: p.Pacifism}
+}
+
+// Ошибка в файле квеста. Path - путь к неверному полю в JSON вида steps.2.choices.0.next
+// (индексы с 0), по нему редактор показывает ошибку рядом с полем
+type Error struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Все ошибки файла в порядке полей
+type Errors []*Error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Переводит файл в модель хранилища; ошибка типа Errors называет шаг и неверное поле
+func (f *File) Quest() (storage.NewQuest, error) {
+	quest, errs := f.convert(false)
+	if len(errs) > 0 {
+		return storage.NewQuest{}, errs
+	}
+	return quest, nil
+}
+
+// Проверяет файл так же, как Quest, и вдобавок его полноту: название, текст рассказа,
+// варианты выбора и реплики. Так проверяет квест редактор; nil - квест можно сохранить
+func (f *File) Validate() Errors {
+	_, errs := f.convert(true)
+	return errs
+}
+
+func (f *File) convert(strict bool) (storage.NewQuest, Errors) {
+	var errs Errors
+	fail := func(path, format string, args ...interface{}) {
+		errs = append(errs, &Error{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if strict && strings.TrimSpace(f.Title) == "" {
+		fail("title", "title is required")
+	}
+	if len(f.Steps) == 0 {
+		fail("steps", "quest has no steps")
+	}
+	if f.MaxPlayers < 0 {
+		fail("max_players", "invalid max_players")
+	}
+	// Как и в /update_quest, у квеста с ролями мест столько же, сколько ролей
+	if strict && f.MaxPlayers > 0 && len(f.Roles) > 0 && f.MaxPlayers != len(f.Roles) {
+		fail("max_players", "max_players must match the number of roles")
+	}
+
+	quest := storage.NewQuest{Title: f.Title, MaxPlayers: f.MaxPlayers}
+	if quest.MaxPlayers == 0 {
+		quest.MaxPlayers = len(f.Roles)
+	}
+	if quest.MaxPlayers == 0 {
+		quest.MaxPlayers = 2
+	}
+
+	characters := make(map[string]bool)
+	for i, name := range f.Characters {
+		if name == "" || characters[name] {
+			fail(fmt.Sprintf("characters.%d", i), "character name %q is empty or repeated", name)
+			continue
+		}
+		characters[name] = true
+		quest.Characters = append(quest.Characters, name)
+	}
+
+	roles := make(map[string]int)
+	for i, role := range f.Roles {
+		path := fmt.Sprintf("roles.%d", i)
+		if role.Name == "" || roles[role.Name] != 0 {
+			fail(path+".name", "role name %q is empty or repeated", role.Name)
+		}
+		if role.Character != "" && !characters[role.Character] {
+			fail(path+".character", "role %q: unknown character %q", role.Name, role.Character)
+		}
+		if roles[role.Name] == 0 {
+			roles[role.Name] = i + 1
+		}
+		quest.Roles = append(quest.Roles, storage.Role{Position: i + 1, Name: role.Name, Character: role.Character})
+	}
+
+	// Номера шагов по ID, чтобы переходы можно было проверить до разбора шагов
+	numbers := make(map[string]int)
+	for i, step := range f.Steps {
+		path := fmt.Sprintf("steps.%d.id", i)
+		switch {
+		case step.ID == "":
+			fail(path, "step %d has no id", i+1)
+		case numbers[step.ID] != 0:
+			fail(path, "step id %q is used twice", step.ID)
+		default:
+			numbers[step.ID] = i + 1
+		}
+	}
+	next := func(id string) (int, error) {
+		if id == "" {
+			return storage.NextStepEnd, nil
+		}
+		n, ok := numbers[id]
+		if !ok {
+			return 0, fmt.Errorf("unknown next step %q", id)
+		}
+		return n, nil
+	}
+
+	for i, step := range f.Steps {
+		path := fmt.Sprintf("steps.%d", i)
+		s := storage.Step{Type: step.Type}
+		var err error
+		if s.NextStep, err = next(step.Next); err != nil {
+			fail(path+".next", "step %q: %v", step.ID, err)
+		}
+
+		switch step.Type {
+		case storage.StepNarration:
+			if strict && strings.TrimSpace(step.Text) == "" {
+				fail(path+".text", "step %q: text is required", step.ID)
+			}
+			s.Text = step.Text
+
+		case storage.StepPlayerAction:
+			if strict && len(step.Choices) == 0 {
+				fail(path+".choices", "step %q: add at least one choice", step.ID)
+			}
+			if timeout := step.VoteTimeoutSeconds; timeout != nil && *timeout < 0 {
+				fail(path+".vote_timeout_seconds", "step %q: invalid vote_timeout_seconds", step.ID)
+			} else if timeout != nil && *timeout > 0 {
+				// 0 - как и без поля, действует таймаут сервера
+				s.VoteTimeoutSeconds = timeout
+			}
+			s.AudiencePoll = step.AudiencePoll
+			for j, c := range step.Choices {
+				choicePath := fmt.Sprintf("%s.choices.%d", path, j)
+				if strict && strings.TrimSpace(c.Text) == "" {
+					fail(choicePath+".text", "step %q: choice %d has no text", step.ID, j+1)
+				}
+				playerIndex := c.Player
+				if c.Role != "" {
+					if playerIndex = roles[c.Role]; playerIndex == 0 {
+						fail(choicePath+".role", "step %q: unknown role %q", step.ID, c.Role)
+					}
+				}
+				choiceNext := 0
+				if c.Next != "" {
+					if choiceNext, err = next(c.Next); err != nil {
+						fail(choicePath+".next", "step %q: choice %q: %v", step.ID, c.Text, err)
+					}
+				}
+				s.Choices = append(s.Choices, storage.Choice{
+					Text:        c.Text,
+					Points:      c.Points.toStorage(),
+					PlayerIndex: playerIndex,
+					IsDefault:   c.Default,
+					NextStep:    choiceNext,
+				})
+			}
+
+		case storage.StepCharacterAction:
+			if !characters[step.Character] {
+				fail(path+".character", "step %q: unknown character %q", step.ID, step.Character)
+			}
+			if strict && len(step.Lines) == 0 {
+				fail(path+".lines", "step %q: add at least one line", step.ID)
+			}
+			s.Character = step.Character
+			for j, line := range step.Lines {
+				linePath := fmt.Sprintf("%s.lines.%d", path, j)
+				if strict && strings.TrimSpace(line.Text) == "" {
+					fail(linePath+".text", "step %q: line %d has no text", step.ID, j+1)
+				}
+				// У реплики, как и у варианта выбора, пустой next означает переход самого шага, а не конец квеста
+				lineNext := 0
+				if line.Next != "" {
+					if lineNext, err = next(line.Next); err != nil {
+						fail(linePath+".next", "step %q: line %q: %v", step.ID, line.Text, err)
+					}
+				}
+				s.Lines = append(s.Lines, storage.CharacterLine{
+					Text:      line.Text,
+					Condition: line.Condition.toStorage(),
+					Priority:  line.Priority,
+					NextStep:  lineNext,
+				})
+			}
+
+		default:
+			fail(path+".type", "step %q: unknown step type %q", step.ID, step.Type)
+		}
+
+		quest.Steps = append(quest.Steps, s)
+	}
+
+	return quest, errs
+}
+
+// ID шага в файле по его номеру в квесте
+func stepID(number int) string {
+	return "step-" + strconv.Itoa(number)
+}
+
+// Записывает новый квест в формате файла. ID шагов строятся по их номерам;
+// так обновляются квесты в формате запроса /make_quest
+func FromQuest(quest storage.NewQuest) *File {
+	f := newFile(quest.Title, quest.MaxPlayers, quest.Roles)
+	f.Characters = quest.Characters
+
+	for i, s := range quest.Steps {
+		step := fileStep(s, stepID(i+1), f.Roles)
+		if next := quest.NextStepNumber(i); next != 0 {
+			step.Next = stepID(next)
+		}
+		// Неверный номер, как и при сохранении квеста, означает переход шага
+		for j, c := range s.Choices {
+			if c.NextStep > 0 && c.NextStep <= len(quest.Steps) {
+				step.Choices[j].Next = stepID(c.NextStep)
+			}
+		}
+		for j, line := range s.Lines {
+			if line.NextStep > 0 && line.NextStep <= len(quest.Steps) {
+				step.Lines[j].Next = stepID(line.NextStep)
+			}
+		}
+		f.Steps = append(f.Steps, step)
+	}
+	return f
+}
+
+// Выгружает сохраненный квест. Шаги собираются обходом переходов от начального,
+// поэтому недостижимые шаги в файл не попадают; объявленные персонажи выгружаются все
+func Export(quests storage.QuestStore, questID int) (*File, error) {
+	quest, err := quests.Get(questID)
+	if err != nil {
+		return nil, err
+	}
+	characters, err := quests.Characters(questID)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := quests.Roles(questID)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make(map[int]*storage.Step)
+	queue := []int{quest.InitialStep}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == 0 || steps[id] != nil {
+			continue
+		}
+		step, err := quests.Step(id)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", id, err)
+		}
+		steps[id] = step
+		queue = append(queue, step.NextStep)
+		for _, c := range step.Choices {
+			queue = append(queue, c.NextStep)
+		}
+		for _, line := range step.Lines {
+			queue = append(queue, line.NextStep)
+		}
+	}
+
+	ordered := make([]storage.Step, 0, len(steps))
+	for _, step := range steps {
+		ordered = append(ordered, *step)
+	}
+	return build(quest, characters, roles, ordered), nil
+}
+
+// Выгружает сохраненный квест со всеми шагами, в том числе недостижимыми: так квест
+// открывает редактор, чтобы не потерять шаги, к которым автор еще не провел переходы
+func Load(quests storage.QuestStore, questID int) (*File, error) {
+	quest, err := quests.Get(questID)
+	if err != nil {
+		return nil, err
+	}
+	characters, err := quests.Characters(questID)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := quests.Roles(questID)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := quests.Steps(questID)
+	if err != nil {
+		return nil, err
+	}
+	return build(quest, characters, roles, steps), nil
+}
+
+// Шаги идут в порядке номеров, но начальный шаг всегда первый. Переходы к шагам,
+// которых нет среди steps, записываются концом квеста. Персонажи - объявленные в квесте
+// и затем те, что встречаются в ролях и шагах, но не объявлены
+func build(quest *storage.Quest, declared []string, roles []storage.Role, steps []storage.Step) *File {
+	sort.SliceStable(steps, func(i, j int) bool {
+		if (steps[i].ID == quest.InitialStep) != (steps[j].ID == quest.InitialStep) {
+			return steps[i].ID == quest.InitialStep
+		}
+		return steps[i].Number < steps[j].Number
+	})
+	ids := make(map[int]string)
+	for _, step := range steps {
+		ids[step.ID] = stepID(step.Number)
+	}
+
+	f := newFile(quest.Title, quest.MaxPlayers, roles)
+	characters := make(map[string]bool)
+	addCharacter := func(name string) {
+		if name != "" && !characters[name] {
+			characters[name] = true
+			f.Characters = append(f.Characters, name)
+		}
+	}
+	for _, name := range declared {
+		addCharacter(name)
+	}
+	for _, role := range roles {
+		addCharacter(role.Character)
+	}
+
+	for _, s := range steps {
+		addCharacter(s.Character)
+		step := fileStep(s, ids[s.ID], f.Roles)
+		step.Next = ids[s.NextStep]
+		for j, c := range s.Choices {
+			step.Choices[j].Next = ids[c.NextStep]
+		}
+		for j, line := range s.Lines {
+			step.Lines[j].Next = ids[line.NextStep]
+		}
+		f.Steps = append(f.Steps, step)
+	}
+	return f
+}
+
+func newFile(title string, maxPlayers int, roles []storage.Role) *File {
+	f := &File{Format: Format, Version: Version, Title: title, MaxPlayers: maxPlayers, Steps: []Step{}}
+	for _, role := range roles {
+		f.Roles = append(f.Roles, Role{Name: role.Name, Character: role.Character})
+	}
+	return f
+}
+
+// Содержимое шага без переходов: их вызывающий заполняет сам
+func fileStep(s storage.Step, id string, roles []Role) Step {
+	step := Step{
+		ID:                 id,
+		Type:               s.Type,
+		Text:               s.Text,
+		VoteTimeoutSeconds: s.VoteTimeoutSeconds,
+		AudiencePoll:       s.AudiencePoll,
+		Character:          s.Character,
+	}
+	for _, c := range s.Choices {
+		choice := Choice{Text: c.Text, Points: fromStorage(c.Points), Default: c.IsDefault}
+		// Номер игрока записываем именем роли, если такая роль есть
+		if c.PlayerIndex > 0 && c.PlayerIndex <= len(roles) {
+			choice.Role = roles[c.PlayerIndex-1].Name
+		} else {
+			choice.Player = c.PlayerIndex
+		}
+		step.Choices = append(step.Choices, choice)
+	}
+	for _, line := range s.Lines {
+		step.Lines = append(step.Lines, Line{Text: line.Text, Condition: fromStorage(line.Condition), Priority: line.Priority})
+	}
+	return step
+}
@@ -0,0 +1,198 @@
+package questfile_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"quest_maker/questfile"
+	"quest_maker/storage"
+	"quest_maker/storage/memory"
+)
+
+// Квест с ролями, развилкой по реплике и досрочным концом:
+// 1 рассказ -> 2 выбор -> 3 реплика стражника -> 4 рассказ, конец;
+// выбор "Уйти" ведет сразу на 4, реплика "Стой!" уводит на 5, откуда квест заканчивается
+func testQuest() storage.NewQuest {
+	timeout := 30
+	return storage.NewQuest{
+		Title:      "Приключения Каджита",
+		MaxPlayers: 2,
+		Characters: []string{"Каджит", "Стражник"},
+		Roles:      []storage.Role{{Position: 1, Name: "Вор", Character: "Каджит"}, {Position: 2, Name: "Маг"}},
+		Steps: []storage.Step{
+			{Type: storage.StepNarration, Text: "Каджит вышел из кустов."},
+			{Type: storage.StepPlayerAction, VoteTimeoutSeconds: &timeout, AudiencePoll: true, Choices: []storage.Choice{
+				{Text: "Напасть", Points: storage.Points{Violence: 2}, PlayerIndex: 1},
+				{Text: "Уйти", Points: storage.Points{Pacifism: 1}, IsDefault: true, NextStep: 4},
+			}},
+			{Type: storage.StepCharacterAction, Character: "Стражник", Lines: []storage.CharacterLine{
+				{Text: "Стой!", Condition: storage.Points{Violence: 2}, Priority: 1, NextStep: 5},
+				{Text: "Проходи."},
+			}},
+			{Type: storage.StepNarration, Text: "Конец.", NextStep: storage.NextStepEnd},
+			{Type: storage.StepNarration, Text: "Каджита поймали."},
+		},
+	}
+}
+
+func TestFromQuest(t *testing.T) {
+	file := questfile.FromQuest(testQuest())
+	if file.Format != questfile.Format || file.Version != questfile.Version || len(file.Steps) != 5 {
+		t.Fatalf("Unexpected file %+v", file)
+	}
+
+	var next []string
+	for _, step := range file.Steps {
+		next = append(next, step.ID+"->"+step.Next)
+	}
+	if got := strings.Join(next, " "); got != "step-1->step-2 step-2->step-3 step-3->step-4 step-4-> step-5->" {
+		t.Errorf("Unexpected step links %s", got)
+	}
+	if line := file.Steps[2].Lines[0]; line.Next != "step-5" || line.Condition.Violence != 2 {
+		t.Errorf("Unexpected line %+v", line)
+	}
+	if choice := file.Steps[1].Choices[0]; choice.Role != "Вор" || choice.Player != 0 || choice.Next != "" {
+		t.Errorf("Expected the choice to name its role, got %+v", choice)
+	}
+	if choice := file.Steps[1].Choices[1]; choice.Next != "step-4" {
+		t.Errorf("Expected the choice to lead to step-4, got %+v", choice)
+	}
+
+	// Файл переводится обратно в тот же квест, только последний шаг явно завершает квест
+	quest, err := file.Quest()
+	if err != nil {
+		t.Fatalf("Quest failed: %v", err)
+	}
+	want := testQuest()
+	want.Steps[0].NextStep, want.Steps[1].NextStep, want.Steps[2].NextStep = 2, 3, 4
+	want.Steps[4].NextStep = storage.NextStepEnd
+	if !reflect.DeepEqual(quest, want) {
+		t.Errorf("Expected %+v, got %+v", want, quest)
+	}
+}
+
+func TestQuestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(f *questfile.File)
+		want string
+	}{
+		{"no steps", func(f *questfile.File) { f.Steps = nil }, "quest has no steps"},
+		{"missing id", func(f *questfile.File) { f.Steps[1].ID = "" }, "step 2 has no id"},
+		{"repeated id", func(f *questfile.File) { f.Steps[1].ID = "step-1" }, `step id "step-1" is used twice`},
+		{"unknown next", func(f *questfile.File) { f.Steps[0].Next = "gate" }, `step "step-1": unknown next step "gate"`},
+		{"unknown line next", func(f *questfile.File) { f.Steps[2].Lines[1].Next = "gate" }, `line "Проходи.": unknown next step "gate"`},
+		{"unknown choice next", func(f *questfile.File) { f.Steps[1].Choices[1].Next = "gate" }, `choice "Уйти": unknown next step "gate"`},
+		{"unknown role", func(f *questfile.File) { f.Steps[1].Choices[0].Role = "Жрец" }, `unknown role "Жрец"`},
+		{"unknown character", func(f *questfile.File) { f.Steps[2].Character = "Дракон" }, `unknown character "Дракон"`},
+		{"role of an unknown character", func(f *questfile.File) { f.Roles[1].Character = "Дракон" }, `role "Маг": unknown character`},
+		{"unknown type", func(f *questfile.File) { f.Steps[3].Type = "cutscene" }, `unknown step type "cutscene"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := questfile.FromQuest(testQuest())
+			tt.edit(file)
+			if _, err := file.Quest(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"current version", `{"format": "quest_maker", "version": 1, "steps": []}`, ""},
+		{"newer version", `{"format": "quest_maker", "version": 2}`, "unsupported version 2"},
+		{"request format", `{"title": "Квест", "steps": []}`, "not a quest_maker quest file"},
+		{"invalid JSON", `{`, "invalid JSON"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := questfile.Parse([]byte(tt.data))
+			if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("Expected error %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	if !questfile.IsQuestFile([]byte(`{"format": "other"}`)) || questfile.IsQuestFile([]byte(`{"title": "Квест"}`)) {
+		t.Errorf("Expected only data with a format field to be a quest file")
+	}
+}
+
+func TestExport(t *testing.T) {
+	store := memory.New()
+	quest := testQuest()
+	// Недостижимый шаг в файл не попадает, а персонаж, которого нет ни в одном шаге, попадает
+	quest.Steps[4].NextStep = storage.NextStepEnd
+	quest.Steps = append(quest.Steps, storage.Step{Type: storage.StepNarration, Text: "Забытая сцена."})
+	quest.Characters = append(quest.Characters, "Летописец")
+	questID, err := store.Quests().Create(quest)
+	if err != nil {
+		t.Fatalf("Failed to create quest: %v", err)
+	}
+
+	file, err := questfile.Export(store.Quests(), questID)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	want := questfile.FromQuest(testQuest())
+	want.Characters = append(want.Characters, "Летописец")
+	if !reflect.DeepEqual(file, want) {
+		t.Errorf("Expected %+v, got %+v", want, file)
+	}
+
+	if _, err := questfile.Export(store.Quests(), questID+100); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Редактор получает и недостижимый шаг
+	file, err = questfile.Load(store.Quests(), questID)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(file.Steps) != 6 || file.Steps[5].ID != "step-6" || file.Steps[5].Text != "Забытая сцена." {
+		t.Errorf("Expected the unreachable step to be loaded, got %+v", file.Steps)
+	}
+	if !reflect.DeepEqual(file.Steps[:5], want.Steps) {
+		t.Errorf("Expected steps %+v, got %+v", want.Steps, file.Steps[:5])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if errs := questfile.FromQuest(testQuest()).Validate(); errs != nil {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+
+	// Validate собирает все ошибки сразу и указывает путь к каждому полю
+	file := questfile.FromQuest(testQuest())
+	file.Title = " "
+	file.MaxPlayers = 3
+	file.Steps[0].Text = ""
+	file.Steps[1].Choices[1].Next = "gate"
+	file.Steps[1].Choices[0].Text = ""
+	file.Steps[2].Lines = nil
+	wantPaths := []string{"title", "max_players", "steps.0.text", "steps.1.choices.0.text", "steps.1.choices.1.next", "steps.2.lines"}
+
+	errs := file.Validate()
+	var paths []string
+	for _, err := range errs {
+		paths = append(paths, err.Path)
+	}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("Expected errors at %v, got %v", wantPaths, errs)
+	}
+
+	// Quest не требует полноты и возвращает только ошибки переходов
+	_, err := file.Quest()
+	if errs, ok := err.(questfile.Errors); !ok || len(errs) != 1 || errs[0].Path != "steps.1.choices.1.next" {
+		t.Errorf("Expected a single next step error, got %v", err)
+	}
+}
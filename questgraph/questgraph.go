@@ -0,0 +1,215 @@
+// Пакет questgraph строит граф переходов квеста: шаги - узлы, переходы шагов, вариантов выбора
+// и реплик персонажей - ребра. Граф выводится в JSON, Graphviz DOT или Mermaid.
+// Узлы, до которых нельзя дойти от начального шага ни по одному ребру, помечаются недостижимыми
+package questgraph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"quest_maker/engine"
+	"quest_maker/storage"
+)
+
+// Типы ребер
+const (
+	EdgeNext   = "next"   // Переход шага рассказа
+	EdgeChoice = "choice" // Вариант выбора игроков
+	EdgeLine   = "line"   // Реплика персонажа
+)
+
+type Graph struct {
+	Title string `json:"title"`
+	Start int    `json:"start"` // Номер начального шага
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+// Узел - шаг квеста; ID - номер шага, начиная с 1
+type Node struct {
+	ID        int    `json:"id"`
+	Type      string `json:"type"`
+	Text      string `json:"text,omitempty"`      // Текст рассказа
+	Character string `json:"character,omitempty"` // Персонаж character_action шага
+	Reachable bool   `json:"reachable"`
+}
+
+// Ребро ведет к шагу To; To = 0 - квест заканчивается
+type Edge struct {
+	From      int    `json:"from"`
+	To        int    `json:"to"`
+	Kind      string `json:"kind"`
+	Text      string `json:"text,omitempty"`      // Текст варианта или реплики
+	Condition string `json:"condition,omitempty"` // Кому доступен вариант или при каких очках выбирается реплика
+	Points    string `json:"points,omitempty"`    // Очки за выбор варианта
+}
+
+// Граф сохраненного квеста со всеми его шагами
+func Load(quests storage.QuestStore, questID int) (*Graph, error) {
+	quest, err := quests.Get(questID)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := quests.Roles(questID)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := quests.Steps(questID)
+	if err != nil {
+		return nil, err
+	}
+	return Build(quest.Title, steps, quest.InitialStep, roles), nil
+}
+
+// Граф нового, еще не сохраненного квеста
+func FromQuest(quest storage.NewQuest) *Graph {
+	saved := engine.FromQuest(quest)
+	steps := make([]storage.Step, 0, len(saved))
+	for _, step := range saved {
+		steps = append(steps, *step)
+	}
+	// Как и при сохранении, роли нумеруются по порядку
+	roles := make([]storage.Role, len(quest.Roles))
+	for i, role := range quest.Roles {
+		role.Position = i + 1
+		roles[i] = role
+	}
+	return Build(quest.Title, steps, 1, roles)
+}
+
+// Строит граф по сохраненным шагам: NextStep в них - ID шагов. Узлы идут по номерам шагов
+func Build(title string, steps []storage.Step, start int, roles []storage.Role) *Graph {
+	sort.Slice(steps, func(i, j int) bool { return steps[i].Number < steps[j].Number })
+	numbers := make(map[int]int)
+	for _, step := range steps {
+		numbers[step.ID] = step.Number
+	}
+	roleNames := make(map[int]string)
+	for _, role := range roles {
+		roleNames[role.Position] = role.Name
+	}
+
+	g := &Graph{Title: title, Start: numbers[start], Nodes: []Node{}, Edges: []Edge{}}
+	for _, step := range steps {
+		node := Node{ID: step.Number, Type: step.Type, Text: step.Text, Character: step.Character}
+		g.Nodes = append(g.Nodes, node)
+
+		// Вариант или реплика без своего перехода ведут туда же, куда и шаг
+		to := func(next int) int {
+			if next == 0 {
+				next = step.NextStep
+			}
+			return numbers[next]
+		}
+		switch step.Type {
+		case storage.StepPlayerAction:
+			for _, c := range step.Choices {
+				g.Edges = append(g.Edges, Edge{
+					From:      step.Number,
+					To:        to(c.NextStep),
+					Kind:      EdgeChoice,
+					Text:      c.Text,
+					Condition: choiceCondition(c, roleNames),
+					Points:    formatPoints(c.Points, true),
+				})
+			}
+		case storage.StepCharacterAction:
+			for _, line := range step.Lines {
+				g.Edges = append(g.Edges, Edge{
+					From:      step.Number,
+					To:        to(line.NextStep),
+					Kind:      EdgeLine,
+					Text:      line.Text,
+					Condition: lineCondition(line),
+				})
+			}
+		}
+		// Шаг без вариантов и реплик переходит дальше сам
+		if len(step.Choices) == 0 && len(step.Lines) == 0 {
+			g.Edges = append(g.Edges, Edge{From: step.Number, To: to(0), Kind: EdgeNext})
+		}
+	}
+
+	g.markReachable()
+	return g
+}
+
+func (g *Graph) markReachable() {
+	index := make(map[int]int)
+	for i, node := range g.Nodes {
+		index[node.ID] = i
+	}
+	next := make(map[int][]int)
+	for _, edge := range g.Edges {
+		next[edge.From] = append(next[edge.From], edge.To)
+	}
+
+	queue := []int{g.Start}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		i, ok := index[id]
+		if !ok || g.Nodes[i].Reachable {
+			continue
+		}
+		g.Nodes[i].Reachable = true
+		queue = append(queue, next[id]...)
+	}
+}
+
+// Узлы, до которых нельзя дойти от начального шага
+func (g *Graph) Unreachable() []int {
+	var ids []int
+	for _, node := range g.Nodes {
+		if !node.Reachable {
+			ids = append(ids, node.ID)
+		}
+	}
+	return ids
+}
+
+func choiceCondition(c storage.Choice, roles map[int]string) string {
+	var parts []string
+	switch {
+	case c.PlayerIndex != 0 && roles[c.PlayerIndex] != "":
+		parts = append(parts, roles[c.PlayerIndex])
+	case c.PlayerIndex != 0:
+		parts = append(parts, fmt.Sprintf("player %d", c.PlayerIndex))
+	}
+	if c.IsDefault {
+		parts = append(parts, "default")
+	}
+	return strings.Join(parts, ", ")
+}
+
+func lineCondition(line storage.CharacterLine) string {
+	var parts []string
+	if points := formatPoints(line.Condition, false); points != "" {
+		parts = append(parts, points)
+	}
+	if line.Priority != 0 {
+		parts = append(parts, fmt.Sprintf("priority %d", line.Priority))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// "+violence 2, -pacifism 1" для очков за выбор, "violence 2" для условия реплики
+func formatPoints(p storage.Points, signed bool) string {
+	var parts []string
+	for _, point := range []struct {
+		name  string
+		value int
+	}{{"violence", p.Violence}, {"whatever", p.Whatever}, {"pacifism", p.Pacifism}} {
+		switch {
+		case point.value == 0:
+		case signed && point.value < 0:
+			parts = append(parts, fmt.Sprintf("-%s %d", point.name, -point.value))
+		case signed:
+			parts = append(parts, fmt.Sprintf("+%s %d", point.name, point.value))
+		default:
+			parts = append(parts, fmt.Sprintf("%s %d", point.name, point.value))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
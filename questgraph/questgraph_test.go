@@ -0,0 +1,116 @@
+package questgraph_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"quest_maker/questgraph"
+	"quest_maker/storage"
+)
+
+// Третий шаг недостижим: первый вариант ведет на четвертый, а выбор завершает квест
+var quest = storage.NewQuest{
+	Title:      "Развилка",
+	MaxPlayers: 2,
+	Characters: []string{"Стражник"},
+	Roles:      []storage.Role{{Name: "Вор"}},
+	Steps: []storage.Step{
+		{Type: storage.StepNarration, Text: "Каджит у ворот.\nСтемнело."},
+		{Type: storage.StepPlayerAction, NextStep: storage.NextStepEnd, Choices: []storage.Choice{
+			{Text: "Напасть", Points: storage.Points{Violence: 2, Pacifism: -1}, PlayerIndex: 1, NextStep: 4},
+			{Text: "Уйти", IsDefault: true},
+		}},
+		{Type: storage.StepNarration, Text: "Забытая сцена."},
+		{Type: storage.StepCharacterAction, Character: "Стражник", Lines: []storage.CharacterLine{
+			{Text: "Стой!", Condition: storage.Points{Violence: 2}, Priority: 1, NextStep: 1},
+			{Text: "Проходи."},
+		}},
+	},
+}
+
+func TestFromQuest(t *testing.T) {
+	graph := questgraph.FromQuest(quest)
+
+	wantNodes := []questgraph.Node{
+		{ID: 1, Type: storage.StepNarration, Text: "Каджит у ворот.\nСтемнело.", Reachable: true},
+		{ID: 2, Type: storage.StepPlayerAction, Reachable: true},
+		{ID: 3, Type: storage.StepNarration, Text: "Забытая сцена."},
+		{ID: 4, Type: storage.StepCharacterAction, Character: "Стражник", Reachable: true},
+	}
+	if !reflect.DeepEqual(graph.Nodes, wantNodes) {
+		t.Errorf("Expected nodes %+v, got %+v", wantNodes, graph.Nodes)
+	}
+
+	// Вариант без своего перехода и реплика без перехода ведут туда же, куда шаг
+	wantEdges := []questgraph.Edge{
+		{From: 1, To: 2, Kind: questgraph.EdgeNext},
+		{From: 2, To: 4, Kind: questgraph.EdgeChoice, Text: "Напасть", Condition: "Вор", Points: "+violence 2, -pacifism 1"},
+		{From: 2, To: 0, Kind: questgraph.EdgeChoice, Text: "Уйти", Condition: "default"},
+		{From: 3, To: 4, Kind: questgraph.EdgeNext},
+		{From: 4, To: 1, Kind: questgraph.EdgeLine, Text: "Стой!", Condition: "violence 2, priority 1"},
+		{From: 4, To: 0, Kind: questgraph.EdgeLine, Text: "Проходи."},
+	}
+	if !reflect.DeepEqual(graph.Edges, wantEdges) {
+		t.Errorf("Expected edges %+v, got %+v", wantEdges, graph.Edges)
+	}
+
+	if unreachable := graph.Unreachable(); !reflect.DeepEqual(unreachable, []int{3}) {
+		t.Errorf("Expected step 3 to be unreachable, got %v", unreachable)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	graph := questgraph.FromQuest(quest)
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{questgraph.FormatDOT, []string{
+			`label="Развилка";`,
+			`s1 [label="1. Каджит у ворот.…", shape=box, penwidth=2];`,
+			`s2 [label="2. choice", shape=diamond];`,
+			`s3 [label="3. Забытая сцена.", shape=box, style="filled,dashed"`,
+			`s4 [label="4. Стражник", shape=ellipse];`,
+			`s2 -> s4 [label="Напасть [Вор; +violence 2, -pacifism 1]"];`,
+			`s4 -> end [label="Проходи."];`,
+			`s1 -> s2;`,
+		}},
+		{questgraph.FormatMermaid, []string{
+			`title: "Развилка"`,
+			`s2{"2. choice"}`,
+			`s4(["4. Стражник"])`,
+			`s2 -->|"Уйти [default]"| end_`,
+			`s1 --> s2`,
+			`class s3 unreachable`,
+		}},
+		{questgraph.FormatJSON, []string{`"reachable": false`, `"kind": "line"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := graph.Write(&buf, tt.format); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("Expected output to contain %q, got:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	graph.Write(&buf, questgraph.FormatJSON)
+	var decoded questgraph.Graph
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || !reflect.DeepEqual(&decoded, graph) {
+		t.Errorf("Expected JSON to decode into the same graph, got %+v (%v)", decoded, err)
+	}
+
+	if err := graph.Write(&buf, "svg"); err != questgraph.ErrUnknownFormat {
+		t.Errorf("Expected ErrUnknownFormat, got %v", err)
+	}
+}
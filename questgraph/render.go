@@ -0,0 +1,181 @@
+package questgraph
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"quest_maker/storage"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatDOT     = "dot"
+	FormatMermaid = "mermaid"
+)
+
+var ErrUnknownFormat = errors.New("unknown graph format, expected dot, mermaid or json")
+
+// Длина текста в подписях DOT и Mermaid; полный текст есть в JSON
+const labelLength = 40
+
+// MIME-тип вывода в формате format
+func ContentType(format string) string {
+	switch format {
+	case FormatJSON:
+		return "application/json"
+	case FormatDOT:
+		return "text/vnd.graphviz; charset=utf-8"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+func (g *Graph) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(g)
+	case FormatDOT:
+		g.writeDOT(w)
+		return nil
+	case FormatMermaid:
+		g.writeMermaid(w)
+		return nil
+	default:
+		return ErrUnknownFormat
+	}
+}
+
+// Подпись узла: номер шага и его содержимое
+func nodeLabel(node Node) string {
+	switch node.Type {
+	case storage.StepNarration:
+		return fmt.Sprintf("%d. %s", node.ID, shorten(node.Text))
+	case storage.StepCharacterAction:
+		return fmt.Sprintf("%d. %s", node.ID, node.Character)
+	default:
+		return fmt.Sprintf("%d. choice", node.ID)
+	}
+}
+
+// Подпись ребра: текст варианта или реплики, затем условие и очки в скобках
+func edgeLabel(edge Edge) string {
+	label := shorten(edge.Text)
+	var details []string
+	for _, d := range []string{edge.Condition, edge.Points} {
+		if d != "" {
+			details = append(details, d)
+		}
+	}
+	if len(details) > 0 {
+		label += " [" + strings.Join(details, "; ") + "]"
+	}
+	return strings.TrimSpace(label)
+}
+
+// Первая строка текста, не длиннее labelLength символов
+func shorten(text string) string {
+	text, _, cut := strings.Cut(text, "\n")
+	runes := []rune(text)
+	if len(runes) > labelLength {
+		return string(runes[:labelLength-1]) + "…"
+	}
+	if cut {
+		return text + "…"
+	}
+	return text
+}
+
+func (g *Graph) hasEnd() bool {
+	for _, edge := range g.Edges {
+		if edge.To == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Graph) writeDOT(w io.Writer) {
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	shapes := map[string]string{
+		storage.StepNarration:       "box",
+		storage.StepPlayerAction:    "diamond",
+		storage.StepCharacterAction: "ellipse",
+	}
+
+	fmt.Fprintf(w, "digraph quest {\n")
+	fmt.Fprintf(w, "  label=%s;\n", quote(g.Title))
+	fmt.Fprintf(w, "  node [fontname=\"Helvetica\"];\n")
+	for _, node := range g.Nodes {
+		attrs := fmt.Sprintf("label=%s, shape=%s", quote(nodeLabel(node)), shapes[node.Type])
+		switch {
+		case !node.Reachable:
+			attrs += `, style="filled,dashed", fillcolor="#f8d7da", color="#c0392b"`
+		case node.ID == g.Start:
+			attrs += `, penwidth=2`
+		}
+		fmt.Fprintf(w, "  s%d [%s];\n", node.ID, attrs)
+	}
+	if g.hasEnd() {
+		fmt.Fprintf(w, "  end [label=\"end\", shape=doublecircle];\n")
+	}
+	for _, edge := range g.Edges {
+		to := "end"
+		if edge.To != 0 {
+			to = fmt.Sprintf("s%d", edge.To)
+		}
+		if label := edgeLabel(edge); label != "" {
+			fmt.Fprintf(w, "  s%d -> %s [label=%s];\n", edge.From, to, quote(label))
+		} else {
+			fmt.Fprintf(w, "  s%d -> %s;\n", edge.From, to)
+		}
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+func (g *Graph) writeMermaid(w io.Writer) {
+	// Кавычки в подписях Mermaid записываются сущностью
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, "#quot;") + `"`
+	}
+	shapes := map[string][2]string{
+		storage.StepNarration:       {"[", "]"},
+		storage.StepPlayerAction:    {"{", "}"},
+		storage.StepCharacterAction: {"([", "])"},
+	}
+
+	fmt.Fprintf(w, "---\ntitle: %q\n---\n", g.Title)
+	fmt.Fprintf(w, "flowchart TD\n")
+	var unreachable []string
+	for _, node := range g.Nodes {
+		shape := shapes[node.Type]
+		fmt.Fprintf(w, "  s%d%s%s%s\n", node.ID, shape[0], quote(nodeLabel(node)), shape[1])
+		if !node.Reachable {
+			unreachable = append(unreachable, fmt.Sprintf("s%d", node.ID))
+		}
+	}
+	if g.hasEnd() {
+		fmt.Fprintf(w, "  end_((\"end\"))\n")
+	}
+	for _, edge := range g.Edges {
+		to := "end_"
+		if edge.To != 0 {
+			to = fmt.Sprintf("s%d", edge.To)
+		}
+		if label := edgeLabel(edge); label != "" {
+			fmt.Fprintf(w, "  s%d -->|%s| %s\n", edge.From, quote(label), to)
+		} else {
+			fmt.Fprintf(w, "  s%d --> %s\n", edge.From, to)
+		}
+	}
+	if len(unreachable) > 0 {
+		fmt.Fprintf(w, "  classDef unreachable fill:#f8d7da,stroke:#c0392b,stroke-dasharray:5 5\n")
+		fmt.Fprintf(w, "  class %s unreachable\n", strings.Join(unreachable, ","))
+	}
+}
@@ -0,0 +1,518 @@
+// Пакет questscript - текстовый язык для написания квестов, похожий на Markdown и Ink.
+// Сценарий переводится в ту же модель storage.NewQuest, которую сохраняет /make_quest;
+// ошибки указывают номер строки. Описание языка - docs/quest_script.md
+package questscript
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"quest_maker/storage"
+)
+
+// Метка, которая завершает квест
+const End = "END"
+
+// Ошибка в строке сценария
+type Error struct {
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// Все ошибки сценария по порядку строк
+type Errors []*Error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Переход на метку, который разрешается после чтения всего сценария
+type divert struct {
+	label string
+	line  int
+	set   func(step int)
+}
+
+type scene struct {
+	label string
+	line  int
+	first int // Индекс первого шага сцены; -1, пока шагов нет
+}
+
+type parser struct {
+	quest  storage.NewQuest
+	errors Errors
+
+	characters  map[string]bool
+	roles       map[string]int
+	playersLine int // Строка "players:"; 0 - число игроков не задано
+
+	scenes  []*scene
+	labels  map[string]*scene
+	diverts []divert
+
+	// Открытый блок: шаг, в который дописываются строки, пока не встретится пустая строка
+	step     *storage.Step
+	diverted bool // Сцена закончилась переходом; до новой сцены шагов быть не должно
+
+	// Настройки "~" для следующего блока выборов
+	settings     *storage.Step
+	settingsLine int
+}
+
+// Читает сценарий квеста. При ошибках возвращает Errors со всеми найденными ошибками
+func Parse(source string) (storage.NewQuest, error) {
+	p := &parser{
+		characters: make(map[string]bool),
+		roles:      make(map[string]int),
+		labels:     make(map[string]*scene),
+	}
+	p.scenes = append(p.scenes, &scene{first: -1})
+
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		p.line(i+1, strings.TrimSpace(line))
+	}
+	p.closeBlock()
+	p.finish(len(lines))
+
+	if len(p.errors) > 0 {
+		return storage.NewQuest{}, p.errors
+	}
+	return p.quest, nil
+}
+
+func (p *parser) errorf(line int, format string, args ...interface{}) {
+	p.errors = append(p.errors, &Error{Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) line(n int, line string) {
+	switch {
+	case line == "":
+		p.closeBlock()
+
+	case strings.HasPrefix(line, "//"):
+		// Комментарий
+
+	case strings.HasPrefix(line, "=="):
+		p.closeBlock()
+		p.scene(n, line)
+
+	case strings.HasPrefix(line, "#"):
+		p.closeBlock()
+		if p.quest.Title != "" {
+			p.errorf(n, "title is already set")
+			return
+		}
+		p.quest.Title = strings.TrimSpace(strings.TrimLeft(line, "#"))
+
+	case strings.HasPrefix(line, "->"):
+		p.closeBlock()
+		p.sceneDivert(n, strings.TrimSpace(strings.TrimPrefix(line, "->")))
+
+	case strings.HasPrefix(line, "~"):
+		p.setting(n, strings.TrimSpace(strings.TrimPrefix(line, "~")))
+
+	case strings.HasPrefix(line, "*"):
+		p.choice(n, strings.TrimSpace(strings.TrimPrefix(line, "*")))
+
+	case strings.HasPrefix(line, "@"):
+		p.characterLine(n, strings.TrimPrefix(line, "@"))
+
+	default:
+		if p.header(n, line) {
+			return
+		}
+		p.narration(n, strings.TrimPrefix(line, `\`))
+	}
+}
+
+// Настройки квеста "ключ: значение" до первого шага
+func (p *parser) header(n int, line string) bool {
+	key, value, ok := strings.Cut(line, ":")
+	if !ok || len(p.quest.Steps) > 0 || p.step != nil {
+		return false
+	}
+	value = strings.TrimSpace(value)
+
+	switch strings.TrimSpace(key) {
+	case "players":
+		players, err := strconv.Atoi(value)
+		if err != nil || players < 1 {
+			p.errorf(n, "players must be a positive number, got %q", value)
+			return true
+		}
+		p.quest.MaxPlayers = players
+		p.playersLine = n
+
+	case "character":
+		if value == "" || p.characters[value] {
+			p.errorf(n, "character name %q is empty or repeated", value)
+			return true
+		}
+		p.addCharacter(value)
+
+	case "role":
+		// Роль и, в скобках, персонаж, которого она играет: "role: Вор (Каджит)"
+		name, character := value, ""
+		if open := strings.LastIndex(value, "("); open > 0 && strings.HasSuffix(value, ")") {
+			name = strings.TrimSpace(value[:open])
+			character = strings.TrimSpace(value[open+1 : len(value)-1])
+		}
+		if name == "" || p.roles[name] != 0 {
+			p.errorf(n, "role name %q is empty or repeated", name)
+			return true
+		}
+		if character != "" {
+			p.addCharacter(character)
+		}
+		p.roles[name] = len(p.quest.Roles) + 1
+		p.quest.Roles = append(p.quest.Roles, storage.Role{Position: len(p.quest.Roles) + 1, Name: name, Character: character})
+
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *parser) addCharacter(name string) {
+	if !p.characters[name] {
+		p.characters[name] = true
+		p.quest.Characters = append(p.quest.Characters, name)
+	}
+}
+
+func (p *parser) scene(n int, line string) {
+	label := strings.TrimSpace(strings.Trim(line, "="))
+	switch {
+	case label == "" || strings.ContainsAny(label, " \t"):
+		p.errorf(n, "scene label must be a single word, got %q", label)
+		return
+	case label == End:
+		p.errorf(n, "%s is reserved for the end of the quest", End)
+		return
+	case p.labels[label] != nil:
+		p.errorf(n, "scene %q is already defined on line %d", label, p.labels[label].line)
+		return
+	}
+
+	s := &scene{label: label, line: n, first: -1}
+	p.scenes = append(p.scenes, s)
+	p.labels[label] = s
+	p.diverted = false
+}
+
+func (p *parser) current() *scene {
+	return p.scenes[len(p.scenes)-1]
+}
+
+// Добавляет шаг в текущую сцену и делает его открытым блоком
+func (p *parser) open(n int, step storage.Step) bool {
+	if p.diverted {
+		p.errorf(n, "text after a divert; start a new scene with == label ==")
+		return false
+	}
+	if scene := p.current(); scene.first < 0 {
+		scene.first = len(p.quest.Steps)
+	}
+	p.quest.Steps = append(p.quest.Steps, step)
+	p.step = &p.quest.Steps[len(p.quest.Steps)-1]
+	return true
+}
+
+func (p *parser) closeBlock() {
+	p.step = nil
+	if p.settings != nil {
+		p.errorf(p.settingsLine, "settings must be followed by choices")
+		p.settings = nil
+	}
+}
+
+// Индекс последнего шага. Срез шагов растет, поэтому переходы запоминают индекс, а не указатель
+func (p *parser) last() int {
+	return len(p.quest.Steps) - 1
+}
+
+func (p *parser) narration(n int, text string) {
+	if p.step != nil && p.step.Type == storage.StepNarration {
+		p.step.Text += "\n" + text
+		return
+	}
+	p.closeBlock()
+	p.open(n, storage.Step{Type: storage.StepNarration, Text: text})
+}
+
+// Настройки блока выборов: "~ timeout 60" и "~ audience"
+func (p *parser) setting(n int, line string) {
+	if p.settings == nil && (p.step == nil || p.step.Type != storage.StepPlayerAction) {
+		p.closeBlock()
+		p.settings = &storage.Step{}
+		p.settingsLine = n
+	}
+	target := p.settings
+	if target == nil {
+		target = p.step
+	}
+
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 2 && fields[0] == "timeout":
+		seconds, err := strconv.Atoi(fields[1])
+		if err != nil || seconds < 1 {
+			p.errorf(n, "timeout must be a positive number of seconds, got %q", fields[1])
+			return
+		}
+		target.VoteTimeoutSeconds = &seconds
+	case len(fields) == 1 && fields[0] == "audience":
+		target.AudiencePoll = true
+	default:
+		p.errorf(n, "unknown setting %q, expected \"timeout N\" or \"audience\"", line)
+	}
+}
+
+// Вариант выбора: "* Текст [+violence 2] (Вор, default) -> метка"
+func (p *parser) choice(n int, line string) {
+	if p.step == nil || p.step.Type != storage.StepPlayerAction {
+		settings := p.settings
+		p.settings = nil
+		p.closeBlock()
+
+		step := storage.Step{Type: storage.StepPlayerAction}
+		if settings != nil {
+			step.VoteTimeoutSeconds = settings.VoteTimeoutSeconds
+			step.AudiencePoll = settings.AudiencePoll
+		}
+		if !p.open(n, step) {
+			return
+		}
+	}
+
+	text, label, options, points, ok := p.splitLine(n, line, true)
+	if !ok {
+		return
+	}
+	choice := storage.Choice{Text: text, Points: points}
+	for _, option := range options {
+		switch fields := strings.Fields(option); {
+		case option == "default":
+			choice.IsDefault = true
+		case len(fields) == 2 && fields[0] == "player":
+			player, err := strconv.Atoi(fields[1])
+			if err != nil || player < 1 {
+				p.errorf(n, "player must be a positive number, got %q", fields[1])
+				return
+			}
+			choice.PlayerIndex = player
+		default:
+			if p.roles[option] == 0 {
+				p.errorf(n, "unknown role %q", option)
+				return
+			}
+			choice.PlayerIndex = p.roles[option]
+		}
+	}
+
+	p.step.Choices = append(p.step.Choices, choice)
+	if label != "" {
+		step, index := p.last(), len(p.step.Choices)-1
+		p.addDivert(n, label, false, func(next int) { p.quest.Steps[step].Choices[index].NextStep = next })
+	}
+}
+
+// Реплика персонажа: "@Имя: Текст [violence 3] (priority 1) -> метка".
+// Подряд идущие реплики одного персонажа - один шаг, реплика выбирается по очкам прохождения
+func (p *parser) characterLine(n int, line string) {
+	name, rest, ok := strings.Cut(line, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		p.errorf(n, "character line must look like \"@Name: text\"")
+		return
+	}
+
+	if p.step == nil || p.step.Type != storage.StepCharacterAction || p.step.Character != name {
+		p.closeBlock()
+		p.addCharacter(name)
+		if !p.open(n, storage.Step{Type: storage.StepCharacterAction, Character: name}) {
+			return
+		}
+	}
+
+	text, label, options, condition, ok := p.splitLine(n, strings.TrimSpace(rest), false)
+	if !ok {
+		return
+	}
+	characterLine := storage.CharacterLine{Text: text, Condition: condition}
+	for _, option := range options {
+		fields := strings.Fields(option)
+		if len(fields) != 2 || fields[0] != "priority" {
+			p.errorf(n, "unknown line option %q, expected \"priority N\"", option)
+			return
+		}
+		priority, err := strconv.Atoi(fields[1])
+		if err != nil {
+			p.errorf(n, "priority must be a number, got %q", fields[1])
+			return
+		}
+		characterLine.Priority = priority
+	}
+
+	p.step.Lines = append(p.step.Lines, characterLine)
+	if label != "" {
+		step, index := p.last(), len(p.step.Lines)-1
+		p.addDivert(n, label, false, func(next int) { p.quest.Steps[step].Lines[index].NextStep = next })
+	}
+}
+
+// Переход всей сцены: последний шаг ведет на метку, а не на следующую сцену
+func (p *parser) sceneDivert(n int, label string) {
+	if p.current().first < 0 {
+		p.errorf(n, "divert before any step of the scene")
+		return
+	}
+	if p.diverted {
+		p.errorf(n, "scene already ends with a divert")
+		return
+	}
+	step := p.last()
+	p.addDivert(n, label, true, func(next int) { p.quest.Steps[step].NextStep = next })
+	p.diverted = true
+}
+
+func (p *parser) addDivert(n int, label string, allowEnd bool, set func(step int)) {
+	if label == End && !allowEnd {
+		p.errorf(n, "-> %s is only allowed on its own line; a choice or a line without a divert follows its step", End)
+		return
+	}
+	p.diverts = append(p.diverts, divert{label: label, line: n, set: set})
+}
+
+// Разбирает строку варианта или реплики с конца: "-> метка", затем "(опции)", затем "[очки]".
+// У вариантов очки со знаком ("+violence 2"), у реплик - условие без знака ("violence 2")
+func (p *parser) splitLine(n int, line string, signed bool) (text, label string, options []string, points storage.Points, ok bool) {
+	if i := strings.LastIndex(line, "->"); i >= 0 {
+		label = strings.TrimSpace(line[i+2:])
+		line = strings.TrimSpace(line[:i])
+		if label == "" || strings.ContainsAny(label, " \t") {
+			p.errorf(n, "divert needs a single scene label, got %q", label)
+			return "", "", nil, points, false
+		}
+	}
+
+	if strings.HasSuffix(line, ")") {
+		if i := strings.LastIndex(line, "("); i >= 0 {
+			for _, option := range strings.Split(line[i+1:len(line)-1], ",") {
+				if option = strings.TrimSpace(option); option != "" {
+					options = append(options, option)
+				}
+			}
+			line = strings.TrimSpace(line[:i])
+		}
+	}
+
+	if strings.HasSuffix(line, "]") {
+		if i := strings.LastIndex(line, "["); i >= 0 {
+			points, ok = p.points(n, line[i+1:len(line)-1], signed)
+			if !ok {
+				return "", "", nil, points, false
+			}
+			line = strings.TrimSpace(line[:i])
+		}
+	}
+
+	if line == "" {
+		p.errorf(n, "text is empty")
+		return "", "", nil, points, false
+	}
+	return line, label, options, points, true
+}
+
+// Очки "+violence 2, -pacifism 1" или условие "violence 2, whatever 1"
+func (p *parser) points(n int, source string, signed bool) (storage.Points, bool) {
+	var points storage.Points
+	fields := strings.Fields(strings.ReplaceAll(source, ",", " "))
+	if len(fields)%2 != 0 {
+		p.errorf(n, "points must be pairs of a name and a number, got %q", source)
+		return points, false
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+		name, sign := fields[i], 1
+		if signed {
+			switch {
+			case strings.HasPrefix(name, "+"):
+				name = name[1:]
+			case strings.HasPrefix(name, "-"):
+				name, sign = name[1:], -1
+			}
+		}
+		value, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			p.errorf(n, "%q is not a number", fields[i+1])
+			return points, false
+		}
+		value *= sign
+
+		switch name {
+		case "violence":
+			points.Violence += value
+		case "whatever":
+			points.Whatever += value
+		case "pacifism":
+			points.Pacifism += value
+		default:
+			p.errorf(n, "unknown points %q, expected violence, whatever or pacifism", fields[i])
+			return points, false
+		}
+	}
+	return points, true
+}
+
+// Проверяет сцены и разрешает переходы по меткам
+func (p *parser) finish(lines int) {
+	for _, scene := range p.scenes {
+		if scene.first < 0 && scene.label != "" {
+			p.errorf(scene.line, "scene %q has no steps", scene.label)
+		}
+	}
+	for _, d := range p.diverts {
+		if d.label == End {
+			d.set(storage.NextStepEnd)
+			continue
+		}
+		scene := p.labels[d.label]
+		if scene == nil {
+			p.errorf(d.line, "unknown scene %q", d.label)
+			continue
+		}
+		if scene.first >= 0 {
+			d.set(scene.first + 1)
+		}
+	}
+
+	if len(p.quest.Steps) == 0 {
+		p.errorf(lines, "quest has no steps")
+	}
+	// Как и в /make_quest, у квеста с ролями мест столько же, сколько ролей: иначе игру не начать
+	if p.playersLine > 0 && len(p.quest.Roles) > 0 && p.quest.MaxPlayers != len(p.quest.Roles) {
+		p.errorf(p.playersLine, "players must match the number of roles (%d), got %d", len(p.quest.Roles), p.quest.MaxPlayers)
+	}
+	if p.quest.MaxPlayers == 0 {
+		p.quest.MaxPlayers = len(p.quest.Roles)
+	}
+	if p.quest.MaxPlayers == 0 {
+		p.quest.MaxPlayers = 2
+	}
+
+	// Ошибки переходов находятся после остальных; сортируем по строкам
+	sort.SliceStable(p.errors, func(i, j int) bool { return p.errors[i].Line < p.errors[j].Line })
+}
@@ -0,0 +1,121 @@
+package questscript_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"quest_maker/questscript"
+	"quest_maker/storage"
+)
+
+const script = `// Побег из темницы
+# Побег из темницы
+players: 3
+role: Вор (Каджит)
+role: Маг
+role: Воин
+
+Каджит просыпается в камере.
+Где-то капает вода.
+
+~ timeout 60
+~ audience
+* Вскрыть замок [+whatever 2, +pacifism 1] (Вор)
+* Наложить чары сна [+pacifism 3] (Маг, default) -> sleep
+* Ждать (Воин) -> caught
+
+@Тюремщик: Эй, что за шум? [violence 1] (priority 1) -> caught
+@Тюремщик: Тишина.
+-> END
+
+== sleep ==
+\* Тюремщик спит *
+-> freedom
+
+== caught ==
+Тюремщик поднял тревогу.
+-> END
+
+== freedom ==
+Вы выбрались на свободу.
+`
+
+func TestParse(t *testing.T) {
+	quest, err := questscript.Parse(script)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	timeout := 60
+	want := storage.NewQuest{
+		Title:      "Побег из темницы",
+		MaxPlayers: 3,
+		Characters: []string{"Каджит", "Тюремщик"},
+		Roles:      []storage.Role{{Position: 1, Name: "Вор", Character: "Каджит"}, {Position: 2, Name: "Маг"}, {Position: 3, Name: "Воин"}},
+		Steps: []storage.Step{
+			{Type: storage.StepNarration, Text: "Каджит просыпается в камере.\nГде-то капает вода."},
+			{Type: storage.StepPlayerAction, VoteTimeoutSeconds: &timeout, AudiencePoll: true, Choices: []storage.Choice{
+				{Text: "Вскрыть замок", Points: storage.Points{Whatever: 2, Pacifism: 1}, PlayerIndex: 1},
+				{Text: "Наложить чары сна", Points: storage.Points{Pacifism: 3}, PlayerIndex: 2, IsDefault: true, NextStep: 4},
+				{Text: "Ждать", PlayerIndex: 3, NextStep: 5},
+			}},
+			{Type: storage.StepCharacterAction, Character: "Тюремщик", NextStep: storage.NextStepEnd, Lines: []storage.CharacterLine{
+				{Text: "Эй, что за шум?", Condition: storage.Points{Violence: 1}, Priority: 1, NextStep: 5},
+				{Text: "Тишина."},
+			}},
+			{Type: storage.StepNarration, Text: "* Тюремщик спит *", NextStep: 6},
+			{Type: storage.StepNarration, Text: "Тюремщик поднял тревогу.", NextStep: storage.NextStepEnd},
+			{Type: storage.StepNarration, Text: "Вы выбрались на свободу."},
+		},
+	}
+	if !reflect.DeepEqual(quest, want) {
+		t.Errorf("Expected %+v, got %+v", want, quest)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"empty", "// только комментарий", []string{"line 1: quest has no steps"}},
+		{"unknown scene", "Начало.\n-> finale", []string{`line 2: unknown scene "finale"`}},
+		{"unknown role", "role: Вор\n* Напасть (Маг)", []string{`line 2: unknown role "Маг"`}},
+		{"players differ from roles", "players: 3\nrole: Вор\nrole: Маг\n* Напасть", []string{"line 1: players must match the number of roles (2), got 3"}},
+		{"bad points", "* Напасть [+strength 2]", []string{`line 1: unknown points "+strength"`}},
+		{"odd points", "* Напасть [+violence]", []string{"line 1: points must be pairs"}},
+		{"end on a choice", "* Уйти -> END", []string{"line 1: -> END is only allowed on its own line"}},
+		{"text after a divert", "Начало.\n-> END\nЕще текст.", []string{"line 3: text after a divert"}},
+		{"repeated scene", "== a ==\nА.\n== a ==\nБ.", []string{`line 3: scene "a" is already defined on line 1`}},
+		{"empty scene", "== a ==\n== b ==\nБ.", []string{`line 1: scene "a" has no steps`}},
+		{"settings without choices", "~ timeout 30\n\nТекст.", []string{"line 1: settings must be followed by choices"}},
+		{"unknown line option", "@Страж: Стой! (loud)", []string{`line 1: unknown line option "loud"`}},
+		{
+			// Все ошибки перечисляются по порядку строк
+			"several errors",
+			"Начало.\n-> nowhere\n\n== next ==\n* Бежать [+speed 1]",
+			[]string{`line 2: unknown scene "nowhere"`, `line 5: unknown points "+speed"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := questscript.Parse(tt.script)
+			var errs questscript.Errors
+			if !errors.As(err, &errs) {
+				t.Fatalf("Expected questscript.Errors, got %v", err)
+			}
+			if len(errs) != len(tt.want) {
+				t.Fatalf("Expected %d errors, got %v", len(tt.want), err)
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(errs[i].Error(), want) {
+					t.Errorf("Expected error %q, got %q", want, errs[i].Error())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+// Пакет simulator перебирает все пути одиночного прохождения квеста без сервера и базы:
+// какие концовки достижимы, в каких пределах бывают очки на каждом шаге
+// и какие реплики персонажей не выбираются ни при каких достижимых очках
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"quest_maker/engine"
+	"quest_maker/storage"
+)
+
+const (
+	DefaultMaxDepth = 100
+	DefaultMaxPaths = 100000
+)
+
+type Options struct {
+	// Наибольшее число шагов на пути; более длинные пути (например, петли) обрезаются
+	MaxDepth int
+	// После стольких найденных путей, полных и обрезанных, перебор останавливается
+	MaxPaths int
+}
+
+// Наименьшие и наибольшие значения очков по каждой категории отдельно
+type Range struct {
+	Min, Max storage.Points
+}
+
+func (r *Range) add(p storage.Points, first bool) {
+	if first {
+		r.Min, r.Max = p, p
+		return
+	}
+	r.Min = storage.Points{Violence: min(r.Min.Violence, p.Violence), Whatever: min(r.Min.Whatever, p.Whatever), Pacifism: min(r.Min.Pacifism, p.Pacifism)}
+	r.Max = storage.Points{Violence: max(r.Max.Violence, p.Violence), Whatever: max(r.Max.Whatever, p.Whatever), Pacifism: max(r.Max.Pacifism, p.Pacifism)}
+}
+
+// Достижимый шаг: сколько путей через него проходит и с какими очками на него попадают
+type StepStats struct {
+	Step   *storage.Step
+	Visits int
+	Points Range
+}
+
+// Шаг, на котором заканчиваются пути, и итоговые очки этих путей
+type Ending struct {
+	StepID int
+	Paths  int
+	Points Range
+}
+
+// Реплика персонажа, которая не выбирается ни на одном пути
+type DeadLine struct {
+	StepID int
+	Line   storage.CharacterLine
+}
+
+type Report struct {
+	Paths        int  // Полных путей до конца квеста
+	Truncated    int  // Путей, обрезанных по MaxDepth
+	LimitReached bool // Перебор остановлен по MaxPaths, цифры неполные
+	Endings      []Ending
+	Steps        []StepStats // Достижимые шаги по возрастанию ID
+	Unreachable  []int
+	DeadLines    []DeadLine // Только при полном переборе: на обрезанных путях реплики могли бы выбраться
+}
+
+// Перебор неполный: часть путей обрезана или остановлена по лимиту
+func (r *Report) Incomplete() bool {
+	return r.Truncated > 0 || r.LimitReached
+}
+
+type explorer struct {
+	steps   engine.Steps
+	opts    Options
+	report  Report
+	stats   map[int]*StepStats
+	endings map[int]*Ending
+	picked  map[int]map[int]bool // Индексы выбранных реплик по шагам
+}
+
+// Перебирает пути из шага start: на player_action шагах пробует каждый вариант (роли не учитываются,
+// как в одиночном прохождении), реплики персонажей выбираются по правилам engine
+func Explore(steps engine.Steps, start int, opts Options) (*Report, error) {
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = DefaultMaxDepth
+	}
+	if opts.MaxPaths <= 0 {
+		opts.MaxPaths = DefaultMaxPaths
+	}
+
+	e := &explorer{
+		steps:   steps,
+		opts:    opts,
+		stats:   make(map[int]*StepStats),
+		endings: make(map[int]*Ending),
+		picked:  make(map[int]map[int]bool),
+	}
+	if err := e.walk(engine.State{StepID: start}, 0); err != nil {
+		return nil, err
+	}
+	return e.summarize(), nil
+}
+
+func (e *explorer) walk(state engine.State, depth int) error {
+	if e.report.LimitReached {
+		return nil
+	}
+	if depth >= e.opts.MaxDepth {
+		// Обрезанные пути тоже считаются, иначе петля с выбором перебиралась бы бесконечно
+		e.report.Truncated++
+		e.countPath()
+		return nil
+	}
+
+	view, err := engine.Look(e.steps, state)
+	if err != nil {
+		return fmt.Errorf("step %d: %w", state.StepID, err)
+	}
+	e.visit(view, state.Points)
+
+	if !view.NeedsChoice() {
+		next, err := engine.Proceed(e.steps, state)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", state.StepID, err)
+		}
+		return e.follow(state.StepID, next, depth)
+	}
+
+	// Шаг с выбором без вариантов - тупик, прохождение на нем застревает
+	if len(view.Choices) == 0 {
+		e.finish(state.StepID, state.Points)
+		return nil
+	}
+	for _, choice := range view.Choices {
+		next, err := engine.Choose(e.steps, state, choice.ID)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", state.StepID, err)
+		}
+		if err := e.follow(state.StepID, next, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *explorer) follow(stepID int, next engine.State, depth int) error {
+	if next.Finished {
+		e.finish(stepID, next.Points)
+		return nil
+	}
+	if _, err := e.steps.Step(next.StepID); err != nil {
+		return fmt.Errorf("step %d leads to missing step %d", stepID, next.StepID)
+	}
+	return e.walk(next, depth+1)
+}
+
+func (e *explorer) visit(view *engine.View, points storage.Points) {
+	stats, ok := e.stats[view.Step.ID]
+	if !ok {
+		stats = &StepStats{Step: view.Step}
+		e.stats[view.Step.ID] = stats
+	}
+	stats.Points.add(points, !ok)
+	stats.Visits++
+
+	for i := range view.Step.Lines {
+		if view.Line == &view.Step.Lines[i] {
+			if e.picked[view.Step.ID] == nil {
+				e.picked[view.Step.ID] = make(map[int]bool)
+			}
+			e.picked[view.Step.ID][i] = true
+		}
+	}
+}
+
+func (e *explorer) finish(stepID int, points storage.Points) {
+	ending, ok := e.endings[stepID]
+	if !ok {
+		ending = &Ending{StepID: stepID}
+		e.endings[stepID] = ending
+	}
+	ending.Points.add(points, !ok)
+	ending.Paths++
+
+	e.report.Paths++
+	e.countPath()
+}
+
+func (e *explorer) countPath() {
+	if e.report.Paths+e.report.Truncated >= e.opts.MaxPaths {
+		e.report.LimitReached = true
+	}
+}
+
+func (e *explorer) summarize() *Report {
+	ids := make([]int, 0, len(e.steps))
+	for id := range e.steps {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	report := e.report
+	for _, id := range ids {
+		stats, ok := e.stats[id]
+		if !ok {
+			report.Unreachable = append(report.Unreachable, id)
+			continue
+		}
+		report.Steps = append(report.Steps, *stats)
+
+		for i, line := range stats.Step.Lines {
+			if !report.Incomplete() && !e.picked[id][i] {
+				report.DeadLines = append(report.DeadLines, DeadLine{StepID: id, Line: line})
+			}
+		}
+		if ending, ok := e.endings[id]; ok {
+			report.Endings = append(report.Endings, *ending)
+		}
+	}
+	return &report
+}
+
+func formatRange(r Range) string {
+	return fmt.Sprintf("violence %d..%d, whatever %d..%d, pacifism %d..%d",
+		r.Min.Violence, r.Max.Violence, r.Min.Whatever, r.Max.Whatever, r.Min.Pacifism, r.Max.Pacifism)
+}
+
+// Печатает отчет в виде текста для командной строки
+func (r *Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "Paths: %d", r.Paths)
+	if r.Truncated > 0 {
+		fmt.Fprintf(w, ", truncated by depth: %d", r.Truncated)
+	}
+	if r.LimitReached {
+		fmt.Fprint(w, " (path limit reached, results are incomplete)")
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "\nEndings:")
+	for _, ending := range r.Endings {
+		fmt.Fprintf(w, "  step %d: paths %d, %s\n", ending.StepID, ending.Paths, formatRange(ending.Points))
+	}
+
+	fmt.Fprintln(w, "\nPoints on entering each step:")
+	for _, stats := range r.Steps {
+		fmt.Fprintf(w, "  step %d (%s): visits %d, %s\n", stats.Step.ID, stats.Step.Type, stats.Visits, formatRange(stats.Points))
+	}
+
+	if len(r.Unreachable) > 0 {
+		fmt.Fprintf(w, "\nUnreachable steps: %v\n", r.Unreachable)
+	}
+	if r.Incomplete() {
+		fmt.Fprintln(w, "\nCharacter lines are not checked: not all paths were explored")
+	} else if len(r.DeadLines) > 0 {
+		fmt.Fprintln(w, "\nCharacter lines that are never selected:")
+		for _, dead := range r.DeadLines {
+			fmt.Fprintf(w, "  step %d: %q\n", dead.StepID, dead.Line.Text)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package simulator_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"quest_maker/engine"
+	"quest_maker/simulator"
+	"quest_maker/storage"
+)
+
+// 1 выбор из трех вариантов -> 2 реплика стражника: "Стой!" уводит на 4, остальные - на 3.
+// Реплика "Никогда" требует очков, которые нельзя набрать
+func testQuest() engine.Steps {
+	return engine.FromQuest(storage.NewQuest{Steps: []storage.Step{
+		{Type: storage.StepPlayerAction, Choices: []storage.Choice{
+			{Text: "Напасть", Points: storage.Points{Violence: 2}},
+			{Text: "Уйти", Points: storage.Points{Pacifism: 1}},
+			{Text: "Ждать", Points: storage.Points{Whatever: 1}},
+		}},
+		{Type: storage.StepCharacterAction, Character: "Стражник", Lines: []storage.CharacterLine{
+			{Text: "Стой!", Condition: storage.Points{Violence: 2}, NextStep: 4},
+			{Text: "Проходи.", Condition: storage.Points{Pacifism: 1}},
+			{Text: "Никогда", Condition: storage.Points{Whatever: 9}, NextStep: 3},
+		}},
+		{Type: storage.StepNarration, Text: "Мирный конец"},
+		{Type: storage.StepNarration, Text: "Бой"},
+		{Type: storage.StepNarration, Text: "Потерянная сцена"},
+	}})
+}
+
+func TestExplore(t *testing.T) {
+	quest := testQuest()
+	// "Бой" по порядку ведет к 5; обрываем переход, чтобы шаг 5 стал недостижим
+	quest[4].NextStep = 0
+
+	report, err := simulator.Explore(quest, 1, simulator.Options{})
+	if err != nil {
+		t.Fatalf("Explore failed: %v", err)
+	}
+
+	if report.Paths != 3 || report.Truncated != 0 || report.LimitReached {
+		t.Errorf("Expected 3 complete paths, got %+v", report)
+	}
+
+	// Мирный и нейтральный пути проходят через 3 и тоже заканчиваются на 4
+	if len(report.Endings) != 1 || report.Endings[0].StepID != 4 || report.Endings[0].Paths != 3 {
+		t.Fatalf("Expected all paths to end at step 4, got %+v", report.Endings)
+	}
+	want := simulator.Range{Max: storage.Points{Violence: 2, Whatever: 1, Pacifism: 1}}
+	if report.Endings[0].Points != want {
+		t.Errorf("Expected ending points %+v, got %+v", want, report.Endings[0].Points)
+	}
+
+	visits := make(map[int]int)
+	for _, stats := range report.Steps {
+		visits[stats.Step.ID] = stats.Visits
+	}
+	if fmt.Sprint(visits) != "map[1:1 2:3 3:2 4:3]" {
+		t.Errorf("Unexpected visits %v", visits)
+	}
+	if fmt.Sprint(report.Unreachable) != "[5]" {
+		t.Errorf("Expected step 5 to be unreachable, got %v", report.Unreachable)
+	}
+	if len(report.DeadLines) != 1 || report.DeadLines[0].Line.Text != "Никогда" {
+		t.Errorf("Expected the only dead line to be \"Никогда\", got %+v", report.DeadLines)
+	}
+}
+
+func TestExploreLimits(t *testing.T) {
+	// Реплика возвращает к выбору: без ограничения глубины перебор не закончится
+	loop := engine.FromQuest(storage.NewQuest{Steps: []storage.Step{
+		{Type: storage.StepPlayerAction, Choices: []storage.Choice{
+			{Text: "Хватит", Points: storage.Points{Pacifism: 5}},
+			{Text: "Еще раз", Points: storage.Points{Whatever: 1}},
+		}},
+		{Type: storage.StepCharacterAction, Character: "Эхо", Lines: []storage.CharacterLine{
+			{Text: "Снова", Condition: storage.Points{Whatever: 1}, NextStep: 1},
+			{Text: "Прощай", Condition: storage.Points{Pacifism: 5}, NextStep: 3},
+		}},
+		{Type: storage.StepNarration, Text: "Конец"},
+	}})
+
+	tests := []struct {
+		name      string
+		opts      simulator.Options
+		paths     int
+		truncated int
+		limit     bool
+	}{
+		{"depth cap", simulator.Options{MaxDepth: 6}, 2, 2, false},
+		{"path cap", simulator.Options{MaxDepth: 50, MaxPaths: 2}, 2, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := simulator.Explore(loop, 1, tt.opts)
+			if err != nil {
+				t.Fatalf("Explore failed: %v", err)
+			}
+			if report.Paths != tt.paths || report.Truncated != tt.truncated || report.LimitReached != tt.limit {
+				t.Errorf("Expected %d paths, %d truncated, limit %v, got %+v", tt.paths, tt.truncated, tt.limit, report)
+			}
+		})
+	}
+}
+
+func TestExploreChoiceLoop(t *testing.T) {
+	// Оба варианта возвращают к тому же выбору: полных путей нет, и останавливает перебор только MaxPaths
+	loop := engine.FromQuest(storage.NewQuest{Steps: []storage.Step{
+		{Type: storage.StepPlayerAction, Choices: []storage.Choice{
+			{Text: "Налево", NextStep: 1},
+			{Text: "Направо", NextStep: 1},
+		}},
+	}})
+
+	tests := []struct {
+		name      string
+		opts      simulator.Options
+		truncated int
+	}{
+		{"default limits", simulator.Options{}, simulator.DefaultMaxPaths},
+		{"path cap", simulator.Options{MaxPaths: 10}, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := simulator.Explore(loop, 1, tt.opts)
+			if err != nil {
+				t.Fatalf("Explore failed: %v", err)
+			}
+			if report.Paths != 0 || report.Truncated != tt.truncated || !report.LimitReached {
+				t.Errorf("Expected %d truncated paths and the limit reached, got %+v", tt.truncated, report)
+			}
+		})
+	}
+}
+
+func TestExploreIncompleteDeadLines(t *testing.T) {
+	// С глубиной 2 пути обрываются после реплики стражника: перебор неполный, и о невыбранных репликах судить нельзя
+	report, err := simulator.Explore(testQuest(), 1, simulator.Options{MaxDepth: 2})
+	if err != nil {
+		t.Fatalf("Explore failed: %v", err)
+	}
+	if !report.Incomplete() || len(report.DeadLines) != 0 {
+		t.Errorf("Expected an incomplete report without dead lines, got %+v", report)
+	}
+
+	var out bytes.Buffer
+	report.Write(&out)
+	if !strings.Contains(out.String(), "Character lines are not checked") || strings.Contains(out.String(), "\"Никогда\"") {
+		t.Errorf("Expected the report to skip dead lines, got:\n%s", out.String())
+	}
+}
+
+func TestExploreMissingStep(t *testing.T) {
+	quest := testQuest()
+	quest[3].NextStep = 42
+
+	if _, err := simulator.Explore(quest, 1, simulator.Options{}); err == nil || !strings.Contains(err.Error(), "step 3 leads to missing step 42") {
+		t.Errorf("Expected error about the link from step 3, got %v", err)
+	}
+}
+
+func TestReportWrite(t *testing.T) {
+	report, err := simulator.Explore(testQuest(), 1, simulator.Options{})
+	if err != nil {
+		t.Fatalf("Explore failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	report.Write(&out)
+	for _, want := range []string{"Paths: 3", "step 5: paths 3", "step 2 (character_action): visits 3", "\"Никогда\""} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected report to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Пакет memory - реализация storage.Store в памяти процесса для локальных демо и тестов.
+// Данные пропадают при перезапуске
+package memory
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"quest_maker/storage"
+)
+
+// Все данные хранилища. Записи хранятся по значению, поэтому копия карт - независимый снимок
+type data struct {
+	ids map[string]int // Последний выданный ID по таблицам
+
+	users     map[int]storage.User
+	sessions  map[string]session // По хешу токена
+	apiTokens map[int]storage.APIToken
+
+	quests       map[int]storage.Quest
+	roles        map[int][]storage.Role // По квесту
+	characters   map[int][]string       // Объявленные персонажи по квесту
+	authors      []author               // В порядке добавления
+	steps        map[int]storage.Step
+	questSteps   map[int][]int // ID шагов квеста по номеру
+	choices      map[int]storage.Choice
+	playthroughs map[int]storage.Playthrough
+
+	servers       map[int]storage.Server
+	players       map[int]storage.Player
+	mps           map[int]storage.MultiplayerPlaythrough // По серверу
+	votes         []vote                                 // В порядке голосования
+	spectators    map[int]storage.Spectator
+	audienceVotes []audienceVote
+}
+
+type session struct {
+	userID    int
+	expiresAt time.Time
+}
+
+type author struct {
+	questID int
+	userID  int
+	role    string
+}
+
+type vote struct {
+	serverID int
+	stepID   int
+	storage.Vote
+}
+
+type audienceVote struct {
+	serverID    int
+	stepID      int
+	spectatorID int
+	choiceID    int
+}
+
+func newData() *data {
+	return &data{
+		ids:          make(map[string]int),
+		users:        make(map[int]storage.User),
+		sessions:     make(map[string]session),
+		apiTokens:    make(map[int]storage.APIToken),
+		quests:       make(map[int]storage.Quest),
+		roles:        make(map[int][]storage.Role),
+		characters:   make(map[int][]string),
+		steps:        make(map[int]storage.Step),
+		questSteps:   make(map[int][]int),
+		choices:      make(map[int]storage.Choice),
+		playthroughs: make(map[int]storage.Playthrough),
+		servers:      make(map[int]storage.Server),
+		players:      make(map[int]storage.Player),
+		mps:          make(map[int]storage.MultiplayerPlaythrough),
+		spectators:   make(map[int]storage.Spectator),
+	}
+}
+
+// Срезы внутри записей (шаги, области токенов) никогда не меняются на месте,
+// поэтому их достаточно разделять между снимками
+func (d *data) clone() *data {
+	return &data{
+		ids:           maps.Clone(d.ids),
+		users:         maps.Clone(d.users),
+		sessions:      maps.Clone(d.sessions),
+		apiTokens:     maps.Clone(d.apiTokens),
+		quests:        maps.Clone(d.quests),
+		roles:         maps.Clone(d.roles),
+		characters:    maps.Clone(d.characters),
+		authors:       slices.Clone(d.authors),
+		steps:         maps.Clone(d.steps),
+		questSteps:    maps.Clone(d.questSteps),
+		choices:       maps.Clone(d.choices),
+		playthroughs:  maps.Clone(d.playthroughs),
+		servers:       maps.Clone(d.servers),
+		players:       maps.Clone(d.players),
+		mps:           maps.Clone(d.mps),
+		votes:         slices.Clone(d.votes),
+		spectators:    maps.Clone(d.spectators),
+		audienceVotes: slices.Clone(d.audienceVotes),
+	}
+}
+
+// ID новой записи; у каждой таблицы своя последовательность, как у SERIAL в PostgreSQL
+func (d *data) nextID(table string) int {
+	d.ids[table]++
+	return d.ids[table]
+}
+
+type shared struct {
+	mu   sync.Mutex
+	data *data
+}
+
+type Store struct {
+	db *shared
+	tx *data // Снимок данных внутри Atomic; nil вне транзакции
+}
+
+func New() *Store {
+	return &Store{db: &shared{data: newData()}}
+}
+
+func (s *Store) Quests() storage.QuestStore             { return questStore{s} }
+func (s *Store) Playthroughs() storage.PlaythroughStore { return playthroughStore{s} }
+func (s *Store) Servers() storage.ServerStore           { return serverStore{s} }
+func (s *Store) Users() storage.UserStore               { return userStore{s} }
+
+// Транзакция работает со снимком данных и держит общую блокировку до конца,
+// поэтому транзакции выполняются по очереди и Lock ничего не делает сам
+func (s *Store) Atomic(fn func(tx storage.Store) error) error {
+	// Вложенный вызов выполняется в уже открытой транзакции
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	tx := s.db.data.clone()
+	if err := fn(&Store{db: s.db, tx: tx}); err != nil {
+		return err
+	}
+	s.db.data = tx
+	return nil
+}
+
+func (s *Store) read(fn func(d *data) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return fn(s.db.data)
+}
+
+// Изменение вне Atomic выполняется в собственной транзакции, чтобы ошибка не оставляла половину записей
+func (s *Store) write(fn func(d *data) error) error {
+	return s.Atomic(func(tx storage.Store) error {
+		return fn(tx.(*Store).tx)
+	})
+}
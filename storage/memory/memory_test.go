@@ -0,0 +1,15 @@
+package memory_test
+
+import (
+	"testing"
+
+	"quest_maker/storage"
+	"quest_maker/storage/memory"
+	"quest_maker/storage/storagetest"
+)
+
+func TestStoreContract(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		return memory.New()
+	})
+}
@@ -0,0 +1,102 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+
+	"quest_maker/storage"
+)
+
+type playthroughStore struct {
+	s *Store
+}
+
+func (ps playthroughStore) Create(p storage.Playthrough) (int, error) {
+	var id int
+	err := ps.s.write(func(d *data) error {
+		// Как внешние ключи в PostgreSQL: ссылка на несуществующую запись - ошибка, а не ErrNotFound
+		if _, ok := d.quests[p.QuestID]; !ok {
+			return fmt.Errorf("quest %d not found", p.QuestID)
+		}
+		if _, ok := d.steps[p.StepID]; !ok {
+			return fmt.Errorf("step %d not found", p.StepID)
+		}
+
+		id = d.nextID("playthrough")
+		d.playthroughs[id] = storage.Playthrough{
+			ID:         id,
+			QuestID:    p.QuestID,
+			UserID:     p.UserID,
+			PlayerName: p.PlayerName,
+			StepID:     p.StepID,
+		}
+		return nil
+	})
+	return id, err
+}
+
+// Прохождение пользователя вместе с названием квеста; прохождения без пользователя не находятся
+func (d *data) playthrough(id, userID int) (*storage.Playthrough, error) {
+	p, ok := d.playthroughs[id]
+	if !ok || p.UserID == 0 || p.UserID != userID {
+		return nil, storage.ErrNotFound
+	}
+	p.QuestTitle = d.quests[p.QuestID].Title
+	return &p, nil
+}
+
+func (ps playthroughStore) Get(id, userID int) (*storage.Playthrough, error) {
+	var p *storage.Playthrough
+	err := ps.s.read(func(d *data) error {
+		var err error
+		p, err = d.playthrough(id, userID)
+		return err
+	})
+	return p, err
+}
+
+func (ps playthroughStore) List(userID int) ([]storage.Playthrough, error) {
+	var playthroughs []storage.Playthrough
+	err := ps.s.read(func(d *data) error {
+		for id := range d.playthroughs {
+			if p, err := d.playthrough(id, userID); err == nil {
+				playthroughs = append(playthroughs, *p)
+			}
+		}
+		return nil
+	})
+
+	sort.Slice(playthroughs, func(i, j int) bool {
+		return playthroughs[i].ID > playthroughs[j].ID
+	})
+	return playthroughs, err
+}
+
+func (ps playthroughStore) Advance(id, userID, stepID int, points storage.Points) error {
+	return ps.s.write(func(d *data) error {
+		p, ok := d.playthroughs[id]
+		if !ok || p.UserID == 0 || p.UserID != userID {
+			return storage.ErrNotFound
+		}
+		if _, ok := d.steps[stepID]; !ok {
+			return fmt.Errorf("step %d not found", stepID)
+		}
+		p.StepID = stepID
+		p.Points = p.Points.Add(points)
+		d.playthroughs[id] = p
+		return nil
+	})
+}
+
+func (ps playthroughStore) Finish(id, userID int, points storage.Points) error {
+	return ps.s.write(func(d *data) error {
+		p, ok := d.playthroughs[id]
+		if !ok || p.UserID == 0 || p.UserID != userID {
+			return storage.ErrNotFound
+		}
+		p.Finished = true
+		p.Points = p.Points.Add(points)
+		d.playthroughs[id] = p
+		return nil
+	})
+}
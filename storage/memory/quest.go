@@ -0,0 +1,386 @@
+package memory
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"quest_maker/storage"
+)
+
+type questStore struct {
+	s *Store
+}
+
+func (q questStore) Create(quest storage.NewQuest) (int, error) {
+	var questID int
+	err := q.s.write(func(d *data) error {
+		questID = d.nextID("quest")
+		initialStep, err := d.insertContent(questID, quest)
+		if err != nil {
+			return err
+		}
+		d.quests[questID] = storage.Quest{
+			ID:          questID,
+			Title:       quest.Title,
+			Status:      storage.QuestStatusDraft,
+			MaxPlayers:  quest.MaxPlayers,
+			OwnerID:     quest.OwnerID,
+			InitialStep: initialStep,
+			CreatedAt:   time.Now(),
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return questID, nil
+}
+
+// Персонажи, роли и шаги квеста; возвращает ID начального шага
+func (d *data) insertContent(questID int, quest storage.NewQuest) (int, error) {
+	characters := make(map[string]bool)
+	for _, name := range quest.Characters {
+		characters[name] = true
+	}
+
+	// Как и в SQL-хранилищах, персонажи с прежними именами сохраняют свое место, новые добавляются в конец
+	var declared []string
+	for _, name := range d.characters[questID] {
+		if characters[name] {
+			declared = append(declared, name)
+		}
+	}
+	for _, name := range quest.Characters {
+		if !slices.Contains(declared, name) {
+			declared = append(declared, name)
+		}
+	}
+	d.characters[questID] = declared
+
+	var roles []storage.Role
+	for i, role := range quest.Roles {
+		if role.Character != "" && !characters[role.Character] {
+			return 0, fmt.Errorf("character %q not found", role.Character)
+		}
+		roles = append(roles, storage.Role{Position: i + 1, Name: role.Name, Character: role.Character})
+	}
+	d.roles[questID] = roles
+
+	// Сначала выдаем ID всем шагам, чтобы реплики могли ссылаться на любой шаг
+	stepIDs := make([]int, len(quest.Steps))
+	for i := range quest.Steps {
+		stepIDs[i] = d.nextID("step")
+	}
+
+	for i, step := range quest.Steps {
+		saved := storage.Step{ID: stepIDs[i], Number: i + 1, Type: step.Type}
+
+		// Шаг ведет к следующему по порядку или к шагу, заданному в NextStep
+		if next := quest.NextStepNumber(i); next != 0 {
+			saved.NextStep = stepIDs[next-1]
+		}
+
+		switch step.Type {
+		case storage.StepNarration:
+			saved.Text = step.Text
+
+		case storage.StepPlayerAction:
+			saved.VoteTimeoutSeconds = copyInt(step.VoteTimeoutSeconds)
+			saved.AudiencePoll = step.AudiencePoll
+			for _, c := range step.Choices {
+				c.ID = d.nextID("choice")
+				c.StepID = saved.ID
+
+				// Как и у реплик, неверный номер шага означает переход самого шага
+				nextStep := 0
+				if c.NextStep > 0 && c.NextStep <= len(stepIDs) {
+					nextStep = stepIDs[c.NextStep-1]
+				}
+				c.NextStep = nextStep
+				d.choices[c.ID] = c
+				saved.Choices = append(saved.Choices, c)
+			}
+
+		case storage.StepCharacterAction:
+			if !characters[step.Character] {
+				return 0, fmt.Errorf("character %q not found", step.Character)
+			}
+			saved.Character = step.Character
+			for _, line := range step.Lines {
+				line.ID = d.nextID("character_line")
+
+				// Номер шага превращаем в его ID; неверный номер означает переход по порядку
+				nextStep := 0
+				if line.NextStep > 0 && line.NextStep <= len(stepIDs) {
+					nextStep = stepIDs[line.NextStep-1]
+				}
+				line.NextStep = nextStep
+				saved.Lines = append(saved.Lines, line)
+			}
+
+		default:
+			return 0, fmt.Errorf("unknown step type %q", step.Type)
+		}
+
+		d.steps[saved.ID] = saved
+	}
+	d.questSteps[questID] = stepIDs
+	if len(stepIDs) == 0 {
+		return 0, nil
+	}
+	return stepIDs[0], nil
+}
+
+// Старые шаги остаются для начатых прохождений, но в Steps больше не попадают
+func (q questStore) Replace(id int, quest storage.NewQuest) error {
+	return q.s.write(func(d *data) error {
+		saved, ok := d.quests[id]
+		if !ok || saved.Status == storage.QuestStatusDeleted {
+			return storage.ErrNotFound
+		}
+		initialStep, err := d.insertContent(id, quest)
+		if err != nil {
+			return err
+		}
+		saved.Title = quest.Title
+		saved.MaxPlayers = quest.MaxPlayers
+		saved.InitialStep = initialStep
+		d.quests[id] = saved
+		return nil
+	})
+}
+
+// Квест вместе с именем владельца
+func (d *data) quest(id int) (*storage.Quest, error) {
+	quest, ok := d.quests[id]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	quest.Owner = d.users[quest.OwnerID].Username
+	return &quest, nil
+}
+
+// Роль пользователя в квесте; пустая строка, если он не автор
+func (d *data) questRole(quest storage.Quest, userID int) string {
+	if userID == 0 {
+		return ""
+	}
+	if quest.OwnerID == userID {
+		return storage.AuthorRoleOwner
+	}
+	for _, a := range d.authors {
+		if a.questID == quest.ID && a.userID == userID {
+			return a.role
+		}
+	}
+	return ""
+}
+
+func (q questStore) Get(id int) (*storage.Quest, error) {
+	var quest *storage.Quest
+	err := q.s.read(func(d *data) error {
+		var err error
+		quest, err = d.quest(id)
+		return err
+	})
+	return quest, err
+}
+
+func (q questStore) List(userID int) ([]storage.QuestListItem, error) {
+	var quests []storage.QuestListItem
+	err := q.s.read(func(d *data) error {
+		for id, quest := range d.quests {
+			role := d.questRole(quest, userID)
+			if quest.Status != storage.QuestStatusPublished && (quest.Status != storage.QuestStatusDraft || role == "") {
+				continue
+			}
+			withOwner, err := d.quest(id)
+			if err != nil {
+				return err
+			}
+			quests = append(quests, storage.QuestListItem{Quest: *withOwner, MyRole: role})
+		}
+		return nil
+	})
+
+	sort.Slice(quests, func(i, j int) bool {
+		if !quests[i].CreatedAt.Equal(quests[j].CreatedAt) {
+			return quests[i].CreatedAt.After(quests[j].CreatedAt)
+		}
+		return quests[i].ID > quests[j].ID
+	})
+	return quests, err
+}
+
+func (q questStore) Access(questID, userID int) (storage.QuestAccess, error) {
+	var access storage.QuestAccess
+	err := q.s.read(func(d *data) error {
+		quest, ok := d.quests[questID]
+		if !ok || quest.Status == storage.QuestStatusDeleted {
+			return storage.ErrNotFound
+		}
+		access = storage.QuestAccess{Status: quest.Status, Role: d.questRole(quest, userID)}
+		return nil
+	})
+	return access, err
+}
+
+func (q questStore) Update(id int, title string, maxPlayers int) error {
+	return q.s.write(func(d *data) error {
+		quest, ok := d.quests[id]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		if title != "" {
+			quest.Title = title
+		}
+		if maxPlayers != 0 {
+			quest.MaxPlayers = maxPlayers
+		}
+		d.quests[id] = quest
+		return nil
+	})
+}
+
+func (q questStore) SetStatus(id int, status string) error {
+	return q.s.write(func(d *data) error {
+		quest, ok := d.quests[id]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		quest.Status = status
+		d.quests[id] = quest
+		return nil
+	})
+}
+
+func (q questStore) Roles(questID int) ([]storage.Role, error) {
+	var roles []storage.Role
+	err := q.s.read(func(d *data) error {
+		roles = slices.Clone(d.roles[questID])
+		return nil
+	})
+	return roles, err
+}
+
+func (q questStore) Characters(questID int) ([]string, error) {
+	var characters []string
+	err := q.s.read(func(d *data) error {
+		characters = slices.Clone(d.characters[questID])
+		return nil
+	})
+	return characters, err
+}
+
+func (q questStore) Authors(questID int) ([]storage.Author, error) {
+	var authors []storage.Author
+	err := q.s.read(func(d *data) error {
+		for _, a := range d.authors {
+			user, ok := d.users[a.userID]
+			if a.questID != questID || !ok {
+				continue
+			}
+			authors = append(authors, storage.Author{UserID: a.userID, Username: user.Username, Role: a.role})
+		}
+		return nil
+	})
+	return authors, err
+}
+
+func (q questStore) SetAuthor(questID, userID int, role string) error {
+	return q.s.write(func(d *data) error {
+		if _, ok := d.quests[questID]; !ok {
+			return fmt.Errorf("quest %d not found", questID)
+		}
+		if _, ok := d.users[userID]; !ok {
+			return fmt.Errorf("user %d not found", userID)
+		}
+
+		for i, a := range d.authors {
+			if a.questID == questID && a.userID == userID {
+				d.authors[i].role = role
+				return nil
+			}
+		}
+		d.authors = append(d.authors, author{questID: questID, userID: userID, role: role})
+		return nil
+	})
+}
+
+func (q questStore) RemoveAuthor(questID int, username string) error {
+	return q.s.write(func(d *data) error {
+		for i, a := range d.authors {
+			if a.questID == questID && strings.EqualFold(d.users[a.userID].Username, username) {
+				d.authors = slices.Delete(d.authors, i, i+1)
+				return nil
+			}
+		}
+		return storage.ErrNotFound
+	})
+}
+
+func (q questStore) Step(id int) (*storage.Step, error) {
+	var step storage.Step
+	err := q.s.read(func(d *data) error {
+		var ok bool
+		step, ok = d.steps[id]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Вызывающий может менять шаг, не затрагивая хранилище
+	step.VoteTimeoutSeconds = copyInt(step.VoteTimeoutSeconds)
+	step.Choices = slices.Clone(step.Choices)
+	step.Lines = slices.Clone(step.Lines)
+	return &step, nil
+}
+
+func (q questStore) Steps(questID int) ([]storage.Step, error) {
+	var ids []int
+	q.s.read(func(d *data) error {
+		ids = d.questSteps[questID]
+		return nil
+	})
+
+	steps := make([]storage.Step, 0, len(ids))
+	for _, id := range ids {
+		step, err := q.Step(id)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, *step)
+	}
+	return steps, nil
+}
+
+func (q questStore) Choice(id int) (*storage.Choice, error) {
+	var choice storage.Choice
+	err := q.s.read(func(d *data) error {
+		var ok bool
+		choice, ok = d.choices[id]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &choice, nil
+}
+
+func copyInt(n *int) *int {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	return &c
+}
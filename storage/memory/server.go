@@ -0,0 +1,608 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"quest_maker/storage"
+)
+
+type serverStore struct {
+	s *Store
+}
+
+func (ss serverStore) Create(server storage.Server, host storage.Player, initialStep int) (int, error) {
+	var serverID int
+	err := ss.s.write(func(d *data) error {
+		if _, ok := d.quests[server.QuestID]; !ok {
+			return fmt.Errorf("quest %d not found", server.QuestID)
+		}
+		if _, ok := d.steps[initialStep]; !ok {
+			return fmt.Errorf("step %d not found", initialStep)
+		}
+		for _, other := range d.servers {
+			if other.InviteCode == server.InviteCode {
+				return fmt.Errorf("invite code %q is already used", server.InviteCode)
+			}
+		}
+
+		serverID = d.nextID("game_server")
+		d.servers[serverID] = storage.Server{
+			ID:                 serverID,
+			QuestID:            server.QuestID,
+			Name:               server.Name,
+			MaxPlayers:         server.MaxPlayers,
+			VoteTimeoutSeconds: server.VoteTimeoutSeconds,
+			AFKFallback:        server.AFKFallback,
+			IsPublic:           server.IsPublic,
+			InviteCode:         server.InviteCode,
+			PasswordHash:       server.PasswordHash,
+			Host:               host.Name,
+			AllowSpectators:    server.AllowSpectators,
+			Status:             storage.ServerStatusWaiting,
+			CreatedAt:          time.Now(),
+		}
+
+		host.ServerID = serverID
+		if err := d.addPlayer(host); err != nil {
+			return err
+		}
+
+		d.mps[serverID] = storage.MultiplayerPlaythrough{ID: d.nextID("multiplayer_playthrough"), ServerID: serverID, StepID: initialStep}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return serverID, nil
+}
+
+// Сервер вместе с названием квеста и количеством игроков
+func (d *data) server(id int) (*storage.Server, error) {
+	server, ok := d.servers[id]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	server.QuestTitle = d.quests[server.QuestID].Title
+	for _, player := range d.players {
+		if player.ServerID == id {
+			server.PlayerCount++
+		}
+	}
+	return &server, nil
+}
+
+func (ss serverStore) Get(id int) (*storage.Server, error) {
+	var server *storage.Server
+	err := ss.s.read(func(d *data) error {
+		var err error
+		server, err = d.server(id)
+		return err
+	})
+	return server, err
+}
+
+func (ss serverStore) GetByInviteCode(code string) (*storage.Server, error) {
+	var server *storage.Server
+	err := ss.s.read(func(d *data) error {
+		for id, s := range d.servers {
+			if s.InviteCode == strings.ToUpper(code) {
+				var err error
+				server, err = d.server(id)
+				return err
+			}
+		}
+		return storage.ErrNotFound
+	})
+	return server, err
+}
+
+func (ss serverStore) InviteCodeTaken(code string) (bool, error) {
+	var taken bool
+	err := ss.s.read(func(d *data) error {
+		for _, s := range d.servers {
+			if s.InviteCode == code {
+				taken = true
+			}
+		}
+		return nil
+	})
+	return taken, err
+}
+
+func (ss serverStore) HasActive(questID int) (bool, error) {
+	var active bool
+	err := ss.s.read(func(d *data) error {
+		for _, s := range d.servers {
+			if s.QuestID == questID && (s.Status == storage.ServerStatusWaiting || s.Status == storage.ServerStatusInProgress) {
+				active = true
+			}
+		}
+		return nil
+	})
+	return active, err
+}
+
+func (ss serverStore) ListPublic() ([]storage.Server, error) {
+	return ss.list(func(s storage.Server) bool {
+		return s.IsPublic && s.Status == storage.ServerStatusWaiting
+	})
+}
+
+func (ss serverStore) ListSpectatable() ([]storage.Server, error) {
+	return ss.list(func(s storage.Server) bool {
+		return s.IsPublic && s.Status == storage.ServerStatusInProgress && s.AllowSpectators
+	})
+}
+
+// Серверы, подходящие под условие match, новые сначала
+func (ss serverStore) list(match func(s storage.Server) bool) ([]storage.Server, error) {
+	var servers []storage.Server
+	err := ss.s.read(func(d *data) error {
+		for id, s := range d.servers {
+			if !match(s) {
+				continue
+			}
+			server, err := d.server(id)
+			if err != nil {
+				return err
+			}
+			servers = append(servers, *server)
+		}
+		return nil
+	})
+
+	sort.Slice(servers, func(i, j int) bool {
+		if !servers[i].CreatedAt.Equal(servers[j].CreatedAt) {
+			return servers[i].CreatedAt.After(servers[j].CreatedAt)
+		}
+		return servers[i].ID > servers[j].ID
+	})
+	return servers, err
+}
+
+// Транзакции и так выполняются по очереди, поэтому блокировать отдельный сервер не нужно
+func (ss serverStore) Lock(id int) (*storage.Server, error) {
+	return ss.Get(id)
+}
+
+func (ss serverStore) SetStatus(id int, status string) error {
+	return ss.s.write(func(d *data) error {
+		server, ok := d.servers[id]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		server.Status = status
+		d.servers[id] = server
+		return nil
+	})
+}
+
+func (ss serverStore) SetHost(id int, host string) error {
+	return ss.s.write(func(d *data) error {
+		server, ok := d.servers[id]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		server.Host = host
+		d.servers[id] = server
+		return nil
+	})
+}
+
+// Игроки сервера по времени входа
+func (d *data) serverPlayers(serverID int) []storage.Player {
+	var players []storage.Player
+	for _, player := range d.players {
+		if player.ServerID == serverID {
+			players = append(players, player)
+		}
+	}
+	sort.Slice(players, func(i, j int) bool {
+		if !players[i].JoinedAt.Equal(players[j].JoinedAt) {
+			return players[i].JoinedAt.Before(players[j].JoinedAt)
+		}
+		return players[i].ID < players[j].ID
+	})
+	return players
+}
+
+func (d *data) findPlayer(match func(storage.Player) bool) (int, bool) {
+	for id, player := range d.players {
+		if match(player) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (ss serverStore) Players(serverID int) ([]storage.Player, error) {
+	var players []storage.Player
+	err := ss.s.read(func(d *data) error {
+		players = d.serverPlayers(serverID)
+		return nil
+	})
+	return players, err
+}
+
+func (ss serverStore) PlayerBySession(token string) (*storage.Player, error) {
+	var player storage.Player
+	err := ss.s.read(func(d *data) error {
+		id, ok := d.findPlayer(func(p storage.Player) bool { return p.SessionToken == token })
+		if !ok {
+			return storage.ErrNotFound
+		}
+		player = d.players[id]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &player, nil
+}
+
+func (d *data) addPlayer(player storage.Player) error {
+	if _, ok := d.servers[player.ServerID]; !ok {
+		return fmt.Errorf("server %d not found", player.ServerID)
+	}
+
+	// Пользователь занимает на сервере одно место; игроки без пользователя не ограничены
+	_, taken := d.findPlayer(func(p storage.Player) bool {
+		return player.UserID != 0 && p.ServerID == player.ServerID && p.UserID == player.UserID
+	})
+	if taken {
+		return storage.ErrConflict
+	}
+	if _, used := d.findPlayer(func(p storage.Player) bool { return p.SessionToken == player.SessionToken }); used {
+		return fmt.Errorf("session token is already used")
+	}
+	if err := d.checkRoleFree(player.ServerID, player.Name, player.PlayerIndex); err != nil {
+		return err
+	}
+
+	id := d.nextID("server_player")
+	d.players[id] = storage.Player{
+		ID:           id,
+		ServerID:     player.ServerID,
+		Name:         player.Name,
+		UserID:       player.UserID,
+		PlayerIndex:  player.PlayerIndex,
+		SessionToken: player.SessionToken,
+		JoinedAt:     time.Now(),
+		LastSeenAt:   player.LastSeenAt,
+	}
+	return nil
+}
+
+func (ss serverStore) AddPlayer(player storage.Player) error {
+	return ss.s.write(func(d *data) error {
+		return d.addPlayer(player)
+	})
+}
+
+// Меняет игроков сервера с именем name; ErrNotFound, если таких нет
+func (d *data) updatePlayer(serverID int, name string, update func(p *storage.Player)) error {
+	found := false
+	for id, player := range d.players {
+		if player.ServerID == serverID && player.Name == name {
+			update(&player)
+			d.players[id] = player
+			found = true
+		}
+	}
+	if !found {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+// Как уникальный индекс (server_id, player_index): роль на сервере занимает один игрок
+func (d *data) checkRoleFree(serverID int, name string, playerIndex int) error {
+	_, taken := d.findPlayer(func(p storage.Player) bool {
+		return playerIndex != 0 && p.ServerID == serverID && p.PlayerIndex == playerIndex && p.Name != name
+	})
+	if taken {
+		return fmt.Errorf("role %d is already taken", playerIndex)
+	}
+	return nil
+}
+
+func (ss serverStore) SetPlayerRole(serverID int, name string, playerIndex int) error {
+	return ss.s.write(func(d *data) error {
+		err := d.updatePlayer(serverID, name, func(p *storage.Player) {
+			p.PlayerIndex = playerIndex
+			p.IsReady = false
+		})
+		if err != nil {
+			return err
+		}
+		return d.checkRoleFree(serverID, name, playerIndex)
+	})
+}
+
+func (ss serverStore) SetPlayerReady(serverID int, name string, ready bool) error {
+	return ss.s.write(func(d *data) error {
+		return d.updatePlayer(serverID, name, func(p *storage.Player) {
+			p.IsReady = ready
+		})
+	})
+}
+
+func (ss serverStore) RemovePlayer(serverID int, name string) error {
+	return ss.s.write(func(d *data) error {
+		found := false
+		for id, player := range d.players {
+			if player.ServerID == serverID && player.Name == name {
+				delete(d.players, id)
+				found = true
+			}
+		}
+		if !found {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (ss serverStore) TouchPlayer(token string, at time.Time) error {
+	return ss.s.write(func(d *data) error {
+		id, ok := d.findPlayer(func(p storage.Player) bool { return p.SessionToken == token })
+		if !ok {
+			return storage.ErrNotFound
+		}
+		player := d.players[id]
+		player.LastSeenAt = at
+		d.players[id] = player
+		return nil
+	})
+}
+
+func (ss serverStore) Playthrough(serverID int) (*storage.MultiplayerPlaythrough, error) {
+	var mp storage.MultiplayerPlaythrough
+	err := ss.s.read(func(d *data) error {
+		var ok bool
+		mp, ok = d.mps[serverID]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	mp.VoteDeadline = copyTime(mp.VoteDeadline)
+	return &mp, nil
+}
+
+func (ss serverStore) SavePlaythrough(mp storage.MultiplayerPlaythrough) error {
+	return ss.s.write(func(d *data) error {
+		saved, ok := d.mps[mp.ServerID]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		if _, ok := d.steps[mp.StepID]; !ok {
+			return fmt.Errorf("step %d not found", mp.StepID)
+		}
+		saved.StepID = mp.StepID
+		saved.Points = mp.Points
+		saved.VoteDeadline = copyTime(mp.VoteDeadline)
+		d.mps[mp.ServerID] = saved
+		return nil
+	})
+}
+
+func (ss serverStore) ExpiredVotes(now time.Time) ([]int, error) {
+	var serverIDs []int
+	err := ss.s.read(func(d *data) error {
+		for serverID, mp := range d.mps {
+			if d.servers[serverID].Status != storage.ServerStatusInProgress {
+				continue
+			}
+			if mp.VoteDeadline != nil && !mp.VoteDeadline.After(now) {
+				serverIDs = append(serverIDs, serverID)
+			}
+		}
+		return nil
+	})
+	sort.Ints(serverIDs)
+	return serverIDs, err
+}
+
+func (ss serverStore) Votes(serverID, stepID int) ([]storage.Vote, error) {
+	var votes []storage.Vote
+	err := ss.s.read(func(d *data) error {
+		for _, v := range d.votes {
+			if v.serverID == serverID && v.stepID == stepID {
+				votes = append(votes, v.Vote)
+			}
+		}
+		return nil
+	})
+	return votes, err
+}
+
+func (ss serverStore) SaveVote(serverID, stepID int, v storage.Vote, replace bool) error {
+	return ss.s.write(func(d *data) error {
+		// Как и в PostgreSQL, голос на сервере без прохождения просто не сохраняется
+		if _, ok := d.mps[serverID]; !ok {
+			return nil
+		}
+
+		for i, saved := range d.votes {
+			if saved.serverID == serverID && saved.stepID == stepID && saved.PlayerName == v.PlayerName {
+				if replace {
+					d.votes[i].ChoiceID = v.ChoiceID
+				}
+				return nil
+			}
+		}
+		d.votes = append(d.votes, vote{serverID: serverID, stepID: stepID, Vote: v})
+		return nil
+	})
+}
+
+func (ss serverStore) DeleteVote(serverID, stepID int, playerName string) error {
+	return ss.s.write(func(d *data) error {
+		d.votes = deleteWhere(d.votes, func(v vote) bool {
+			return v.serverID == serverID && v.stepID == stepID && v.PlayerName == playerName
+		})
+		return nil
+	})
+}
+
+func (ss serverStore) Spectators(serverID int) ([]storage.Spectator, error) {
+	var spectators []storage.Spectator
+	err := ss.s.read(func(d *data) error {
+		for _, spectator := range d.spectators {
+			if spectator.ServerID == serverID {
+				spectators = append(spectators, spectator)
+			}
+		}
+		return nil
+	})
+
+	sort.Slice(spectators, func(i, j int) bool {
+		if !spectators[i].JoinedAt.Equal(spectators[j].JoinedAt) {
+			return spectators[i].JoinedAt.Before(spectators[j].JoinedAt)
+		}
+		return spectators[i].ID < spectators[j].ID
+	})
+	return spectators, err
+}
+
+func (d *data) spectatorBySession(token string) (storage.Spectator, bool) {
+	for _, spectator := range d.spectators {
+		if spectator.SessionToken == token {
+			return spectator, true
+		}
+	}
+	return storage.Spectator{}, false
+}
+
+func (ss serverStore) SpectatorBySession(token string) (*storage.Spectator, error) {
+	var spectator storage.Spectator
+	err := ss.s.read(func(d *data) error {
+		var ok bool
+		spectator, ok = d.spectatorBySession(token)
+		if !ok {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &spectator, nil
+}
+
+func (ss serverStore) AddSpectator(spectator storage.Spectator) error {
+	return ss.s.write(func(d *data) error {
+		if _, ok := d.servers[spectator.ServerID]; !ok {
+			return fmt.Errorf("server %d not found", spectator.ServerID)
+		}
+		for _, other := range d.spectators {
+			if other.ServerID == spectator.ServerID && other.Name == spectator.Name {
+				return storage.ErrConflict
+			}
+		}
+		if _, used := d.spectatorBySession(spectator.SessionToken); used {
+			return fmt.Errorf("session token is already used")
+		}
+
+		id := d.nextID("server_spectator")
+		d.spectators[id] = storage.Spectator{
+			ID:           id,
+			ServerID:     spectator.ServerID,
+			Name:         spectator.Name,
+			UserID:       spectator.UserID,
+			SessionToken: spectator.SessionToken,
+			JoinedAt:     time.Now(),
+			LastSeenAt:   spectator.LastSeenAt,
+		}
+		return nil
+	})
+}
+
+func (ss serverStore) RemoveSpectator(token string) error {
+	return ss.s.write(func(d *data) error {
+		spectator, ok := d.spectatorBySession(token)
+		if !ok {
+			return storage.ErrNotFound
+		}
+		delete(d.spectators, spectator.ID)
+
+		// Голоса зрителя удаляются вместе с ним
+		d.audienceVotes = deleteWhere(d.audienceVotes, func(v audienceVote) bool {
+			return v.spectatorID == spectator.ID
+		})
+		return nil
+	})
+}
+
+func (ss serverStore) TouchSpectator(token string, at time.Time) error {
+	return ss.s.write(func(d *data) error {
+		spectator, ok := d.spectatorBySession(token)
+		if !ok {
+			return storage.ErrNotFound
+		}
+		spectator.LastSeenAt = at
+		d.spectators[spectator.ID] = spectator
+		return nil
+	})
+}
+
+func (ss serverStore) AudienceVotes(serverID, stepID int) (map[int]int, error) {
+	tally := make(map[int]int)
+	err := ss.s.read(func(d *data) error {
+		for _, v := range d.audienceVotes {
+			if v.serverID == serverID && v.stepID == stepID {
+				tally[v.choiceID]++
+			}
+		}
+		return nil
+	})
+	return tally, err
+}
+
+func (ss serverStore) SaveAudienceVote(serverID, stepID, spectatorID, choiceID int) error {
+	return ss.s.write(func(d *data) error {
+		if _, ok := d.mps[serverID]; !ok {
+			return storage.ErrNotFound
+		}
+		if _, ok := d.spectators[spectatorID]; !ok {
+			return fmt.Errorf("spectator %d not found", spectatorID)
+		}
+		if _, ok := d.choices[choiceID]; !ok {
+			return fmt.Errorf("choice %d not found", choiceID)
+		}
+
+		for i, v := range d.audienceVotes {
+			if v.serverID == serverID && v.stepID == stepID && v.spectatorID == spectatorID {
+				d.audienceVotes[i].choiceID = choiceID
+				return nil
+			}
+		}
+		d.audienceVotes = append(d.audienceVotes, audienceVote{serverID: serverID, stepID: stepID, spectatorID: spectatorID, choiceID: choiceID})
+		return nil
+	})
+}
+
+func deleteWhere[T any](items []T, match func(T) bool) []T {
+	var kept []T
+	for _, item := range items {
+		if !match(item) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
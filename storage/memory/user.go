@@ -0,0 +1,273 @@
+package memory
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"quest_maker/storage"
+)
+
+type userStore struct {
+	s *Store
+}
+
+func (us userStore) insert(username, passwordHash string, isGuest bool) (*storage.User, error) {
+	var user storage.User
+	err := us.s.write(func(d *data) error {
+		if _, ok := d.userByName(username); ok {
+			return storage.ErrConflict
+		}
+		user = storage.User{ID: d.nextID("app_user"), Username: username, PasswordHash: passwordHash, IsGuest: isGuest}
+		d.users[user.ID] = user
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (us userStore) Create(username, passwordHash string) (*storage.User, error) {
+	return us.insert(username, passwordHash, false)
+}
+
+func (us userStore) CreateGuest(username string) (*storage.User, error) {
+	return us.insert(username, "", true)
+}
+
+// Поиск по имени без учета регистра, как по индексу LOWER(username)
+func (d *data) userByName(username string) (storage.User, bool) {
+	for _, user := range d.users {
+		if strings.ToLower(user.Username) == strings.ToLower(username) {
+			return user, true
+		}
+	}
+	return storage.User{}, false
+}
+
+func (us userStore) Get(id int) (*storage.User, error) {
+	var user storage.User
+	err := us.s.read(func(d *data) error {
+		var ok bool
+		user, ok = d.users[id]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (us userStore) GetByName(username string) (*storage.User, error) {
+	var user storage.User
+	err := us.s.read(func(d *data) error {
+		var ok bool
+		user, ok = d.userByName(username)
+		if !ok {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (us userStore) CreateSession(userID int, tokenHash string, expiresAt time.Time) error {
+	return us.s.write(func(d *data) error {
+		if _, ok := d.users[userID]; !ok {
+			return fmt.Errorf("user %d not found", userID)
+		}
+		if _, ok := d.sessions[tokenHash]; ok {
+			return fmt.Errorf("session already exists")
+		}
+		d.sessions[tokenHash] = session{userID: userID, expiresAt: expiresAt}
+		return nil
+	})
+}
+
+func (us userStore) SessionUser(tokenHash string, now time.Time) (*storage.User, error) {
+	var user storage.User
+	err := us.s.read(func(d *data) error {
+		session, ok := d.sessions[tokenHash]
+		if !ok || !session.expiresAt.After(now) {
+			return storage.ErrNotFound
+		}
+		user, ok = d.users[session.userID]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (us userStore) DeleteSession(tokenHash string) error {
+	return us.s.write(func(d *data) error {
+		delete(d.sessions, tokenHash)
+		return nil
+	})
+}
+
+func (us userStore) CreateAPIToken(token *storage.APIToken) error {
+	return us.s.write(func(d *data) error {
+		if _, ok := d.users[token.UserID]; !ok {
+			return fmt.Errorf("user %d not found", token.UserID)
+		}
+
+		token.ID = d.nextID("api_token")
+		token.CreatedAt = time.Now()
+		d.apiTokens[token.ID] = storage.APIToken{
+			ID:        token.ID,
+			UserID:    token.UserID,
+			Name:      token.Name,
+			TokenHash: token.TokenHash,
+			Prefix:    token.Prefix,
+			Scopes:    slices.Clone(token.Scopes),
+			CreatedAt: token.CreatedAt,
+			ExpiresAt: copyTime(token.ExpiresAt),
+		}
+		return nil
+	})
+}
+
+func (us userStore) UseAPIToken(tokenHash string, now time.Time) (*storage.User, []string, error) {
+	var user storage.User
+	var scopes []string
+	err := us.s.write(func(d *data) error {
+		for id, token := range d.apiTokens {
+			if token.TokenHash != tokenHash || token.RevokedAt != nil {
+				continue
+			}
+			if token.ExpiresAt != nil && !token.ExpiresAt.After(now) {
+				continue
+			}
+
+			var ok bool
+			user, ok = d.users[token.UserID]
+			if !ok {
+				continue
+			}
+			token.LastUsedAt = &now
+			d.apiTokens[id] = token
+			scopes = slices.Clone(token.Scopes)
+			return nil
+		}
+		return storage.ErrNotFound
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &user, scopes, nil
+}
+
+func (us userStore) APITokens(userID int) ([]storage.APIToken, error) {
+	var tokens []storage.APIToken
+	err := us.s.read(func(d *data) error {
+		for _, token := range d.apiTokens {
+			if token.UserID != userID {
+				continue
+			}
+			token.Scopes = slices.Clone(token.Scopes)
+			token.LastUsedAt = copyTime(token.LastUsedAt)
+			token.ExpiresAt = copyTime(token.ExpiresAt)
+			token.RevokedAt = copyTime(token.RevokedAt)
+			tokens = append(tokens, token)
+		}
+		return nil
+	})
+
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+		}
+		return tokens[i].ID > tokens[j].ID
+	})
+	return tokens, err
+}
+
+func (us userStore) RevokeAPIToken(id, userID int, now time.Time) error {
+	return us.s.write(func(d *data) error {
+		token, ok := d.apiTokens[id]
+		if !ok || token.UserID != userID || token.RevokedAt != nil {
+			return storage.ErrNotFound
+		}
+		token.RevokedAt = &now
+		d.apiTokens[id] = token
+		return nil
+	})
+}
+
+func (us userStore) ClaimGuest(guest, account storage.User) error {
+	return us.s.write(func(d *data) error {
+		for id, p := range d.playthroughs {
+			if p.UserID == guest.ID {
+				p.UserID = account.ID
+				p.PlayerName = account.Username
+				d.playthroughs[id] = p
+			}
+		}
+
+		// Серверы, где учетная запись уже играет, остаются за гостем
+		var serverIDs []int
+		for _, player := range d.players {
+			if player.UserID != guest.ID {
+				continue
+			}
+			_, accountPlays := d.findPlayer(func(p storage.Player) bool {
+				return p.ServerID == player.ServerID && p.UserID == account.ID
+			})
+			if !accountPlays {
+				serverIDs = append(serverIDs, player.ServerID)
+			}
+		}
+
+		for _, serverID := range serverIDs {
+			for id, player := range d.players {
+				if player.ServerID == serverID && player.UserID == guest.ID {
+					player.UserID = account.ID
+					player.Name = account.Username
+					d.players[id] = player
+				}
+			}
+			for i, v := range d.votes {
+				if v.serverID == serverID && v.PlayerName == guest.Username {
+					d.votes[i].PlayerName = account.Username
+				}
+			}
+			if server := d.servers[serverID]; server.Host == guest.Username {
+				server.Host = account.Username
+				d.servers[serverID] = server
+			}
+		}
+
+		// Места зрителей переносятся, только если имя учетной записи на сервере свободно
+		for id, spectator := range d.spectators {
+			if spectator.UserID != guest.ID {
+				continue
+			}
+			nameTaken := false
+			for _, other := range d.spectators {
+				if other.ServerID == spectator.ServerID && other.Name == account.Username {
+					nameTaken = true
+				}
+			}
+			if !nameTaken {
+				spectator.UserID = account.ID
+				spectator.Name = account.Username
+				d.spectators[id] = spectator
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,25 @@
+package storage
+
+// Одиночное прохождение квеста
+type Playthrough struct {
+	ID         int
+	QuestID    int
+	QuestTitle string
+	UserID     int
+	PlayerName string
+	StepID     int
+	Finished   bool
+	Points     Points
+}
+
+type PlaythroughStore interface {
+	Create(p Playthrough) (int, error)
+	// Прохождение пользователя; чужое прохождение не находится
+	Get(id, userID int) (*Playthrough, error)
+	// Прохождения пользователя, последние сначала
+	List(userID int) ([]Playthrough, error)
+	// Переводит прохождение на шаг stepID и добавляет очки
+	Advance(id, userID, stepID int, points Points) error
+	// Завершает прохождение на текущем шаге и добавляет очки
+	Finish(id, userID int, points Points) error
+}
@@ -0,0 +1,97 @@
+// Пакет postgres - реализация storage.Store поверх PostgreSQL
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"quest_maker/storage"
+	"quest_maker/storage/sqlstore"
+)
+
+type conn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type Store struct {
+	db *sql.DB // nil внутри транзакции
+	q  conn
+}
+
+func New(db *sql.DB) *Store {
+	return &Store{db: db, q: db}
+}
+
+func (s *Store) Quests() storage.QuestStore             { return sqlstore.Quests(s.q, sqlstore.Postgres) }
+func (s *Store) Playthroughs() storage.PlaythroughStore { return sqlstore.Playthroughs(s.q) }
+func (s *Store) Servers() storage.ServerStore           { return serverStore{s.q} }
+func (s *Store) Users() storage.UserStore               { return userStore{s.q} }
+
+func (s *Store) Atomic(fn func(tx storage.Store) error) error {
+	// Вложенный вызов выполняется в уже открытой транзакции
+	if s.db == nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(&Store{q: tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Время хранится в колонках TIMESTAMP без часового пояса, поэтому всегда пишем UTC
+func utc(t time.Time) time.Time {
+	return t.UTC()
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: utc(*t), Valid: true}
+}
+
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func nullInt(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+// ErrNotFound, если запрос не изменил ни одной строки
+func affected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package postgres_test
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+
+	"quest_maker/migrator"
+	"quest_maker/storage"
+	"quest_maker/storage/postgres"
+	"quest_maker/storage/storagetest"
+)
+
+// Тесты контракта на настоящей базе; запускаются, только если задан TEST_DATABASE_URL.
+// База очищается перед каждым тестом, поэтому не указывайте рабочую
+func TestStoreContract(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close()
+
+	err = migrator.MustGetNewMigrator(os.DirFS("../../migrations"), ".").ApplyMigrations(db)
+	if err != nil {
+		t.Fatalf("Failed to apply migrations: %v", err)
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		truncateTables(t, db)
+		return postgres.New(db)
+	})
+}
+
+func truncateTables(t *testing.T, db *sql.DB) {
+	t.Helper()
+	rows, err := db.Query("SELECT tablename FROM pg_tables WHERE schemaname = 'public' AND tablename <> 'schema_migrations'")
+	if err != nil {
+		t.Fatalf("Failed to list tables: %v", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatalf("Failed to list tables: %v", err)
+		}
+		tables = append(tables, `"`+table+`"`)
+	}
+
+	if len(tables) > 0 {
+		_, err = db.Exec("TRUNCATE " + strings.Join(tables, ", ") + " RESTART IDENTITY CASCADE")
+		if err != nil {
+			t.Fatalf("Failed to clean database: %v", err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"quest_maker/storage"
+)
+
+type userStore struct {
+	q conn
+}
+
+func (s userStore) insert(username string, passwordHash sql.NullString, isGuest bool) (*storage.User, error) {
+	user := storage.User{Username: username, PasswordHash: passwordHash.String, IsGuest: isGuest}
+	err := s.q.QueryRow(`
+		INSERT INTO app_user (username, password_hash, is_guest) VALUES ($1, $2, $3)
+		ON CONFLICT (LOWER(username)) DO NOTHING
+		RETURNING id
+	`, username, passwordHash, isGuest).Scan(&user.ID)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s userStore) Create(username, passwordHash string) (*storage.User, error) {
+	return s.insert(username, sql.NullString{String: passwordHash, Valid: true}, false)
+}
+
+func (s userStore) CreateGuest(username string) (*storage.User, error) {
+	return s.insert(username, sql.NullString{}, true)
+}
+
+func (s userStore) Get(id int) (*storage.User, error) {
+	var user storage.User
+	err := s.q.QueryRow(`
+		SELECT id, username, COALESCE(is_guest, FALSE), COALESCE(password_hash, '') FROM app_user WHERE id = $1
+	`, id).Scan(&user.ID, &user.Username, &user.IsGuest, &user.PasswordHash)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s userStore) GetByName(username string) (*storage.User, error) {
+	var user storage.User
+	err := s.q.QueryRow(`
+		SELECT id, username, COALESCE(is_guest, FALSE), COALESCE(password_hash, '') FROM app_user WHERE LOWER(username) = LOWER($1)
+	`, username).Scan(&user.ID, &user.Username, &user.IsGuest, &user.PasswordHash)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s userStore) CreateSession(userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := s.q.Exec(
+		"INSERT INTO user_session (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		userID, tokenHash, utc(expiresAt),
+	)
+	return err
+}
+
+func (s userStore) SessionUser(tokenHash string, now time.Time) (*storage.User, error) {
+	var user storage.User
+	err := s.q.QueryRow(`
+		SELECT u.id, u.username, COALESCE(u.is_guest, FALSE), COALESCE(u.password_hash, '')
+		FROM user_session us
+		JOIN app_user u ON us.user_id = u.id
+		WHERE us.token_hash = $1 AND us.expires_at > $2
+	`, tokenHash, utc(now)).Scan(&user.ID, &user.Username, &user.IsGuest, &user.PasswordHash)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s userStore) DeleteSession(tokenHash string) error {
+	_, err := s.q.Exec("DELETE FROM user_session WHERE token_hash = $1", tokenHash)
+	return err
+}
+
+func (s userStore) CreateAPIToken(token *storage.APIToken) error {
+	return s.q.QueryRow(`
+		INSERT INTO api_token (user_id, name, token_hash, token_prefix, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, token.UserID, token.Name, token.TokenHash, token.Prefix, strings.Join(token.Scopes, " "), nullTime(token.ExpiresAt)).Scan(&token.ID, &token.CreatedAt)
+}
+
+func (s userStore) UseAPIToken(tokenHash string, now time.Time) (*storage.User, []string, error) {
+	var user storage.User
+	var scopes string
+	err := s.q.QueryRow(`
+		UPDATE api_token t SET last_used_at = $2
+		FROM app_user u
+		WHERE t.user_id = u.id AND t.token_hash = $1
+		  AND t.revoked_at IS NULL AND (t.expires_at IS NULL OR t.expires_at > $2)
+		RETURNING u.id, u.username, COALESCE(u.is_guest, FALSE), t.scopes
+	`, tokenHash, utc(now)).Scan(&user.ID, &user.Username, &user.IsGuest, &scopes)
+	if err != nil {
+		return nil, nil, notFound(err)
+	}
+	return &user, strings.Fields(scopes), nil
+}
+
+func (s userStore) APITokens(userID int) ([]storage.APIToken, error) {
+	rows, err := s.q.Query(`
+		SELECT id, user_id, name, token_hash, token_prefix, scopes, created_at, last_used_at, expires_at, revoked_at
+		FROM api_token
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []storage.APIToken
+	for rows.Next() {
+		var token storage.APIToken
+		var scopes string
+		var lastUsedAt, expiresAt, revokedAt sql.NullTime
+		err := rows.Scan(&token.ID, &token.UserID, &token.Name, &token.TokenHash, &token.Prefix, &scopes, &token.CreatedAt,
+			&lastUsedAt, &expiresAt, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Fields(scopes)
+		token.LastUsedAt = timePtr(lastUsedAt)
+		token.ExpiresAt = timePtr(expiresAt)
+		token.RevokedAt = timePtr(revokedAt)
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s userStore) RevokeAPIToken(id, userID int, now time.Time) error {
+	return affected(s.q.Exec(`
+		UPDATE api_token SET revoked_at = $3
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID, utc(now)))
+}
+
+func (s userStore) ClaimGuest(guest, account storage.User) error {
+	_, err := s.q.Exec(`
+		UPDATE playthrough SET user_id = $2, player_name = $3 WHERE user_id = $1
+	`, guest.ID, account.ID, account.Username)
+	if err != nil {
+		return fmt.Errorf("failed to move playthroughs: %v", err)
+	}
+
+	rows, err := s.q.Query(`
+		SELECT sp.server_id FROM server_player sp
+		WHERE sp.user_id = $1
+		  AND NOT EXISTS (SELECT 1 FROM server_player other WHERE other.server_id = sp.server_id AND other.user_id = $2)
+	`, guest.ID, account.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get guest servers: %v", err)
+	}
+	var serverIDs []int
+	for rows.Next() {
+		var serverID int
+		if err := rows.Scan(&serverID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan guest server: %v", err)
+		}
+		serverIDs = append(serverIDs, serverID)
+	}
+	rows.Close()
+
+	for _, serverID := range serverIDs {
+		_, err = s.q.Exec(`
+			UPDATE server_player SET user_id = $3, player_name = $4 WHERE server_id = $1 AND user_id = $2
+		`, serverID, guest.ID, account.ID, account.Username)
+		if err != nil {
+			return fmt.Errorf("failed to move server seat: %v", err)
+		}
+		_, err = s.q.Exec(`
+			UPDATE player_choice pc SET player_name = $3
+			FROM multiplayer_playthrough mp
+			WHERE pc.multiplayer_playthrough = mp.id AND mp.server_id = $1 AND pc.player_name = $2
+		`, serverID, guest.Username, account.Username)
+		if err != nil {
+			return fmt.Errorf("failed to move votes: %v", err)
+		}
+		_, err = s.q.Exec(`
+			UPDATE game_server SET host_player = $3 WHERE id = $1 AND host_player = $2
+		`, serverID, guest.Username, account.Username)
+		if err != nil {
+			return fmt.Errorf("failed to move host rights: %v", err)
+		}
+	}
+
+	_, err = s.q.Exec(`
+		UPDATE server_spectator ss SET user_id = $2, spectator_name = $3
+		WHERE ss.user_id = $1
+		  AND NOT EXISTS (SELECT 1 FROM server_spectator other WHERE other.server_id = ss.server_id AND other.spectator_name = $3)
+	`, guest.ID, account.ID, account.Username)
+	if err != nil {
+		return fmt.Errorf("failed to move spectator seats: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package storage
+
+import "time"
+
+const (
+	QuestStatusDraft     = "draft"
+	QuestStatusPublished = "published"
+	QuestStatusDeleted   = "deleted"
+)
+
+// Права пользователя на квест
+const (
+	AuthorRoleOwner  = "owner"
+	AuthorRoleEditor = "editor"
+	AuthorRoleViewer = "viewer"
+)
+
+// Типы шагов квеста
+const (
+	StepNarration       = "narration"
+	StepPlayerAction    = "player_action"
+	StepCharacterAction = "character_action"
+)
+
+type Quest struct {
+	ID          int
+	Title       string
+	Status      string
+	MaxPlayers  int
+	OwnerID     int
+	Owner       string // Имя владельца; пустое для квестов, созданных до учетных записей
+	InitialStep int
+	CreatedAt   time.Time
+}
+
+// Квест в списке вместе с ролью пользователя, запросившего список
+type QuestListItem struct {
+	Quest
+	MyRole string
+}
+
+type Role struct {
+	Position  int // Используется как player_index в выборах
+	Name      string
+	Character string
+}
+
+type Author struct {
+	UserID   int
+	Username string
+	Role     string
+}
+
+// Статус квеста и роль пользователя в нем
+type QuestAccess struct {
+	Status string
+	Role   string // Пустая строка, если пользователь не автор квеста
+}
+
+// Черновик доступен только авторам: они могут проходить его и создавать серверы для проверки
+func (a QuestAccess) CanPlay() bool {
+	return a.Status == QuestStatusPublished || a.Role != ""
+}
+
+func (a QuestAccess) CanEdit() bool {
+	return a.Role == AuthorRoleOwner || a.Role == AuthorRoleEditor
+}
+
+func (a QuestAccess) IsOwner() bool {
+	return a.Role == AuthorRoleOwner
+}
+
+type Step struct {
+	ID       int
+	Number   int
+	Type     string
+	NextStep int // 0 - последний шаг квеста
+
+	// narration
+	Text string
+
+	// player_action
+	VoteTimeoutSeconds *int // nil - таймаут сервера
+	AudiencePoll       bool
+	Choices            []Choice
+
+	// character_action
+	Character string
+	Lines     []CharacterLine
+}
+
+// Вариант выбора игрока на player_action шаге
+type Choice struct {
+	ID          int
+	StepID      int
+	Text        string
+	Points      Points
+	PlayerIndex int // 0 - доступен всем игрокам
+	IsDefault   bool
+	NextStep    int // 0 - переход самого шага
+}
+
+// Реплика персонажа на character_action шаге; выбирается по очкам прохождения
+type CharacterLine struct {
+	ID        int
+	Text      string
+	Condition Points
+	Priority  int
+	NextStep  int // 0 - следующий шаг по порядку
+}
+
+// NextStep шага в NewQuest: квест заканчивается на этом шаге
+const NextStepEnd = -1
+
+// Новый квест. NextStep шагов, вариантов выбора и реплик персонажей здесь - номер шага в квесте, начиная с 1.
+// Шаг с NextStep = 0 ведет к следующему по порядку, с NextStepEnd - завершает квест
+type NewQuest struct {
+	Title      string
+	MaxPlayers int
+	OwnerID    int
+	Characters []string
+	Roles      []Role // Position заполняется по порядку
+	Steps      []Step
+}
+
+// Номер шага, к которому ведет шаг с индексом i, или 0, если на нем квест заканчивается.
+// Неверный номер, как и 0, означает переход по порядку
+func (q NewQuest) NextStepNumber(i int) int {
+	next := q.Steps[i].NextStep
+	switch {
+	case next == NextStepEnd:
+		return 0
+	case next > 0 && next <= len(q.Steps):
+		return next
+	case i+1 < len(q.Steps):
+		return i + 2
+	default:
+		return 0
+	}
+}
+
+type QuestStore interface {
+	// Сохраняет квест черновиком вместе со всеми шагами
+	Create(quest NewQuest) (int, error)
+	Get(id int) (*Quest, error)
+	// Опубликованные квесты и черновики, в которых пользователь - автор; userID = 0 - анонимный запрос
+	List(userID int) ([]QuestListItem, error)
+	// ErrNotFound, если квеста нет или он удален
+	Access(questID, userID int) (QuestAccess, error)
+	// Пустой title и maxPlayers = 0 не меняют соответствующее поле
+	Update(id int, title string, maxPlayers int) error
+	// Заменяет название, число игроков, персонажей, роли и шаги квеста. Шаги, на которых стоят начатые
+	// прохождения, остаются в хранилище, но к квесту больше не относятся
+	Replace(id int, quest NewQuest) error
+	SetStatus(id int, status string) error
+
+	Roles(questID int) ([]Role, error)
+	// Объявленные персонажи квеста по порядку добавления, включая те, что не встречаются ни в ролях, ни в шагах
+	Characters(questID int) ([]string, error)
+	Authors(questID int) ([]Author, error)
+	// Добавляет соавтора или меняет его роль
+	SetAuthor(questID, userID int, role string) error
+	RemoveAuthor(questID int, username string) error
+
+	// Шаг со всеми вариантами выбора или репликами
+	Step(id int) (*Step, error)
+	// Все шаги квеста по номеру, включая недостижимые от начального. У квестов, созданных
+	// до миграции 18_step_quest, известны только шаги, достижимые от начального
+	Steps(questID int) ([]Step, error)
+	Choice(id int) (*Choice, error)
+}
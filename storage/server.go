@@ -0,0 +1,137 @@
+package storage
+
+import "time"
+
+const (
+	ServerStatusWaiting    = "waiting"
+	ServerStatusInProgress = "in_progress"
+	ServerStatusFinished   = "finished"
+	ServerStatusAbandoned  = "abandoned"
+)
+
+// Допустимые переходы статуса сервера; finished и abandoned - конечные состояния
+var serverStatusTransitions = map[string][]string{
+	ServerStatusWaiting:    {ServerStatusInProgress, ServerStatusAbandoned},
+	ServerStatusInProgress: {ServerStatusFinished, ServerStatusAbandoned},
+}
+
+func CanTransitionServerStatus(from, to string) bool {
+	for _, allowed := range serverStatusTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Стратегии для игроков, не успевших проголосовать до дедлайна
+const (
+	AFKFallbackRandom  = "random"
+	AFKFallbackDefault = "default"
+	AFKFallbackSkip    = "skip"
+)
+
+type Server struct {
+	ID                 int
+	QuestID            int
+	QuestTitle         string
+	Name               string
+	MaxPlayers         int
+	VoteTimeoutSeconds int // 0 - ждать всех игроков без ограничения
+	AFKFallback        string
+	IsPublic           bool
+	InviteCode         string
+	PasswordHash       string // Пустая строка - сервер без пароля
+	Host               string
+	AllowSpectators    bool
+	Status             string
+	CreatedAt          time.Time
+	PlayerCount        int
+}
+
+type Player struct {
+	ID           int
+	ServerID     int
+	Name         string
+	UserID       int
+	PlayerIndex  int // 0 - роль не выбрана
+	IsReady      bool
+	SessionToken string
+	JoinedAt     time.Time
+	LastSeenAt   time.Time
+}
+
+type Spectator struct {
+	ID           int
+	ServerID     int
+	Name         string
+	UserID       int
+	SessionToken string
+	JoinedAt     time.Time
+	LastSeenAt   time.Time
+}
+
+// Общее прохождение игроков сервера
+type MultiplayerPlaythrough struct {
+	ID           int
+	ServerID     int
+	StepID       int
+	Points       Points
+	VoteDeadline *time.Time // nil - голосование без ограничения по времени
+}
+
+// Голос игрока на шаге
+type Vote struct {
+	PlayerName string
+	ChoiceID   int
+}
+
+type ServerStore interface {
+	// Создает сервер, его хоста как первого игрока и общее прохождение с начального шага квеста
+	Create(server Server, host Player, initialStep int) (int, error)
+	Get(id int) (*Server, error)
+	GetByInviteCode(code string) (*Server, error)
+	InviteCodeTaken(code string) (bool, error)
+	// Есть ли у квеста серверы, ожидающие игроков или с идущей игрой
+	HasActive(questID int) (bool, error)
+	// Публичные серверы, ожидающие игроков; новые сначала
+	ListPublic() ([]Server, error)
+	// Публичные идущие игры, открытые для зрителей; новые сначала
+	ListSpectatable() ([]Server, error)
+	// Блокирует сервер до конца транзакции Atomic
+	Lock(id int) (*Server, error)
+	SetStatus(id int, status string) error
+	SetHost(id int, host string) error
+
+	// Игроки сервера по времени входа
+	Players(serverID int) ([]Player, error)
+	PlayerBySession(token string) (*Player, error)
+	// ErrConflict, если пользователь уже на сервере
+	AddPlayer(player Player) error
+	// Назначает игроку роль (0 - снимает ее) и сбрасывает готовность
+	SetPlayerRole(serverID int, name string, playerIndex int) error
+	SetPlayerReady(serverID int, name string, ready bool) error
+	RemovePlayer(serverID int, name string) error
+	TouchPlayer(token string, at time.Time) error
+
+	Playthrough(serverID int) (*MultiplayerPlaythrough, error)
+	// Сохраняет текущий шаг, очки и дедлайн голосования
+	SavePlaythrough(mp MultiplayerPlaythrough) error
+	// Серверы идущих игр, у которых дедлайн голосования наступил к моменту now
+	ExpiredVotes(now time.Time) ([]int, error)
+
+	Votes(serverID, stepID int) ([]Vote, error)
+	// Сохраняет голос; если игрок уже голосовал на шаге, голос заменяется только при replace
+	SaveVote(serverID, stepID int, vote Vote, replace bool) error
+	DeleteVote(serverID, stepID int, playerName string) error
+
+	Spectators(serverID int) ([]Spectator, error)
+	SpectatorBySession(token string) (*Spectator, error)
+	// ErrConflict, если зритель с таким именем уже на сервере
+	AddSpectator(spectator Spectator) error
+	RemoveSpectator(token string) error
+	TouchSpectator(token string, at time.Time) error
+	// Количество голосов зрителей по вариантам шага
+	AudienceVotes(serverID, stepID int) (map[int]int, error)
+	SaveAudienceVote(serverID, stepID, spectatorID, choiceID int) error
+}
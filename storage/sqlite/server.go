@@ -0,0 +1,415 @@
+package sqlite
+
+import (
+	"database/sql"
+	"time"
+
+	"quest_maker/storage"
+)
+
+type serverStore struct {
+	q conn
+}
+
+const serverColumns = `
+	gs.id, gs.quest_id, q.title, gs.server_name, gs.max_players, COALESCE(gs.vote_timeout_seconds, 0), gs.afk_fallback,
+	gs.is_public, gs.invite_code, COALESCE(gs.password_hash, ''), COALESCE(gs.host_player, ''), gs.allow_spectators,
+	gs.status, gs.created_at, (SELECT COUNT(*) FROM server_player sp WHERE sp.server_id = gs.id)
+`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanServer(row scanner) (*storage.Server, error) {
+	var s storage.Server
+	var createdAt timestamp
+	err := row.Scan(&s.ID, &s.QuestID, &s.QuestTitle, &s.Name, &s.MaxPlayers, &s.VoteTimeoutSeconds, &s.AFKFallback,
+		&s.IsPublic, &s.InviteCode, &s.PasswordHash, &s.Host, &s.AllowSpectators,
+		&s.Status, &createdAt, &s.PlayerCount)
+	if err != nil {
+		return nil, err
+	}
+	s.CreatedAt = createdAt.Time
+	return &s, nil
+}
+
+func (s serverStore) Create(server storage.Server, host storage.Player, initialStep int) (int, error) {
+	var serverID int
+	err := s.q.QueryRow(`
+		INSERT INTO game_server (quest_id, server_name, max_players, vote_timeout_seconds, afk_fallback, is_public, invite_code, password_hash, host_player, allow_spectators)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id
+	`, server.QuestID, server.Name, server.MaxPlayers, nullInt(server.VoteTimeoutSeconds), server.AFKFallback, server.IsPublic,
+		server.InviteCode, nullString(server.PasswordHash), host.Name, server.AllowSpectators).Scan(&serverID)
+	if err != nil {
+		return 0, err
+	}
+
+	host.ServerID = serverID
+	if err := s.AddPlayer(host); err != nil {
+		return 0, err
+	}
+
+	_, err = s.q.Exec("INSERT INTO multiplayer_playthrough (server_id, current_step) VALUES ($1, $2)", serverID, initialStep)
+	if err != nil {
+		return 0, err
+	}
+	return serverID, nil
+}
+
+func (s serverStore) Get(id int) (*storage.Server, error) {
+	server, err := scanServer(s.q.QueryRow(`
+		SELECT `+serverColumns+`
+		FROM game_server gs
+		JOIN quest q ON gs.quest_id = q.id
+		WHERE gs.id = $1
+	`, id))
+	return server, notFound(err)
+}
+
+func (s serverStore) GetByInviteCode(code string) (*storage.Server, error) {
+	server, err := scanServer(s.q.QueryRow(`
+		SELECT `+serverColumns+`
+		FROM game_server gs
+		JOIN quest q ON gs.quest_id = q.id
+		WHERE gs.invite_code = UPPER($1)
+	`, code))
+	return server, notFound(err)
+}
+
+func (s serverStore) InviteCodeTaken(code string) (bool, error) {
+	var exists bool
+	err := s.q.QueryRow("SELECT EXISTS (SELECT 1 FROM game_server WHERE invite_code = $1)", code).Scan(&exists)
+	return exists, err
+}
+
+func (s serverStore) HasActive(questID int) (bool, error) {
+	var exists bool
+	err := s.q.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM game_server WHERE quest_id = $1 AND status IN ('waiting', 'in_progress'))
+	`, questID).Scan(&exists)
+	return exists, err
+}
+
+func (s serverStore) ListPublic() ([]storage.Server, error) {
+	return s.list("gs.is_public = true AND gs.status = 'waiting'")
+}
+
+func (s serverStore) ListSpectatable() ([]storage.Server, error) {
+	return s.list("gs.is_public = true AND gs.status = 'in_progress' AND gs.allow_spectators")
+}
+
+// Серверы, подходящие под условие where, новые сначала
+func (s serverStore) list(where string) ([]storage.Server, error) {
+	rows, err := s.q.Query(`
+		SELECT ` + serverColumns + `
+		FROM game_server gs
+		JOIN quest q ON gs.quest_id = q.id
+		WHERE ` + where + `
+		ORDER BY gs.created_at DESC, gs.id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var servers []storage.Server
+	for rows.Next() {
+		server, err := scanServer(rows)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, *server)
+	}
+	return servers, rows.Err()
+}
+
+// Транзакции и так идут по очереди через единственное соединение, см. Open
+func (s serverStore) Lock(id int) (*storage.Server, error) {
+	return s.Get(id)
+}
+
+func (s serverStore) SetStatus(id int, status string) error {
+	return affected(s.q.Exec("UPDATE game_server SET status = $2 WHERE id = $1", id, status))
+}
+
+func (s serverStore) SetHost(id int, host string) error {
+	return affected(s.q.Exec("UPDATE game_server SET host_player = $2 WHERE id = $1", id, nullString(host)))
+}
+
+const playerColumns = `
+	id, server_id, player_name, COALESCE(user_id, 0), COALESCE(player_index, 0), COALESCE(is_ready, FALSE),
+	session_token, joined_at, COALESCE(last_seen_at, joined_at)
+`
+
+func scanPlayer(row scanner) (*storage.Player, error) {
+	var p storage.Player
+	var joinedAt, lastSeenAt timestamp
+	err := row.Scan(&p.ID, &p.ServerID, &p.Name, &p.UserID, &p.PlayerIndex, &p.IsReady, &p.SessionToken, &joinedAt, &lastSeenAt)
+	if err != nil {
+		return nil, err
+	}
+	p.JoinedAt = joinedAt.Time
+	p.LastSeenAt = lastSeenAt.Time
+	return &p, nil
+}
+
+func (s serverStore) Players(serverID int) ([]storage.Player, error) {
+	rows, err := s.q.Query(`
+		SELECT `+playerColumns+`
+		FROM server_player
+		WHERE server_id = $1
+		ORDER BY joined_at, id
+	`, serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var players []storage.Player
+	for rows.Next() {
+		player, err := scanPlayer(rows)
+		if err != nil {
+			return nil, err
+		}
+		players = append(players, *player)
+	}
+	return players, rows.Err()
+}
+
+func (s serverStore) PlayerBySession(token string) (*storage.Player, error) {
+	player, err := scanPlayer(s.q.QueryRow(`
+		SELECT `+playerColumns+` FROM server_player WHERE session_token = $1
+	`, token))
+	return player, notFound(err)
+}
+
+func (s serverStore) AddPlayer(player storage.Player) error {
+	var id int
+	err := s.q.QueryRow(`
+		INSERT INTO server_player (server_id, player_name, user_id, player_index, session_token, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (server_id, user_id) DO NOTHING
+		RETURNING id
+	`, player.ServerID, player.Name, nullInt(player.UserID), nullInt(player.PlayerIndex), player.SessionToken, utc(player.LastSeenAt)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return storage.ErrConflict
+	}
+	return err
+}
+
+func (s serverStore) SetPlayerRole(serverID int, name string, playerIndex int) error {
+	return affected(s.q.Exec(`
+		UPDATE server_player SET player_index = $3, is_ready = FALSE
+		WHERE server_id = $1 AND player_name = $2
+	`, serverID, name, nullInt(playerIndex)))
+}
+
+func (s serverStore) SetPlayerReady(serverID int, name string, ready bool) error {
+	return affected(s.q.Exec(`
+		UPDATE server_player SET is_ready = $3 WHERE server_id = $1 AND player_name = $2
+	`, serverID, name, ready))
+}
+
+func (s serverStore) RemovePlayer(serverID int, name string) error {
+	return affected(s.q.Exec("DELETE FROM server_player WHERE server_id = $1 AND player_name = $2", serverID, name))
+}
+
+func (s serverStore) TouchPlayer(token string, at time.Time) error {
+	return affected(s.q.Exec("UPDATE server_player SET last_seen_at = $2 WHERE session_token = $1", token, utc(at)))
+}
+
+func (s serverStore) Playthrough(serverID int) (*storage.MultiplayerPlaythrough, error) {
+	var mp storage.MultiplayerPlaythrough
+	var deadline timestamp
+	err := s.q.QueryRow(`
+		SELECT id, server_id, current_step, violence_point, whatever_point, pacifism_point, vote_deadline
+		FROM multiplayer_playthrough
+		WHERE server_id = $1
+	`, serverID).Scan(&mp.ID, &mp.ServerID, &mp.StepID, &mp.Points.Violence, &mp.Points.Whatever, &mp.Points.Pacifism, &deadline)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	mp.VoteDeadline = timePtr(deadline)
+	return &mp, nil
+}
+
+func (s serverStore) SavePlaythrough(mp storage.MultiplayerPlaythrough) error {
+	return affected(s.q.Exec(`
+		UPDATE multiplayer_playthrough
+		SET current_step = $2, violence_point = $3, whatever_point = $4, pacifism_point = $5, vote_deadline = $6
+		WHERE server_id = $1
+	`, mp.ServerID, mp.StepID, mp.Points.Violence, mp.Points.Whatever, mp.Points.Pacifism, nullTime(mp.VoteDeadline)))
+}
+
+func (s serverStore) ExpiredVotes(now time.Time) ([]int, error) {
+	rows, err := s.q.Query(`
+		SELECT mp.server_id
+		FROM multiplayer_playthrough mp
+		JOIN game_server gs ON mp.server_id = gs.id
+		WHERE gs.status = 'in_progress' AND mp.vote_deadline <= $1
+		ORDER BY mp.server_id
+	`, utc(now))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var serverIDs []int
+	for rows.Next() {
+		var serverID int
+		if err := rows.Scan(&serverID); err != nil {
+			return nil, err
+		}
+		serverIDs = append(serverIDs, serverID)
+	}
+	return serverIDs, rows.Err()
+}
+
+func (s serverStore) Votes(serverID, stepID int) ([]storage.Vote, error) {
+	rows, err := s.q.Query(`
+		SELECT pc.player_name, pc.choice_id
+		FROM player_choice pc
+		JOIN multiplayer_playthrough mp ON pc.multiplayer_playthrough = mp.id
+		WHERE mp.server_id = $1 AND pc.step_id = $2
+		ORDER BY pc.id
+	`, serverID, stepID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var votes []storage.Vote
+	for rows.Next() {
+		var vote storage.Vote
+		if err := rows.Scan(&vote.PlayerName, &vote.ChoiceID); err != nil {
+			return nil, err
+		}
+		votes = append(votes, vote)
+	}
+	return votes, rows.Err()
+}
+
+func (s serverStore) SaveVote(serverID, stepID int, vote storage.Vote, replace bool) error {
+	onConflict := "DO NOTHING"
+	if replace {
+		onConflict = "DO UPDATE SET choice_id = EXCLUDED.choice_id"
+	}
+	_, err := s.q.Exec(`
+		INSERT INTO player_choice (multiplayer_playthrough, player_name, choice_id, step_id)
+		SELECT mp.id, $2, $3, $4 FROM multiplayer_playthrough mp WHERE mp.server_id = $1
+		ON CONFLICT (multiplayer_playthrough, player_name, step_id) `+onConflict,
+		serverID, vote.PlayerName, vote.ChoiceID, stepID)
+	return err
+}
+
+func (s serverStore) DeleteVote(serverID, stepID int, playerName string) error {
+	_, err := s.q.Exec(`
+		DELETE FROM player_choice
+		WHERE multiplayer_playthrough IN (SELECT id FROM multiplayer_playthrough WHERE server_id = $1)
+		  AND step_id = $2 AND player_name = $3
+	`, serverID, stepID, playerName)
+	return err
+}
+
+const spectatorColumns = `
+	id, server_id, spectator_name, COALESCE(user_id, 0), session_token, joined_at, COALESCE(last_seen_at, joined_at)
+`
+
+func scanSpectator(row scanner) (*storage.Spectator, error) {
+	var sp storage.Spectator
+	var joinedAt, lastSeenAt timestamp
+	err := row.Scan(&sp.ID, &sp.ServerID, &sp.Name, &sp.UserID, &sp.SessionToken, &joinedAt, &lastSeenAt)
+	if err != nil {
+		return nil, err
+	}
+	sp.JoinedAt = joinedAt.Time
+	sp.LastSeenAt = lastSeenAt.Time
+	return &sp, nil
+}
+
+func (s serverStore) Spectators(serverID int) ([]storage.Spectator, error) {
+	rows, err := s.q.Query(`
+		SELECT `+spectatorColumns+`
+		FROM server_spectator
+		WHERE server_id = $1
+		ORDER BY joined_at, id
+	`, serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var spectators []storage.Spectator
+	for rows.Next() {
+		spectator, err := scanSpectator(rows)
+		if err != nil {
+			return nil, err
+		}
+		spectators = append(spectators, *spectator)
+	}
+	return spectators, rows.Err()
+}
+
+func (s serverStore) SpectatorBySession(token string) (*storage.Spectator, error) {
+	spectator, err := scanSpectator(s.q.QueryRow(`
+		SELECT `+spectatorColumns+` FROM server_spectator WHERE session_token = $1
+	`, token))
+	return spectator, notFound(err)
+}
+
+func (s serverStore) AddSpectator(spectator storage.Spectator) error {
+	var id int
+	err := s.q.QueryRow(`
+		INSERT INTO server_spectator (server_id, spectator_name, user_id, session_token, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (server_id, spectator_name) DO NOTHING
+		RETURNING id
+	`, spectator.ServerID, spectator.Name, nullInt(spectator.UserID), spectator.SessionToken, utc(spectator.LastSeenAt)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return storage.ErrConflict
+	}
+	return err
+}
+
+func (s serverStore) RemoveSpectator(token string) error {
+	return affected(s.q.Exec("DELETE FROM server_spectator WHERE session_token = $1", token))
+}
+
+func (s serverStore) TouchSpectator(token string, at time.Time) error {
+	return affected(s.q.Exec("UPDATE server_spectator SET last_seen_at = $2 WHERE session_token = $1", token, utc(at)))
+}
+
+func (s serverStore) AudienceVotes(serverID, stepID int) (map[int]int, error) {
+	rows, err := s.q.Query(`
+		SELECT av.choice_id, COUNT(*)
+		FROM audience_vote av
+		JOIN multiplayer_playthrough mp ON av.multiplayer_playthrough = mp.id
+		WHERE mp.server_id = $1 AND av.step_id = $2
+		GROUP BY av.choice_id
+	`, serverID, stepID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tally := make(map[int]int)
+	for rows.Next() {
+		var choiceID, votes int
+		if err := rows.Scan(&choiceID, &votes); err != nil {
+			return nil, err
+		}
+		tally[choiceID] = votes
+	}
+	return tally, rows.Err()
+}
+
+func (s serverStore) SaveAudienceVote(serverID, stepID, spectatorID, choiceID int) error {
+	return affected(s.q.Exec(`
+		INSERT INTO audience_vote (multiplayer_playthrough, spectator_id, choice_id, step_id)
+		SELECT mp.id, $2, $3, $4 FROM multiplayer_playthrough mp WHERE mp.server_id = $1
+		ON CONFLICT (multiplayer_playthrough, spectator_id, step_id)
+		DO UPDATE SET choice_id = EXCLUDED.choice_id, created_at = CURRENT_TIMESTAMP
+	`, serverID, spectatorID, choiceID, stepID))
+}
@@ -0,0 +1,123 @@
+// Пакет sqlite - реализация storage.Store поверх файла SQLite для запуска без PostgreSQL
+package sqlite
+
+import (
+	"database/sql"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"quest_maker/storage"
+	"quest_maker/storage/sqlstore"
+)
+
+// Открывает файл базы, создавая его при необходимости
+func Open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite допускает одного писателя; одно соединение выстраивает транзакции в очередь,
+	// поэтому Lock может обойтись без SELECT ... FOR UPDATE
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+type conn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type Store struct {
+	db *sql.DB // nil внутри транзакции
+	q  conn
+}
+
+func New(db *sql.DB) *Store {
+	return &Store{db: db, q: db}
+}
+
+func (s *Store) Quests() storage.QuestStore             { return sqlstore.Quests(s.q, sqlstore.SQLite) }
+func (s *Store) Playthroughs() storage.PlaythroughStore { return sqlstore.Playthroughs(s.q) }
+func (s *Store) Servers() storage.ServerStore           { return serverStore{s.q} }
+func (s *Store) Users() storage.UserStore               { return userStore{s.q} }
+
+func (s *Store) Atomic(fn func(tx storage.Store) error) error {
+	// Вложенный вызов выполняется в уже открытой транзакции
+	if s.db == nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(&Store{q: tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Время хранится текстом в UTC. Ширина дробной части постоянна,
+// чтобы строки сравнивались в том же порядке, что и моменты времени
+const timeLayout = "2006-01-02 15:04:05.000000"
+
+func utc(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+func nullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: utc(*t), Valid: true}
+}
+
+// Время из базы, см. sqlstore.Timestamp
+type timestamp = sqlstore.Timestamp
+
+func timePtr(ts timestamp) *time.Time {
+	if !ts.Valid {
+		return nil
+	}
+	return &ts.Time
+}
+
+func nullInt(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+// ErrNotFound, если запрос не изменил ни одной строки
+func affected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package sqlite_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"quest_maker/migrator"
+	"quest_maker/storage"
+	"quest_maker/storage/sqlite"
+	"quest_maker/storage/storagetest"
+)
+
+// Каждый тест получает новый файл базы во временном каталоге
+func TestStoreContract(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		db, err := sqlite.Open(filepath.Join(t.TempDir(), "quest.db"))
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		err = migrator.MustGetNewMigrator(os.DirFS("../../migrations/sqlite"), ".").ApplySQLiteMigrations(db)
+		if err != nil {
+			t.Fatalf("Failed to apply migrations: %v", err)
+		}
+		return sqlite.New(db)
+	})
+}
@@ -0,0 +1,81 @@
+package sqlstore
+
+import "quest_maker/storage"
+
+type playthroughStore struct {
+	q Conn
+}
+
+func (s playthroughStore) Create(p storage.Playthrough) (int, error) {
+	var id int
+	err := s.q.QueryRow(
+		"INSERT INTO playthrough (player_name, user_id, quest, step) VALUES ($1, $2, $3, $4) RETURNING id",
+		p.PlayerName, nullInt(p.UserID), p.QuestID, p.StepID,
+	).Scan(&id)
+	return id, err
+}
+
+func (s playthroughStore) Get(id, userID int) (*storage.Playthrough, error) {
+	var p storage.Playthrough
+	err := s.q.QueryRow(`
+		SELECT p.id, p.quest, q.title, COALESCE(p.user_id, 0), p.player_name, p.step, COALESCE(p.finished, FALSE),
+		       p.violence_point, p.whatever_point, p.pacifism_point
+		FROM playthrough p
+		JOIN quest q ON p.quest = q.id
+		WHERE p.id = $1 AND p.user_id = $2
+	`, id, userID).Scan(&p.ID, &p.QuestID, &p.QuestTitle, &p.UserID, &p.PlayerName, &p.StepID, &p.Finished,
+		&p.Points.Violence, &p.Points.Whatever, &p.Points.Pacifism)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &p, nil
+}
+
+func (s playthroughStore) List(userID int) ([]storage.Playthrough, error) {
+	rows, err := s.q.Query(`
+		SELECT p.id, p.quest, q.title, COALESCE(p.user_id, 0), p.player_name, p.step, COALESCE(p.finished, FALSE),
+		       p.violence_point, p.whatever_point, p.pacifism_point
+		FROM playthrough p
+		JOIN quest q ON p.quest = q.id
+		WHERE p.user_id = $1
+		ORDER BY p.id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var playthroughs []storage.Playthrough
+	for rows.Next() {
+		var p storage.Playthrough
+		err := rows.Scan(&p.ID, &p.QuestID, &p.QuestTitle, &p.UserID, &p.PlayerName, &p.StepID, &p.Finished,
+			&p.Points.Violence, &p.Points.Whatever, &p.Points.Pacifism)
+		if err != nil {
+			return nil, err
+		}
+		playthroughs = append(playthroughs, p)
+	}
+	return playthroughs, rows.Err()
+}
+
+func (s playthroughStore) Advance(id, userID, stepID int, points storage.Points) error {
+	return affected(s.q.Exec(`
+		UPDATE playthrough
+		SET step = $3,
+			violence_point = violence_point + $4,
+			whatever_point = whatever_point + $5,
+			pacifism_point = pacifism_point + $6
+		WHERE id = $1 AND user_id = $2
+	`, id, userID, stepID, points.Violence, points.Whatever, points.Pacifism))
+}
+
+func (s playthroughStore) Finish(id, userID int, points storage.Points) error {
+	return affected(s.q.Exec(`
+		UPDATE playthrough
+		SET finished = TRUE,
+			violence_point = violence_point + $3,
+			whatever_point = whatever_point + $4,
+			pacifism_point = pacifism_point + $5
+		WHERE id = $1 AND user_id = $2
+	`, id, userID, points.Violence, points.Whatever, points.Pacifism))
+}
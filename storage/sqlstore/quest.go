@@ -0,0 +1,528 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+
+	"quest_maker/storage"
+)
+
+type questStore struct {
+	q Conn
+	d Dialect
+}
+
+func (s questStore) Create(quest storage.NewQuest) (int, error) {
+	var questID int
+	err := s.q.QueryRow(
+		fmt.Sprintf("INSERT INTO quest (title, max_players, owner_id, status, created_at, updated_at) VALUES ($1, $2, $3, $4, %[1]s, %[1]s) RETURNING id", s.d.Now),
+		quest.Title, quest.MaxPlayers, nullInt(quest.OwnerID), storage.QuestStatusDraft,
+	).Scan(&questID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert quest: %v", err)
+	}
+
+	if err := s.insertContent(questID, quest); err != nil {
+		return 0, err
+	}
+	return questID, nil
+}
+
+// Персонажи, роли и шаги квеста; начальным становится первый шаг
+func (s questStore) insertContent(questID int, quest storage.NewQuest) error {
+	// Персонаж, уже объявленный в квесте, остается прежней строкой: на нее ссылаются старые шаги
+	characterIDs := make(map[string]int)
+	for _, name := range quest.Characters {
+		var charID int
+		err := s.q.QueryRow("SELECT id FROM character WHERE quest = $1 AND name = $2 AND NOT detached", questID, name).Scan(&charID)
+		if err == sql.ErrNoRows {
+			err = s.q.QueryRow("INSERT INTO character (quest, name) VALUES ($1, $2) RETURNING id", questID, name).Scan(&charID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to insert character: %v", err)
+		}
+		characterIDs[name] = charID
+	}
+
+	for i, role := range quest.Roles {
+		var characterID sql.NullInt64
+		if role.Character != "" {
+			charID, exists := characterIDs[role.Character]
+			if !exists {
+				return fmt.Errorf("character %q not found", role.Character)
+			}
+			characterID = nullInt(charID)
+		}
+		_, err := s.q.Exec("INSERT INTO quest_role (quest, name, position, character) VALUES ($1, $2, $3, $4)", questID, role.Name, i+1, characterID)
+		if err != nil {
+			return fmt.Errorf("failed to insert role: %v", err)
+		}
+	}
+
+	// Сначала создаем все шаги без содержимого, чтобы реплики могли ссылаться на любой шаг
+	stepIDs := make([]int, len(quest.Steps))
+	for i := range quest.Steps {
+		err := s.q.QueryRow(fmt.Sprintf("INSERT INTO step (quest, number, created_at, updated_at) VALUES ($1, $2, %[1]s, %[1]s) RETURNING id", s.d.Now), questID, i+1).Scan(&stepIDs[i])
+		if err != nil {
+			return fmt.Errorf("failed to insert step: %v", err)
+		}
+	}
+
+	// Шаг ведет к следующему по порядку или к шагу, заданному в NextStep
+	for i := range stepIDs {
+		next := quest.NextStepNumber(i)
+		if next == 0 {
+			continue
+		}
+		_, err := s.q.Exec("UPDATE step SET next_step = $1 WHERE id = $2", stepIDs[next-1], stepIDs[i])
+		if err != nil {
+			return fmt.Errorf("failed to update next_step: %v", err)
+		}
+	}
+
+	for i, step := range quest.Steps {
+		stepID := stepIDs[i]
+
+		switch step.Type {
+		case storage.StepNarration:
+			_, err := s.q.Exec("INSERT INTO narration_action (step, text) VALUES ($1, $2)", stepID, step.Text)
+			if err != nil {
+				return fmt.Errorf("failed to insert narration action: %v", err)
+			}
+
+		case storage.StepPlayerAction:
+			var voteTimeout sql.NullInt64
+			if step.VoteTimeoutSeconds != nil {
+				voteTimeout = sql.NullInt64{Int64: int64(*step.VoteTimeoutSeconds), Valid: true}
+			}
+
+			var playerActionID int
+			err := s.q.QueryRow(
+				"INSERT INTO player_action (step, vote_timeout_seconds, audience_poll) VALUES ($1, $2, $3) RETURNING id",
+				stepID, voteTimeout, step.AudiencePoll,
+			).Scan(&playerActionID)
+			if err != nil {
+				return fmt.Errorf("failed to insert player action: %v", err)
+			}
+
+			for _, c := range step.Choices {
+				// Как и у реплик, неверный номер шага означает переход самого шага
+				var nextStepID sql.NullInt64
+				if c.NextStep > 0 && c.NextStep <= len(stepIDs) {
+					nextStepID = nullInt(stepIDs[c.NextStep-1])
+				}
+
+				_, err := s.q.Exec(
+					"INSERT INTO player_action_choice (player_action, text, violence_point, whatever_point, pacifism_point, player_index, is_default, next_step) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+					playerActionID, c.Text, c.Points.Violence, c.Points.Whatever, c.Points.Pacifism, c.PlayerIndex, c.IsDefault, nextStepID,
+				)
+				if err != nil {
+					return fmt.Errorf("failed to insert player action choice: %v", err)
+				}
+			}
+
+		case storage.StepCharacterAction:
+			charID, exists := characterIDs[step.Character]
+			if !exists {
+				return fmt.Errorf("character %q not found", step.Character)
+			}
+
+			var characterActionID int
+			err := s.q.QueryRow("INSERT INTO character_action (character, step) VALUES ($1, $2) RETURNING id", charID, stepID).Scan(&characterActionID)
+			if err != nil {
+				return fmt.Errorf("failed to insert character action: %v", err)
+			}
+
+			for _, line := range step.Lines {
+				// Номер шага превращаем в его ID; неверный номер означает переход по порядку
+				var nextStepID sql.NullInt64
+				if line.NextStep > 0 && line.NextStep <= len(stepIDs) {
+					nextStepID = nullInt(stepIDs[line.NextStep-1])
+				}
+
+				_, err = s.q.Exec(
+					"INSERT INTO character_action_choice (character_action, text, violence_point_condition, whatever_point_condition, pacifism_point_condition, priority, next_step) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+					characterActionID, line.Text,
+					line.Condition.Violence, line.Condition.Whatever, line.Condition.Pacifism,
+					line.Priority, nextStepID,
+				)
+				if err != nil {
+					return fmt.Errorf("failed to insert character action choice: %v", err)
+				}
+			}
+
+		default:
+			return fmt.Errorf("unknown step type %q", step.Type)
+		}
+	}
+
+	if len(stepIDs) > 0 {
+		_, err := s.q.Exec("UPDATE quest SET initial_step = $1 WHERE id = $2", stepIDs[0], questID)
+		if err != nil {
+			return fmt.Errorf("failed to update quest initial_step: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Старые шаги отвязываются от квеста, но остаются в базе: на них могут стоять начатые прохождения.
+// Персонажи с прежними именами сохраняются, а убранные из квеста удаляются или, если на них
+// ссылаются старые шаги, отвязываются
+func (s questStore) Replace(id int, quest storage.NewQuest) error {
+	err := affected(s.q.Exec(
+		fmt.Sprintf("UPDATE quest SET title = $2, max_players = $3, updated_at = %s WHERE id = $1 AND status <> $4", s.d.Now),
+		id, quest.Title, quest.MaxPlayers, storage.QuestStatusDeleted,
+	))
+	if err != nil {
+		return err
+	}
+	if _, err := s.q.Exec("UPDATE step SET quest = NULL WHERE quest = $1", id); err != nil {
+		return fmt.Errorf("failed to detach steps: %v", err)
+	}
+	if _, err := s.q.Exec("DELETE FROM quest_role WHERE quest = $1", id); err != nil {
+		return fmt.Errorf("failed to delete roles: %v", err)
+	}
+	if err := s.removeCharacters(id, quest.Characters); err != nil {
+		return err
+	}
+	return s.insertContent(id, quest)
+}
+
+// Убирает из квеста персонажей, которых нет среди keep
+func (s questStore) removeCharacters(questID int, keep []string) error {
+	current, err := s.characters(questID)
+	if err != nil {
+		return err
+	}
+	for _, c := range current {
+		if slices.Contains(keep, c.name) {
+			continue
+		}
+		_, err := s.q.Exec("DELETE FROM character WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM character_action ca WHERE ca.character = $1)", c.id)
+		if err != nil {
+			return fmt.Errorf("failed to delete character: %v", err)
+		}
+		if _, err := s.q.Exec("UPDATE character SET detached = TRUE WHERE id = $1", c.id); err != nil {
+			return fmt.Errorf("failed to detach character: %v", err)
+		}
+	}
+	return nil
+}
+
+type character struct {
+	id   int
+	name string
+}
+
+func (s questStore) characters(questID int) ([]character, error) {
+	rows, err := s.q.Query("SELECT id, name FROM character WHERE quest = $1 AND NOT detached ORDER BY id", questID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var characters []character
+	for rows.Next() {
+		var c character
+		if err := rows.Scan(&c.id, &c.name); err != nil {
+			return nil, err
+		}
+		characters = append(characters, c)
+	}
+	return characters, rows.Err()
+}
+
+func (s questStore) Characters(questID int) ([]string, error) {
+	characters, err := s.characters(questID)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, c := range characters {
+		names = append(names, c.name)
+	}
+	return names, nil
+}
+
+func (s questStore) Get(id int) (*storage.Quest, error) {
+	var quest storage.Quest
+	var createdAt Timestamp
+	err := s.q.QueryRow(`
+		SELECT q.id, q.title, q.status, q.max_players, COALESCE(q.owner_id, 0), COALESCE(u.username, ''),
+		       COALESCE(q.initial_step, 0), q.created_at
+		FROM quest q
+		LEFT JOIN app_user u ON q.owner_id = u.id
+		WHERE q.id = $1
+	`, id).Scan(&quest.ID, &quest.Title, &quest.Status, &quest.MaxPlayers, &quest.OwnerID, &quest.Owner, &quest.InitialStep, &createdAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	quest.CreatedAt = createdAt.Time
+	return &quest, nil
+}
+
+func (s questStore) List(userID int) ([]storage.QuestListItem, error) {
+	rows, err := s.q.Query(`
+		SELECT q.id, q.title, q.status, q.max_players, COALESCE(q.owner_id, 0), COALESCE(u.username, ''),
+		       COALESCE(q.initial_step, 0), q.created_at,
+		       COALESCE(CASE WHEN q.owner_id = $1 THEN 'owner' ELSE qa.role END, '')
+		FROM quest q
+		LEFT JOIN app_user u ON q.owner_id = u.id
+		LEFT JOIN quest_author qa ON qa.quest = q.id AND qa.user_id = $1
+		WHERE q.status = 'published'
+		   OR (q.status = 'draft' AND (q.owner_id = $1 OR qa.id IS NOT NULL))
+		ORDER BY q.created_at DESC, q.id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var quests []storage.QuestListItem
+	for rows.Next() {
+		var item storage.QuestListItem
+		var createdAt Timestamp
+		err := rows.Scan(&item.ID, &item.Title, &item.Status, &item.MaxPlayers, &item.OwnerID, &item.Owner,
+			&item.InitialStep, &createdAt, &item.MyRole)
+		if err != nil {
+			return nil, err
+		}
+		item.CreatedAt = createdAt.Time
+		quests = append(quests, item)
+	}
+	return quests, rows.Err()
+}
+
+func (s questStore) Access(questID, userID int) (storage.QuestAccess, error) {
+	var access storage.QuestAccess
+	var role sql.NullString
+	err := s.q.QueryRow(`
+		SELECT q.status,
+		       CASE WHEN q.owner_id = $2 THEN 'owner' ELSE qa.role END
+		FROM quest q
+		LEFT JOIN quest_author qa ON qa.quest = q.id AND qa.user_id = $2
+		WHERE q.id = $1 AND q.status <> 'deleted'
+	`, questID, userID).Scan(&access.Status, &role)
+	if err != nil {
+		return access, notFound(err)
+	}
+	access.Role = role.String
+	return access, nil
+}
+
+func (s questStore) Update(id int, title string, maxPlayers int) error {
+	return affected(s.q.Exec(fmt.Sprintf(`
+		UPDATE quest
+		SET title = COALESCE(NULLIF($2, ''), title),
+			max_players = COALESCE(NULLIF($3, 0), max_players),
+			updated_at = %s
+		WHERE id = $1
+	`, s.d.Now), id, title, maxPlayers))
+}
+
+func (s questStore) SetStatus(id int, status string) error {
+	return affected(s.q.Exec(fmt.Sprintf("UPDATE quest SET status = $2, updated_at = %s WHERE id = $1", s.d.Now), id, status))
+}
+
+func (s questStore) Roles(questID int) ([]storage.Role, error) {
+	rows, err := s.q.Query(`
+		SELECT qr.position, qr.name, COALESCE(c.name, '')
+		FROM quest_role qr
+		LEFT JOIN character c ON qr.character = c.id
+		WHERE qr.quest = $1
+		ORDER BY qr.position
+	`, questID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []storage.Role
+	for rows.Next() {
+		var role storage.Role
+		if err := rows.Scan(&role.Position, &role.Name, &role.Character); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (s questStore) Authors(questID int) ([]storage.Author, error) {
+	rows, err := s.q.Query(`
+		SELECT qa.user_id, u.username, qa.role
+		FROM quest_author qa
+		JOIN app_user u ON qa.user_id = u.id
+		WHERE qa.quest = $1
+		ORDER BY qa.created_at, qa.id
+	`, questID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var authors []storage.Author
+	for rows.Next() {
+		var author storage.Author
+		if err := rows.Scan(&author.UserID, &author.Username, &author.Role); err != nil {
+			return nil, err
+		}
+		authors = append(authors, author)
+	}
+	return authors, rows.Err()
+}
+
+func (s questStore) SetAuthor(questID, userID int, role string) error {
+	_, err := s.q.Exec(`
+		INSERT INTO quest_author (quest, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (quest, user_id) DO UPDATE SET role = EXCLUDED.role
+	`, questID, userID, role)
+	return err
+}
+
+func (s questStore) RemoveAuthor(questID int, username string) error {
+	return affected(s.q.Exec(`
+		DELETE FROM quest_author
+		WHERE quest = $1 AND user_id IN (SELECT id FROM app_user WHERE LOWER(username) = LOWER($2))
+	`, questID, username))
+}
+
+func (s questStore) Step(id int) (*storage.Step, error) {
+	step := storage.Step{ID: id}
+	var nextStep sql.NullInt64
+	var text, character sql.NullString
+	var voteTimeout sql.NullInt64
+	var audiencePoll sql.NullBool
+	err := s.q.QueryRow(`
+		SELECT s.number, s.next_step,
+		       CASE
+		           WHEN pa.id IS NOT NULL THEN 'player_action'
+		           WHEN ca.id IS NOT NULL THEN 'character_action'
+		           ELSE 'narration'
+		       END,
+		       na.text, pa.vote_timeout_seconds, pa.audience_poll, c.name
+		FROM step s
+		LEFT JOIN narration_action na ON s.id = na.step
+		LEFT JOIN player_action pa ON s.id = pa.step
+		LEFT JOIN character_action ca ON s.id = ca.step
+		LEFT JOIN character c ON ca.character = c.id
+		WHERE s.id = $1
+	`, id).Scan(&step.Number, &nextStep, &step.Type, &text, &voteTimeout, &audiencePoll, &character)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	step.NextStep = int(nextStep.Int64)
+	step.Text = text.String
+	step.AudiencePoll = audiencePoll.Bool
+	step.Character = character.String
+	if voteTimeout.Valid {
+		timeout := int(voteTimeout.Int64)
+		step.VoteTimeoutSeconds = &timeout
+	}
+
+	switch step.Type {
+	case storage.StepPlayerAction:
+		rows, err := s.q.Query(`
+			SELECT pac.id, pac.text, pac.violence_point, pac.whatever_point, pac.pacifism_point, pac.player_index, pac.is_default,
+			       COALESCE(pac.next_step, 0)
+			FROM player_action_choice pac
+			JOIN player_action pa ON pac.player_action = pa.id
+			WHERE pa.step = $1
+			ORDER BY pac.id
+		`, id)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			choice := storage.Choice{StepID: id}
+			err := rows.Scan(&choice.ID, &choice.Text, &choice.Points.Violence, &choice.Points.Whatever, &choice.Points.Pacifism,
+				&choice.PlayerIndex, &choice.IsDefault, &choice.NextStep)
+			if err != nil {
+				return nil, err
+			}
+			step.Choices = append(step.Choices, choice)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+	case storage.StepCharacterAction:
+		rows, err := s.q.Query(`
+			SELECT cac.id, cac.text, cac.violence_point_condition, cac.whatever_point_condition, cac.pacifism_point_condition,
+			       cac.priority, COALESCE(cac.next_step, 0)
+			FROM character_action_choice cac
+			JOIN character_action ca ON cac.character_action = ca.id
+			WHERE ca.step = $1
+			ORDER BY cac.id
+		`, id)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var line storage.CharacterLine
+			err := rows.Scan(&line.ID, &line.Text, &line.Condition.Violence, &line.Condition.Whatever, &line.Condition.Pacifism,
+				&line.Priority, &line.NextStep)
+			if err != nil {
+				return nil, err
+			}
+			step.Lines = append(step.Lines, line)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &step, nil
+}
+
+func (s questStore) Steps(questID int) ([]storage.Step, error) {
+	rows, err := s.q.Query("SELECT id FROM step WHERE quest = $1 ORDER BY number", questID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	steps := make([]storage.Step, 0, len(ids))
+	for _, id := range ids {
+		step, err := s.Step(id)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, *step)
+	}
+	return steps, nil
+}
+
+func (s questStore) Choice(id int) (*storage.Choice, error) {
+	var choice storage.Choice
+	err := s.q.QueryRow(`
+		SELECT pac.id, pa.step, pac.text, pac.violence_point, pac.whatever_point, pac.pacifism_point, pac.player_index, pac.is_default,
+		       COALESCE(pac.next_step, 0)
+		FROM player_action_choice pac
+		JOIN player_action pa ON pac.player_action = pa.id
+		WHERE pac.id = $1
+	`, id).Scan(&choice.ID, &choice.StepID, &choice.Text, &choice.Points.Violence, &choice.Points.Whatever, &choice.Points.Pacifism,
+		&choice.PlayerIndex, &choice.IsDefault, &choice.NextStep)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &choice, nil
+}
@@ -0,0 +1,96 @@
+// Пакет sqlstore - запросы к квестам и одиночным прохождениям, общие для storage/postgres и storage/sqlite.
+// Чем отличаются диалекты, описывает Dialect. Запросы серверов и пользователей расходятся сильнее
+// (блокировки, UPDATE ... FROM) и остаются в пакетах драйверов
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"quest_maker/storage"
+)
+
+// *sql.DB или *sql.Tx
+type Conn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Различия SQL-диалектов, от которых зависят общие запросы
+type Dialect struct {
+	Now string // Выражение текущего времени для created_at и updated_at
+}
+
+var (
+	Postgres = Dialect{Now: "NOW()"}
+	SQLite   = Dialect{Now: "CURRENT_TIMESTAMP"}
+)
+
+func Quests(q Conn, d Dialect) storage.QuestStore {
+	return questStore{q: q, d: d}
+}
+
+func Playthroughs(q Conn) storage.PlaythroughStore {
+	return playthroughStore{q: q}
+}
+
+// Время из базы. PostgreSQL и колонки TIMESTAMP в SQLite драйвер отдает как time.Time,
+// а результаты выражений вроде COALESCE в SQLite - строкой
+type Timestamp struct {
+	Time  time.Time
+	Valid bool
+}
+
+func (ts *Timestamp) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*ts = Timestamp{}
+		return nil
+	case time.Time:
+		*ts = Timestamp{Time: v.UTC(), Valid: true}
+		return nil
+	case string:
+		return ts.parse(v)
+	case []byte:
+		return ts.parse(string(v))
+	}
+	return fmt.Errorf("unsupported time value %T", value)
+}
+
+func (ts *Timestamp) parse(s string) error {
+	// Дробная часть необязательна: CURRENT_TIMESTAMP пишет время с точностью до секунды
+	t, err := time.Parse("2006-01-02 15:04:05.999999999", s)
+	if err != nil {
+		return err
+	}
+	*ts = Timestamp{Time: t, Valid: true}
+	return nil
+}
+
+func nullInt(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
+
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+// ErrNotFound, если запрос не изменил ни одной строки
+func affected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
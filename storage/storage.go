@@ -0,0 +1,40 @@
+// Пакет storage описывает хранилище квестов, прохождений, серверов и пользователей.
+// Обработчики работают только с этими интерфейсами; реализация для PostgreSQL - в storage/postgres
+package storage
+
+import "errors"
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("already exists")
+)
+
+type Store interface {
+	Quests() QuestStore
+	Playthroughs() PlaythroughStore
+	Servers() ServerStore
+	Users() UserStore
+
+	// Выполняет fn в одной транзакции: если fn вернула ошибку, изменения откатываются.
+	// Внутри fn нужно работать только с переданным хранилищем
+	Atomic(fn func(tx Store) error) error
+}
+
+// Очки категорий: насилие, пофигизм, пацифизм
+type Points struct {
+	Violence int
+	Whatever int
+	Pacifism int
+}
+
+func (p Points) Add(other Points) Points {
+	return Points{
+		Violence: p.Violence + other.Violence,
+		Whatever: p.Whatever + other.Whatever,
+		Pacifism: p.Pacifism + other.Pacifism,
+	}
+}
+
+func (p Points) Sub(other Points) Points {
+	return p.Add(Points{Violence: -other.Violence, Whatever: -other.Whatever, Pacifism: -other.Pacifism})
+}
@@ -0,0 +1,1156 @@
+// Пакет storagetest - общий набор тестов контракта storage.Store.
+// Каждая реализация хранилища должна проходить его целиком
+package storagetest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"quest_maker/storage"
+)
+
+// Запускает все тесты контракта; newStore должна возвращать пустое хранилище
+func Run(t *testing.T, newStore func(t *testing.T) storage.Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store storage.Store)
+	}{
+		{"Users", testUsers},
+		{"Sessions", testSessions},
+		{"APITokens", testAPITokens},
+		{"Quests", testQuests},
+		{"QuestAccess", testQuestAccess},
+		{"QuestAuthors", testQuestAuthors},
+		{"Playthroughs", testPlaythroughs},
+		{"Servers", testServers},
+		{"Players", testPlayers},
+		{"Votes", testVotes},
+		{"Spectators", testSpectators},
+		{"Atomic", testAtomic},
+		{"Lock", testLock},
+		{"ClaimGuest", testClaimGuest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+// Шаги квеста из fixture в порядке прохождения
+type questSteps struct {
+	questID   int
+	narration int
+	vote      int
+	reply     int
+	ending    int
+	attack    int // Выбор первой роли на шаге vote
+	leave     int // Общий выбор по умолчанию на шаге vote
+}
+
+func createUser(t *testing.T, store storage.Store, username string) *storage.User {
+	t.Helper()
+	user, err := store.Users().Create(username, "hash-"+username)
+	if err != nil {
+		t.Fatalf("Failed to create user %s: %v", username, err)
+	}
+	return user
+}
+
+func createQuest(t *testing.T, store storage.Store, ownerID int) questSteps {
+	t.Helper()
+	timeout := 30
+	questID, err := store.Quests().Create(storage.NewQuest{
+		Title:      "Приключения Каджита",
+		MaxPlayers: 2,
+		OwnerID:    ownerID,
+		Characters: []string{"Каджит", "Стражник"},
+		Roles: []storage.Role{
+			{Name: "Вор", Character: "Каджит"},
+			{Name: "Маг"},
+		},
+		Steps: []storage.Step{
+			{Type: storage.StepNarration, Text: "Каджит вышел из кустов."},
+			{
+				Type:               storage.StepPlayerAction,
+				VoteTimeoutSeconds: &timeout,
+				AudiencePoll:       true,
+				Choices: []storage.Choice{
+					{Text: "Напасть", Points: storage.Points{Violence: 2}, PlayerIndex: 1},
+					{Text: "Уйти", Points: storage.Points{Pacifism: 1}, IsDefault: true, NextStep: 4},
+				},
+			},
+			{
+				Type:      storage.StepCharacterAction,
+				Character: "Стражник",
+				Lines: []storage.CharacterLine{
+					{Text: "Стой!", Condition: storage.Points{Violence: 2}, Priority: 1, NextStep: 1},
+					{Text: "Проходи.", NextStep: 99},
+				},
+			},
+			{Type: storage.StepNarration, Text: "Конец."},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create quest: %v", err)
+	}
+
+	quest, err := store.Quests().Get(questID)
+	if err != nil {
+		t.Fatalf("Failed to get quest: %v", err)
+	}
+
+	// Проходим по цепочке next_step от начального шага
+	var ids []int
+	for id := quest.InitialStep; id != 0; {
+		step, err := store.Quests().Step(id)
+		if err != nil {
+			t.Fatalf("Failed to get step %d: %v", id, err)
+		}
+		ids = append(ids, id)
+		id = step.NextStep
+	}
+	if len(ids) != 4 {
+		t.Fatalf("Expected 4 chained steps, got %d", len(ids))
+	}
+
+	vote, err := store.Quests().Step(ids[1])
+	if err != nil {
+		t.Fatalf("Failed to get step: %v", err)
+	}
+	if len(vote.Choices) != 2 {
+		t.Fatalf("Expected 2 choices, got %d", len(vote.Choices))
+	}
+
+	return questSteps{
+		questID:   questID,
+		narration: ids[0],
+		vote:      ids[1],
+		reply:     ids[2],
+		ending:    ids[3],
+		attack:    vote.Choices[0].ID,
+		leave:     vote.Choices[1].ID,
+	}
+}
+
+func createServer(t *testing.T, store storage.Store, quest questSteps, host *storage.User, code string) int {
+	t.Helper()
+	serverID, err := store.Servers().Create(storage.Server{
+		QuestID:         quest.questID,
+		Name:            "Сервер " + code,
+		MaxPlayers:      2,
+		AFKFallback:     storage.AFKFallbackRandom,
+		IsPublic:        true,
+		InviteCode:      code,
+		AllowSpectators: true,
+	}, storage.Player{
+		Name:         host.Username,
+		UserID:       host.ID,
+		SessionToken: code + "-" + host.Username,
+		LastSeenAt:   time.Now(),
+	}, quest.narration)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	return serverID
+}
+
+func addPlayer(t *testing.T, store storage.Store, serverID int, user *storage.User) {
+	t.Helper()
+	err := store.Servers().AddPlayer(storage.Player{
+		ServerID:     serverID,
+		Name:         user.Username,
+		UserID:       user.ID,
+		SessionToken: fmt.Sprintf("%d-%s", serverID, user.Username),
+		LastSeenAt:   time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to add player %s: %v", user.Username, err)
+	}
+}
+
+func playerNames(t *testing.T, store storage.Store, serverID int) []string {
+	t.Helper()
+	players, err := store.Servers().Players(serverID)
+	if err != nil {
+		t.Fatalf("Failed to get players: %v", err)
+	}
+	var names []string
+	for _, player := range players {
+		names = append(names, player.Name)
+	}
+	return names
+}
+
+func expectErr(t *testing.T, err, want error, what string) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Errorf("%s: expected %v, got %v", what, want, err)
+	}
+}
+
+func expectNoErr(t *testing.T, err error, what string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+}
+
+func expectNames(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func testUsers(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	if alice.ID == 0 || alice.IsGuest {
+		t.Errorf("Expected a regular user with an ID, got %+v", alice)
+	}
+
+	// Имена уникальны без учета регистра
+	_, err := store.Users().Create("alice", "other")
+	expectErr(t, err, storage.ErrConflict, "Create with a taken name")
+	_, err = store.Users().CreateGuest("ALICE")
+	expectErr(t, err, storage.ErrConflict, "CreateGuest with a taken name")
+
+	found, err := store.Users().GetByName("aLiCe")
+	expectNoErr(t, err, "GetByName")
+	if found.ID != alice.ID || found.Username != "Alice" || found.PasswordHash != "hash-Alice" {
+		t.Errorf("Expected Alice, got %+v", found)
+	}
+
+	guest, err := store.Users().CreateGuest("guest-1")
+	expectNoErr(t, err, "CreateGuest")
+	got, err := store.Users().Get(guest.ID)
+	expectNoErr(t, err, "Get")
+	if !got.IsGuest || got.PasswordHash != "" || got.Username != "guest-1" {
+		t.Errorf("Expected a guest without password, got %+v", got)
+	}
+
+	_, err = store.Users().Get(guest.ID + alice.ID + 100)
+	expectErr(t, err, storage.ErrNotFound, "Get of a missing user")
+	_, err = store.Users().GetByName("nobody")
+	expectErr(t, err, storage.ErrNotFound, "GetByName of a missing user")
+}
+
+func testSessions(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	now := time.Now()
+
+	expectNoErr(t, store.Users().CreateSession(alice.ID, "session-hash", now.Add(time.Hour)), "CreateSession")
+
+	user, err := store.Users().SessionUser("session-hash", now)
+	expectNoErr(t, err, "SessionUser")
+	if user.ID != alice.ID {
+		t.Errorf("Expected user %d, got %d", alice.ID, user.ID)
+	}
+
+	_, err = store.Users().SessionUser("session-hash", now.Add(2*time.Hour))
+	expectErr(t, err, storage.ErrNotFound, "SessionUser after expiry")
+	_, err = store.Users().SessionUser("unknown-hash", now)
+	expectErr(t, err, storage.ErrNotFound, "SessionUser of an unknown session")
+
+	expectNoErr(t, store.Users().DeleteSession("session-hash"), "DeleteSession")
+	_, err = store.Users().SessionUser("session-hash", now)
+	expectErr(t, err, storage.ErrNotFound, "SessionUser after logout")
+
+	// Удаление несуществующей сессии - не ошибка
+	expectNoErr(t, store.Users().DeleteSession("session-hash"), "DeleteSession twice")
+}
+
+func testAPITokens(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	bob := createUser(t, store, "Bob")
+	now := time.Now()
+
+	first := &storage.APIToken{UserID: alice.ID, Name: "ci", TokenHash: "hash-1", Prefix: "qm_1", Scopes: []string{"quests:read", "quests:write"}}
+	expectNoErr(t, store.Users().CreateAPIToken(first), "CreateAPIToken")
+	if first.ID == 0 || first.CreatedAt.IsZero() {
+		t.Errorf("Expected ID and CreatedAt to be filled, got %+v", first)
+	}
+
+	expired := now.Add(-time.Minute)
+	second := &storage.APIToken{UserID: alice.ID, Name: "old", TokenHash: "hash-2", Prefix: "qm_2", Scopes: []string{"quests:read"}, ExpiresAt: &expired}
+	expectNoErr(t, store.Users().CreateAPIToken(second), "CreateAPIToken")
+
+	user, scopes, err := store.Users().UseAPIToken("hash-1", now)
+	expectNoErr(t, err, "UseAPIToken")
+	if user.ID != alice.ID {
+		t.Errorf("Expected user %d, got %d", alice.ID, user.ID)
+	}
+	expectNames(t, scopes, "quests:read", "quests:write")
+
+	_, _, err = store.Users().UseAPIToken("hash-2", now)
+	expectErr(t, err, storage.ErrNotFound, "UseAPIToken of an expired token")
+	_, _, err = store.Users().UseAPIToken("unknown", now)
+	expectErr(t, err, storage.ErrNotFound, "UseAPIToken of an unknown token")
+
+	tokens, err := store.Users().APITokens(alice.ID)
+	expectNoErr(t, err, "APITokens")
+	if len(tokens) != 2 {
+		t.Fatalf("Expected 2 tokens, got %d", len(tokens))
+	}
+	if tokens[0].ID != second.ID || tokens[1].ID != first.ID {
+		t.Errorf("Expected newest token first, got %d, %d", tokens[0].ID, tokens[1].ID)
+	}
+	if tokens[1].LastUsedAt == nil || tokens[0].LastUsedAt != nil {
+		t.Errorf("Expected only the used token to have LastUsedAt")
+	}
+	if tokens[0].ExpiresAt == nil || tokens[0].Prefix != "qm_2" || tokens[0].Name != "old" {
+		t.Errorf("Unexpected token %+v", tokens[0])
+	}
+
+	// Чужой токен отозвать нельзя
+	expectErr(t, store.Users().RevokeAPIToken(first.ID, bob.ID, now), storage.ErrNotFound, "RevokeAPIToken by another user")
+
+	expectNoErr(t, store.Users().RevokeAPIToken(first.ID, alice.ID, now), "RevokeAPIToken")
+	expectErr(t, store.Users().RevokeAPIToken(first.ID, alice.ID, now), storage.ErrNotFound, "RevokeAPIToken twice")
+	_, _, err = store.Users().UseAPIToken("hash-1", now)
+	expectErr(t, err, storage.ErrNotFound, "UseAPIToken of a revoked token")
+
+	tokens, err = store.Users().APITokens(bob.ID)
+	expectNoErr(t, err, "APITokens")
+	if len(tokens) != 0 {
+		t.Errorf("Expected no tokens for Bob, got %d", len(tokens))
+	}
+}
+
+func testQuests(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	steps := createQuest(t, store, alice.ID)
+
+	quest, err := store.Quests().Get(steps.questID)
+	expectNoErr(t, err, "Get")
+	if quest.Title != "Приключения Каджита" || quest.Status != storage.QuestStatusDraft ||
+		quest.MaxPlayers != 2 || quest.OwnerID != alice.ID || quest.Owner != "Alice" {
+		t.Errorf("Unexpected quest %+v", quest)
+	}
+
+	narration, err := store.Quests().Step(steps.narration)
+	expectNoErr(t, err, "Step")
+	if narration.Type != storage.StepNarration || narration.Text != "Каджит вышел из кустов." || narration.Number != 1 {
+		t.Errorf("Unexpected narration step %+v", narration)
+	}
+
+	vote, err := store.Quests().Step(steps.vote)
+	expectNoErr(t, err, "Step")
+	if vote.Type != storage.StepPlayerAction || !vote.AudiencePoll || vote.VoteTimeoutSeconds == nil || *vote.VoteTimeoutSeconds != 30 {
+		t.Errorf("Unexpected player action step %+v", vote)
+	}
+	attack := vote.Choices[0]
+	if attack.Text != "Напасть" || attack.Points.Violence != 2 || attack.PlayerIndex != 1 || attack.IsDefault || attack.StepID != steps.vote {
+		t.Errorf("Unexpected choice %+v", attack)
+	}
+	if !vote.Choices[1].IsDefault || vote.Choices[1].PlayerIndex != 0 {
+		t.Errorf("Expected a default choice for all players, got %+v", vote.Choices[1])
+	}
+	// Номер шага у варианта превращается в ID шага, без номера остается переход шага
+	if attack.NextStep != 0 || vote.Choices[1].NextStep != steps.ending {
+		t.Errorf("Expected only the second choice to lead to the ending, got %+v", vote.Choices)
+	}
+
+	choice, err := store.Quests().Choice(steps.leave)
+	expectNoErr(t, err, "Choice")
+	if choice.StepID != steps.vote || choice.Points.Pacifism != 1 || choice.NextStep != steps.ending {
+		t.Errorf("Unexpected choice %+v", choice)
+	}
+	_, err = store.Quests().Choice(steps.attack + steps.leave + 100)
+	expectErr(t, err, storage.ErrNotFound, "Choice of a missing choice")
+
+	// Номер шага в репликах превращается в ID шага, неверный номер - в переход по порядку
+	reply, err := store.Quests().Step(steps.reply)
+	expectNoErr(t, err, "Step")
+	if reply.Type != storage.StepCharacterAction || reply.Character != "Стражник" || len(reply.Lines) != 2 {
+		t.Fatalf("Unexpected character step %+v", reply)
+	}
+	if reply.Lines[0].NextStep != steps.narration || reply.Lines[0].Priority != 1 || reply.Lines[0].Condition.Violence != 2 {
+		t.Errorf("Unexpected first line %+v", reply.Lines[0])
+	}
+	if reply.Lines[1].NextStep != 0 {
+		t.Errorf("Expected invalid step number to fall through, got %d", reply.Lines[1].NextStep)
+	}
+
+	_, err = store.Quests().Step(steps.ending + 100)
+	expectErr(t, err, storage.ErrNotFound, "Step of a missing step")
+
+	// Явный переход шага: первый шаг ведет к третьему, второй завершает квест
+	jumpID, err := store.Quests().Create(storage.NewQuest{
+		Title:      "Развилка",
+		MaxPlayers: 1,
+		OwnerID:    alice.ID,
+		Steps: []storage.Step{
+			{Type: storage.StepNarration, Text: "Начало.", NextStep: 3},
+			{Type: storage.StepNarration, Text: "Тупик.", NextStep: storage.NextStepEnd},
+			{Type: storage.StepNarration, Text: "Дорога.", NextStep: 2},
+		},
+	})
+	expectNoErr(t, err, "Create with explicit next steps")
+	jump, err := store.Quests().Get(jumpID)
+	expectNoErr(t, err, "Get")
+	jumpStart := jump.InitialStep
+	var texts []string
+	for id := jump.InitialStep; id != 0 && len(texts) < 5; {
+		step, err := store.Quests().Step(id)
+		expectNoErr(t, err, "Step")
+		texts = append(texts, step.Text)
+		id = step.NextStep
+	}
+	if strings.Join(texts, " ") != "Начало. Дорога. Тупик." {
+		t.Errorf("Expected steps to follow explicit next steps, got %v", texts)
+	}
+
+	// Steps возвращает все шаги по номеру, а не по переходам
+	all, err := store.Quests().Steps(steps.questID)
+	expectNoErr(t, err, "Steps")
+	if len(all) != 4 || all[0].ID != steps.narration || all[3].ID != steps.ending || len(all[1].Choices) != 2 || len(all[2].Lines) != 2 {
+		t.Errorf("Unexpected steps %+v", all)
+	}
+	all, err = store.Quests().Steps(jumpID)
+	expectNoErr(t, err, "Steps")
+	if len(all) != 3 || all[1].Text != "Тупик." || all[1].Number != 2 {
+		t.Errorf("Expected steps in number order, got %+v", all)
+	}
+	all, err = store.Quests().Steps(jumpID + 100)
+	expectNoErr(t, err, "Steps of a missing quest")
+	if len(all) != 0 {
+		t.Errorf("Expected no steps of a missing quest, got %+v", all)
+	}
+
+	// Replace меняет содержимое квеста, а старые шаги остаются для начатых прохождений
+	err = store.Quests().Replace(jumpID, storage.NewQuest{
+		Title:      "Новая развилка",
+		MaxPlayers: 2,
+		Characters: []string{"Страж"},
+		Roles:      []storage.Role{{Name: "Воин", Character: "Страж"}},
+		Steps: []storage.Step{
+			{Type: storage.StepCharacterAction, Character: "Страж", Lines: []storage.CharacterLine{{Text: "Кто идет?"}}},
+			{Type: storage.StepNarration, Text: "Конец."},
+		},
+	})
+	expectNoErr(t, err, "Replace")
+	jump, err = store.Quests().Get(jumpID)
+	expectNoErr(t, err, "Get")
+	if jump.Title != "Новая развилка" || jump.MaxPlayers != 2 || jump.Status != storage.QuestStatusDraft {
+		t.Errorf("Unexpected replaced quest %+v", jump)
+	}
+	all, err = store.Quests().Steps(jumpID)
+	expectNoErr(t, err, "Steps")
+	if len(all) != 2 || all[0].ID != jump.InitialStep || all[0].Character != "Страж" || all[0].NextStep != all[1].ID {
+		t.Errorf("Unexpected replaced steps %+v", all)
+	}
+	roles, err := store.Quests().Roles(jumpID)
+	expectNoErr(t, err, "Roles")
+	if len(roles) != 1 || roles[0] != (storage.Role{Position: 1, Name: "Воин", Character: "Страж"}) {
+		t.Errorf("Unexpected replaced roles %+v", roles)
+	}
+	old, err := store.Quests().Step(jumpStart)
+	expectNoErr(t, err, "Step of a replaced step")
+	if old.Text != "Начало." {
+		t.Errorf("Expected the old step to stay, got %+v", old)
+	}
+	expectErr(t, store.Quests().Replace(jumpID+100, storage.NewQuest{Title: "x"}), storage.ErrNotFound, "Replace of a missing quest")
+
+	// Персонажи объявлены, даже если не встречаются в шагах; повторный Replace их не размножает
+	characters, err := store.Quests().Characters(steps.questID)
+	expectNoErr(t, err, "Characters")
+	if fmt.Sprint(characters) != "[Каджит Стражник]" {
+		t.Errorf("Unexpected characters %v", characters)
+	}
+	replaced := storage.NewQuest{
+		Title:      "Новая развилка",
+		MaxPlayers: 1,
+		Characters: []string{"Страж", "Торговец"},
+		Steps: []storage.Step{
+			{Type: storage.StepCharacterAction, Character: "Страж", Lines: []storage.CharacterLine{{Text: "Стой!"}}},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		expectNoErr(t, store.Quests().Replace(jumpID, replaced), "Replace")
+	}
+	characters, err = store.Quests().Characters(jumpID)
+	expectNoErr(t, err, "Characters")
+	if fmt.Sprint(characters) != "[Страж Торговец]" {
+		t.Errorf("Expected each character once after two replaces, got %v", characters)
+	}
+	guardStep, err := store.Quests().Get(jumpID)
+	expectNoErr(t, err, "Get")
+
+	// Убранный персонаж больше не объявлен, но старый шаг по-прежнему знает, кто говорит
+	replaced.Characters = []string{"Торговец", "Гонец"}
+	replaced.Steps = []storage.Step{{Type: storage.StepNarration, Text: "Пусто."}}
+	expectNoErr(t, store.Quests().Replace(jumpID, replaced), "Replace")
+	characters, err = store.Quests().Characters(jumpID)
+	expectNoErr(t, err, "Characters")
+	if fmt.Sprint(characters) != "[Торговец Гонец]" {
+		t.Errorf("Expected the removed character to be gone, got %v", characters)
+	}
+	old, err = store.Quests().Step(guardStep.InitialStep)
+	expectNoErr(t, err, "Step of a replaced step")
+	if old.Character != "Страж" {
+		t.Errorf("Expected the old step to keep its character, got %+v", old)
+	}
+
+	roles, err = store.Quests().Roles(steps.questID)
+	expectNoErr(t, err, "Roles")
+	if len(roles) != 2 || roles[0] != (storage.Role{Position: 1, Name: "Вор", Character: "Каджит"}) ||
+		roles[1] != (storage.Role{Position: 2, Name: "Маг"}) {
+		t.Errorf("Unexpected roles %+v", roles)
+	}
+
+	expectNoErr(t, store.Quests().Update(steps.questID, "Новое название", 0), "Update")
+	expectNoErr(t, store.Quests().Update(steps.questID, "", 4), "Update")
+	quest, err = store.Quests().Get(steps.questID)
+	expectNoErr(t, err, "Get")
+	if quest.Title != "Новое название" || quest.MaxPlayers != 4 {
+		t.Errorf("Expected updated title and max players, got %+v", quest)
+	}
+	expectErr(t, store.Quests().Update(steps.questID+100, "x", 0), storage.ErrNotFound, "Update of a missing quest")
+
+	// Персонаж роли должен быть объявлен в квесте
+	_, err = store.Quests().Create(storage.NewQuest{
+		Title:   "Без персонажей",
+		OwnerID: alice.ID,
+		Roles:   []storage.Role{{Name: "Вор", Character: "Каджит"}},
+	})
+	if err == nil {
+		t.Errorf("Expected an error for a role with an unknown character")
+	}
+}
+
+func testQuestAccess(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	bob := createUser(t, store, "Bob")
+	steps := createQuest(t, store, alice.ID)
+
+	access, err := store.Quests().Access(steps.questID, alice.ID)
+	expectNoErr(t, err, "Access")
+	if !access.IsOwner() || !access.CanEdit() || !access.CanPlay() {
+		t.Errorf("Expected owner access, got %+v", access)
+	}
+
+	// Черновик виден только авторам
+	for _, userID := range []int{bob.ID, 0} {
+		access, err = store.Quests().Access(steps.questID, userID)
+		expectNoErr(t, err, "Access")
+		if access.Role != "" || access.CanPlay() {
+			t.Errorf("Expected no access to a draft for user %d, got %+v", userID, access)
+		}
+
+		quests, err := store.Quests().List(userID)
+		expectNoErr(t, err, "List")
+		if len(quests) != 0 {
+			t.Errorf("Expected drafts to be hidden from user %d, got %d quests", userID, len(quests))
+		}
+	}
+
+	quests, err := store.Quests().List(alice.ID)
+	expectNoErr(t, err, "List")
+	if len(quests) != 1 || quests[0].MyRole != storage.AuthorRoleOwner || quests[0].Owner != "Alice" {
+		t.Errorf("Expected the owner to see the draft, got %+v", quests)
+	}
+
+	expectNoErr(t, store.Quests().SetStatus(steps.questID, storage.QuestStatusPublished), "SetStatus")
+	second := createQuest(t, store, bob.ID)
+	expectNoErr(t, store.Quests().SetStatus(second.questID, storage.QuestStatusPublished), "SetStatus")
+
+	quests, err = store.Quests().List(0)
+	expectNoErr(t, err, "List")
+	if len(quests) != 2 || quests[0].ID != second.questID || quests[1].ID != steps.questID {
+		t.Fatalf("Expected both published quests, newest first, got %+v", quests)
+	}
+	if quests[0].MyRole != "" {
+		t.Errorf("Expected no role for an anonymous user, got %q", quests[0].MyRole)
+	}
+
+	access, err = store.Quests().Access(steps.questID, bob.ID)
+	expectNoErr(t, err, "Access")
+	if !access.CanPlay() || access.CanEdit() {
+		t.Errorf("Expected play-only access to a published quest, got %+v", access)
+	}
+
+	// Удаленный квест недоступен, но Get его еще находит
+	expectNoErr(t, store.Quests().SetStatus(steps.questID, storage.QuestStatusDeleted), "SetStatus")
+	_, err = store.Quests().Access(steps.questID, alice.ID)
+	expectErr(t, err, storage.ErrNotFound, "Access to a deleted quest")
+	quest, err := store.Quests().Get(steps.questID)
+	expectNoErr(t, err, "Get")
+	if quest.Status != storage.QuestStatusDeleted {
+		t.Errorf("Expected deleted status, got %s", quest.Status)
+	}
+
+	quests, err = store.Quests().List(alice.ID)
+	expectNoErr(t, err, "List")
+	if len(quests) != 1 || quests[0].ID != second.questID {
+		t.Errorf("Expected deleted quest to be hidden, got %+v", quests)
+	}
+
+	expectErr(t, store.Quests().SetStatus(second.questID+100, storage.QuestStatusDraft), storage.ErrNotFound, "SetStatus of a missing quest")
+	_, err = store.Quests().Access(second.questID+100, alice.ID)
+	expectErr(t, err, storage.ErrNotFound, "Access to a missing quest")
+}
+
+func testQuestAuthors(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	bob := createUser(t, store, "Bob")
+	carol := createUser(t, store, "Carol")
+	steps := createQuest(t, store, alice.ID)
+
+	expectNoErr(t, store.Quests().SetAuthor(steps.questID, bob.ID, storage.AuthorRoleEditor), "SetAuthor")
+	expectNoErr(t, store.Quests().SetAuthor(steps.questID, carol.ID, storage.AuthorRoleViewer), "SetAuthor")
+
+	access, err := store.Quests().Access(steps.questID, bob.ID)
+	expectNoErr(t, err, "Access")
+	if access.Role != storage.AuthorRoleEditor || !access.CanEdit() || access.IsOwner() {
+		t.Errorf("Expected editor access, got %+v", access)
+	}
+
+	quests, err := store.Quests().List(carol.ID)
+	expectNoErr(t, err, "List")
+	if len(quests) != 1 || quests[0].MyRole != storage.AuthorRoleViewer {
+		t.Errorf("Expected a co-author to see the draft, got %+v", quests)
+	}
+
+	// Повторное добавление меняет роль, а не добавляет автора
+	expectNoErr(t, store.Quests().SetAuthor(steps.questID, bob.ID, storage.AuthorRoleViewer), "SetAuthor")
+	authors, err := store.Quests().Authors(steps.questID)
+	expectNoErr(t, err, "Authors")
+	want := []storage.Author{
+		{UserID: bob.ID, Username: "Bob", Role: storage.AuthorRoleViewer},
+		{UserID: carol.ID, Username: "Carol", Role: storage.AuthorRoleViewer},
+	}
+	if fmt.Sprint(authors) != fmt.Sprint(want) {
+		t.Errorf("Expected %+v, got %+v", want, authors)
+	}
+
+	expectNoErr(t, store.Quests().RemoveAuthor(steps.questID, "BOB"), "RemoveAuthor")
+	expectErr(t, store.Quests().RemoveAuthor(steps.questID, "Bob"), storage.ErrNotFound, "RemoveAuthor twice")
+
+	access, err = store.Quests().Access(steps.questID, bob.ID)
+	expectNoErr(t, err, "Access")
+	if access.Role != "" {
+		t.Errorf("Expected removed author to lose access, got %+v", access)
+	}
+}
+
+func testPlaythroughs(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	bob := createUser(t, store, "Bob")
+	steps := createQuest(t, store, alice.ID)
+
+	first, err := store.Playthroughs().Create(storage.Playthrough{QuestID: steps.questID, UserID: alice.ID, PlayerName: "Alice", StepID: steps.narration})
+	expectNoErr(t, err, "Create")
+	second, err := store.Playthroughs().Create(storage.Playthrough{QuestID: steps.questID, UserID: alice.ID, PlayerName: "Alice", StepID: steps.narration})
+	expectNoErr(t, err, "Create")
+
+	p, err := store.Playthroughs().Get(first, alice.ID)
+	expectNoErr(t, err, "Get")
+	if p.QuestID != steps.questID || p.QuestTitle != "Приключения Каджита" || p.StepID != steps.narration ||
+		p.PlayerName != "Alice" || p.Finished || p.Points != (storage.Points{}) {
+		t.Errorf("Unexpected playthrough %+v", p)
+	}
+
+	// Чужое прохождение не находится
+	_, err = store.Playthroughs().Get(first, bob.ID)
+	expectErr(t, err, storage.ErrNotFound, "Get of another user's playthrough")
+	expectErr(t, store.Playthroughs().Advance(first, bob.ID, steps.vote, storage.Points{}), storage.ErrNotFound, "Advance of another user's playthrough")
+
+	// Очки накапливаются
+	expectNoErr(t, store.Playthroughs().Advance(first, alice.ID, steps.vote, storage.Points{Violence: 1, Pacifism: 2}), "Advance")
+	expectNoErr(t, store.Playthroughs().Advance(first, alice.ID, steps.reply, storage.Points{Violence: 1, Whatever: 3}), "Advance")
+	p, err = store.Playthroughs().Get(first, alice.ID)
+	expectNoErr(t, err, "Get")
+	if p.StepID != steps.reply || p.Points != (storage.Points{Violence: 2, Whatever: 3, Pacifism: 2}) {
+		t.Errorf("Unexpected playthrough after advancing %+v", p)
+	}
+
+	// Завершение оставляет шаг и добавляет последние очки
+	expectErr(t, store.Playthroughs().Finish(first, bob.ID, storage.Points{}), storage.ErrNotFound, "Finish of another user's playthrough")
+	expectNoErr(t, store.Playthroughs().Finish(first, alice.ID, storage.Points{Pacifism: 1}), "Finish")
+	p, err = store.Playthroughs().Get(first, alice.ID)
+	expectNoErr(t, err, "Get")
+	if !p.Finished || p.StepID != steps.reply || p.Points != (storage.Points{Violence: 2, Whatever: 3, Pacifism: 3}) {
+		t.Errorf("Unexpected playthrough after finishing %+v", p)
+	}
+
+	list, err := store.Playthroughs().List(alice.ID)
+	expectNoErr(t, err, "List")
+	if len(list) != 2 || list[0].ID != second || list[1].ID != first {
+		t.Errorf("Expected newest playthrough first, got %+v", list)
+	}
+	list, err = store.Playthroughs().List(bob.ID)
+	expectNoErr(t, err, "List")
+	if len(list) != 0 {
+		t.Errorf("Expected no playthroughs for Bob, got %d", len(list))
+	}
+}
+
+func testServers(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	steps := createQuest(t, store, alice.ID)
+	serverID := createServer(t, store, steps, alice, "ABC123")
+
+	server, err := store.Servers().Get(serverID)
+	expectNoErr(t, err, "Get")
+	if server.Status != storage.ServerStatusWaiting || server.Host != "Alice" || server.QuestTitle != "Приключения Каджита" ||
+		server.PlayerCount != 1 || server.MaxPlayers != 2 || server.AFKFallback != storage.AFKFallbackRandom ||
+		server.VoteTimeoutSeconds != 0 || server.PasswordHash != "" || !server.IsPublic || !server.AllowSpectators {
+		t.Errorf("Unexpected server %+v", server)
+	}
+
+	mp, err := store.Servers().Playthrough(serverID)
+	expectNoErr(t, err, "Playthrough")
+	if mp.StepID != steps.narration || mp.VoteDeadline != nil || mp.Points != (storage.Points{}) {
+		t.Errorf("Unexpected playthrough %+v", mp)
+	}
+
+	// Код приглашения ищется без учета регистра
+	byCode, err := store.Servers().GetByInviteCode("abc123")
+	expectNoErr(t, err, "GetByInviteCode")
+	if byCode.ID != serverID {
+		t.Errorf("Expected server %d, got %d", serverID, byCode.ID)
+	}
+	_, err = store.Servers().GetByInviteCode("NOPE")
+	expectErr(t, err, storage.ErrNotFound, "GetByInviteCode of an unknown code")
+
+	taken, err := store.Servers().InviteCodeTaken("ABC123")
+	expectNoErr(t, err, "InviteCodeTaken")
+	free, err := store.Servers().InviteCodeTaken("ZZZ999")
+	expectNoErr(t, err, "InviteCodeTaken")
+	if !taken || free {
+		t.Errorf("Expected ABC123 to be taken and ZZZ999 to be free")
+	}
+
+	_, err = store.Servers().Get(serverID + 100)
+	expectErr(t, err, storage.ErrNotFound, "Get of a missing server")
+	_, err = store.Servers().Lock(serverID + 100)
+	expectErr(t, err, storage.ErrNotFound, "Lock of a missing server")
+
+	expectNoErr(t, store.Servers().SetHost(serverID, "Bob"), "SetHost")
+	expectErr(t, store.Servers().SetStatus(serverID+100, storage.ServerStatusAbandoned), storage.ErrNotFound, "SetStatus of a missing server")
+
+	// Публичные серверы делятся на ожидающие игроков и идущие игры, открытые для зрителей
+	private, err := store.Servers().Create(storage.Server{
+		QuestID: steps.questID, Name: "Приватный", MaxPlayers: 2, AFKFallback: storage.AFKFallbackSkip, InviteCode: "PRIV01",
+	}, storage.Player{Name: "Alice", UserID: alice.ID, SessionToken: "private-alice", LastSeenAt: time.Now()}, steps.narration)
+	expectNoErr(t, err, "Create")
+	closed := createServer(t, store, steps, alice, "CLOSED")
+	expectNoErr(t, store.Servers().SetStatus(closed, storage.ServerStatusAbandoned), "SetStatus")
+	newest := createServer(t, store, steps, alice, "NEW001")
+	expectNoErr(t, store.Servers().SetStatus(newest, storage.ServerStatusInProgress), "SetStatus")
+	noSpectators, err := store.Servers().Create(storage.Server{
+		QuestID: steps.questID, Name: "Без зрителей", MaxPlayers: 2, AFKFallback: storage.AFKFallbackSkip, IsPublic: true, InviteCode: "NOSPEC",
+	}, storage.Player{Name: "Alice", UserID: alice.ID, SessionToken: "nospec-alice", LastSeenAt: time.Now()}, steps.narration)
+	expectNoErr(t, err, "Create")
+	expectNoErr(t, store.Servers().SetStatus(noSpectators, storage.ServerStatusInProgress), "SetStatus")
+
+	servers, err := store.Servers().ListPublic()
+	expectNoErr(t, err, "ListPublic")
+	if len(servers) != 1 || servers[0].ID != serverID {
+		t.Fatalf("Expected public server %d, got %+v", serverID, servers)
+	}
+	if servers[0].Host != "Bob" || servers[0].Status != storage.ServerStatusWaiting {
+		t.Errorf("Unexpected server %+v", servers[0])
+	}
+
+	servers, err = store.Servers().ListSpectatable()
+	expectNoErr(t, err, "ListSpectatable")
+	if len(servers) != 1 || servers[0].ID != newest {
+		t.Fatalf("Expected spectatable server %d, got %+v", newest, servers)
+	}
+	if servers[0].Status != storage.ServerStatusInProgress || !servers[0].AllowSpectators {
+		t.Errorf("Unexpected server %+v", servers[0])
+	}
+
+	// Квест занят, пока у него есть ожидающий сервер или идущая игра
+	idle := createQuest(t, store, alice.ID)
+	idleServer := createServer(t, store, idle, alice, "IDLE01")
+	expectNoErr(t, store.Servers().SetStatus(idleServer, storage.ServerStatusFinished), "SetStatus")
+	for questID, want := range map[int]bool{steps.questID: true, idle.questID: false} {
+		active, err := store.Servers().HasActive(questID)
+		expectNoErr(t, err, "HasActive")
+		if active != want {
+			t.Errorf("Expected HasActive(%d) = %v, got %v", questID, want, active)
+		}
+	}
+
+	private2, err := store.Servers().Get(private)
+	expectNoErr(t, err, "Get")
+	if private2.IsPublic || private2.AllowSpectators || private2.AFKFallback != storage.AFKFallbackSkip {
+		t.Errorf("Unexpected private server %+v", private2)
+	}
+}
+
+func testPlayers(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	bob := createUser(t, store, "Bob")
+	steps := createQuest(t, store, alice.ID)
+	serverID := createServer(t, store, steps, alice, "ABC123")
+
+	addPlayer(t, store, serverID, bob)
+	err := store.Servers().AddPlayer(storage.Player{ServerID: serverID, Name: "Bob", UserID: bob.ID, SessionToken: "bob-again", LastSeenAt: time.Now()})
+	expectErr(t, err, storage.ErrConflict, "AddPlayer twice")
+
+	expectNames(t, playerNames(t, store, serverID), "Alice", "Bob")
+	server, err := store.Servers().Get(serverID)
+	expectNoErr(t, err, "Get")
+	if server.PlayerCount != 2 {
+		t.Errorf("Expected 2 players, got %d", server.PlayerCount)
+	}
+
+	player, err := store.Servers().PlayerBySession(fmt.Sprintf("%d-Bob", serverID))
+	expectNoErr(t, err, "PlayerBySession")
+	if player.Name != "Bob" || player.UserID != bob.ID || player.ServerID != serverID || player.PlayerIndex != 0 || player.IsReady {
+		t.Errorf("Unexpected player %+v", player)
+	}
+	_, err = store.Servers().PlayerBySession("unknown")
+	expectErr(t, err, storage.ErrNotFound, "PlayerBySession of an unknown session")
+
+	// Смена роли сбрасывает готовность
+	expectNoErr(t, store.Servers().SetPlayerRole(serverID, "Bob", 2), "SetPlayerRole")
+	expectNoErr(t, store.Servers().SetPlayerReady(serverID, "Bob", true), "SetPlayerReady")
+	player, err = store.Servers().PlayerBySession(fmt.Sprintf("%d-Bob", serverID))
+	expectNoErr(t, err, "PlayerBySession")
+	if player.PlayerIndex != 2 || !player.IsReady {
+		t.Errorf("Expected Bob to be ready with role 2, got %+v", player)
+	}
+	expectNoErr(t, store.Servers().SetPlayerRole(serverID, "Bob", 1), "SetPlayerRole")
+	player, err = store.Servers().PlayerBySession(fmt.Sprintf("%d-Bob", serverID))
+	expectNoErr(t, err, "PlayerBySession")
+	if player.PlayerIndex != 1 || player.IsReady {
+		t.Errorf("Expected role change to reset readiness, got %+v", player)
+	}
+
+	// Роль на сервере может занимать только один игрок
+	if err := store.Servers().SetPlayerRole(serverID, "Alice", 1); err == nil {
+		t.Errorf("Expected SetPlayerRole of a taken role to fail")
+	}
+	player, err = store.Servers().PlayerBySession("ABC123-Alice")
+	expectNoErr(t, err, "PlayerBySession")
+	if player.PlayerIndex != 0 {
+		t.Errorf("Expected Alice to keep no role, got %d", player.PlayerIndex)
+	}
+
+	expectErr(t, store.Servers().SetPlayerRole(serverID, "Nobody", 1), storage.ErrNotFound, "SetPlayerRole of a missing player")
+	expectErr(t, store.Servers().SetPlayerReady(serverID, "Nobody", true), storage.ErrNotFound, "SetPlayerReady of a missing player")
+
+	seen := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	expectNoErr(t, store.Servers().TouchPlayer(fmt.Sprintf("%d-Bob", serverID), seen), "TouchPlayer")
+	player, err = store.Servers().PlayerBySession(fmt.Sprintf("%d-Bob", serverID))
+	expectNoErr(t, err, "PlayerBySession")
+	if !player.LastSeenAt.Equal(seen) {
+		t.Errorf("Expected last seen at %v, got %v", seen, player.LastSeenAt)
+	}
+	expectErr(t, store.Servers().TouchPlayer("unknown", seen), storage.ErrNotFound, "TouchPlayer of an unknown session")
+
+	expectNoErr(t, store.Servers().RemovePlayer(serverID, "Alice"), "RemovePlayer")
+	expectErr(t, store.Servers().RemovePlayer(serverID, "Alice"), storage.ErrNotFound, "RemovePlayer twice")
+	expectNames(t, playerNames(t, store, serverID), "Bob")
+}
+
+func testVotes(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	steps := createQuest(t, store, alice.ID)
+	serverID := createServer(t, store, steps, alice, "ABC123")
+
+	deadline := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	err := store.Servers().SavePlaythrough(storage.MultiplayerPlaythrough{
+		ServerID:     serverID,
+		StepID:       steps.vote,
+		Points:       storage.Points{Violence: 1, Whatever: 2, Pacifism: 3},
+		VoteDeadline: &deadline,
+	})
+	expectNoErr(t, err, "SavePlaythrough")
+
+	mp, err := store.Servers().Playthrough(serverID)
+	expectNoErr(t, err, "Playthrough")
+	if mp.ServerID != serverID || mp.StepID != steps.vote || mp.Points != (storage.Points{Violence: 1, Whatever: 2, Pacifism: 3}) ||
+		mp.VoteDeadline == nil || !mp.VoteDeadline.Equal(deadline) {
+		t.Errorf("Unexpected playthrough %+v", mp)
+	}
+
+	// Дедлайн учитывается только у идущих игр
+	expired, err := store.Servers().ExpiredVotes(deadline.Add(time.Second))
+	expectNoErr(t, err, "ExpiredVotes")
+	if len(expired) != 0 {
+		t.Errorf("Expected no expired votes before the game starts, got %v", expired)
+	}
+	expectNoErr(t, store.Servers().SetStatus(serverID, storage.ServerStatusInProgress), "SetStatus")
+	expired, err = store.Servers().ExpiredVotes(deadline.Add(-time.Second))
+	expectNoErr(t, err, "ExpiredVotes")
+	if len(expired) != 0 {
+		t.Errorf("Expected no expired votes before the deadline, got %v", expired)
+	}
+	expired, err = store.Servers().ExpiredVotes(deadline)
+	expectNoErr(t, err, "ExpiredVotes")
+	if len(expired) != 1 || expired[0] != serverID {
+		t.Errorf("Expected server %d to expire at the deadline, got %v", serverID, expired)
+	}
+
+	mp.VoteDeadline = nil
+	expectNoErr(t, store.Servers().SavePlaythrough(*mp), "SavePlaythrough")
+	expired, err = store.Servers().ExpiredVotes(deadline.Add(time.Hour))
+	expectNoErr(t, err, "ExpiredVotes")
+	if len(expired) != 0 {
+		t.Errorf("Expected no expired votes without a deadline, got %v", expired)
+	}
+	expectErr(t, store.Servers().SavePlaythrough(storage.MultiplayerPlaythrough{ServerID: serverID + 100, StepID: steps.vote}),
+		storage.ErrNotFound, "SavePlaythrough of a missing server")
+
+	// Без replace первый голос игрока на шаге остается
+	vote := func(name string, choiceID int, replace bool) {
+		t.Helper()
+		err := store.Servers().SaveVote(serverID, steps.vote, storage.Vote{PlayerName: name, ChoiceID: choiceID}, replace)
+		expectNoErr(t, err, "SaveVote")
+	}
+	vote("Alice", steps.attack, false)
+	vote("Alice", steps.leave, false)
+	vote("Bob", steps.leave, false)
+
+	votes, err := store.Servers().Votes(serverID, steps.vote)
+	expectNoErr(t, err, "Votes")
+	want := []storage.Vote{{PlayerName: "Alice", ChoiceID: steps.attack}, {PlayerName: "Bob", ChoiceID: steps.leave}}
+	if fmt.Sprint(votes) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, votes)
+	}
+
+	vote("Alice", steps.leave, true)
+	expectNoErr(t, store.Servers().DeleteVote(serverID, steps.vote, "Bob"), "DeleteVote")
+	expectNoErr(t, store.Servers().DeleteVote(serverID, steps.vote, "Nobody"), "DeleteVote of a missing vote")
+
+	votes, err = store.Servers().Votes(serverID, steps.vote)
+	expectNoErr(t, err, "Votes")
+	want = []storage.Vote{{PlayerName: "Alice", ChoiceID: steps.leave}}
+	if fmt.Sprint(votes) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, votes)
+	}
+
+	votes, err = store.Servers().Votes(serverID, steps.narration)
+	expectNoErr(t, err, "Votes")
+	if len(votes) != 0 {
+		t.Errorf("Expected votes to be per step, got %v", votes)
+	}
+}
+
+func testSpectators(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	carol := createUser(t, store, "Carol")
+	steps := createQuest(t, store, alice.ID)
+	serverID := createServer(t, store, steps, alice, "ABC123")
+
+	spectate := func(name string, userID int) *storage.Spectator {
+		t.Helper()
+		err := store.Servers().AddSpectator(storage.Spectator{ServerID: serverID, Name: name, UserID: userID, SessionToken: "watch-" + name, LastSeenAt: time.Now()})
+		expectNoErr(t, err, "AddSpectator")
+		spectator, err := store.Servers().SpectatorBySession("watch-" + name)
+		expectNoErr(t, err, "SpectatorBySession")
+		return spectator
+	}
+	first := spectate("Carol", carol.ID)
+	second := spectate("Зритель", 0)
+
+	if first.ServerID != serverID || first.UserID != carol.ID || first.Name != "Carol" {
+		t.Errorf("Unexpected spectator %+v", first)
+	}
+
+	err := store.Servers().AddSpectator(storage.Spectator{ServerID: serverID, Name: "Carol", SessionToken: "watch-again", LastSeenAt: time.Now()})
+	expectErr(t, err, storage.ErrConflict, "AddSpectator with a taken name")
+
+	spectators, err := store.Servers().Spectators(serverID)
+	expectNoErr(t, err, "Spectators")
+	if len(spectators) != 2 || spectators[0].ID != first.ID || spectators[1].ID != second.ID {
+		t.Errorf("Expected spectators in join order, got %+v", spectators)
+	}
+
+	// Повторный голос зрителя на шаге заменяет прежний
+	expectNoErr(t, store.Servers().SaveAudienceVote(serverID, steps.vote, first.ID, steps.attack), "SaveAudienceVote")
+	expectNoErr(t, store.Servers().SaveAudienceVote(serverID, steps.vote, second.ID, steps.attack), "SaveAudienceVote")
+	expectNoErr(t, store.Servers().SaveAudienceVote(serverID, steps.vote, first.ID, steps.leave), "SaveAudienceVote")
+
+	tally, err := store.Servers().AudienceVotes(serverID, steps.vote)
+	expectNoErr(t, err, "AudienceVotes")
+	if len(tally) != 2 || tally[steps.attack] != 1 || tally[steps.leave] != 1 {
+		t.Errorf("Unexpected tally %v", tally)
+	}
+	expectErr(t, store.Servers().SaveAudienceVote(serverID+100, steps.vote, first.ID, steps.attack),
+		storage.ErrNotFound, "SaveAudienceVote on a missing server")
+
+	seen := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	expectNoErr(t, store.Servers().TouchSpectator("watch-Carol", seen), "TouchSpectator")
+	spectator, err := store.Servers().SpectatorBySession("watch-Carol")
+	expectNoErr(t, err, "SpectatorBySession")
+	if !spectator.LastSeenAt.Equal(seen) {
+		t.Errorf("Expected last seen at %v, got %v", seen, spectator.LastSeenAt)
+	}
+	expectErr(t, store.Servers().TouchSpectator("unknown", seen), storage.ErrNotFound, "TouchSpectator of an unknown session")
+
+	// Голоса ушедшего зрителя не учитываются
+	expectNoErr(t, store.Servers().RemoveSpectator("watch-Carol"), "RemoveSpectator")
+	expectErr(t, store.Servers().RemoveSpectator("watch-Carol"), storage.ErrNotFound, "RemoveSpectator twice")
+	_, err = store.Servers().SpectatorBySession("watch-Carol")
+	expectErr(t, err, storage.ErrNotFound, "SpectatorBySession after leaving")
+
+	tally, err = store.Servers().AudienceVotes(serverID, steps.vote)
+	expectNoErr(t, err, "AudienceVotes")
+	if len(tally) != 1 || tally[steps.attack] != 1 {
+		t.Errorf("Unexpected tally after leaving %v", tally)
+	}
+}
+
+func testAtomic(t *testing.T, store storage.Store) {
+	failure := errors.New("rollback")
+
+	err := store.Atomic(func(tx storage.Store) error {
+		if _, err := tx.Users().Create("Alice", "hash"); err != nil {
+			return err
+		}
+		// Внутри транзакции изменения уже видны
+		if _, err := tx.Users().GetByName("Alice"); err != nil {
+			return err
+		}
+		return failure
+	})
+	expectErr(t, err, failure, "Atomic")
+
+	_, err = store.Users().GetByName("Alice")
+	expectErr(t, err, storage.ErrNotFound, "GetByName after rollback")
+
+	// Вложенный вызов выполняется в той же транзакции
+	err = store.Atomic(func(tx storage.Store) error {
+		if _, err := tx.Users().Create("Bob", "hash"); err != nil {
+			return err
+		}
+		return tx.Atomic(func(nested storage.Store) error {
+			_, err := nested.Users().Create("Carol", "hash")
+			return err
+		})
+	})
+	expectNoErr(t, err, "Atomic")
+
+	for _, name := range []string{"Bob", "Carol"} {
+		_, err = store.Users().GetByName(name)
+		expectNoErr(t, err, "GetByName after commit")
+	}
+
+	err = store.Atomic(func(tx storage.Store) error {
+		if _, err := tx.Users().Create("Dave", "hash"); err != nil {
+			return err
+		}
+		return tx.Atomic(func(nested storage.Store) error {
+			return failure
+		})
+	})
+	expectErr(t, err, failure, "Atomic")
+	_, err = store.Users().GetByName("Dave")
+	expectErr(t, err, storage.ErrNotFound, "GetByName after nested rollback")
+}
+
+// Lock не дает параллельным транзакциям занять больше мест, чем есть на сервере
+func testLock(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	steps := createQuest(t, store, alice.ID)
+	serverID := createServer(t, store, steps, alice, "ABC123")
+
+	var users []*storage.User
+	for i := 0; i < 8; i++ {
+		users = append(users, createUser(t, store, fmt.Sprintf("Player%d", i)))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(users))
+	for _, user := range users {
+		wg.Add(1)
+		go func(user *storage.User) {
+			defer wg.Done()
+			errs <- store.Atomic(func(tx storage.Store) error {
+				server, err := tx.Servers().Lock(serverID)
+				if err != nil {
+					return err
+				}
+				players, err := tx.Servers().Players(serverID)
+				if err != nil {
+					return err
+				}
+				if len(players) >= server.MaxPlayers {
+					return nil
+				}
+				return tx.Servers().AddPlayer(storage.Player{
+					ServerID:     serverID,
+					Name:         user.Username,
+					UserID:       user.ID,
+					SessionToken: "lock-" + user.Username,
+					LastSeenAt:   time.Now(),
+				})
+			})
+		}(user)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		expectNoErr(t, err, "Atomic")
+	}
+	if names := playerNames(t, store, serverID); len(names) != 2 {
+		t.Errorf("Expected the server to stay at 2 players, got %v", names)
+	}
+}
+
+func testClaimGuest(t *testing.T, store storage.Store) {
+	alice := createUser(t, store, "Alice")
+	bob := createUser(t, store, "Bob")
+	guest, err := store.Users().CreateGuest("guest-1")
+	expectNoErr(t, err, "CreateGuest")
+	steps := createQuest(t, store, alice.ID)
+
+	playthroughID, err := store.Playthroughs().Create(storage.Playthrough{QuestID: steps.questID, UserID: guest.ID, PlayerName: "guest-1", StepID: steps.narration})
+	expectNoErr(t, err, "Create")
+
+	// Сервер, где гость - хост и уже голосовал
+	hosted := createServer(t, store, steps, guest, "GUEST1")
+	expectNoErr(t, store.Servers().SaveVote(hosted, steps.vote, storage.Vote{PlayerName: "guest-1", ChoiceID: steps.attack}, false), "SaveVote")
+
+	// Сервер, где Боб уже играет: место остается за гостем
+	shared := createServer(t, store, steps, bob, "SHARED")
+	addPlayer(t, store, shared, guest)
+
+	// Сервер, который гость смотрит
+	watched := createServer(t, store, steps, alice, "WATCH1")
+	err = store.Servers().AddSpectator(storage.Spectator{ServerID: watched, Name: "guest-1", UserID: guest.ID, SessionToken: "watch-guest", LastSeenAt: time.Now()})
+	expectNoErr(t, err, "AddSpectator")
+
+	expectNoErr(t, store.Users().ClaimGuest(*guest, *bob), "ClaimGuest")
+
+	p, err := store.Playthroughs().Get(playthroughID, bob.ID)
+	expectNoErr(t, err, "Get")
+	if p.PlayerName != "Bob" {
+		t.Errorf("Expected playthrough to be renamed, got %q", p.PlayerName)
+	}
+	_, err = store.Playthroughs().Get(playthroughID, guest.ID)
+	expectErr(t, err, storage.ErrNotFound, "Get of a claimed playthrough")
+
+	expectNames(t, playerNames(t, store, hosted), "Bob")
+	server, err := store.Servers().Get(hosted)
+	expectNoErr(t, err, "Get")
+	if server.Host != "Bob" {
+		t.Errorf("Expected host rights to move to Bob, got %q", server.Host)
+	}
+	votes, err := store.Servers().Votes(hosted, steps.vote)
+	expectNoErr(t, err, "Votes")
+	if len(votes) != 1 || votes[0].PlayerName != "Bob" {
+		t.Errorf("Expected the vote to move to Bob, got %v", votes)
+	}
+
+	expectNames(t, playerNames(t, store, shared), "Bob", "guest-1")
+
+	spectator, err := store.Servers().SpectatorBySession("watch-guest")
+	expectNoErr(t, err, "SpectatorBySession")
+	if spectator.Name != "Bob" || spectator.UserID != bob.ID {
+		t.Errorf("Expected the spectator seat to move to Bob, got %+v", spectator)
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import "time"
+
+type User struct {
+	ID           int
+	Username     string
+	IsGuest      bool
+	PasswordHash string // Пустая строка у гостей
+}
+
+// Личный API-токен; сам токен не хранится, только его хеш
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	TokenHash  string
+	Prefix     string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+}
+
+type UserStore interface {
+	// ErrConflict, если имя занято (без учета регистра)
+	Create(username, passwordHash string) (*User, error)
+	CreateGuest(username string) (*User, error)
+	Get(id int) (*User, error)
+	// Поиск по имени без учета регистра
+	GetByName(username string) (*User, error)
+
+	CreateSession(userID int, tokenHash string, expiresAt time.Time) error
+	// Пользователь действующей на момент now сессии
+	SessionUser(tokenHash string, now time.Time) (*User, error)
+	DeleteSession(tokenHash string) error
+
+	// Заполняет ID и CreatedAt токена
+	CreateAPIToken(token *APIToken) error
+	// Находит действующий токен и отмечает его использование
+	UseAPIToken(tokenHash string, now time.Time) (*User, []string, error)
+	APITokens(userID int) ([]APIToken, error)
+	RevokeAPIToken(id, userID int, now time.Time) error
+
+	// Переносит прохождения, места на серверах и места зрителей гостя в учетную запись.
+	// Имя игрока меняется на имя учетной записи, в том числе в голосах и у хоста сервера.
+	// Серверы, где учетная запись уже играет или смотрит, остаются за гостем
+	ClaimGuest(guest, account User) error
+}
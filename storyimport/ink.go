@@ -0,0 +1,458 @@
+package storyimport
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"quest_maker/storage"
+)
+
+var (
+	inkKnot     = regexp.MustCompile(`^={2,}\s*(function\s+)?([\p{L}\p{N}_]+)\s*(\(.*\))?\s*=*$`)
+	inkStitch   = regexp.MustCompile(`^=\s*([\p{L}\p{N}_]+)\s*(\(.*\))?$`)
+	inkBullets  = regexp.MustCompile(`^([*+]\s*)+`)
+	inkGather   = regexp.MustCompile(`^(-\s*)+`)
+	inkPoints   = regexp.MustCompile(`^~\s*(violence|whatever|pacifism)\s*(\+=|-=)\s*(\d+)$`)
+	inkLogic    = regexp.MustCompile(`\{[^}]*\}`)
+	inkComment  = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	inkSpeaker  = regexp.MustCompile(`^(character|speaker)\s*:\s*(.+)$`)
+	inkTitleTag = regexp.MustCompile(`^title\s*:\s*(.+)$`)
+)
+
+// Вариант выбора Ink вместе с телом - текстом и переходом после выбора
+type inkChoice struct {
+	text   string
+	line   int
+	points storage.Points
+	body   []storage.Step
+	divert *target
+}
+
+// Переход на собирающую строку "- ...", который станет известен, когда после нее появится шаг
+type gatherRef struct {
+	step, choice int
+}
+
+type inkParser struct {
+	*builder
+	knot     string
+	text     []string
+	textLine int
+	choices  []*inkChoice // Варианты текущего выбора; nil вне выбора
+	gather   []gatherRef
+	diverted bool // После перехода текст блока уже не показывается
+	skipKnot bool // Пропуск функции или повторного узла
+	nested   bool // Пропуск вложенного выбора
+}
+
+// Переводит подмножество Ink: узлы и стежки, текст, выборы "*" и "+" с переходами,
+// собирающие строки "-" и очки "~ violence += 1" в теле варианта. Строка с тегом
+// "#character: Имя" становится репликой персонажа. Переменные, условия, вложенные
+// выборы, туннели и потоки пропускаются с предупреждением
+func Ink(source string) (*Result, error) {
+	p := &inkParser{builder: newBuilder()}
+	p.ends = map[string]bool{"END": true, "DONE": true}
+	p.begin("", 1)
+
+	// Многострочные комментарии заменяем пустыми строками, чтобы не сбить номера строк
+	source = inkComment.ReplaceAllStringFunc(strings.ReplaceAll(source, "\r\n", "\n"), func(c string) string {
+		return strings.Repeat("\n", strings.Count(c, "\n"))
+	})
+	for i, line := range strings.Split(source, "\n") {
+		if c := strings.Index(line, "//"); c >= 0 {
+			line = line[:c]
+		}
+		p.line(i+1, strings.TrimSpace(line))
+	}
+	p.closeBlock()
+
+	// Без текста до первого узла история начинается с первого узла
+	start := ""
+	if blk := p.blocks[0]; len(blk.steps) == 0 && blk.alias == nil && len(p.blocks) > 1 {
+		start = p.blocks[1].label
+	}
+	return p.build(start)
+}
+
+func (p *inkParser) line(n int, line string) {
+	if m := inkKnot.FindStringSubmatch(line); m != nil {
+		p.closeBlock()
+		if m[1] != "" {
+			p.warn(n, "function %q is not supported and was skipped", m[2])
+			p.skipKnot = true
+			return
+		}
+		if m[3] != "" {
+			p.warn(n, "parameters of knot %q are not supported", m[2])
+		}
+		p.knot = m[2]
+		p.startBlock(m[2], n)
+		return
+	}
+	if p.skipKnot {
+		return
+	}
+	if m := inkStitch.FindStringSubmatch(line); m != nil && p.knot != "" {
+		// Узел без собственного текста переходит к первому стежку
+		if blk := p.current(); len(blk.steps) == 0 && blk.alias == nil && len(p.text) == 0 && p.choices == nil {
+			blk.alias = &target{label: p.knot + "." + m[1], line: n}
+		}
+		p.closeBlock()
+		if m[2] != "" {
+			p.warn(n, "parameters of stitch %q are not supported", m[1])
+		}
+		p.startBlock(p.knot+"."+m[1], n)
+		return
+	}
+	if line == "" || strings.HasPrefix(line, "TODO:") {
+		return
+	}
+
+	if bullets := inkBullets.FindString(line); bullets != "" {
+		if strings.Count(bullets, "*")+strings.Count(bullets, "+") > 1 {
+			p.warn(n, "nested choices are not supported and were skipped")
+			p.nested = true
+			return
+		}
+		p.nested = false
+		p.choice(n, strings.TrimSpace(line[len(bullets):]))
+		return
+	}
+	if gather := inkGather.FindString(line); gather != "" && !strings.HasPrefix(line, "->") {
+		if strings.Count(gather, "-") > 1 {
+			p.warn(n, "nested gathers are not supported and were skipped")
+			p.nested = true
+			return
+		}
+		p.nested = false
+		p.closeChoices(true)
+		line = strings.TrimSpace(line[len(gather):])
+		if strings.HasPrefix(line, "(") {
+			if end := strings.Index(line, ")"); end >= 0 {
+				p.warn(n, "labels are not supported")
+				line = strings.TrimSpace(line[end+1:])
+			}
+		}
+		if line == "" {
+			return
+		}
+	}
+	if p.nested {
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(line, "INCLUDE"):
+		p.warn(n, "INCLUDE is not supported, include the story into one file")
+	case strings.HasPrefix(line, "VAR ") || strings.HasPrefix(line, "CONST ") || strings.HasPrefix(line, "LIST "):
+		p.warn(n, "variables are not supported")
+	case strings.HasPrefix(line, "<-"):
+		p.warn(n, "threads are not supported")
+	case strings.HasPrefix(line, "~"):
+		p.logic(n, line)
+	case strings.HasPrefix(line, "->"):
+		p.divert(n, strings.TrimSpace(line[2:]))
+	case strings.HasPrefix(line, "#"):
+		p.globalTag(n, strings.TrimSpace(line[1:]))
+	default:
+		p.content(n, line)
+	}
+}
+
+func (p *inkParser) startBlock(label string, n int) {
+	if !p.begin(label, n) {
+		p.warn(n, "knot %q is defined twice, the second one is skipped", label)
+		p.skipKnot = true
+	}
+}
+
+// Строка текста; текст после перехода и перед "->" в той же строке
+func (p *inkParser) content(n int, line string) {
+	line, to := p.splitDivert(n, line)
+	text, tags := line, ""
+	if i := strings.Index(line, "#"); i >= 0 {
+		text, tags = strings.TrimSpace(line[:i]), line[i+1:]
+	}
+	text = p.cleanText(n, text)
+
+	speaker := ""
+	for _, tag := range strings.Split(tags, "#") {
+		tag = strings.TrimSpace(tag)
+		if m := inkSpeaker.FindStringSubmatch(tag); m != nil {
+			speaker = strings.TrimSpace(m[2])
+		} else if tag != "" {
+			p.warn(n, "tag %q is ignored", tag)
+		}
+	}
+
+	if text != "" {
+		if p.diverted && p.choices == nil {
+			p.warn(n, "text after a divert is never shown")
+		} else if speaker != "" {
+			p.flushText()
+			p.addStep(storage.Step{Type: storage.StepCharacterAction, Character: speaker, Lines: []storage.CharacterLine{{Text: text}}})
+		} else {
+			if len(p.text) == 0 {
+				p.textLine = n
+			}
+			p.text = append(p.text, text)
+		}
+	}
+	if to != nil {
+		p.divertTo(n, *to)
+	}
+}
+
+// Отделяет переход "-> цель" в конце строки
+func (p *inkParser) splitDivert(n int, line string) (string, *target) {
+	i := strings.Index(line, "->")
+	if i < 0 {
+		return line, nil
+	}
+	label := strings.TrimSpace(line[i+2:])
+	if strings.Contains(label, "->") || label == "" {
+		p.warn(n, "tunnels are not supported")
+		return strings.TrimSpace(line[:i]), nil
+	}
+	return strings.TrimSpace(line[:i]), &target{label: label, scope: p.knot, line: n}
+}
+
+// Убирает условия, подстановки и склейку, которых нет в квесте
+func (p *inkParser) cleanText(n int, text string) string {
+	if inkLogic.MatchString(text) {
+		p.warn(n, "conditional text is not supported and was removed")
+		text = inkLogic.ReplaceAllString(text, "")
+	}
+	if strings.Contains(text, "<>") {
+		p.warn(n, "glue is not supported")
+		text = strings.ReplaceAll(text, "<>", "")
+	}
+	return strings.TrimSpace(text)
+}
+
+func (p *inkParser) globalTag(n int, tag string) {
+	if m := inkTitleTag.FindStringSubmatch(tag); m != nil && p.title == "" {
+		p.title = strings.TrimSpace(m[1])
+		return
+	}
+	p.warn(n, "tag %q is ignored", tag)
+}
+
+// "~ violence += 2" в теле варианта добавляет очки за выбор
+func (p *inkParser) logic(n int, line string) {
+	m := inkPoints.FindStringSubmatch(line)
+	if m == nil || len(p.choices) == 0 {
+		p.warn(n, "logic %q is not supported", line)
+		return
+	}
+	value, _ := strconv.Atoi(m[3])
+	if m[2] == "-=" {
+		value = -value
+	}
+	points := &p.choices[len(p.choices)-1].points
+	switch m[1] {
+	case "violence":
+		points.Violence += value
+	case "whatever":
+		points.Whatever += value
+	case "pacifism":
+		points.Pacifism += value
+	}
+}
+
+func (p *inkParser) divert(n int, label string) {
+	if label == "" || strings.Contains(label, "->") {
+		p.warn(n, "tunnels are not supported")
+		return
+	}
+	p.divertTo(n, target{label: label, scope: p.knot, line: n})
+}
+
+func (p *inkParser) divertTo(n int, to target) {
+	p.flushText()
+	if len(p.choices) > 0 {
+		choice := p.choices[len(p.choices)-1]
+		if choice.divert != nil {
+			p.warn(n, "text after a divert is never shown")
+			return
+		}
+		choice.divert = &to
+		return
+	}
+	if p.diverted {
+		p.warn(n, "text after a divert is never shown")
+		return
+	}
+	p.diverted = true
+
+	blk := p.current()
+	switch {
+	case len(p.gather) > 0:
+		p.attachGather(to)
+	case len(blk.steps) == 0:
+		blk.alias = &to
+	default:
+		p.linkStep(len(blk.steps)-1, to)
+	}
+}
+
+// "* Текст [только в выборе] только после -> цель"
+func (p *inkParser) choice(n int, line string) {
+	p.flushText()
+	if p.choices == nil && p.diverted {
+		p.warn(n, "text after a divert is never shown")
+	}
+	if strings.HasPrefix(line, "(") {
+		if end := strings.Index(line, ")"); end >= 0 {
+			p.warn(n, "labels are not supported")
+			line = strings.TrimSpace(line[end+1:])
+		}
+	}
+	if inkLogic.MatchString(line) {
+		p.warn(n, "choice conditions are not supported, the choice is always shown")
+		line = strings.TrimSpace(inkLogic.ReplaceAllString(line, ""))
+	}
+	line, to := p.splitDivert(n, line)
+	if i := strings.Index(line, "#"); i >= 0 {
+		p.warn(n, "tag %q is ignored", strings.TrimSpace(line[i+1:]))
+		line = strings.TrimSpace(line[:i])
+	}
+
+	text, output := line, ""
+	if open := strings.Index(line, "["); open >= 0 {
+		if end := strings.Index(line[open:], "]"); end >= 0 {
+			before, inside, after := line[:open], line[open+1:open+end], line[open+end+1:]
+			text = strings.TrimSpace(before + inside)
+			if strings.TrimSpace(after) != "" {
+				output = strings.TrimSpace(before + after)
+			}
+		}
+	}
+	if text == "" {
+		p.warn(n, "fallback choices are not supported")
+		p.nested = true
+		return
+	}
+
+	if p.choices == nil {
+		p.choices = []*inkChoice{}
+	}
+	choice := &inkChoice{text: text, line: n, divert: to}
+	p.choices = append(p.choices, choice)
+	if output != "" {
+		p.textLine = n
+		p.text = append(p.text, output)
+	}
+}
+
+// Добавляет шаг выбора, за ним тела вариантов по порядку. С gather варианты
+// без перехода ведут на собирающую строку, иначе заканчивают историю
+func (p *inkParser) closeChoices(gather bool) {
+	p.flushText()
+	if p.choices == nil {
+		return
+	}
+	choices := p.choices
+	p.choices = nil
+
+	step := storage.Step{Type: storage.StepPlayerAction}
+	for _, c := range choices {
+		step.Choices = append(step.Choices, storage.Choice{Text: c.text, Points: c.points})
+	}
+	// Вариант без перехода и без собирающей строки заканчивает историю
+	// через переход самого шага
+	step.NextStep = storage.NextStepEnd
+	index := p.add(step)
+	p.diverted = false
+
+	for i, c := range choices {
+		if len(c.body) == 0 {
+			switch {
+			case c.divert != nil:
+				p.linkChoice(index, i, *c.divert)
+			case gather:
+				p.gather = append(p.gather, gatherRef{step: index, choice: i})
+			default:
+				p.warn(c.line, "the story ends after choice %q", c.text)
+			}
+			continue
+		}
+
+		first := len(p.current().steps)
+		for _, s := range c.body {
+			p.add(s)
+		}
+		last := len(p.current().steps) - 1
+		p.linkChoice(index, i, p.localTarget(first))
+		switch {
+		case c.divert != nil:
+			p.linkStep(last, *c.divert)
+		case gather:
+			p.gather = append(p.gather, gatherRef{step: last, choice: -1})
+		default:
+			p.current().steps[last].NextStep = storage.NextStepEnd
+			p.warn(c.line, "the story ends after choice %q", c.text)
+		}
+	}
+}
+
+// Направляет ожидающие переходы на собирающую строку в цель to
+func (p *inkParser) attachGather(to target) {
+	for _, g := range p.gather {
+		if g.choice < 0 {
+			p.linkStep(g.step, to)
+		} else {
+			p.linkChoice(g.step, g.choice, to)
+		}
+	}
+	p.gather = nil
+}
+
+func (p *inkParser) flushText() {
+	if len(p.text) == 0 {
+		return
+	}
+	text := strings.Join(p.text, "\n")
+	p.text = nil
+	p.addStep(storage.Step{Type: storage.StepNarration, Text: text})
+}
+
+// Шаг попадает в тело последнего варианта или в сам блок
+func (p *inkParser) addStep(step storage.Step) {
+	if len(p.choices) > 0 {
+		choice := p.choices[len(p.choices)-1]
+		if choice.divert != nil {
+			p.warn(p.textLine, "text after a divert is never shown")
+			return
+		}
+		choice.body = append(choice.body, step)
+		return
+	}
+	if len(p.gather) > 0 {
+		p.attachGather(p.localTarget(len(p.current().steps)))
+	}
+	p.add(step)
+}
+
+// Завершает блок. Ink заканчивает историю, когда у узла кончается текст
+func (p *inkParser) closeBlock() {
+	if p.skipKnot {
+		p.skipKnot = false
+		return
+	}
+	p.closeChoices(false)
+	if len(p.gather) > 0 {
+		for _, g := range p.gather {
+			if g.choice < 0 {
+				p.current().steps[g.step].NextStep = storage.NextStepEnd
+			}
+		}
+		p.gather = nil
+	}
+	if !p.diverted {
+		p.end()
+	}
+	p.diverted = false
+	p.nested = false
+}
@@ -0,0 +1,127 @@
+package storyimport_test
+
+import (
+	"reflect"
+	"testing"
+
+	"quest_maker/storage"
+	"quest_maker/storyimport"
+)
+
+const ink = `# title: Побег из темницы
+VAR torch = false
+-> cell
+
+=== cell ===
+Каджит просыпается в камере. // комментарий
+Где-то капает вода.
+Эй, что за шум? #speaker: Тюремщик
+* Вскрыть замок
+  ~ whatever += 2
+  ~ pacifism += 1
+  Щелк.
+  -> corridor
+* [Ждать] Каджит ждет.
+* Кричать -> guard.alarm
+- Время идет.
+-> END
+
+=== guard ===
+= alarm
+Тревога! {torch: Факел гаснет.}
+-> DONE
+
+=== corridor ===
+/* Коридор
+   без выхода */
+Коридор.
+-> nowhere
+`
+
+func TestInk(t *testing.T) {
+	result, err := storyimport.Ink(ink)
+	if err != nil {
+		t.Fatalf("Ink failed: %v", err)
+	}
+
+	want := storage.NewQuest{
+		Title:      "Побег из темницы",
+		MaxPlayers: 2,
+		Characters: []string{"Тюремщик"},
+		Steps: []storage.Step{
+			{Type: storage.StepNarration, Text: "Каджит просыпается в камере.\nГде-то капает вода."},
+			{Type: storage.StepCharacterAction, Character: "Тюремщик", Lines: []storage.CharacterLine{{Text: "Эй, что за шум?"}}},
+			{Type: storage.StepPlayerAction, NextStep: storage.NextStepEnd, Choices: []storage.Choice{
+				{Text: "Вскрыть замок", Points: storage.Points{Whatever: 2, Pacifism: 1}, NextStep: 4},
+				{Text: "Ждать", NextStep: 5},
+				{Text: "Кричать", NextStep: 7},
+			}},
+			{Type: storage.StepNarration, Text: "Щелк.", NextStep: 8},
+			{Type: storage.StepNarration, Text: "Каджит ждет.", NextStep: 6},
+			{Type: storage.StepNarration, Text: "Время идет.", NextStep: storage.NextStepEnd},
+			{Type: storage.StepNarration, Text: "Тревога!", NextStep: storage.NextStepEnd},
+			{Type: storage.StepNarration, Text: "Коридор.", NextStep: storage.NextStepEnd},
+		},
+	}
+	if !reflect.DeepEqual(result.Quest, want) {
+		t.Errorf("Expected %+v, got %+v", want, result.Quest)
+	}
+
+	wantWarnings := []string{
+		"line 2: variables are not supported",
+		"line 21: conditional text is not supported and was removed",
+		`line 28: unknown target "nowhere", the story ends here`,
+	}
+	if len(result.Warnings) != len(wantWarnings) {
+		t.Fatalf("Expected warnings %v, got %v", wantWarnings, result.Warnings)
+	}
+	for i, want := range wantWarnings {
+		if result.Warnings[i].String() != want {
+			t.Errorf("Expected warning %q, got %q", want, result.Warnings[i].String())
+		}
+	}
+}
+
+func TestInkWarnings(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"nested choice", "* Войти\n** Осмотреться\n-> END", "line 2: nested choices are not supported and were skipped"},
+		{"function", "Текст.\n=== function twice(x) ===\n~ return x * 2", `line 2: function "twice" is not supported and was skipped`},
+		{"choice without a divert", "* Уйти\nКонец.", `line 1: the story ends after choice "Уйти"`},
+		{"text after a divert", "Текст.\n-> END\nЕще текст.", "line 3: text after a divert is never shown"},
+		{"tunnel", "Текст.\n-> shop ->", "line 2: tunnels are not supported"},
+		{"unknown logic", "* Взять\n~ gold = gold + 1\n-> END", `line 2: logic "~ gold = gold + 1" is not supported`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := storyimport.Ink(tt.source)
+			if err != nil {
+				t.Fatalf("Ink failed: %v", err)
+			}
+			for _, warning := range result.Warnings {
+				if warning.String() == tt.want {
+					return
+				}
+			}
+			t.Errorf("Expected warning %q, got %v", tt.want, result.Warnings)
+		})
+	}
+}
+
+// Узел без текста переходит к первому стежку, а стежок находится по имени внутри своего узла
+func TestInkStitches(t *testing.T) {
+	result, err := storyimport.Ink("-> house\n=== house ===\n= hall\nХолл.\n* Наверх -> upstairs\n= upstairs\nЧердак.\n-> END")
+	if err != nil {
+		t.Fatalf("Ink failed: %v", err)
+	}
+	steps := result.Quest.Steps
+	if len(steps) != 3 || steps[0].Text != "Холл." || steps[1].Choices[0].NextStep != 3 || steps[2].Text != "Чердак." {
+		t.Errorf("Unexpected steps %+v", steps)
+	}
+	if len(result.Warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", result.Warnings)
+	}
+}
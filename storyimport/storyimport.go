@@ -0,0 +1,243 @@
+// Пакет storyimport переводит истории из других редакторов в квесты: Twine (формат Twee 3)
+// и подмножество Ink. Конструкции, которых нет в модели квеста (переменные, условия, макросы),
+// пропускаются, а в результат попадает предупреждение с номером строки
+package storyimport
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"quest_maker/storage"
+)
+
+const (
+	FormatTwee = "twee"
+	FormatInk  = "ink"
+)
+
+var ErrUnknownFormat = errors.New("unknown story format, expected twee or ink")
+
+// Конструкция истории, которую нельзя перенести в квест
+type Warning struct {
+	Line    int
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("line %d: %s", w.Line, w.Message)
+}
+
+type Result struct {
+	Quest    storage.NewQuest
+	Warnings []Warning
+}
+
+// Переводит историю в формате format ("twee" или "ink")
+func Convert(format, source string) (*Result, error) {
+	switch format {
+	case FormatTwee:
+		return Twee(source)
+	case FormatInk:
+		return Ink(source)
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// Формат по расширению файла; пустая строка, если расширение незнакомо
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".twee", ".tw":
+		return FormatTwee
+	case ".ink":
+		return FormatInk
+	default:
+		return ""
+	}
+}
+
+// Шаги одного отрывка Twine или узла Ink. Шаги блока идут подряд, сами блоки
+// расставляются при сборке квеста: начальный первым, остальные в порядке файла
+type block struct {
+	label string
+	line  int
+	steps []storage.Step
+	alias *target // Блок без шагов, который сразу переходит дальше
+}
+
+// Цель перехода: первый шаг блока с меткой label или шаг step блока local.
+// Метка сначала ищется как scope.label, так в Ink стежок находится по имени внутри своего узла
+type target struct {
+	label string
+	scope string
+	line  int
+	local *int
+	step  int
+}
+
+// Переход шага (choice = -1) или варианта выбора, который разрешается при сборке
+type link struct {
+	block, step int
+	choice      int
+	to          target
+}
+
+type builder struct {
+	title    string
+	blocks   []*block
+	labels   map[string]int
+	links    []link
+	warnings []Warning
+	chars    []string
+	ends     map[string]bool // Метки, которые завершают историю
+}
+
+func newBuilder() *builder {
+	return &builder{labels: make(map[string]int)}
+}
+
+func (b *builder) warn(line int, format string, args ...interface{}) {
+	b.warnings = append(b.warnings, Warning{Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// Начинает блок; false, если метка уже занята
+func (b *builder) begin(label string, line int) bool {
+	if _, exists := b.labels[label]; exists {
+		return false
+	}
+	b.labels[label] = len(b.blocks)
+	b.blocks = append(b.blocks, &block{label: label, line: line})
+	return true
+}
+
+func (b *builder) current() *block {
+	return b.blocks[len(b.blocks)-1]
+}
+
+// Добавляет шаг в текущий блок и возвращает его индекс в блоке
+func (b *builder) add(step storage.Step) int {
+	blk := b.current()
+	blk.steps = append(blk.steps, step)
+	if step.Type == storage.StepCharacterAction {
+		b.character(step.Character)
+	}
+	return len(blk.steps) - 1
+}
+
+func (b *builder) character(name string) {
+	for _, c := range b.chars {
+		if c == name {
+			return
+		}
+	}
+	b.chars = append(b.chars, name)
+}
+
+// Переход шага step текущего блока
+func (b *builder) linkStep(step int, to target) {
+	b.links = append(b.links, link{block: len(b.blocks) - 1, step: step, choice: -1, to: to})
+}
+
+func (b *builder) linkChoice(step, choice int, to target) {
+	b.links = append(b.links, link{block: len(b.blocks) - 1, step: step, choice: choice, to: to})
+}
+
+// Цель - шаг текущего блока
+func (b *builder) localTarget(step int) target {
+	blk := len(b.blocks) - 1
+	return target{local: &blk, step: step}
+}
+
+// Собирает квест, начиная с блока start. Переходы на неизвестные метки попадают в предупреждения
+func (b *builder) build(start string) (*Result, error) {
+	startIndex, ok := b.labels[start]
+	if !ok {
+		return nil, fmt.Errorf("start %q not found", start)
+	}
+
+	// Пустой начальный блок, который сразу переходит дальше, заменяем его целью
+	for seen := 0; b.blocks[startIndex].alias != nil && seen < len(b.blocks); seen++ {
+		alias := b.blocks[startIndex].alias
+		next, ok := b.labels[alias.scope+"."+alias.label]
+		if !ok || alias.scope == "" {
+			next, ok = b.labels[alias.label]
+		}
+		if !ok {
+			break
+		}
+		startIndex = next
+	}
+
+	order := []int{startIndex}
+	for i := range b.blocks {
+		if i != startIndex {
+			order = append(order, i)
+		}
+	}
+	offsets := make(map[int]int)
+	quest := storage.NewQuest{Title: b.title, MaxPlayers: 2, Characters: b.chars}
+	for _, i := range order {
+		offsets[i] = len(quest.Steps)
+		quest.Steps = append(quest.Steps, b.blocks[i].steps...)
+	}
+	if len(quest.Steps) == 0 {
+		return nil, errors.New("story has no text or choices")
+	}
+
+	for _, l := range b.links {
+		number := b.resolve(l.to, offsets)
+		step := &quest.Steps[offsets[l.block]+l.step]
+		if l.choice < 0 {
+			step.NextStep = number
+			continue
+		}
+		// Вариант не может сам завершить квест; тогда действует переход шага
+		if number > 0 {
+			step.Choices[l.choice].NextStep = number
+		}
+	}
+
+	sort.SliceStable(b.warnings, func(i, j int) bool { return b.warnings[i].Line < b.warnings[j].Line })
+	return &Result{Quest: quest, Warnings: b.warnings}, nil
+}
+
+// Последний шаг блока завершает историю, если переход не задан явно:
+// иначе он перешел бы по порядку в чужой блок
+func (b *builder) end() {
+	if blk := b.current(); len(blk.steps) > 0 {
+		blk.steps[len(blk.steps)-1].NextStep = storage.NextStepEnd
+	}
+}
+
+// Номер шага цели, начиная с 1, или storage.NextStepEnd
+func (b *builder) resolve(to target, offsets map[int]int) int {
+	if to.local != nil {
+		return offsets[*to.local] + to.step + 1
+	}
+	for seen := 0; seen <= len(b.blocks); seen++ {
+		if b.ends[to.label] {
+			return storage.NextStepEnd
+		}
+		i, ok := b.labels[to.scope+"."+to.label]
+		if !ok || to.scope == "" {
+			i, ok = b.labels[to.label]
+		}
+		if !ok {
+			b.warn(to.line, "unknown target %q, the story ends here", to.label)
+			return storage.NextStepEnd
+		}
+		blk := b.blocks[i]
+		if len(blk.steps) > 0 {
+			return offsets[i] + 1
+		}
+		if blk.alias == nil {
+			return storage.NextStepEnd
+		}
+		to = *blk.alias
+	}
+	b.warn(to.line, "diverts around %q never reach any text", to.label)
+	return storage.NextStepEnd
+}
@@ -0,0 +1,159 @@
+package storyimport
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+
+	"quest_maker/storage"
+)
+
+var (
+	// ":: Имя [теги] {метаданные}"
+	tweeHeader = regexp.MustCompile(`^::\s*(.*?)\s*(\[[^\]]*\])?\s*(\{.*\})?\s*$`)
+	tweeLink   = regexp.MustCompile(`\[\[(.+?)\]\]`)
+	// Макросы SugarCube <<...>> и Harlowe (имя: ...), HTML-теги
+	tweeMacro = regexp.MustCompile(`<<.*?>>|\([a-z][a-z0-9-]*:[^)]*\)|</?[a-zA-Z][^>]*>`)
+)
+
+var errNoPassages = errors.New("story has no passages")
+
+type tweePassage struct {
+	name  string
+	line  int
+	tags  []string
+	lines []string
+}
+
+// Переводит историю Twine в формате Twee 3. Каждый отрывок - рассказ с текстом отрывка,
+// а ссылки отрывка - выбор игроков, варианты которого ведут на отрывки-цели.
+// Отрывок без ссылок завершает историю
+func Twee(source string) (*Result, error) {
+	b := newBuilder()
+	var passages []*tweePassage
+	var current *tweePassage
+	for i, line := range strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n") {
+		if m := tweeHeader.FindStringSubmatch(line); m != nil && strings.HasPrefix(line, "::") {
+			current = &tweePassage{name: m[1], line: i + 1, tags: strings.Fields(strings.Trim(m[2], "[]"))}
+			passages = append(passages, current)
+			continue
+		}
+		if current == nil {
+			if strings.TrimSpace(line) != "" {
+				b.warn(i+1, "text before the first passage is ignored")
+			}
+			continue
+		}
+		current.lines = append(current.lines, line)
+	}
+
+	start := ""
+	for _, p := range passages {
+		switch {
+		case p.name == "StoryTitle":
+			b.title = strings.TrimSpace(strings.Join(p.lines, "\n"))
+			continue
+		case p.name == "StoryData":
+			var data struct {
+				Start string `json:"start"`
+			}
+			if err := json.Unmarshal([]byte(strings.Join(p.lines, "\n")), &data); err != nil {
+				b.warn(p.line, "StoryData is not valid JSON")
+			}
+			start = data.Start
+			continue
+		case hasTag(p.tags, "script"), hasTag(p.tags, "stylesheet"), hasTag(p.tags, "widget"):
+			b.warn(p.line, "passage %q with story code is ignored", p.name)
+			continue
+		}
+
+		if !b.begin(p.name, p.line) {
+			b.warn(p.line, "passage %q is defined twice, the second one is ignored", p.name)
+			continue
+		}
+		b.tweePassage(p)
+	}
+
+	if len(b.blocks) == 0 {
+		return nil, errNoPassages
+	}
+	// Без StoryData история начинается с отрывка Start, а если его нет - с первого
+	if start == "" {
+		start = b.blocks[0].label
+		if _, ok := b.labels["Start"]; ok {
+			start = "Start"
+		}
+	}
+	return b.build(start)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Текст и цель ссылки: [[Цель]], [[Текст->Цель]], [[Цель<-Текст]], [[Текст|Цель]]
+func parseTweeLink(inner string) (text, target string) {
+	if i := strings.LastIndex(inner, "->"); i >= 0 {
+		return strings.TrimSpace(inner[:i]), strings.TrimSpace(inner[i+2:])
+	}
+	if i := strings.Index(inner, "<-"); i >= 0 {
+		return strings.TrimSpace(inner[i+2:]), strings.TrimSpace(inner[:i])
+	}
+	if i := strings.LastIndex(inner, "|"); i >= 0 {
+		return strings.TrimSpace(inner[:i]), strings.TrimSpace(inner[i+1:])
+	}
+	inner = strings.TrimSpace(inner)
+	return inner, inner
+}
+
+func (b *builder) tweePassage(p *tweePassage) {
+	type choice struct {
+		text, target string
+		line         int
+	}
+	var text []string
+	var choices []choice
+
+	for i, line := range p.lines {
+		n := p.line + i + 1
+		if macros := tweeMacro.FindAllString(line, -1); len(macros) > 0 {
+			b.warn(n, "%s is not supported and was removed", macros[0])
+			line = tweeMacro.ReplaceAllString(line, "")
+		}
+
+		// Строка из одних ссылок - варианты выбора; ссылка внутри текста остается в нем своим текстом
+		links := tweeLink.FindAllStringSubmatch(line, -1)
+		for _, m := range links {
+			linkText, target := parseTweeLink(m[1])
+			choices = append(choices, choice{text: linkText, target: target, line: n})
+		}
+		if strings.TrimSpace(tweeLink.ReplaceAllString(line, "")) == "" && len(links) > 0 {
+			continue
+		}
+		text = append(text, tweeLink.ReplaceAllStringFunc(line, func(link string) string {
+			linkText, _ := parseTweeLink(link[2 : len(link)-2])
+			return linkText
+		}))
+	}
+
+	if narration := strings.TrimSpace(strings.Join(text, "\n")); narration != "" || len(choices) == 0 {
+		b.add(storage.Step{Type: storage.StepNarration, Text: narration})
+	}
+	if len(choices) > 0 {
+		step := storage.Step{Type: storage.StepPlayerAction}
+		for _, c := range choices {
+			step.Choices = append(step.Choices, storage.Choice{Text: c.text})
+		}
+		index := b.add(step)
+		for i, c := range choices {
+			b.linkChoice(index, i, target{label: c.target, line: c.line})
+		}
+	}
+	b.end()
+}
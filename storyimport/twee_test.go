@@ -0,0 +1,100 @@
+package storyimport_test
+
+import (
+	"reflect"
+	"testing"
+
+	"quest_maker/storage"
+	"quest_maker/storyimport"
+)
+
+const twee = `:: StoryTitle
+Пещера
+
+:: StoryData
+{"ifid": "D674C58C-DEFA-4F70-B7A2-27742230C0FC", "start": "Вход"}
+
+:: Зал {"position": "200,100"}
+Темно. Можно [[вернуться|Вход]] назад.
+
+:: Вход [начало]
+Вы стоите у входа. <<set $torch to true>>
+[[Войти->Зал]]
+[[Сокровищница<-Спуститься]]
+[[Уйти]]
+
+:: Сокровищница
+Золото!
+
+:: Скрипт [script]
+window.setup = {};
+`
+
+func TestTwee(t *testing.T) {
+	result, err := storyimport.Twee(twee)
+	if err != nil {
+		t.Fatalf("Twee failed: %v", err)
+	}
+
+	// Начальный отрывок из StoryData идет первым, остальные - в порядке файла
+	want := storage.NewQuest{
+		Title:      "Пещера",
+		MaxPlayers: 2,
+		Steps: []storage.Step{
+			{Type: storage.StepNarration, Text: "Вы стоите у входа."},
+			{Type: storage.StepPlayerAction, NextStep: storage.NextStepEnd, Choices: []storage.Choice{
+				{Text: "Войти", NextStep: 3},
+				{Text: "Спуститься", NextStep: 5},
+				{Text: "Уйти"},
+			}},
+			{Type: storage.StepNarration, Text: "Темно. Можно вернуться назад."},
+			{Type: storage.StepPlayerAction, NextStep: storage.NextStepEnd, Choices: []storage.Choice{
+				{Text: "вернуться", NextStep: 1},
+			}},
+			{Type: storage.StepNarration, Text: "Золото!", NextStep: storage.NextStepEnd},
+		},
+	}
+	if !reflect.DeepEqual(result.Quest, want) {
+		t.Errorf("Expected %+v, got %+v", want, result.Quest)
+	}
+
+	wantWarnings := []string{
+		`line 11: <<set $torch to true>> is not supported and was removed`,
+		`line 14: unknown target "Уйти", the story ends here`,
+		`line 19: passage "Скрипт" with story code is ignored`,
+	}
+	if len(result.Warnings) != len(wantWarnings) {
+		t.Fatalf("Expected warnings %v, got %v", wantWarnings, result.Warnings)
+	}
+	for i, want := range wantWarnings {
+		if result.Warnings[i].String() != want {
+			t.Errorf("Expected warning %q, got %q", want, result.Warnings[i].String())
+		}
+	}
+}
+
+func TestTweeStart(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		text   string
+	}{
+		{"passage named Start", ":: Пролог\nПролог.\n:: Start\nНачало.", "Начало."},
+		{"first passage", ":: Пролог\nПролог.\n:: Глава\nГлава.", "Пролог."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := storyimport.Twee(tt.source)
+			if err != nil {
+				t.Fatalf("Twee failed: %v", err)
+			}
+			if text := result.Quest.Steps[0].Text; text != tt.text {
+				t.Errorf("Expected %q, got %q", tt.text, text)
+			}
+		})
+	}
+
+	if _, err := storyimport.Twee("просто текст"); err == nil {
+		t.Error("Expected an error for a story without passages")
+	}
+}